@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Player event types accepted by the beacon endpoint
+const (
+	playbackPlay            = "play"
+	playbackPause           = "pause"
+	playbackSeek            = "seek"
+	playbackBuffering       = "buffering"
+	playbackRenditionSwitch = "rendition_switch"
+	playbackEnded           = "ended"
+)
+
+var playbackEventTypes = []string{playbackPlay, playbackPause, playbackSeek, playbackBuffering, playbackRenditionSwitch, playbackEnded}
+
+// Maximum number of events in one beacon
+const maxBeaconEvents = 100
+
+// Maximum length of session and viewer IDs
+const maxSessionIDLength = 100
+
+// Number of points of a retention curve, evenly spaced over the video
+const retentionPoints = 20
+
+// Reports cover this period unless a range is given
+const defaultReportPeriod = 30 * 24 * time.Hour
+
+var playbackEventsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "videostreaming_playback_events_total",
+	Help: "Player events received by the analytics beacon by type.",
+}, []string{"type"})
+
+// playbackEvent is an event sent by a player. Position is the playhead in
+// seconds when the event happened; seeks also carry the position they
+// left (From), buffering the time spent stalled (Duration).
+type playbackEvent struct {
+	Type       string    `json:"type"`
+	VideoID    string    `json:"videoId"`
+	SessionID  string    `json:"sessionId"`
+	ViewerID   string    `json:"viewerId,omitempty"` // Falls back to the session
+	Position   float64   `json:"position"`
+	From       float64   `json:"from,omitzero"`
+	Duration   float64   `json:"duration,omitzero"`
+	Rendition  string    `json:"rendition,omitempty"`
+	ReceivedAt time.Time `json:"receivedAt"`
+}
+
+// Raw events are appended to one JSON lines file per UTC day
+var (
+	analyticsMu      sync.Mutex
+	analyticsLastDay string // Day of the last write, old files are pruned when it changes
+)
+
+// analyticsDir holds the raw event files
+func analyticsDir() string {
+	return filepath.Join(uploadsDir, ".analytics")
+}
+
+// analyticsDayFile returns the event file of a day
+func analyticsDayFile(day time.Time) string {
+	return filepath.Join(analyticsDir(), day.UTC().Format(time.DateOnly)+".jsonl")
+}
+
+// appendPlaybackEvents stores events in the file of the day they were
+// received
+func appendPlaybackEvents(events []playbackEvent) error {
+	analyticsMu.Lock()
+	defer analyticsMu.Unlock()
+
+	if err := os.MkdirAll(analyticsDir(), os.ModePerm); err != nil {
+		return err
+	}
+	day := time.Now().UTC().Format(time.DateOnly)
+	if day != analyticsLastDay {
+		analyticsLastDay = day
+		pruneAnalyticsLocked()
+	}
+
+	file, err := os.OpenFile(analyticsDayFile(time.Now()), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// pruneAnalyticsLocked removes the event files older than the configured
+// retention. analyticsMu must be held.
+func pruneAnalyticsLocked() {
+	cutoff := time.Now().UTC().AddDate(0, 0, -getConfig().Analytics.RetentionDays).Format(time.DateOnly)
+	files, _ := filepath.Glob(filepath.Join(analyticsDir(), "*.jsonl"))
+	for _, file := range files {
+		if strings.TrimSuffix(filepath.Base(file), ".jsonl") < cutoff {
+			os.Remove(file)
+		}
+	}
+}
+
+// readPlaybackEvents returns the events received in [from, to), in the
+// order they were received. An empty videoID selects every video.
+func readPlaybackEvents(from, to time.Time, videoID string) ([]playbackEvent, error) {
+	analyticsMu.Lock()
+	defer analyticsMu.Unlock()
+
+	var events []playbackEvent
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		file, err := os.Open(analyticsDayFile(day))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var e playbackEvent
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+				continue // A line cut short by a crash
+			}
+			if (videoID == "" || e.VideoID == videoID) && !e.ReceivedAt.Before(from) && e.ReceivedAt.Before(to) {
+				events = append(events, e)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+// validate checks an event from a player
+func (e *playbackEvent) validate() error {
+	switch {
+	case !slices.Contains(playbackEventTypes, e.Type):
+		return fmt.Errorf("type must be one of %s", strings.Join(playbackEventTypes, ", "))
+	case e.SessionID == "" || len(e.SessionID) > maxSessionIDLength:
+		return fmt.Errorf("sessionId must be 1 to %d characters", maxSessionIDLength)
+	case len(e.ViewerID) > maxSessionIDLength:
+		return fmt.Errorf("viewerId must be up to %d characters", maxSessionIDLength)
+	case len(e.Rendition) > maxSessionIDLength:
+		return fmt.Errorf("rendition must be up to %d characters", maxSessionIDLength)
+	case e.Position < 0 || e.From < 0 || e.Duration < 0 ||
+		math.IsInf(e.Position, 0) || math.IsInf(e.From, 0) || math.IsInf(e.Duration, 0):
+		return fmt.Errorf("position, from and duration must be non-negative seconds")
+	case !videoExists(e.VideoID):
+		return fmt.Errorf("video %q not found", e.VideoID)
+	}
+	return nil
+}
+
+// collectPlaybackEvents is the beacon endpoint of players. It takes one
+// event or a batch of them as {"events": [...]}; the body is read as JSON
+// whatever its content type, as navigator.sendBeacon may send text/plain.
+func collectPlaybackEvents(c *fiber.Ctx) error {
+	var batch struct {
+		Events []playbackEvent `json:"events"`
+	}
+	body := c.Body()
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if batch.Events == nil {
+		var single playbackEvent
+		if err := json.Unmarshal(body, &single); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request body",
+			})
+		}
+		batch.Events = []playbackEvent{single}
+	}
+	if len(batch.Events) > maxBeaconEvents {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("A beacon carries at most %d events", maxBeaconEvents),
+		})
+	}
+
+	now := time.Now().UTC()
+	for i := range batch.Events {
+		e := &batch.Events[i]
+		if err := e.validate(); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid event %d: %v", i, err),
+			})
+		}
+		e.ReceivedAt = now
+	}
+
+	if err := appendPlaybackEvents(batch.Events); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to store playback events", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store events",
+		})
+	}
+	for _, e := range batch.Events {
+		playbackEventsTotal.WithLabelValues(e.Type).Inc()
+	}
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"accepted": len(batch.Events),
+	})
+}
+
+// playbackSession is what one player session of a video amounts to
+type playbackSession struct {
+	videoID       string
+	viewerID      string
+	day           string
+	played        bool
+	completed     bool
+	watchSeconds  float64
+	bufferSeconds float64
+	switches      int
+	intervals     [][2]float64 // Watched ranges of the video
+	playing       bool
+	playheadAt    float64
+}
+
+// observe updates the session with its next event. Time counts as watched
+// between a play and the position of any later event, unless a seek or
+// pause came in between.
+func (s *playbackSession) observe(e playbackEvent) {
+	switch e.Type {
+	case playbackPlay:
+		s.played = true
+		s.playing = true
+		s.playheadAt = e.Position
+		return
+	case playbackSeek:
+		if s.playing {
+			s.watch(e.From)
+		}
+		s.playheadAt = e.Position
+		return
+	case playbackBuffering:
+		s.bufferSeconds += e.Duration
+	case playbackRenditionSwitch:
+		s.switches++
+	case playbackEnded:
+		s.completed = true
+	}
+	if s.playing {
+		s.watch(e.Position)
+	}
+	if e.Type == playbackPause || e.Type == playbackEnded {
+		s.playing = false
+	}
+}
+
+// watch counts the playback from the playhead to position
+func (s *playbackSession) watch(position float64) {
+	if position > s.playheadAt {
+		s.watchSeconds += position - s.playheadAt
+		s.intervals = append(s.intervals, [2]float64{s.playheadAt, position})
+	}
+	s.playheadAt = position
+}
+
+// groupSessions replays events into sessions per video and session ID
+func groupSessions(events []playbackEvent) []*playbackSession {
+	byKey := make(map[string]*playbackSession)
+	var sessions []*playbackSession
+	for _, e := range events {
+		key := e.VideoID + "\x00" + e.SessionID
+		s, ok := byKey[key]
+		if !ok {
+			s = &playbackSession{
+				videoID:  e.VideoID,
+				viewerID: e.ViewerID,
+				day:      e.ReceivedAt.UTC().Format(time.DateOnly),
+			}
+			if s.viewerID == "" {
+				s.viewerID = "session:" + e.SessionID
+			}
+			byKey[key] = s
+			sessions = append(sessions, s)
+		}
+		s.observe(e)
+	}
+	return sessions
+}
+
+// videoReport aggregates the sessions of a video
+type videoReport struct {
+	VideoID             string  `json:"videoId"`
+	Title               string  `json:"title"`
+	Views               int     `json:"views"`
+	UniqueViewers       int     `json:"uniqueViewers"`
+	TotalWatchSeconds   float64 `json:"totalWatchSeconds"`
+	AverageWatchSeconds float64 `json:"averageWatchSeconds"`
+	CompletionRate      float64 `json:"completionRate"`
+	RebufferRatio       float64 `json:"rebufferRatio"` // Of the time spent stalled over watching and stalled
+	RenditionSwitches   int     `json:"renditionSwitches"`
+}
+
+// retentionPoint is the share of views that watched a position
+type retentionPoint struct {
+	Position float64 `json:"position"` // Seconds
+	Viewers  float64 `json:"viewers"`  // From 0 to 1
+}
+
+// dailyViews counts the views of a day
+type dailyViews struct {
+	Day   string `json:"day"`
+	Views int    `json:"views"`
+}
+
+// buildReports aggregates sessions into a report per video, by views
+func buildReports(sessions []*playbackSession) []*videoReport {
+	reports := make(map[string]*videoReport)
+	viewers := make(map[string]map[string]bool)
+	buffering := make(map[string]float64)
+	completions := make(map[string]int)
+	for _, s := range sessions {
+		r, ok := reports[s.videoID]
+		if !ok {
+			r = &videoReport{VideoID: s.videoID, Title: lookupMetadata(s.videoID).displayName(s.videoID)}
+			reports[s.videoID] = r
+			viewers[s.videoID] = make(map[string]bool)
+		}
+		buffering[s.videoID] += s.bufferSeconds
+		r.RenditionSwitches += s.switches
+		if !s.played {
+			continue
+		}
+		r.Views++
+		viewers[s.videoID][s.viewerID] = true
+		r.TotalWatchSeconds += s.watchSeconds
+		if s.completed {
+			completions[s.videoID]++
+		}
+	}
+
+	list := make([]*videoReport, 0, len(reports))
+	for id, r := range reports {
+		r.UniqueViewers = len(viewers[id])
+		if r.Views > 0 {
+			r.AverageWatchSeconds = r.TotalWatchSeconds / float64(r.Views)
+			r.CompletionRate = float64(completions[id]) / float64(r.Views)
+		}
+		if stalled := buffering[id]; stalled > 0 {
+			r.RebufferRatio = stalled / (stalled + r.TotalWatchSeconds)
+		}
+		list = append(list, r)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].Views != list[b].Views {
+			return list[a].Views > list[b].Views
+		}
+		return list[a].VideoID < list[b].VideoID
+	})
+	return list
+}
+
+// retentionCurve returns the share of views that watched each point of a
+// video
+func retentionCurve(sessions []*playbackSession, duration float64) []retentionPoint {
+	if duration <= 0 {
+		return nil
+	}
+	points := make([]retentionPoint, retentionPoints)
+	views := 0
+	for _, s := range sessions {
+		if !s.played {
+			continue
+		}
+		views++
+		for i := range points {
+			position := duration * float64(i) / retentionPoints
+			if slices.ContainsFunc(s.intervals, func(r [2]float64) bool { return r[0] <= position && position < r[1] }) {
+				points[i].Viewers++
+			}
+		}
+	}
+	for i := range points {
+		points[i].Position = duration * float64(i) / retentionPoints
+		if views > 0 {
+			points[i].Viewers /= float64(views)
+		}
+	}
+	return points
+}
+
+// reportRange reads the from and to parameters of a report. A date as
+// to includes that whole day.
+func reportRange(c *fiber.Ctx) (time.Time, time.Time, error) {
+	from, err := queryTime(c, "from")
+	if err != nil {
+		return from, from, err
+	}
+	to, err := queryTime(c, "to")
+	if err != nil {
+		return from, to, err
+	}
+	if to.IsZero() {
+		to = time.Now()
+	} else if len(c.Query("to")) == len(time.DateOnly) {
+		to = to.Add(24 * time.Hour)
+	}
+	if from.IsZero() {
+		from = to.Add(-defaultReportPeriod)
+	}
+	if !from.Before(to) {
+		return from, to, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+// getAnalyticsVideos reports the views, viewers, watch time and rebuffering
+// of every watched video, as JSON or as CSV with format=csv
+func getAnalyticsVideos(c *fiber.Ctx) error {
+	from, to, err := reportRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	events, err := readPlaybackEvents(from, to, "")
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to read playback events", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read playback events",
+		})
+	}
+	reports := buildReports(groupSessions(events))
+
+	if c.Query("format") == "csv" {
+		rows := [][]string{{"videoId", "title", "views", "uniqueViewers", "totalWatchSeconds", "averageWatchSeconds", "completionRate", "rebufferRatio", "renditionSwitches"}}
+		for _, r := range reports {
+			rows = append(rows, []string{csvText(r.VideoID), csvText(r.Title), strconv.Itoa(r.Views), strconv.Itoa(r.UniqueViewers),
+				formatDecimal(r.TotalWatchSeconds), formatDecimal(r.AverageWatchSeconds),
+				formatDecimal(r.CompletionRate), formatDecimal(r.RebufferRatio), strconv.Itoa(r.RenditionSwitches)})
+		}
+		return sendCSV(c, "videos.csv", rows)
+	}
+	return c.JSON(fiber.Map{
+		"from":   from,
+		"to":     to,
+		"videos": reports,
+	})
+}
+
+// getAnalyticsVideo reports the watching of one video with its retention
+// curve and daily views. format=csv returns the retention curve.
+func getAnalyticsVideo(c *fiber.Ctx) error {
+	id := c.Params("id")
+	from, to, err := reportRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	events, err := readPlaybackEvents(from, to, id)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to read playback events", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read playback events",
+		})
+	}
+	if len(events) == 0 && !videoExists(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video not found",
+		})
+	}
+
+	sessions := groupSessions(events)
+	report := &videoReport{VideoID: id, Title: lookupMetadata(id).displayName(id)}
+	if reports := buildReports(sessions); len(reports) > 0 {
+		report = reports[0]
+	}
+	retention := retentionCurve(sessions, videoDuration(c.UserContext(), id))
+
+	if c.Query("format") == "csv" {
+		rows := [][]string{{"position", "viewers"}}
+		for _, p := range retention {
+			rows = append(rows, []string{formatDecimal(p.Position), formatDecimal(p.Viewers)})
+		}
+		return sendCSV(c, strings.TrimSuffix(id, filepath.Ext(id))+"-retention.csv", rows)
+	}
+
+	days := make(map[string]int)
+	for _, s := range sessions {
+		if s.played {
+			days[s.day]++
+		}
+	}
+	daily := make([]dailyViews, 0, len(days))
+	for day, views := range days {
+		daily = append(daily, dailyViews{Day: day, Views: views})
+	}
+	sort.Slice(daily, func(a, b int) bool { return daily[a].Day < daily[b].Day })
+
+	return c.JSON(fiber.Map{
+		"from":      from,
+		"to":        to,
+		"summary":   report,
+		"retention": retention,
+		"daily":     daily,
+	})
+}
+
+// formatDecimal formats a number for CSV output
+func formatDecimal(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// csvText keeps spreadsheets from running text cells as formulas
+func csvText(v string) string {
+	if v != "" && strings.ContainsRune("=+-@", rune(v[0])) {
+		return "'" + v
+	}
+	return v
+}
+
+// sendCSV sends rows as a CSV attachment
+func sendCSV(c *fiber.Ctx, name string, rows [][]string) error {
+	var out strings.Builder
+	w := csv.NewWriter(&out)
+	if err := w.WriteAll(rows); err != nil {
+		return err
+	}
+	c.Attachment(name)
+	c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	return c.SendString(out.String())
+}
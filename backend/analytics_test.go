@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// ev returns an event of kind at a playhead position
+func ev(kind string, position float64) playbackEvent {
+	return playbackEvent{Type: kind, Position: position}
+}
+
+func TestPlaybackSessionObserve(t *testing.T) {
+	seek := func(from, to float64) playbackEvent {
+		return playbackEvent{Type: playbackSeek, From: from, Position: to}
+	}
+	buffering := func(position, duration float64) playbackEvent {
+		return playbackEvent{Type: playbackBuffering, Position: position, Duration: duration}
+	}
+
+	tests := []struct {
+		name          string
+		events        []playbackEvent
+		played        bool
+		completed     bool
+		watchSeconds  float64
+		bufferSeconds float64
+		switches      int
+		intervals     [][2]float64
+	}{
+		{
+			name:         "play then pause",
+			events:       []playbackEvent{ev(playbackPlay, 0), ev(playbackPause, 10)},
+			played:       true,
+			watchSeconds: 10,
+			intervals:    [][2]float64{{0, 10}},
+		},
+		{
+			name:         "seek forward skips the range",
+			events:       []playbackEvent{ev(playbackPlay, 0), seek(5, 30), ev(playbackPause, 40)},
+			played:       true,
+			watchSeconds: 15,
+			intervals:    [][2]float64{{0, 5}, {30, 40}},
+		},
+		{
+			name: "seek while paused",
+			events: []playbackEvent{ev(playbackPlay, 0), ev(playbackPause, 10), seek(10, 50),
+				ev(playbackPlay, 50), ev(playbackEnded, 60)},
+			played:       true,
+			completed:    true,
+			watchSeconds: 20,
+			intervals:    [][2]float64{{0, 10}, {50, 60}},
+		},
+		{
+			name:         "seek back watches a range again",
+			events:       []playbackEvent{ev(playbackPlay, 0), seek(20, 10), ev(playbackEnded, 30)},
+			played:       true,
+			completed:    true,
+			watchSeconds: 40,
+			intervals:    [][2]float64{{0, 20}, {10, 30}},
+		},
+		{
+			name:          "buffering counts stalls and the playback before them",
+			events:        []playbackEvent{ev(playbackPlay, 0), buffering(5, 2), buffering(8, 1.5), ev(playbackPause, 10)},
+			played:        true,
+			watchSeconds:  10,
+			bufferSeconds: 3.5,
+			intervals:     [][2]float64{{0, 5}, {5, 8}, {8, 10}},
+		},
+		{
+			name:         "events while paused add no watch time",
+			events:       []playbackEvent{ev(playbackPlay, 0), ev(playbackPause, 10), ev(playbackRenditionSwitch, 30)},
+			played:       true,
+			watchSeconds: 10,
+			switches:     1,
+			intervals:    [][2]float64{{0, 10}},
+		},
+		{
+			name:          "stalled before playing",
+			events:        []playbackEvent{buffering(0, 4), seek(0, 20)},
+			bufferSeconds: 4,
+		},
+	}
+	for _, tt := range tests {
+		s := &playbackSession{}
+		for _, e := range tt.events {
+			s.observe(e)
+		}
+		if s.played != tt.played || s.completed != tt.completed || s.switches != tt.switches {
+			t.Errorf("%s: played %v, completed %v, switches %d, want %v, %v, %d",
+				tt.name, s.played, s.completed, s.switches, tt.played, tt.completed, tt.switches)
+		}
+		if s.watchSeconds != tt.watchSeconds || s.bufferSeconds != tt.bufferSeconds {
+			t.Errorf("%s: watched %v and stalled %v seconds, want %v and %v",
+				tt.name, s.watchSeconds, s.bufferSeconds, tt.watchSeconds, tt.bufferSeconds)
+		}
+		if !slices.Equal(s.intervals, tt.intervals) {
+			t.Errorf("%s: intervals %v, want %v", tt.name, s.intervals, tt.intervals)
+		}
+	}
+}
+
+// session returns the events of a session of a video
+func session(videoID, sessionID, viewerID string, events ...playbackEvent) []playbackEvent {
+	for i := range events {
+		events[i].VideoID, events[i].SessionID, events[i].ViewerID = videoID, sessionID, viewerID
+	}
+	return events
+}
+
+func TestBuildReports(t *testing.T) {
+	var events []playbackEvent
+	events = append(events, session("a.mp4", "s1", "v1", ev(playbackPlay, 0), ev(playbackEnded, 100))...)
+	events = append(events, session("a.mp4", "s2", "v1", ev(playbackPlay, 0),
+		playbackEvent{Type: playbackBuffering, Position: 10, Duration: 5}, ev(playbackPause, 50))...)
+	// Stalled at startup and never played: no view, but the stall counts
+	events = append(events, session("a.mp4", "s3", "", playbackEvent{Type: playbackBuffering, Duration: 10})...)
+	events = append(events, session("b.mp4", "s4", "v2", ev(playbackPlay, 0), ev(playbackRenditionSwitch, 5), ev(playbackPause, 30))...)
+	events = append(events, session("b.mp4", "s5", "v3", ev(playbackPlay, 0), ev(playbackPause, 10))...)
+	events = append(events, session("b.mp4", "s6", "v2", ev(playbackPlay, 0), ev(playbackEnded, 20))...)
+
+	reports := buildReports(groupSessions(events))
+	want := []videoReport{
+		{VideoID: "b.mp4", Views: 3, UniqueViewers: 2, TotalWatchSeconds: 60, AverageWatchSeconds: 20,
+			CompletionRate: 1.0 / 3, RenditionSwitches: 1},
+		{VideoID: "a.mp4", Views: 2, UniqueViewers: 1, TotalWatchSeconds: 150, AverageWatchSeconds: 75,
+			CompletionRate: 0.5, RebufferRatio: 15.0 / 165},
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("%d reports, want %d", len(reports), len(want))
+	}
+	for i, r := range reports {
+		got := *r
+		got.Title = ""
+		if got != want[i] {
+			t.Errorf("report %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+}
+
+func TestRetentionCurve(t *testing.T) {
+	var events []playbackEvent
+	events = append(events, session("a.mp4", "s1", "", ev(playbackPlay, 0), ev(playbackEnded, 100))...)
+	events = append(events, session("a.mp4", "s2", "", ev(playbackPlay, 0), ev(playbackPause, 50))...)
+	events = append(events, session("a.mp4", "s3", "", playbackEvent{Type: playbackBuffering, Duration: 3})...)
+	sessions := groupSessions(events)
+
+	if got := retentionCurve(sessions, 0); got != nil {
+		t.Errorf("retention of an unknown duration = %v, want nil", got)
+	}
+	points := retentionCurve(sessions, 100)
+	if len(points) != retentionPoints {
+		t.Fatalf("%d points, want %d", len(points), retentionPoints)
+	}
+	for _, p := range points {
+		want := 1.0
+		if p.Position >= 50 {
+			want = 0.5
+		}
+		if p.Viewers != want {
+			t.Errorf("viewers at %v = %v, want %v", p.Position, p.Viewers, want)
+		}
+	}
+}
+
+func TestSessionsAcrossDays(t *testing.T) {
+	saved := uploadsDir
+	uploadsDir = t.TempDir()
+	t.Cleanup(func() { uploadsDir = saved })
+
+	day1 := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	day2 := day1.AddDate(0, 0, 1)
+	at := func(e playbackEvent, received time.Time) playbackEvent {
+		e.ReceivedAt = received
+		return e
+	}
+	s1 := session("a.mp4", "s1", "v1", ev(playbackPlay, 0), ev(playbackPause, 120))
+	s2 := session("a.mp4", "s2", "v2", ev(playbackPlay, 0), ev(playbackEnded, 60))
+	files := map[time.Time][]playbackEvent{
+		day1: {at(s1[0], day1.Add(24*time.Hour-time.Minute))},
+		day2: {at(s1[1], day2.Add(time.Minute)), at(s2[0], day2.Add(5*time.Minute)), at(s2[1], day2.Add(6*time.Minute))},
+	}
+	os.MkdirAll(analyticsDir(), os.ModePerm)
+	for day, events := range files {
+		var data []byte
+		for _, e := range events {
+			line, _ := json.Marshal(e)
+			data = append(append(data, line...), '\n')
+		}
+		if err := os.WriteFile(analyticsDayFile(day), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if files, _ := filepath.Glob(filepath.Join(analyticsDir(), "*.jsonl")); len(files) != 2 {
+		t.Fatalf("%d event files, want 2", len(files))
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		days     []string // Of the played sessions
+		watched  float64
+	}{
+		{"both days", day1, day2.AddDate(0, 0, 1), []string{"2026-03-01", "2026-03-02"}, 180},
+		// The first session's play falls outside the range
+		{"second day only", day2, day2.AddDate(0, 0, 1), []string{"2026-03-02"}, 60},
+		{"first day only", day1, day2, []string{"2026-03-01"}, 0},
+	}
+	for _, tt := range tests {
+		events, err := readPlaybackEvents(tt.from, tt.to, "a.mp4")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions := groupSessions(events)
+		var days []string
+		watched := 0.0
+		for _, s := range sessions {
+			if s.played {
+				days = append(days, s.day)
+			}
+			watched += s.watchSeconds
+		}
+		if !slices.Equal(days, tt.days) || watched != tt.watched {
+			t.Errorf("%s: views on %v watching %v seconds, want %v and %v", tt.name, days, watched, tt.days, tt.watched)
+		}
+	}
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Directory holding the chapter thumbnails of each video
+var chaptersDir = "./uploads/chapters"
+
+// Maximum number of chapters of a video
+const maxChapters = 500
+
+// chapter is a titled section of a video. It ends where the next chapter,
+// or the video, ends.
+type chapter struct {
+	ID        string  `json:"id"`
+	Start     float64 `json:"start"` // Seconds
+	Title     string  `json:"title"`
+	Thumbnail string  `json:"thumbnail,omitempty"` // File name in the video's chapter directory
+}
+
+// Chapters per video ID in order of their start, persisted next to the
+// uploads
+var (
+	chapters   = make(map[string][]chapter)
+	chaptersMu sync.Mutex
+)
+
+// chaptersFile is where chapters are stored
+func chaptersFile() string {
+	return filepath.Join(uploadsDir, ".chapters.json")
+}
+
+// loadChapters reads the stored chapters
+func loadChapters() error {
+	chaptersMu.Lock()
+	defer chaptersMu.Unlock()
+	return readJSONFile(chaptersFile(), &chapters)
+}
+
+// lookupChapters returns the chapters of a video
+func lookupChapters(videoID string) []chapter {
+	chaptersMu.Lock()
+	defer chaptersMu.Unlock()
+	return chapters[videoID]
+}
+
+// setChapters replaces the chapters of a video. Thumbnails of chapters
+// that were dropped are removed.
+func setChapters(videoID string, list []chapter) error {
+	chaptersMu.Lock()
+	defer chaptersMu.Unlock()
+
+	kept := make(map[string]bool)
+	for _, ch := range list {
+		kept[ch.Thumbnail] = true
+	}
+	for _, ch := range chapters[videoID] {
+		if ch.Thumbnail != "" && !kept[ch.Thumbnail] {
+			os.Remove(filepath.Join(chaptersDir, videoID, ch.Thumbnail))
+		}
+	}
+
+	if len(list) == 0 {
+		delete(chapters, videoID)
+	} else {
+		chapters[videoID] = list
+	}
+	return writeJSONFile(chaptersFile(), chapters)
+}
+
+// forgetChapters removes the chapters and thumbnails of a deleted video
+func forgetChapters(videoID string) {
+	os.RemoveAll(filepath.Join(chaptersDir, videoID))
+	chaptersMu.Lock()
+	defer chaptersMu.Unlock()
+	if _, ok := chapters[videoID]; !ok {
+		return
+	}
+	delete(chapters, videoID)
+	if err := writeJSONFile(chaptersFile(), chapters); err != nil {
+		slog.Error("Failed to save chapters", "error", err)
+	}
+}
+
+// videoDuration returns the duration of an uploaded video, or 0 if it is
+// unknown
+func videoDuration(ctx context.Context, videoID string) float64 {
+	if e, ok := lookupIndexEntry(videoID); ok && e.Duration > 0 {
+		return e.Duration
+	}
+	duration, _ := getDuration(ctx, filepath.Join(uploadsDir, videoID))
+	return duration
+}
+
+// chapterEnds returns the end of each chapter: the start of the next one,
+// and the duration for the last one
+func chapterEnds(list []chapter, duration float64) []float64 {
+	ends := make([]float64, len(list))
+	for i := range list {
+		if i+1 < len(list) {
+			ends[i] = list[i+1].Start
+		} else {
+			ends[i] = max(duration, list[i].Start)
+		}
+	}
+	return ends
+}
+
+// chaptersResponse describes the chapters of a video with their ends and
+// thumbnail URLs
+func chaptersResponse(videoID string, list []chapter, duration float64) fiber.Map {
+	ends := chapterEnds(list, duration)
+	items := make([]fiber.Map, 0, len(list))
+	for i, ch := range list {
+		item := fiber.Map{
+			"id":    ch.ID,
+			"start": ch.Start,
+			"end":   ends[i],
+			"title": ch.Title,
+		}
+		if ch.Thumbnail != "" {
+			item["thumbnailUrl"] = fmt.Sprintf("/api/videos/%s/chapters/%s/thumbnail", videoID, ch.ID)
+		}
+		items = append(items, item)
+	}
+	return fiber.Map{
+		"videoId":  videoID,
+		"chapters": items,
+		"vttUrl":   fmt.Sprintf("/api/videos/%s/chapters.vtt", videoID),
+	}
+}
+
+// parseChapterStart reads a chapter start given as seconds or as a
+// timestamp string such as "1:15.5"
+func parseChapterStart(raw json.RawMessage) (float64, error) {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return parseTimestamp(text)
+	}
+	var seconds float64
+	if err := json.Unmarshal(raw, &seconds); err != nil || seconds < 0 || math.IsInf(seconds, 0) {
+		return 0, fmt.Errorf("invalid chapter start %s", raw)
+	}
+	return seconds, nil
+}
+
+// validateChapters checks that chapters start at 0, in order, within the
+// video, and have titles
+func validateChapters(list []chapter, duration float64) error {
+	if len(list) > maxChapters {
+		return fmt.Errorf("a video has at most %d chapters", maxChapters)
+	}
+	for i, ch := range list {
+		switch {
+		case ch.Title == "" || utf8.RuneCountInString(ch.Title) > maxTitleLength:
+			return fmt.Errorf("chapter titles must be 1 to %d characters", maxTitleLength)
+		case i == 0 && ch.Start != 0:
+			return fmt.Errorf("the first chapter must start at 0")
+		case i > 0 && ch.Start <= list[i-1].Start:
+			return fmt.Errorf("chapters must be in order of their start, without duplicates")
+		case duration > 0 && ch.Start >= duration:
+			return fmt.Errorf("chapter %q starts after the end of the video", ch.Title)
+		}
+	}
+	return nil
+}
+
+// getVideoChapters returns the chapters of a video
+func getVideoChapters(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if !videoExists(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video not found",
+		})
+	}
+	return c.JSON(chaptersResponse(id, lookupChapters(id), videoDuration(c.UserContext(), id)))
+}
+
+// putVideoChapters replaces the chapters of a video. Chapters sent with the
+// id of an existing chapter keep its thumbnail.
+func putVideoChapters(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if !videoExists(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video not found",
+		})
+	}
+
+	var req struct {
+		Chapters []struct {
+			ID    string          `json:"id"`
+			Start json.RawMessage `json:"start"`
+			Title string          `json:"title"`
+		} `json:"chapters"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	existing := make(map[string]chapter)
+	for _, ch := range lookupChapters(id) {
+		existing[ch.ID] = ch
+	}
+	list := make([]chapter, 0, len(req.Chapters))
+	for _, item := range req.Chapters {
+		start, err := parseChapterStart(item.Start)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid chapters: %v", err),
+			})
+		}
+		ch := chapter{ID: utils.UUIDv4(), Start: start, Title: strings.TrimSpace(item.Title)}
+		if previous, ok := existing[item.ID]; ok {
+			ch.ID = previous.ID
+			ch.Thumbnail = previous.Thumbnail
+		}
+		list = append(list, ch)
+	}
+	duration := videoDuration(c.UserContext(), id)
+	if err := validateChapters(list, duration); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid chapters: %v", err),
+		})
+	}
+
+	if err := setChapters(id, list); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save chapters", "video_id", id, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save chapters",
+		})
+	}
+	slog.InfoContext(c.UserContext(), "Chapters updated", "video_id", id, "chapters", len(list))
+	return c.JSON(chaptersResponse(id, list, duration))
+}
+
+// deleteVideoChapters removes all chapters of a video
+func deleteVideoChapters(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if len(lookupChapters(id)) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video has no chapters",
+		})
+	}
+	forgetChapters(id)
+	slog.InfoContext(c.UserContext(), "Chapters removed", "video_id", id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// findChapter returns the chapter of a video with the given ID
+func findChapter(videoID, chapterID string) (chapter, bool) {
+	for _, ch := range lookupChapters(videoID) {
+		if ch.ID == chapterID {
+			return ch, true
+		}
+	}
+	return chapter{}, false
+}
+
+// putChapterThumbnail stores a PNG/JPEG thumbnail for a chapter
+func putChapterThumbnail(c *fiber.Ctx) error {
+	id, chapterID := c.Params("id"), c.Params("chapterId")
+	if _, ok := findChapter(id, chapterID); !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Chapter not found",
+		})
+	}
+	file, err := c.FormFile("image")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("No image file provided or error parsing form: %v", err),
+		})
+	}
+
+	dir := filepath.Join(chaptersDir, id)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to create chapter directory", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to create chapter directory: %v", err),
+		})
+	}
+	path, err := saveImageUpload(file, dir, "", "thumbnail")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// The chapters may have been replaced meanwhile
+	chaptersMu.Lock()
+	defer chaptersMu.Unlock()
+	list := slices.Clone(chapters[id])
+	i := slices.IndexFunc(list, func(ch chapter) bool { return ch.ID == chapterID })
+	if i < 0 {
+		os.Remove(path)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Chapter not found",
+		})
+	}
+	if list[i].Thumbnail != "" {
+		os.Remove(filepath.Join(dir, list[i].Thumbnail))
+	}
+	list[i].Thumbnail = filepath.Base(path)
+	chapters[id] = list
+	if err := writeJSONFile(chaptersFile(), chapters); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save chapters", "error", err)
+	}
+
+	slog.InfoContext(c.UserContext(), "Chapter thumbnail updated", "video_id", id, "chapter_id", chapterID)
+	return c.JSON(fiber.Map{
+		"url": fmt.Sprintf("/api/videos/%s/chapters/%s/thumbnail", id, chapterID),
+	})
+}
+
+// getChapterThumbnail returns the thumbnail of a chapter
+func getChapterThumbnail(c *fiber.Ctx) error {
+	id := c.Params("id")
+	ch, ok := findChapter(id, c.Params("chapterId"))
+	if !ok || ch.Thumbnail == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Thumbnail not found",
+		})
+	}
+	return sendMedia(c, filepath.Join(chaptersDir, id, ch.Thumbnail))
+}
+
+// getVideoChaptersVTT returns the chapters of a video as a WebVTT chapters
+// track, for players of the HLS and DASH renditions
+func getVideoChaptersVTT(c *fiber.Ctx) error {
+	id := c.Params("id")
+	list := lookupChapters(id)
+	if len(list) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video has no chapters",
+		})
+	}
+
+	ends := chapterEnds(list, videoDuration(c.UserContext(), id))
+	var vtt strings.Builder
+	vtt.WriteString("WEBVTT\n")
+	for i, ch := range list {
+		fmt.Fprintf(&vtt, "\n%d\n%s --> %s\n%s\n", i+1, vttTimestamp(ch.Start), vttTimestamp(ends[i]), ch.Title)
+	}
+
+	c.Set(fiber.HeaderContentType, "text/vtt; charset=utf-8")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.SendString(vtt.String())
+}
+
+// vttTimestamp formats seconds as a WebVTT timestamp (HH:MM:SS.mmm)
+func vttTimestamp(seconds float64) string {
+	ms := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+}
+
+// writeChapterMetadata writes the chapters of a video as an FFMETADATA
+// file for ffmpeg to embed with -map_chapters. It returns "" when the
+// video has no chapters.
+func writeChapterMetadata(ctx context.Context, videoID string) (string, error) {
+	list := lookupChapters(videoID)
+	if len(list) == 0 {
+		return "", nil
+	}
+
+	escape := strings.NewReplacer(`\`, `\\`, "=", `\=`, ";", `\;`, "#", `\#`, "\n", `\`+"\n")
+	ends := chapterEnds(list, videoDuration(ctx, videoID))
+	var metadata strings.Builder
+	metadata.WriteString(";FFMETADATA1\n")
+	for i, ch := range list {
+		fmt.Fprintf(&metadata, "[CHAPTER]\nTIMEBASE=1/1000\nSTART=%d\nEND=%d\ntitle=%s\n",
+			int64(math.Round(ch.Start*1000)), int64(math.Round(ends[i]*1000)), escape.Replace(ch.Title))
+	}
+
+	file, err := createJobInput("chapters-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err := file.WriteString(metadata.String()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// generateVideoChapters queues a job that suggests chapters at the
+// strongest cuts of a video, replacing its current chapters
+func generateVideoChapters(c *fiber.Ctx) error {
+	if err := checkFFmpeg(); err != nil {
+		slog.ErrorContext(c.UserContext(), "FFmpeg not available", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("FFmpeg error: %v", err),
+		})
+	}
+
+	id := c.Params("id")
+	if !videoExists(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Source video not found",
+		})
+	}
+	sourcePath := filepath.Join(uploadsDir, id)
+	slog.InfoContext(c.UserContext(), "Chapter generation requested", "video_id", id)
+
+	j := enqueueJob(c.UserContext(), &job{
+		Kind:    "chapters",
+		VideoID: id,
+	}, jobSpec{
+		ProgressID: id,
+		Duration:   videoDuration(c.UserContext(), id),
+		OutputDir:  newStagingDir(transcodedDir),
+		Source:     sourcePath,
+	})
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"success": true,
+		"videoId": id,
+		"jobId":   j.ID,
+	})
+}
+
+// pickChapterStarts chooses the shots starting chapters: the first shot,
+// then the strongest cuts scoring at least threshold, keeping every chapter
+// at least minLength long, up to maxCount chapters
+func pickChapterStarts(shots []shot, duration, threshold, minLength float64, maxCount int) []int {
+	candidates := make([]int, 0, len(shots))
+	for i := 1; i < len(shots); i++ {
+		if shots[i].Score >= threshold {
+			candidates = append(candidates, i)
+		}
+	}
+	sort.SliceStable(candidates, func(a, b int) bool {
+		return shots[candidates[a]].Score > shots[candidates[b]].Score
+	})
+
+	picked := []int{0}
+	for _, i := range candidates {
+		if len(picked) >= maxCount {
+			break
+		}
+		start := shots[i].Start
+		if duration > 0 && duration-start < minLength {
+			continue
+		}
+		if slices.ContainsFunc(picked, func(p int) bool { return math.Abs(shots[p].Start-start) < minLength }) {
+			continue
+		}
+		picked = append(picked, i)
+	}
+	slices.Sort(picked)
+	return picked
+}
+
+// generateChapters runs a chapters job: it picks chapter starts among the
+// shots of the video's scene analysis, running one first when there is
+// none or it missed cuts below its threshold. Each chapter gets the
+// keyframe of its first shot as thumbnail.
+func generateChapters(ctx context.Context, j *job) error {
+	defer os.RemoveAll(j.spec.OutputDir)
+
+	cfg := getConfig().Chapters
+	analysis, ok := lookupScenes(j.VideoID)
+	if !ok || analysis.Threshold > cfg.SceneThreshold {
+		var err error
+		analysis, err = runSceneAnalysis(ctx, j, min(cfg.SceneThreshold, getConfig().Scenes.Threshold))
+		if err != nil {
+			return err
+		}
+	}
+	picked := pickChapterStarts(analysis.Shots, analysis.Duration, cfg.SceneThreshold, float64(cfg.MinLengthSeconds), cfg.MaxChapters)
+
+	_, span := startStage(ctx, "chapters.thumbnails")
+	dir := filepath.Join(chaptersDir, j.VideoID)
+	err := os.MkdirAll(dir, os.ModePerm)
+	list := make([]chapter, 0, len(picked))
+	for n, i := range picked {
+		if err != nil {
+			break
+		}
+		ch := chapter{ID: utils.UUIDv4(), Start: analysis.Shots[i].Start, Title: fmt.Sprintf("Chapter %d", n+1)}
+		if keyframe := analysis.Shots[i].Keyframe; keyframe != "" {
+			ch.Thumbnail = ch.ID + filepath.Ext(keyframe)
+			err = copyFile(filepath.Join(scenesDir, j.VideoID, keyframe), filepath.Join(dir, ch.Thumbnail))
+		}
+		list = append(list, ch)
+	}
+	endStage(span, err)
+	if err != nil {
+		for _, ch := range list {
+			os.Remove(filepath.Join(dir, ch.Thumbnail))
+		}
+		return fmt.Errorf("chapter thumbnails failed: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Chapters generated", "video_id", j.VideoID, "shots", len(analysis.Shots), "chapters", len(list))
+	return setChapters(j.VideoID, list)
+}
+
+// copyFile copies the file at src to dst
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestValidateChapters(t *testing.T) {
+	many := make([]chapter, maxChapters+1)
+	for i := range many {
+		many[i] = chapter{Start: float64(i), Title: "Part"}
+	}
+	tests := []struct {
+		name     string
+		list     []chapter
+		duration float64
+		wantErr  string
+	}{
+		{name: "no chapters", list: nil, duration: 60},
+		{name: "valid", list: []chapter{{Start: 0, Title: "Intro"}, {Start: 30.5, Title: "Main"}}, duration: 60},
+		{name: "unknown duration", list: []chapter{{Start: 0, Title: "Intro"}, {Start: 9000, Title: "Late"}}},
+		{name: "too many", list: many, wantErr: "at most"},
+		{name: "empty title", list: []chapter{{Start: 0}}, wantErr: "titles"},
+		{name: "title too long", list: []chapter{{Start: 0, Title: strings.Repeat("é", maxTitleLength+1)}}, wantErr: "titles"},
+		{name: "title at the limit", list: []chapter{{Start: 0, Title: strings.Repeat("é", maxTitleLength)}}},
+		{name: "first not at 0", list: []chapter{{Start: 1, Title: "Intro"}}, wantErr: "start at 0"},
+		{name: "out of order", list: []chapter{{Start: 0, Title: "A"}, {Start: 20, Title: "B"}, {Start: 10, Title: "C"}}, wantErr: "in order"},
+		{name: "duplicate start", list: []chapter{{Start: 0, Title: "A"}, {Start: 0, Title: "B"}}, wantErr: "in order"},
+		{name: "after the end", list: []chapter{{Start: 0, Title: "A"}, {Start: 60, Title: "B"}}, duration: 60, wantErr: "after the end"},
+	}
+	for _, tt := range tests {
+		err := validateChapters(tt.list, tt.duration)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error = %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestParseChapterStart(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    float64
+		wantErr bool
+	}{
+		{`75.5`, 75.5, false},
+		{`0`, 0, false},
+		{`"1:15.5"`, 75.5, false},
+		{`"01:00:00"`, 3600, false},
+		{`-1`, 0, true},
+		{`"1:75"`, 0, true},
+		{`true`, 0, true},
+		{`null`, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseChapterStart(json.RawMessage(tt.raw))
+		if (err != nil) != tt.wantErr || (err == nil && got != tt.want) {
+			t.Errorf("parseChapterStart(%s) = %v, %v; want %v, error %v", tt.raw, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestChapterEnds(t *testing.T) {
+	list := []chapter{{Start: 0}, {Start: 10}, {Start: 25}}
+	if got := chapterEnds(list, 40); !slices.Equal(got, []float64{10, 25, 40}) {
+		t.Errorf("got %v", got)
+	}
+	// An unknown or too short duration never ends a chapter before it starts
+	if got := chapterEnds(list, 0); !slices.Equal(got, []float64{10, 25, 25}) {
+		t.Errorf("unknown duration: got %v", got)
+	}
+}
+
+func TestVTTTimestamp(t *testing.T) {
+	tests := []struct {
+		seconds float64
+		want    string
+	}{
+		{0, "00:00:00.000"},
+		{1.5, "00:00:01.500"},
+		{59.9996, "00:01:00.000"},
+		{75.25, "00:01:15.250"},
+		{3599.999, "00:59:59.999"},
+		{3723.004, "01:02:03.004"},
+		{360000, "100:00:00.000"},
+	}
+	for _, tt := range tests {
+		if got := vttTimestamp(tt.seconds); got != tt.want {
+			t.Errorf("vttTimestamp(%v) = %q, want %q", tt.seconds, got, tt.want)
+		}
+	}
+}
+
+func TestPickChapterStarts(t *testing.T) {
+	// Shots every 30 seconds of a 10 minute video, with cut scores
+	scores := []float64{0, 0.5, 0.9, 0.3, 0.8, 0.95, 0.45, 0.7, 0.6, 0.85, 0.2, 0.99, 0.5, 0.4, 0.75, 0.3, 0.65, 0.55, 0.9, 0.98}
+	shots := make([]shot, len(scores))
+	for i, score := range scores {
+		shots[i] = shot{Start: float64(i * 30), End: float64(i*30 + 30), Score: score}
+	}
+	tests := []struct {
+		name      string
+		duration  float64
+		threshold float64
+		minLength float64
+		maxCount  int
+		want      []int
+	}{
+		{"strong cuts a minute apart", 600, 0.8, 60, 20, []int{0, 2, 5, 9, 11, 18}},
+		{"limited count keeps the strongest", 600, 0.8, 60, 3, []int{0, 5, 11}},
+		{"last chapter too short", 600, 0.97, 60, 20, []int{0, 11}},
+		{"unknown duration", 0, 0.97, 60, 20, []int{0, 11, 19}},
+		{"nothing above the threshold", 600, 1, 60, 20, []int{0}},
+		{"two minute chapters", 600, 0.5, 120, 20, []int{0, 11, 5, 16}},
+	}
+	for _, tt := range tests {
+		got := pickChapterStarts(shots, tt.duration, tt.threshold, tt.minLength, tt.maxCount)
+		want := slices.Sorted(slices.Values(tt.want))
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, want)
+		}
+	}
+	if got := pickChapterStarts(shots[:1], 30, 0.5, 60, 20); !slices.Equal(got, []int{0}) {
+		t.Errorf("single shot: got %v", got)
+	}
+}
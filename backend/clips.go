@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// derivation records how a video was produced from other videos
+type derivation struct {
+	Operation string    `json:"operation"` // "clip" or "concat"
+	Sources   []string  `json:"sources"`
+	In        float64   `json:"in,omitempty"`
+	Out       float64   `json:"out,omitempty"`
+	Mode      string    `json:"mode"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Derived video records, persisted next to the uploads
+var (
+	derivations   = make(map[string]derivation)
+	derivationsMu sync.Mutex
+)
+
+// derivationsFile returns the path of the derived video records file
+func derivationsFile() string {
+	return filepath.Join(uploadsDir, ".derived.json")
+}
+
+// loadDerivations reads the derived video records from disk
+func loadDerivations() error {
+	data, err := os.ReadFile(derivationsFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	derivationsMu.Lock()
+	defer derivationsMu.Unlock()
+	return json.Unmarshal(data, &derivations)
+}
+
+// saveDerivationsLocked writes the derived video records to disk.
+// derivationsMu must be held.
+func saveDerivationsLocked() error {
+	data, err := json.MarshalIndent(derivations, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := derivationsFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, derivationsFile())
+}
+
+// recordDerivation stores how video id was produced
+func recordDerivation(id string, d derivation) {
+	derivationsMu.Lock()
+	defer derivationsMu.Unlock()
+	derivations[id] = d
+	if err := saveDerivationsLocked(); err != nil {
+		slog.Error("Failed to save derived video records", "error", err)
+	}
+}
+
+// forgetDerivation removes the record of a deleted video
+func forgetDerivation(id string) {
+	derivationsMu.Lock()
+	defer derivationsMu.Unlock()
+	if _, ok := derivations[id]; !ok {
+		return
+	}
+	delete(derivations, id)
+	if err := saveDerivationsLocked(); err != nil {
+		slog.Error("Failed to save derived video records", "error", err)
+	}
+}
+
+// lookupDerivation returns the derivation record of a video, if any
+func lookupDerivation(id string) (derivation, bool) {
+	derivationsMu.Lock()
+	defer derivationsMu.Unlock()
+	d, ok := derivations[id]
+	return d, ok
+}
+
+// parseTimestamp accepts seconds ("75.5") or clock notation ("1:15.5",
+// "00:01:15.500") and returns seconds
+func parseTimestamp(value string) (float64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, fmt.Errorf("empty timestamp")
+	}
+
+	parts := strings.Split(value, ":")
+	if len(parts) > 3 {
+		return 0, fmt.Errorf("invalid timestamp %q", value)
+	}
+
+	total := 0.0
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil || n < 0 || math.IsInf(n, 0) {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		// Minutes and seconds fields cannot exceed 59 in clock notation
+		if i > 0 && n >= 60 {
+			return 0, fmt.Errorf("invalid timestamp %q", value)
+		}
+		total = total*60 + n
+	}
+	return total, nil
+}
+
+// Names of clips and concatenations whose jobs have not published them yet
+var (
+	reservedUploads   = make(map[string]bool)
+	reservedUploadsMu sync.Mutex
+)
+
+// reserveUploadName returns name, or name with a numeric suffix when a file
+// with that name already exists in uploadsDir or is reserved for another
+// job. The name stays reserved until releaseUploadName is called.
+func reserveUploadName(name string) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	reservedUploadsMu.Lock()
+	defer reservedUploadsMu.Unlock()
+	candidate := name
+	for i := 2; ; i++ {
+		if _, err := os.Stat(filepath.Join(uploadsDir, candidate)); os.IsNotExist(err) && !reservedUploads[candidate] {
+			reservedUploads[candidate] = true
+			return candidate
+		}
+		candidate = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+// holdUploadName reserves a name already chosen for a resumed job
+func holdUploadName(name string) {
+	reservedUploadsMu.Lock()
+	reservedUploads[name] = true
+	reservedUploadsMu.Unlock()
+}
+
+// releaseUploadName frees a reserved name once its job has published the
+// file or failed
+func releaseUploadName(name string) {
+	reservedUploadsMu.Lock()
+	delete(reservedUploads, name)
+	reservedUploadsMu.Unlock()
+}
+
+// requestedUploadName names an output after the name given in a request,
+// with the extension of the output. Names that would be empty or hidden
+// are refused.
+func requestedUploadName(requested, ext string) (string, error) {
+	base := strings.TrimSpace(strings.TrimSuffix(filepath.Base(requested), filepath.Ext(requested)))
+	if base == "" || strings.HasPrefix(base, ".") || strings.ContainsAny(base, `/\`) {
+		return "", fmt.Errorf("invalid name %q", requested)
+	}
+	return base + ext, nil
+}
+
+// clipRequest is the body of POST /api/videos/:id/clips
+type clipRequest struct {
+	In   string `json:"in" form:"in"`
+	Out  string `json:"out" form:"out"`
+	Mode string `json:"mode" form:"mode"` // "copy" (default) or "accurate"
+	Name string `json:"name" form:"name"`
+}
+
+// createClip cuts the range [in, out) of a video into a new video
+func createClip(c *fiber.Ctx) error {
+	if err := checkFFmpeg(); err != nil {
+		slog.ErrorContext(c.UserContext(), "FFmpeg not available", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("FFmpeg error: %v", err),
+		})
+	}
+
+	id := c.Params("id")
+	slog.InfoContext(c.UserContext(), "Clip request received", "video_id", id)
+
+	var req clipRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid request body: %v", err),
+		})
+	}
+
+	sourcePath := filepath.Join(uploadsDir, id)
+	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+		slog.InfoContext(c.UserContext(), "Source video not found", "path", sourcePath)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Source video not found",
+		})
+	}
+
+	in, err := parseTimestamp(req.In)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid in point: %v", err),
+		})
+	}
+	out, err := parseTimestamp(req.Out)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid out point: %v", err),
+		})
+	}
+	if out <= in {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Out point must be after in point",
+		})
+	}
+
+	// Clamp the out point to the source duration when it is known
+	if duration, err := getDuration(c.UserContext(), sourcePath); err == nil {
+		if in >= duration {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("In point is beyond the end of the video (%.3fs)", duration),
+			})
+		}
+		if out > duration {
+			out = duration
+		}
+	}
+
+	mode := strings.ToLower(req.Mode)
+	if mode == "" {
+		mode = "copy"
+	}
+	if mode != "copy" && mode != "accurate" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Mode must be \"copy\" or \"accurate\"",
+		})
+	}
+
+	// Stream copy keeps the source container; re-encodes always produce MP4
+	baseName := strings.TrimSuffix(id, filepath.Ext(id))
+	ext := filepath.Ext(id)
+	if mode == "accurate" {
+		ext = ".mp4"
+	}
+	clipName := fmt.Sprintf("%s_clip_%d-%dms%s", baseName, int64(in*1000), int64(out*1000), ext)
+	if req.Name != "" {
+		var err error
+		if clipName, err = requestedUploadName(req.Name, ext); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	// Reserved until the job publishes the clip, so concurrent requests
+	// cannot pick the same name
+	clipName = reserveUploadName(clipName)
+
+	// The clip is written to a staging directory and only appears in
+	// uploadsDir once it is complete
+	stagingDir := newStagingDir(uploadsDir)
+	outputPath := filepath.Join(stagingDir, clipName)
+
+	length := out - in
+	var args []string
+	if mode == "copy" {
+		// Input seeking with stream copy starts at the keyframe before the
+		// in point, so the cut is fast but not frame accurate
+		args = []string{"-ss", formatSeconds(in), "-i", sourcePath,
+			"-t", formatSeconds(length),
+			"-map", "0",
+			"-c", "copy",
+			"-avoid_negative_ts", "make_zero",
+			"-progress", "pipe:1", // Output progress to stdout
+			outputPath}
+	} else {
+		args = []string{"-ss", formatSeconds(in), "-i", sourcePath,
+			"-t", formatSeconds(length),
+			"-c:v", "libx264",
+			"-preset", "fast",
+			"-crf", "18",
+			"-c:a", "aac",
+			"-movflags", "+faststart",
+			"-progress", "pipe:1", // Output progress to stdout
+			outputPath}
+	}
+
+	// The derivation is recorded by the job once the clip is complete
+	j := enqueueJob(c.UserContext(), &job{Kind: "clip", VideoID: id}, jobSpec{
+		Args:       args,
+		ProgressID: clipName,
+		Duration:   length,
+		OutputDir:  stagingDir,
+		StagingDir: stagingDir,
+		PublishDir: uploadsDir,
+		Output:     clipName,
+		URL:        "/videos/" + clipName,
+		Derived:    clipName,
+		Derivation: &derivation{
+			Operation: "clip",
+			Sources:   []string{id},
+			In:        in,
+			Out:       out,
+			Mode:      mode,
+			CreatedAt: time.Now(),
+		},
+	})
+	<-j.done
+	if err := j.err(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Clipping failed: %v", err),
+		})
+	}
+
+	slog.InfoContext(c.UserContext(), "Clip created", "video_id", clipName, "source", id, "in", in, "out", out, "mode", mode)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":          clipName,
+		"name":        clipName,
+		"url":         "/videos/" + clipName,
+		"derivedFrom": id,
+		"jobId":       j.ID,
+		"in":          in,
+		"out":         out,
+		"mode":        mode,
+	})
+}
+
+// concatRequest is the body of POST /api/videos/concat
+type concatRequest struct {
+	IDs  []string `json:"ids" form:"ids"`
+	Name string   `json:"name" form:"name"`
+}
+
+// concatVideos joins several videos, in the given order, into a new video
+func concatVideos(c *fiber.Ctx) error {
+	if err := checkFFmpeg(); err != nil {
+		slog.ErrorContext(c.UserContext(), "FFmpeg not available", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("FFmpeg error: %v", err),
+		})
+	}
+
+	var req concatRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid request body: %v", err),
+		})
+	}
+	if len(req.IDs) < 2 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "At least two video IDs are required",
+		})
+	}
+	slog.InfoContext(c.UserContext(), "Concat request received", "sources", req.IDs)
+
+	// IDs come from the body and end up in an ffmpeg concat list read with
+	// -safe 0, so they must name uploaded videos and nothing else
+	for _, id := range req.IDs {
+		if !validVideoID(id) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid video ID: %q", id),
+			})
+		}
+		if !videoExists(id) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": fmt.Sprintf("Source video not found: %s", id),
+			})
+		}
+	}
+
+	// Probe every input so differences in size, rate and codecs are known
+	paths := make([]string, len(req.IDs))
+	probes := make([]*videoProbe, len(req.IDs))
+	totalDuration := 0.0
+	for i, id := range req.IDs {
+		paths[i] = filepath.Join(uploadsDir, id)
+		probe, err := probeVideo(c.UserContext(), paths[i])
+		if err != nil || !probe.HasVideo {
+			slog.InfoContext(c.UserContext(), "Failed to probe video", "video_id", id, "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Could not read video stream of %s", id),
+			})
+		}
+		probes[i] = probe
+		totalDuration += probe.Duration
+	}
+
+	// Inputs that match exactly can be joined without re-encoding
+	copyMode := true
+	ext := filepath.Ext(req.IDs[0])
+	for i, p := range probes[1:] {
+		first := probes[0]
+		if p.Width != first.Width || p.Height != first.Height ||
+			math.Abs(p.FrameRate-first.FrameRate) > 0.01 ||
+			p.VideoCodec != first.VideoCodec || p.AudioCodec != first.AudioCodec ||
+			p.HasAudio != first.HasAudio || filepath.Ext(req.IDs[i+1]) != ext {
+			copyMode = false
+			break
+		}
+	}
+	if !copyMode {
+		ext = ".mp4"
+	}
+
+	name := fmt.Sprintf("concat_%s%s", time.Now().Format("20060102_150405"), ext)
+	if req.Name != "" {
+		var err error
+		if name, err = requestedUploadName(req.Name, ext); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+	}
+	name = reserveUploadName(name)
+
+	// Written to a staging directory like clips
+	stagingDir := newStagingDir(uploadsDir)
+	outputPath := filepath.Join(stagingDir, name)
+
+	mode := "copy"
+	var args []string
+	var tempFiles []string
+	if copyMode {
+		listPath, err := writeConcatList(paths)
+		if err != nil {
+			releaseUploadName(name)
+			slog.ErrorContext(c.UserContext(), "Failed to write concat list", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": fmt.Sprintf("Failed to prepare concat: %v", err),
+			})
+		}
+		tempFiles = append(tempFiles, listPath)
+
+		args = []string{"-f", "concat", "-safe", "0", "-i", listPath,
+			"-c", "copy",
+			"-progress", "pipe:1", // Output progress to stdout
+			outputPath}
+	} else {
+		mode = "reencode"
+		args = concatFilterArgs(paths, probes, outputPath)
+	}
+
+	// The derivation is recorded by the job once the video is complete
+	j := enqueueJob(c.UserContext(), &job{Kind: "concat", VideoID: name}, jobSpec{
+		Args:       args,
+		ProgressID: name,
+		Duration:   totalDuration,
+		OutputDir:  stagingDir,
+		StagingDir: stagingDir,
+		PublishDir: uploadsDir,
+		Output:     name,
+		URL:        "/videos/" + name,
+		TempFiles:  tempFiles,
+		Derived:    name,
+		Derivation: &derivation{
+			Operation: "concat",
+			Sources:   req.IDs,
+			Mode:      mode,
+			CreatedAt: time.Now(),
+		},
+	})
+	<-j.done
+	if err := j.err(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Concatenation failed: %v", err),
+		})
+	}
+
+	slog.InfoContext(c.UserContext(), "Videos concatenated", "video_id", name, "sources", req.IDs, "mode", mode)
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"id":          name,
+		"name":        name,
+		"url":         "/videos/" + name,
+		"derivedFrom": req.IDs,
+		"jobId":       j.ID,
+		"mode":        mode,
+	})
+}
+
+// writeConcatList writes an input list for ffmpeg's concat demuxer
+func writeConcatList(paths []string) (string, error) {
+	file, err := createJobInput("concat-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return "", err
+		}
+		// Single quotes are escaped as '\'' inside the quoted path
+		fmt.Fprintf(file, "file '%s'\n", strings.ReplaceAll(abs, "'", `'\''`))
+	}
+	return file.Name(), nil
+}
+
+// concatFilterArgs builds a re-encoding concat that normalizes every input
+// to the resolution and frame rate of the first one. Inputs without audio
+// get a silent track so the concat filter sees matching streams.
+func concatFilterArgs(paths []string, probes []*videoProbe, outputPath string) []string {
+	width, height := probes[0].Width, probes[0].Height
+	// Odd dimensions are not accepted by libx264 with yuv420p
+	width -= width % 2
+	height -= height % 2
+	frameRate := probes[0].FrameRate
+	if frameRate <= 0 {
+		frameRate = 30
+	}
+
+	anyAudio := false
+	for _, p := range probes {
+		if p.HasAudio {
+			anyAudio = true
+		}
+	}
+
+	var args []string
+	for _, path := range paths {
+		args = append(args, "-i", path)
+	}
+
+	// Silent inputs are appended after the real ones
+	silentInput := make(map[int]int)
+	if anyAudio {
+		for i, p := range probes {
+			if !p.HasAudio {
+				silentInput[i] = len(paths) + len(silentInput)
+				args = append(args, "-f", "lavfi",
+					"-t", formatSeconds(p.Duration),
+					"-i", "anullsrc=channel_layout=stereo:sample_rate=48000")
+			}
+		}
+	}
+
+	var filters []string
+	var concatInputs string
+	for i := range paths {
+		filters = append(filters, fmt.Sprintf(
+			"[%d:v]scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=%s,format=yuv420p[v%d]",
+			i, width, height, width, height, strconv.FormatFloat(frameRate, 'f', 3, 64), i))
+		concatInputs += fmt.Sprintf("[v%d]", i)
+
+		if anyAudio {
+			audioInput := i
+			if silent, ok := silentInput[i]; ok {
+				audioInput = silent
+			}
+			filters = append(filters, fmt.Sprintf(
+				"[%d:a]aresample=48000,aformat=channel_layouts=stereo[a%d]", audioInput, i))
+			concatInputs += fmt.Sprintf("[a%d]", i)
+		}
+	}
+
+	audioStreams := 0
+	outputs := "[v]"
+	if anyAudio {
+		audioStreams = 1
+		outputs = "[v][a]"
+	}
+	filters = append(filters, fmt.Sprintf("%sconcat=n=%d:v=1:a=%d%s", concatInputs, len(paths), audioStreams, outputs))
+
+	args = append(args, "-filter_complex", strings.Join(filters, ";"), "-map", "[v]")
+	if anyAudio {
+		args = append(args, "-map", "[a]", "-c:a", "aac")
+	}
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "fast",
+		"-crf", "20",
+		"-movflags", "+faststart",
+		"-progress", "pipe:1", // Output progress to stdout
+		outputPath)
+	return args
+}
+
+// formatSeconds formats seconds for ffmpeg time options
+func formatSeconds(seconds float64) string {
+	return strconv.FormatFloat(seconds, 'f', 3, 64)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestParseTimestamp(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    float64
+		wantErr bool
+	}{
+		{"75.5", 75.5, false},
+		{" 12 ", 12, false},
+		{"1:15.5", 75.5, false},
+		{"00:01:15.500", 75.5, false},
+		{"2:00:00", 7200, false},
+		{"", 0, true},
+		{"1:60", 0, true}, // Seconds field past 59
+		{"1:2:3:4", 0, true},
+		{"-5", 0, true},
+		{"1:-5", 0, true},
+		{"Inf", 0, true},
+		{"1m15s", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseTimestamp(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseTimestamp(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseTimestamp(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRequestedUploadName(t *testing.T) {
+	tests := []struct {
+		requested string
+		want      string
+		wantErr   bool
+	}{
+		{"intro", "intro.mp4", false},
+		{"intro.mov", "intro.mp4", false},
+		{"../../etc/intro.mkv", "intro.mp4", false},
+		{" intro ", "intro.mp4", false},
+		{"..", "", true},
+		{".", "", true},
+		{"/", "", true},
+		{"   ", "", true},
+		{".hidden", "", true},
+		{"dir/.index.json", "", true},
+	}
+	for _, tt := range tests {
+		got, err := requestedUploadName(tt.requested, ".mp4")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("requestedUploadName(%q) error = %v, want error %v", tt.requested, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("requestedUploadName(%q) = %q, want %q", tt.requested, got, tt.want)
+		}
+	}
+}
+
+func TestReserveUploadName(t *testing.T) {
+	saved := uploadsDir
+	uploadsDir = t.TempDir()
+	t.Cleanup(func() { uploadsDir = saved })
+
+	if err := os.WriteFile(filepath.Join(uploadsDir, "clip.mp4"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	first := reserveUploadName("clip.mp4")
+	second := reserveUploadName("clip.mp4")
+	if first != "clip_2.mp4" || second != "clip_3.mp4" {
+		t.Fatalf("got %q and %q, want clip_2.mp4 and clip_3.mp4", first, second)
+	}
+	releaseUploadName(first)
+	releaseUploadName(second)
+	if got := reserveUploadName("clip.mp4"); got != "clip_2.mp4" {
+		t.Errorf("after release got %q, want clip_2.mp4", got)
+	}
+	releaseUploadName("clip_2.mp4")
+}
+
+func TestConcatRefusesPathsOutsideUploads(t *testing.T) {
+	saved := uploadsDir
+	uploadsDir = t.TempDir()
+	t.Cleanup(func() { uploadsDir = saved })
+	for _, name := range []string{"a.mp4", "b.mp4"} {
+		if err := os.WriteFile(filepath.Join(uploadsDir, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ffmpeg must be found; ffprobe leaves a mark if anything is probed
+	bin := t.TempDir()
+	probed := filepath.Join(bin, "probed")
+	scripts := map[string]string{
+		"ffmpeg":  "#!/bin/sh\nexit 0\n",
+		"ffprobe": "#!/bin/sh\ntouch " + probed + "\nexit 1\n",
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin)
+
+	app := fiber.New()
+	app.Post("/concat", concatVideos)
+	tests := []struct {
+		ids  []string
+		want int
+	}{
+		{[]string{"a.mp4", "../../etc/passwd"}, fiber.StatusBadRequest},
+		{[]string{"/etc/passwd", "a.mp4"}, fiber.StatusBadRequest},
+		{[]string{"a.mp4", ".."}, fiber.StatusBadRequest},
+		{[]string{"a.mp4", ".fingerprints.json"}, fiber.StatusBadRequest},
+		{[]string{"a.mp4", ""}, fiber.StatusBadRequest},
+		{[]string{"a.mp4", "missing.mp4"}, fiber.StatusNotFound},
+	}
+	for _, tt := range tests {
+		body, _ := json.Marshal(concatRequest{IDs: tt.ids})
+		req := httptest.NewRequest("POST", "/concat", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.want {
+			t.Errorf("ids %q: status %d, want %d", tt.ids, resp.StatusCode, tt.want)
+		}
+	}
+	if _, err := os.Stat(probed); err == nil {
+		t.Error("an input was probed before every ID was checked")
+	}
+}
+
+func TestConcatFilterArgs(t *testing.T) {
+	probes := []*videoProbe{
+		{Duration: 10, Width: 1281, Height: 721, FrameRate: 25, HasAudio: true},
+		{Duration: 4.5, Width: 640, Height: 360, FrameRate: 30},
+	}
+	args := concatFilterArgs([]string{"a.mp4", "b.mp4"}, probes, "out.mp4")
+
+	// The silent track of the second input is input #2
+	if i := slices.Index(args, "lavfi"); i < 0 || args[i+2] != "4.500" || args[i+4] != "anullsrc=channel_layout=stereo:sample_rate=48000" {
+		t.Errorf("no silent input lasting 4.500 seconds: %q", args)
+	}
+	i := slices.Index(args, "-filter_complex")
+	if i < 0 {
+		t.Fatalf("no filtergraph: %q", args)
+	}
+	graph := args[i+1]
+	for _, want := range []string{
+		"[0:v]scale=1280:720:force_original_aspect_ratio=decrease,pad=1280:720:(ow-iw)/2:(oh-ih)/2,setsar=1,fps=25.000,format=yuv420p[v0]",
+		"[1:v]scale=1280:720:",
+		"[2:a]aresample=48000,aformat=channel_layouts=stereo[a1]",
+		"[v0][a0][v1][a1]concat=n=2:v=1:a=1[v][a]",
+	} {
+		if !strings.Contains(graph, want) {
+			t.Errorf("filtergraph lacks %q:\n%s", want, graph)
+		}
+	}
+	if args[len(args)-1] != "out.mp4" || !slices.Contains(args, "[a]") {
+		t.Errorf("audio or output missing: %q", args)
+	}
+
+	// Without any audio nothing silent is added
+	probes[0].HasAudio = false
+	args = concatFilterArgs([]string{"a.mp4", "b.mp4"}, probes, "out.mp4")
+	if slices.Contains(args, "lavfi") || slices.Contains(args, "[a]") {
+		t.Errorf("audio added to silent inputs: %q", args)
+	}
+	if graph := args[slices.Index(args, "-filter_complex")+1]; !strings.HasSuffix(graph, "[v0][v1]concat=n=2:v=1:a=0[v]") {
+		t.Errorf("filtergraph %s", graph)
+	}
+}
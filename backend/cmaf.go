@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Subdirectories of transcodedDir/<baseName> used by the fMP4 outputs
+const (
+	cmafDirName  = "cmaf"
+	llhlsDirName = "llhls"
+)
+
+// CMAF segment duration in seconds, shared by the HLS and DASH manifests
+const cmafSegmentDuration = 2
+
+// LL-HLS part layout. Segments are llhlsPartsPerSegment parts long and
+// ffmpeg is forced to put a keyframe at each segment start; a segment runs
+// on until a part actually starts with a keyframe.
+const (
+	llhlsPartDuration    = 0.5
+	llhlsPartsPerSegment = 4
+	llhlsPartPattern     = "part_%05d.m4s"
+	llhlsSegmentPattern  = "seg_%05d.m4s"
+	llhlsSourcePlaylist  = "parts.m3u8"
+	llhlsInitSegment     = "init.mp4"
+)
+
+// cmafVideoArgs returns the video encoder options of a CMAF encode, with a
+// keyframe at the start of every segment
+func cmafVideoArgs(filter *videoFilter) []string {
+	video := append([]string{
+		"-c:v", "libx264",
+		"-preset", "fast"},
+		keyframeArgs(cmafSegmentDuration)...)
+	return append(video, filter.outputArgs()...)
+}
+
+// cmafArgs builds the ffmpeg arguments for CMAF packaging. The dash muxer
+// writes fMP4 segments plus manifest.mpd, and with -hls_playlist also
+// master.m3u8 and media playlists referencing the same segments.
+func cmafArgs(input, video []string, rate rateControl, outputPath string) []string {
+	args := append(input, video...)
+	args = append(args, rate.args("")...)
+	return append(args,
+		"-c:a", "aac",
+		"-f", "dash",
+		"-seg_duration", strconv.Itoa(cmafSegmentDuration),
+		"-use_timeline", "1",
+		"-use_template", "1",
+		"-hls_playlist", "1",
+		"-init_seg_name", "init-$RepresentationID$.m4s",
+		"-media_seg_name", "chunk-$RepresentationID$-$Number%05d$.m4s",
+		"-adaptation_sets", "id=0,streams=v id=1,streams=a",
+		"-progress", "pipe:1", // Output progress to stdout
+		outputPath)
+}
+
+// llhlsArgs builds the ffmpeg arguments for an LL-HLS stream. ffmpeg only
+// writes the individual parts and a plain playlist listing them; the
+// low-latency playlist is produced by serveLLHLS.
+func llhlsArgs(sourcePath, outputDir string, filter *videoFilter, rate rateControl) []string {
+	segmentDuration := llhlsPartDuration * llhlsPartsPerSegment
+	args := []string{"-re", "-i", sourcePath} // Read at native rate to behave like a live source
+	args = append(args, filter.inputArgs()...)
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-tune", "zerolatency",
+		"-c:a", "aac")
+	args = append(args, filter.outputArgs()...)
+	args = append(args, rate.args("")...)
+	args = append(args, keyframeArgs(segmentDuration)...)
+	return append(args,
+		"-f", "hls",
+		"-hls_time", strconv.FormatFloat(llhlsPartDuration, 'f', -1, 64),
+		"-hls_list_size", "0",
+		"-hls_segment_type", "fmp4",
+		"-hls_flags", "split_by_time",
+		"-hls_fmp4_init_filename", llhlsInitSegment,
+		"-hls_segment_filename", filepath.Join(outputDir, llhlsPartPattern),
+		"-progress", "pipe:1", // Output progress to stdout
+		filepath.Join(outputDir, llhlsSourcePlaylist))
+}
+
+// llhlsPart is one fMP4 part as listed in the ffmpeg playlist
+type llhlsPart struct {
+	uri         string
+	duration    float64
+	independent bool // Starts with a keyframe
+}
+
+// llhlsState is a snapshot of the parts ffmpeg has finished writing,
+// grouped into segments
+type llhlsState struct {
+	parts  []llhlsPart
+	starts []int // Index of the first part of each segment
+	ended  bool
+}
+
+// readLLHLSState parses the playlist ffmpeg maintains for an LL-HLS stream
+// and reads the keyframe flags of its parts
+func readLLHLSState(dir string) (*llhlsState, error) {
+	file, err := os.Open(filepath.Join(dir, llhlsSourcePlaylist))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var parts []llhlsPart
+	ended := false
+	duration := 0.0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value := strings.TrimSuffix(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if i := strings.Index(value, ","); i >= 0 {
+				value = value[:i]
+			}
+			duration, _ = strconv.ParseFloat(value, 64)
+		case line == "#EXT-X-ENDLIST":
+			ended = true
+		case line != "" && !strings.HasPrefix(line, "#"):
+			parts = append(parts, llhlsPart{uri: line, duration: duration})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// split_by_time cuts parts on any frame, so whether a part starts with
+	// a keyframe is read from the part itself
+	markIndependentParts(dir, parts)
+	return newLLHLSState(parts, ended), nil
+}
+
+// newLLHLSState groups parts into segments. A segment ends once it holds
+// llhlsPartsPerSegment parts, but the next one only starts at a part
+// beginning with a keyframe, so full segments stay decodable on their own
+// even when a part boundary misses the forced keyframe.
+func newLLHLSState(parts []llhlsPart, ended bool) *llhlsState {
+	s := &llhlsState{parts: parts, ended: ended}
+	for i, p := range parts {
+		if i == 0 || (p.independent && i-s.starts[len(s.starts)-1] >= llhlsPartsPerSegment) {
+			s.starts = append(s.starts, i)
+		}
+	}
+	return s
+}
+
+// completeSegments returns how many full segments are available. A
+// segment is complete once the next one has started, or the stream ended.
+func (s *llhlsState) completeSegments() int {
+	if s.ended {
+		return len(s.starts)
+	}
+	return max(len(s.starts)-1, 0)
+}
+
+// segmentParts returns the parts that make up segment msn
+func (s *llhlsState) segmentParts(msn int) []llhlsPart {
+	if msn >= len(s.starts) {
+		return nil
+	}
+	end := len(s.parts)
+	if msn+1 < len(s.starts) {
+		end = s.starts[msn+1]
+	}
+	return s.parts[s.starts[msn]:end]
+}
+
+// has reports whether segment msn, or part part of it when part >= 0,
+// has been written. A complete segment has all the parts it will get.
+func (s *llhlsState) has(msn, part int) bool {
+	if msn < s.completeSegments() {
+		return true
+	}
+	if part < 0 || msn >= len(s.starts) {
+		return false
+	}
+	return part < len(s.segmentParts(msn))
+}
+
+// playlist renders the LL-HLS media playlist. Parts are only listed for
+// the last few segments, as recommended by the spec.
+func (s *llhlsState) playlist() string {
+	complete := s.completeSegments()
+	targetDuration := llhlsPartDuration * llhlsPartsPerSegment
+	for msn := range complete {
+		total := 0.0
+		for _, p := range s.segmentParts(msn) {
+			total += p.duration
+		}
+		targetDuration = max(targetDuration, total)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:9\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Round(targetDuration)))
+	fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n", llhlsPartDuration*3)
+	fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", llhlsPartDuration)
+	b.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n")
+	if s.ended {
+		b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n")
+	}
+	fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"%s\"\n", llhlsInitSegment)
+
+	firstWithParts := complete - 3
+	writeParts := func(parts []llhlsPart) {
+		for _, p := range parts {
+			independent := ""
+			if p.independent {
+				independent = ",INDEPENDENT=YES"
+			}
+			fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\"%s\n", p.duration, p.uri, independent)
+		}
+	}
+
+	for msn := 0; msn < complete; msn++ {
+		parts := s.segmentParts(msn)
+		total := 0.0
+		for _, p := range parts {
+			total += p.duration
+		}
+		if !s.ended && msn >= firstWithParts {
+			writeParts(parts)
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n", total)
+		fmt.Fprintf(&b, llhlsSegmentPattern+"\n", msn)
+	}
+
+	if s.ended {
+		b.WriteString("#EXT-X-ENDLIST\n")
+		return b.String()
+	}
+
+	// Parts of the segment that is still being written
+	writeParts(s.segmentParts(complete))
+	fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\""+llhlsPartPattern+"\"\n", len(s.parts))
+
+	return b.String()
+}
+
+// waitLLHLS polls the ffmpeg playlist until ready returns true, the
+// stream ends or timeout elapses
+func waitLLHLS(dir string, timeout time.Duration, ready func(*llhlsState) bool) (*llhlsState, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		state, err := readLLHLSState(dir)
+		if err == nil && (ready(state) || state.ended) {
+			return state, nil
+		}
+		if time.Now().After(deadline) {
+			return state, err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// serveLLHLS serves the server-generated LL-HLS playlist, its parts and
+// the full segments assembled from them
+func serveLLHLS(c *fiber.Ctx) error {
+	baseName := c.Params("base")
+	file := c.Params("file")
+	if strings.Contains(baseName, "..") || strings.Contains(file, "..") {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid path",
+		})
+	}
+
+	dir := filepath.Join(transcodedDir, baseName, llhlsDirName)
+	blockTimeout := time.Duration(3*llhlsPartDuration*llhlsPartsPerSegment) * time.Second
+
+	if file == "playlist.m3u8" {
+		return serveLLHLSPlaylist(c, dir, blockTimeout)
+	}
+
+	if file == llhlsInitSegment {
+		if _, err := waitLLHLS(dir, blockTimeout, func(s *llhlsState) bool { return len(s.parts) > 0 }); err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Stream not found",
+			})
+		}
+		return sendMedia(c, filepath.Join(dir, file))
+	}
+
+	var index int
+	if _, err := fmt.Sscanf(file, llhlsPartPattern, &index); err == nil {
+		// Requests for the part named in the preload hint block until
+		// ffmpeg has finished writing it
+		state, err := waitLLHLS(dir, blockTimeout, func(s *llhlsState) bool { return index < len(s.parts) })
+		if err != nil || index >= len(state.parts) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Part not found",
+			})
+		}
+		return sendMedia(c, filepath.Join(dir, state.parts[index].uri))
+	}
+
+	if _, err := fmt.Sscanf(file, llhlsSegmentPattern, &index); err == nil {
+		state, err := readLLHLSState(dir)
+		if err != nil || !state.has(index, -1) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Segment not found",
+			})
+		}
+
+		// A full segment is the concatenation of its fMP4 parts
+		var data []byte
+		for _, p := range state.segmentParts(index) {
+			chunk, err := os.ReadFile(filepath.Join(dir, p.uri))
+			if err != nil {
+				slog.ErrorContext(c.UserContext(), "Failed to read LL-HLS part", "part", p.uri, "error", err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to read segment",
+				})
+			}
+			data = append(data, chunk...)
+		}
+		c.Set(fiber.HeaderContentType, mediaContentType(file))
+		c.Set(fiber.HeaderCacheControl, segmentCacheControl)
+		servedBytesTotal.WithLabelValues(c.Route().Path).Add(float64(len(data)))
+		return c.Send(data)
+	}
+
+	return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+		"error": "File not found",
+	})
+}
+
+// serveLLHLSPlaylist handles playlist requests, including blocking reloads
+// driven by the _HLS_msn and _HLS_part query parameters
+func serveLLHLSPlaylist(c *fiber.Ctx, dir string, blockTimeout time.Duration) error {
+	msnParam := c.Query("_HLS_msn")
+	partParam := c.Query("_HLS_part")
+
+	if msnParam == "" && partParam != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "_HLS_part requires _HLS_msn",
+		})
+	}
+
+	state, err := readLLHLSState(dir)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Stream not found",
+		})
+	}
+
+	if msnParam != "" {
+		msn, err := strconv.Atoi(msnParam)
+		if err != nil || msn < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid _HLS_msn",
+			})
+		}
+		part := -1
+		if partParam != "" {
+			part, err = strconv.Atoi(partParam)
+			if err != nil || part < 0 {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid _HLS_part",
+				})
+			}
+		}
+
+		// Clients may not ask for more than two segments into the future
+		if msn > state.completeSegments()+2 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "_HLS_msn is too far ahead of the stream",
+			})
+		}
+
+		state, err = waitLLHLS(dir, blockTimeout, func(s *llhlsState) bool { return s.has(msn, part) })
+		if err != nil {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Stream not found",
+			})
+		}
+		if !state.has(msn, part) && !state.ended {
+			return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+				"error": "Timed out waiting for the requested segment",
+			})
+		}
+	}
+
+	c.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.SendString(state.playlist())
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// box builds an ISO BMFF box from its type and body parts
+func box(typ string, body ...[]byte) []byte {
+	size := 8
+	for _, b := range body {
+		size += len(b)
+	}
+	out := binary.BigEndian.AppendUint32(nil, uint32(size))
+	out = append(out, typ...)
+	for _, b := range body {
+		out = append(out, b...)
+	}
+	return out
+}
+
+// u32 encodes big-endian 32-bit fields
+func u32(values ...uint32) []byte {
+	var out []byte
+	for _, v := range values {
+		out = binary.BigEndian.AppendUint32(out, v)
+	}
+	return out
+}
+
+const (
+	syncFlags    = 0x02000000 // Depends on no other sample
+	nonSyncFlags = 0x01010000 // Depends on others, not a sync sample
+)
+
+// traf builds a track fragment from the bodies of its tfhd and trun
+func traf(tfhd, trun []byte) []byte {
+	return box("traf", box("tfhd", tfhd), box("trun", trun))
+}
+
+func TestFragmentStartsWithSync(t *testing.T) {
+	trexNonSync := map[uint32]uint32{1: nonSyncFlags}
+	tests := []struct {
+		name     string
+		fragment []byte
+		defaults map[uint32]uint32
+		want     bool
+		wantErr  bool
+	}{
+		{
+			name:     "trun first sample flags",
+			fragment: box("moof", traf(u32(0x20, 1, nonSyncFlags), u32(0x5, 3, 100, syncFlags))),
+			want:     true,
+		},
+		{
+			name:     "trun first sample not sync",
+			fragment: box("moof", traf(u32(0x20, 1, syncFlags), u32(0x5, 3, 100, nonSyncFlags))),
+			want:     false,
+		},
+		{
+			name: "per-sample flags after duration and size",
+			fragment: box("moof", traf(u32(0, 1),
+				u32(0x701, 2, 100, 512, 4000, syncFlags, 512, 4000, nonSyncFlags))),
+			want: true,
+		},
+		{
+			name:     "tfhd default flags after optional fields",
+			fragment: box("moof", traf(u32(0x3a, 1, 1, 512, 4000, nonSyncFlags), u32(0x1, 4, 100))),
+			want:     false,
+		},
+		{
+			name:     "trex defaults",
+			fragment: box("moof", traf(u32(0, 1), u32(0, 4))),
+			defaults: trexNonSync,
+			want:     false,
+		},
+		{
+			name:     "no flags anywhere counts as sync",
+			fragment: box("moof", traf(u32(0, 1), u32(0, 4))),
+			want:     true,
+		},
+		{
+			name: "any track starting mid-GOP",
+			fragment: box("moof",
+				traf(u32(0, 1), u32(0x4, 4, syncFlags)),
+				traf(u32(0, 2), u32(0x4, 4, nonSyncFlags))),
+			want: false,
+		},
+		{
+			name:     "styp before moof",
+			fragment: append(box("styp", []byte("msdh")), box("moof", traf(u32(0, 1), u32(0x4, 1, syncFlags)))...),
+			want:     true,
+		},
+		{
+			name:     "missing moof",
+			fragment: box("mdat", []byte{1, 2, 3}),
+			wantErr:  true,
+		},
+		{
+			name:     "truncated trun",
+			fragment: box("moof", traf(u32(0, 1), u32(0x4, 4))),
+			wantErr:  true,
+		},
+		{
+			name:     "box larger than data",
+			fragment: box("moof", traf(u32(0, 1), u32(0x4, 4, syncFlags)))[:20],
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fragmentStartsWithSync(tt.fragment, tt.defaults)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrackDefaultFlags(t *testing.T) {
+	init := append(box("ftyp", []byte("iso6")),
+		box("moov", box("mvex",
+			box("trex", u32(0, 1, 1, 0, 0, nonSyncFlags)),
+			box("trex", u32(0, 2, 1, 1024, 0, syncFlags))))...)
+	got := trackDefaultFlags(init)
+	if got[1] != nonSyncFlags || got[2] != syncFlags || len(got) != 2 {
+		t.Errorf("got %v", got)
+	}
+}
+
+// llhlsParts builds half-second parts, independent where marked "K"
+func llhlsParts(layout string) []llhlsPart {
+	var parts []llhlsPart
+	for i, c := range strings.Split(layout, " ") {
+		parts = append(parts, llhlsPart{
+			uri:         "part_" + string(rune('a'+i)) + ".m4s",
+			duration:    llhlsPartDuration,
+			independent: c == "K",
+		})
+	}
+	return parts
+}
+
+func TestLLHLSSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		layout   string
+		ended    bool
+		starts   []int
+		complete int
+	}{
+		{"aligned keyframes", "K p p p K p p p K", false, []int{0, 4, 8}, 2},
+		{"open last segment", "K p p p K p", false, []int{0, 4}, 1},
+		{"ended stream closes the last segment", "K p p p K p", true, []int{0, 4}, 2},
+		{"missed keyframe extends the segment", "K p p p p K p p p K", false, []int{0, 5, 9}, 2},
+		{"early keyframe stays inside the segment", "K p K p K p p p", false, []int{0, 4}, 1},
+		{"no keyframe after the first part", "K p p p p p p", false, []int{0}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newLLHLSState(llhlsParts(tt.layout), tt.ended)
+			if !slices.Equal(s.starts, tt.starts) {
+				t.Errorf("starts = %v, want %v", s.starts, tt.starts)
+			}
+			if got := s.completeSegments(); got != tt.complete {
+				t.Errorf("complete segments = %d, want %d", got, tt.complete)
+			}
+			for msn := range len(s.starts) {
+				if parts := s.segmentParts(msn); !parts[0].independent {
+					t.Errorf("segment %d starts with a part without keyframe", msn)
+				}
+			}
+		})
+	}
+}
+
+func TestLLHLSHas(t *testing.T) {
+	s := newLLHLSState(llhlsParts("K p p p p K p"), false)
+	tests := []struct {
+		msn, part int
+		want      bool
+	}{
+		{0, -1, true},
+		{0, 4, true},   // Fifth part of the extended segment
+		{0, 7, true},   // The segment is complete, nothing more will come
+		{1, -1, false}, // Still being written
+		{1, 1, true},
+		{1, 2, false},
+		{2, 0, false},
+	}
+	for _, tt := range tests {
+		if got := s.has(tt.msn, tt.part); got != tt.want {
+			t.Errorf("has(%d, %d) = %v, want %v", tt.msn, tt.part, got, tt.want)
+		}
+	}
+}
+
+func TestLLHLSPlaylistIndependentParts(t *testing.T) {
+	// The keyframe of the second segment landed one part late
+	s := newLLHLSState(llhlsParts("K p p p p K p p p K p"), false)
+	playlist := s.playlist()
+
+	for _, p := range s.parts {
+		line := `URI="` + p.uri + `"`
+		i := strings.Index(playlist, line)
+		if i < 0 {
+			t.Fatalf("part %s not listed:\n%s", p.uri, playlist)
+		}
+		marked := strings.HasPrefix(playlist[i+len(line):], ",INDEPENDENT=YES")
+		if marked != p.independent {
+			t.Errorf("part %s marked independent %v, want %v", p.uri, marked, p.independent)
+		}
+	}
+	if !strings.Contains(playlist, "#EXTINF:2.500,\nseg_00000.m4s\n") {
+		t.Errorf("extended first segment missing:\n%s", playlist)
+	}
+	if !strings.Contains(playlist, "#EXT-X-TARGETDURATION:3\n") {
+		t.Errorf("target duration does not cover the extended segment:\n%s", playlist)
+	}
+	if !strings.Contains(playlist, `#EXT-X-PRELOAD-HINT:TYPE=PART,URI="part_00011.m4s"`) {
+		t.Errorf("preload hint missing:\n%s", playlist)
+	}
+}
+
+func TestMarkIndependentParts(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	independent := func(parts []llhlsPart) []bool {
+		var marks []bool
+		for _, p := range parts {
+			marks = append(marks, p.independent)
+		}
+		return marks
+	}
+	syncPart := box("moof", traf(u32(0, 1), u32(0x4, 1, syncFlags)))
+	nonSyncPart := box("moof", traf(u32(0, 1), u32(0x4, 1, nonSyncFlags)))
+
+	write(llhlsInitSegment, box("moov", box("mvex", box("trex", u32(0, 1, 1, 0, 0, nonSyncFlags)))))
+	write("part_0.m4s", syncPart)
+	write("part_1.m4s", nonSyncPart)
+	parts := []llhlsPart{{uri: "part_0.m4s"}, {uri: "part_1.m4s"}, {uri: "part_2.m4s"}}
+	markIndependentParts(dir, parts)
+	if got := independent(parts); !slices.Equal(got, []bool{true, false, false}) {
+		t.Fatalf("got %v", got)
+	}
+
+	// Listed parts are read once, so rewriting one does not change it
+	write("part_1.m4s", syncPart)
+	parts = []llhlsPart{{uri: "part_0.m4s"}, {uri: "part_1.m4s"}}
+	markIndependentParts(dir, parts)
+	if got := independent(parts); !slices.Equal(got, []bool{true, false}) {
+		t.Errorf("cached parts read again: %v", got)
+	}
+
+	// A new encode writes a new init segment
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dir, llhlsInitSegment), later, later); err != nil {
+		t.Fatal(err)
+	}
+	markIndependentParts(dir, parts)
+	if got := independent(parts); !slices.Equal(got, []bool{true, true}) {
+		t.Errorf("cache kept across encodes: %v", got)
+	}
+	partSyncCacheMu.Lock()
+	cached := len(partSyncCache[dir].parts)
+	partSyncCacheMu.Unlock()
+	if cached != 2 {
+		t.Errorf("%d parts cached, want 2", cached)
+	}
+
+	forgetPartSync(dir)
+	partSyncCacheMu.Lock()
+	_, kept := partSyncCache[dir]
+	partSyncCacheMu.Unlock()
+	if kept {
+		t.Error("forgotten directory still cached")
+	}
+}
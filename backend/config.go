@@ -0,0 +1,560 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables that override the config file
+const envPrefix = "VIDEOSTREAMING_"
+
+// Config file read when neither -config nor VIDEOSTREAMING_CONFIG is set,
+// if it exists
+const defaultConfigFile = "config.yaml"
+
+// config holds the server settings. Values come from the defaults below,
+// then the config file, then environment variables, then command line flags.
+type config struct {
+	Port              int      `yaml:"port" toml:"port"`
+	UploadsDir        string   `yaml:"uploadsDir" toml:"uploadsDir"`
+	TranscodedDir     string   `yaml:"transcodedDir" toml:"transcodedDir"`
+	MaxUploadMB       int      `yaml:"maxUploadMB" toml:"maxUploadMB"`
+	AllowedExtensions []string `yaml:"allowedExtensions" toml:"allowedExtensions"`
+
+	// Time running jobs get to finish on shutdown before they are interrupted
+	ShutdownTimeoutSeconds int `yaml:"shutdownTimeoutSeconds" toml:"shutdownTimeoutSeconds"`
+
+	// Reloaded on SIGHUP
+	CORSOrigins       []string        `yaml:"corsOrigins" toml:"corsOrigins"`
+	MaxConcurrentJobs int             `yaml:"maxConcurrentJobs" toml:"maxConcurrentJobs"`
+	DuplicateUploads  string          `yaml:"duplicateUploads" toml:"duplicateUploads"` // reject, link or allow
+	UploadLimits      uploadLimits    `yaml:"uploadLimits" toml:"uploadLimits"`
+	Presets           presetsConfig   `yaml:"presets" toml:"presets"`
+	Verification      verifyConfig    `yaml:"verification" toml:"verification"`
+	Ladder            ladderConfig    `yaml:"ladder" toml:"ladder"`
+	Scenes            sceneConfig     `yaml:"scenes" toml:"scenes"`
+	Chapters          chapterConfig   `yaml:"chapters" toml:"chapters"`
+	Analytics         analyticsConfig `yaml:"analytics" toml:"analytics"`
+	Webhooks          webhookConfig   `yaml:"webhooks" toml:"webhooks"`
+}
+
+// uploadLimits bounds what uploads may contain, so files that would take
+// excessive time or memory to decode are refused. Width and height are
+// landscape; portrait videos are checked turned sideways.
+type uploadLimits struct {
+	MaxDurationSeconds float64 `yaml:"maxDurationSeconds" toml:"maxDurationSeconds"`
+	MaxWidth           int     `yaml:"maxWidth" toml:"maxWidth"`
+	MaxHeight          int     `yaml:"maxHeight" toml:"maxHeight"`
+	MaxFrames          int64   `yaml:"maxFrames" toml:"maxFrames"`
+}
+
+// presetsConfig lists the resolutions and bitrates transcodes may ask for
+type presetsConfig struct {
+	Resolutions       []string `yaml:"resolutions" toml:"resolutions"`
+	Bitrates          []string `yaml:"bitrates" toml:"bitrates"`
+	DefaultResolution string   `yaml:"defaultResolution" toml:"defaultResolution"`
+	DefaultBitrate    string   `yaml:"defaultBitrate" toml:"defaultBitrate"`
+
+	// Used when a request does not choose its rate control
+	DefaultRateControl string `yaml:"defaultRateControl" toml:"defaultRateControl"`
+	DefaultCRF         int    `yaml:"defaultCRF" toml:"defaultCRF"`
+}
+
+// verifyConfig sets how transcodes are checked before they are published.
+// A threshold of 0 accepts any score.
+type verifyConfig struct {
+	DurationToleranceSeconds float64  `yaml:"durationToleranceSeconds" toml:"durationToleranceSeconds"`
+	Metrics                  []string `yaml:"metrics" toml:"metrics"` // Measured unless a request names its own
+	MinVMAF                  float64  `yaml:"minVMAF" toml:"minVMAF"`
+	MinPSNR                  float64  `yaml:"minPSNR" toml:"minPSNR"`
+	MinSSIM                  float64  `yaml:"minSSIM" toml:"minSSIM"`
+}
+
+// ladderConfig sets up the trial encodes of the per-title ladder analysis
+type ladderConfig struct {
+	Metric        string  `yaml:"metric" toml:"metric"` // vmaf, psnr or ssim
+	CRFs          []int   `yaml:"crfs" toml:"crfs"`     // Tried at every preset resolution
+	SampleSeconds int     `yaml:"sampleSeconds" toml:"sampleSeconds"`
+	MaxRungs      int     `yaml:"maxRungs" toml:"maxRungs"`
+	TargetQuality float64 `yaml:"targetQuality" toml:"targetQuality"` // No rungs are added above it
+}
+
+// sceneConfig sets how shot boundaries are detected
+type sceneConfig struct {
+	Threshold      float64 `yaml:"threshold" toml:"threshold"` // Scene score from 0 to 1
+	MinShotSeconds float64 `yaml:"minShotSeconds" toml:"minShotSeconds"`
+}
+
+// chapterConfig sets how chapters are suggested from scene changes
+type chapterConfig struct {
+	SceneThreshold   float64 `yaml:"sceneThreshold" toml:"sceneThreshold"` // Scene score from 0 to 1
+	MinLengthSeconds int     `yaml:"minLengthSeconds" toml:"minLengthSeconds"`
+	MaxChapters      int     `yaml:"maxChapters" toml:"maxChapters"`
+}
+
+// analyticsConfig sets how long playback events and delivery rollups are
+// kept
+type analyticsConfig struct {
+	RetentionDays int `yaml:"retentionDays" toml:"retentionDays"`
+}
+
+// webhookConfig sets which endpoints webhooks may be delivered to
+type webhookConfig struct {
+	// Loopback, private and link-local addresses are refused unless allowed
+	AllowPrivateNetworks bool `yaml:"allowPrivateNetworks" toml:"allowPrivateNetworks"`
+}
+
+// defaultConfig returns the settings used when nothing is configured
+func defaultConfig() *config {
+	return &config{
+		Port:                   8080,
+		UploadsDir:             "./uploads/videos",
+		TranscodedDir:          "./uploads/transcoded",
+		MaxUploadMB:            2000, // 2GB for video uploads
+		AllowedExtensions:      []string{".mp4", ".webm", ".mov"},
+		ShutdownTimeoutSeconds: 30,
+		CORSOrigins:            []string{"http://localhost:3000"}, // Next.js frontend
+		MaxConcurrentJobs:      2,
+		DuplicateUploads:       duplicateReject,
+		UploadLimits: uploadLimits{
+			MaxDurationSeconds: 4 * 60 * 60,
+			MaxWidth:           7680,
+			MaxHeight:          4320,
+			MaxFrames:          1000000,
+		},
+		Presets: presetsConfig{
+			Resolutions:        []string{"240", "360", "480", "720", "1080", "1440", "2160"},
+			Bitrates:           []string{"500k", "1000k", "2000k", "4000k", "8000k", "16000k"},
+			DefaultResolution:  "720",
+			DefaultBitrate:     "1000k",
+			DefaultRateControl: rateBitrate,
+			DefaultCRF:         23,
+		},
+		Verification: verifyConfig{
+			DurationToleranceSeconds: 1,
+		},
+		Ladder: ladderConfig{
+			Metric:        "vmaf",
+			CRFs:          []int{22, 26, 30, 34, 38},
+			SampleSeconds: 30,
+			MaxRungs:      6,
+			TargetQuality: 95,
+		},
+		Scenes: sceneConfig{
+			Threshold:      0.3,
+			MinShotSeconds: 1,
+		},
+		Chapters: chapterConfig{
+			SceneThreshold:   0.4,
+			MinLengthSeconds: 60,
+			MaxChapters:      20,
+		},
+		Analytics: analyticsConfig{
+			RetentionDays: 90,
+		},
+	}
+}
+
+var (
+	configMu      sync.RWMutex
+	currentConfig = defaultConfig()
+
+	// Command line arguments, parsed again on reload so flags keep
+	// precedence over the file
+	configArgs []string
+)
+
+// getConfig returns the active configuration. The returned value must not
+// be modified; a reload replaces it.
+func getConfig() *config {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return currentConfig
+}
+
+// Supported values of a few settings
+var (
+	extensionPattern = regexp.MustCompile(`^\.[a-z0-9]{1,8}$`)
+	bitratePattern   = regexp.MustCompile(`^[1-9][0-9]{0,5}k$`)
+)
+
+// loadConfig builds the configuration from the config file, the
+// environment and args. printConfig reports whether --print-config was given.
+func loadConfig(args []string) (cfg *config, printConfig bool, err error) {
+	flags := flag.NewFlagSet("videostreaming", flag.ContinueOnError)
+	configPath := flags.String("config", "", "path of a YAML or TOML config file")
+	flags.BoolVar(&printConfig, "print-config", false, "print the effective configuration and exit")
+	port := flags.Int("port", 0, "port to listen on")
+	uploads := flags.String("uploads-dir", "", "directory of uploaded videos")
+	transcoded := flags.String("transcoded-dir", "", "directory of transcoded outputs")
+	maxUpload := flags.Int("max-upload-mb", 0, "maximum upload size in megabytes")
+	extensions := flags.String("allowed-extensions", "", "comma separated upload extensions")
+	origins := flags.String("cors-origins", "", "comma separated CORS origins")
+	shutdownTimeout := flags.Int("shutdown-timeout-seconds", 0, "time running jobs get to finish on shutdown")
+	maxJobs := flags.Int("max-concurrent-jobs", 0, "number of ffmpeg jobs run at the same time")
+	if err := flags.Parse(args); err != nil {
+		return nil, false, err
+	}
+
+	cfg = defaultConfig()
+
+	// Config file
+	path := *configPath
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		if err := readConfigFile(path, cfg); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// Environment variables
+	if err := applyConfigEnv(cfg); err != nil {
+		return nil, false, err
+	}
+
+	// Flags given on the command line
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "port":
+			cfg.Port = *port
+		case "uploads-dir":
+			cfg.UploadsDir = *uploads
+		case "transcoded-dir":
+			cfg.TranscodedDir = *transcoded
+		case "max-upload-mb":
+			cfg.MaxUploadMB = *maxUpload
+		case "allowed-extensions":
+			cfg.AllowedExtensions = splitList(*extensions)
+		case "cors-origins":
+			cfg.CORSOrigins = splitList(*origins)
+		case "shutdown-timeout-seconds":
+			cfg.ShutdownTimeoutSeconds = *shutdownTimeout
+		case "max-concurrent-jobs":
+			cfg.MaxConcurrentJobs = *maxJobs
+		}
+	})
+
+	if err := cfg.validate(); err != nil {
+		return nil, false, err
+	}
+	return cfg, printConfig, nil
+}
+
+// readConfigFile decodes a YAML or TOML file, chosen by extension, over cfg
+func readConfigFile(path string, cfg *config) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %v", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+			return fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), cfg)
+		if err != nil {
+			return fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("invalid config file %s: unknown setting %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("config file must be .yaml, .yml or .toml: %s", path)
+	}
+	return nil
+}
+
+// applyConfigEnv overrides cfg with the VIDEOSTREAMING_* variables that are set
+func applyConfigEnv(cfg *config) error {
+	ints := map[string]*int{
+		"PORT":                     &cfg.Port,
+		"MAX_UPLOAD_MB":            &cfg.MaxUploadMB,
+		"MAX_CONCURRENT_JOBS":      &cfg.MaxConcurrentJobs,
+		"SHUTDOWN_TIMEOUT_SECONDS": &cfg.ShutdownTimeoutSeconds,
+	}
+	for name, field := range ints {
+		if value, ok := os.LookupEnv(envPrefix + name); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("%s%s must be a number", envPrefix, name)
+			}
+			*field = n
+		}
+	}
+
+	strs := map[string]*string{
+		"UPLOADS_DIR":    &cfg.UploadsDir,
+		"TRANSCODED_DIR": &cfg.TranscodedDir,
+	}
+	for name, field := range strs {
+		if value, ok := os.LookupEnv(envPrefix + name); ok {
+			*field = value
+		}
+	}
+
+	lists := map[string]*[]string{
+		"ALLOWED_EXTENSIONS": &cfg.AllowedExtensions,
+		"CORS_ORIGINS":       &cfg.CORSOrigins,
+	}
+	for name, field := range lists {
+		if value, ok := os.LookupEnv(envPrefix + name); ok {
+			*field = splitList(value)
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma separated value, dropping empty entries
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// validate checks that every setting is usable
+func (c *config) validate() error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	if c.UploadsDir == "" || c.TranscodedDir == "" {
+		return fmt.Errorf("uploadsDir and transcodedDir must be set")
+	}
+	if c.MaxUploadMB < 1 || c.MaxUploadMB > 1024*1024 {
+		return fmt.Errorf("maxUploadMB must be between 1 and 1048576")
+	}
+
+	if c.ShutdownTimeoutSeconds < 0 || c.ShutdownTimeoutSeconds > 3600 {
+		return fmt.Errorf("shutdownTimeoutSeconds must be between 0 and 3600")
+	}
+
+	if len(c.AllowedExtensions) == 0 {
+		return fmt.Errorf("allowedExtensions must not be empty")
+	}
+	for i, ext := range c.AllowedExtensions {
+		ext = strings.ToLower(ext)
+		if !extensionPattern.MatchString(ext) {
+			return fmt.Errorf("allowed extension %q must look like .mp4", ext)
+		}
+		c.AllowedExtensions[i] = ext
+	}
+
+	for _, origin := range c.CORSOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			return fmt.Errorf("CORS origin %q must look like https://example.com", origin)
+		}
+	}
+
+	if c.MaxConcurrentJobs < 1 || c.MaxConcurrentJobs > 64 {
+		return fmt.Errorf("maxConcurrentJobs must be between 1 and 64")
+	}
+
+	if !slices.Contains(duplicatePolicies, c.DuplicateUploads) {
+		return fmt.Errorf("duplicateUploads must be one of %s", strings.Join(duplicatePolicies, ", "))
+	}
+
+	u := c.UploadLimits
+	if u.MaxDurationSeconds <= 0 {
+		return fmt.Errorf("uploadLimits maxDurationSeconds must be positive")
+	}
+	if u.MaxWidth < 1 || u.MaxHeight < 1 {
+		return fmt.Errorf("uploadLimits maxWidth and maxHeight must be positive")
+	}
+	if u.MaxFrames < 1 {
+		return fmt.Errorf("uploadLimits maxFrames must be positive")
+	}
+
+	p := c.Presets
+	for _, resolution := range p.Resolutions {
+		if height, err := strconv.Atoi(resolution); err != nil || height < 144 || height > 4320 {
+			return fmt.Errorf("preset resolution %q must be a height between 144 and 4320", resolution)
+		}
+	}
+	for _, bitrate := range p.Bitrates {
+		if !bitratePattern.MatchString(bitrate) {
+			return fmt.Errorf("preset bitrate %q must look like 1000k", bitrate)
+		}
+	}
+	if !slices.Contains(p.Resolutions, p.DefaultResolution) {
+		return fmt.Errorf("default resolution %q is not one of the preset resolutions", p.DefaultResolution)
+	}
+	if !slices.Contains(p.Bitrates, p.DefaultBitrate) {
+		return fmt.Errorf("default bitrate %q is not one of the preset bitrates", p.DefaultBitrate)
+	}
+	if !slices.Contains(rateControlModes, p.DefaultRateControl) {
+		return fmt.Errorf("default rate control must be one of %s", strings.Join(rateControlModes, ", "))
+	}
+	if p.DefaultCRF < 0 || p.DefaultCRF > 51 {
+		return fmt.Errorf("default CRF must be between 0 and 51")
+	}
+
+	v := &c.Verification
+	if v.DurationToleranceSeconds <= 0 {
+		return fmt.Errorf("verification durationToleranceSeconds must be positive")
+	}
+	metrics, err := parseQualityMetrics(strings.Join(v.Metrics, ","))
+	if err != nil {
+		return fmt.Errorf("verification metrics: %v", err)
+	}
+	v.Metrics = metrics
+	if v.MinVMAF < 0 || v.MinVMAF > 100 {
+		return fmt.Errorf("verification minVMAF must be between 0 and 100")
+	}
+	if v.MinPSNR < 0 || v.MinPSNR > 100 {
+		return fmt.Errorf("verification minPSNR must be between 0 and 100")
+	}
+	if v.MinSSIM < 0 || v.MinSSIM > 1 {
+		return fmt.Errorf("verification minSSIM must be between 0 and 1")
+	}
+
+	l := c.Ladder
+	if !slices.Contains(qualityMetrics, l.Metric) {
+		return fmt.Errorf("ladder metric must be vmaf, psnr or ssim")
+	}
+	if len(l.CRFs) == 0 {
+		return fmt.Errorf("ladder crfs must not be empty")
+	}
+	for _, crf := range l.CRFs {
+		if crf < 0 || crf > 51 {
+			return fmt.Errorf("ladder CRF %d must be between 0 and 51", crf)
+		}
+	}
+	if l.SampleSeconds < 5 || l.SampleSeconds > 600 {
+		return fmt.Errorf("ladder sampleSeconds must be between 5 and 600")
+	}
+	if l.MaxRungs < 1 || l.MaxRungs > 10 {
+		return fmt.Errorf("ladder maxRungs must be between 1 and 10")
+	}
+	if l.TargetQuality <= 0 {
+		return fmt.Errorf("ladder targetQuality must be positive")
+	}
+
+	sc := c.Scenes
+	if sc.Threshold <= 0 || sc.Threshold >= 1 {
+		return fmt.Errorf("scenes threshold must be between 0 and 1")
+	}
+	if sc.MinShotSeconds < 0 {
+		return fmt.Errorf("scenes minShotSeconds must not be negative")
+	}
+
+	ch := c.Chapters
+	if ch.SceneThreshold <= 0 || ch.SceneThreshold >= 1 {
+		return fmt.Errorf("chapters sceneThreshold must be between 0 and 1")
+	}
+	if ch.MinLengthSeconds < 1 {
+		return fmt.Errorf("chapters minLengthSeconds must be positive")
+	}
+	if ch.MaxChapters < 1 || ch.MaxChapters > maxChapters {
+		return fmt.Errorf("chapters maxChapters must be between 1 and %d", maxChapters)
+	}
+	if c.Analytics.RetentionDays < 1 {
+		return fmt.Errorf("analytics retentionDays must be positive")
+	}
+	return nil
+}
+
+// allowsOrigin reports whether CORS requests from origin are accepted
+func (c *config) allowsOrigin(origin string) bool {
+	return slices.Contains(c.CORSOrigins, strings.TrimSuffix(origin, "/"))
+}
+
+// allowsExtension reports whether uploads may use the file extension ext
+func (c *config) allowsExtension(ext string) bool {
+	return slices.Contains(c.AllowedExtensions, strings.ToLower(ext))
+}
+
+// print writes the configuration as YAML
+func (c *config) print(w io.Writer) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// reloadConfig reads the configuration again and applies the settings that
+// can change while running: CORS origins, duplicate uploads, upload limits,
+// presets, verification, the ladder analysis, scene detection, chapter
+// generation, analytics retention, webhook endpoints and the job concurrency.
+// Other changes are reported and need a restart.
+func reloadConfig() {
+	next, _, err := loadConfig(configArgs)
+	if err != nil {
+		slog.Error("Config reload failed, keeping the current configuration", "error", err)
+		return
+	}
+
+	configMu.Lock()
+	previous := currentConfig
+	updated := *previous
+	updated.CORSOrigins = next.CORSOrigins
+	updated.MaxConcurrentJobs = next.MaxConcurrentJobs
+	updated.DuplicateUploads = next.DuplicateUploads
+	updated.UploadLimits = next.UploadLimits
+	updated.Presets = next.Presets
+	updated.Verification = next.Verification
+	updated.Ladder = next.Ladder
+	updated.Scenes = next.Scenes
+	updated.Chapters = next.Chapters
+	updated.Analytics = next.Analytics
+	updated.Webhooks = next.Webhooks
+	currentConfig = &updated
+	configMu.Unlock()
+
+	if next.Port != previous.Port || next.UploadsDir != previous.UploadsDir ||
+		next.TranscodedDir != previous.TranscodedDir || next.MaxUploadMB != previous.MaxUploadMB ||
+		next.ShutdownTimeoutSeconds != previous.ShutdownTimeoutSeconds ||
+		!slices.Equal(next.AllowedExtensions, previous.AllowedExtensions) {
+		slog.Warn("Config changes to port, directories, upload size, extensions or shutdown timeout need a restart")
+	}
+
+	setMaxConcurrentJobs(updated.MaxConcurrentJobs)
+	slog.Info("Config reloaded",
+		"cors_origins", updated.CORSOrigins,
+		"max_concurrent_jobs", updated.MaxConcurrentJobs,
+		"resolutions", updated.Presets.Resolutions,
+		"bitrates", updated.Presets.Bitrates)
+}
+
+// watchConfigReload reloads the configuration on every SIGHUP
+func watchConfigReload() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reloadConfig()
+		}
+	}()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	file := "port: 8001\nmaxUploadMB: 100\nmaxConcurrentJobs: 3\ncorsOrigins: [\"http://file.example\"]\n"
+	if err := os.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(envPrefix+"CONFIG", path)
+	t.Setenv(envPrefix+"PORT", "8002")
+	t.Setenv(envPrefix+"MAX_UPLOAD_MB", "200")
+	t.Setenv(envPrefix+"CORS_ORIGINS", "http://env.example, http://other.example")
+
+	cfg, printConfig, err := loadConfig([]string{"-port", "8003"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printConfig {
+		t.Error("printConfig = true without -print-config")
+	}
+	if cfg.Port != 8003 {
+		t.Errorf("Port = %d, want the flag value 8003", cfg.Port)
+	}
+	if cfg.MaxUploadMB != 200 {
+		t.Errorf("MaxUploadMB = %d, want the environment value 200", cfg.MaxUploadMB)
+	}
+	if cfg.MaxConcurrentJobs != 3 {
+		t.Errorf("MaxConcurrentJobs = %d, want the file value 3", cfg.MaxConcurrentJobs)
+	}
+	if want := []string{"http://env.example", "http://other.example"}; !slices.Equal(cfg.CORSOrigins, want) {
+		t.Errorf("CORSOrigins = %v, want %v", cfg.CORSOrigins, want)
+	}
+}
+
+func TestLoadConfigRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+		env  map[string]string
+	}{
+		{"unknown setting", "nope: 1\n", nil},
+		{"non numeric env", "", map[string]string{"MAX_UPLOAD_MB": "lots"}},
+		{"invalid port", "port: 70000\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv(envPrefix+"CONFIG", path)
+			for name, value := range tt.env {
+				t.Setenv(envPrefix+name, value)
+			}
+			if _, _, err := loadConfig(nil); err == nil {
+				t.Error("loadConfig succeeded, want an error")
+			}
+		})
+	}
+}
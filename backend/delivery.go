@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// How often completed hours of delivery counters are written to disk
+const deliveryFlushInterval = time.Minute
+
+// Layout of the hour keys of delivery rollups
+const deliveryHourLayout = "2006-01-02T15"
+
+// Longest rollup line read, as rollups of partial hours list their sessions
+const maxRollupLine = 16 << 20
+
+// deliveryRollup sums the requests of one hour for one rendition of a
+// video. Sessions are estimated from the client address and user agent; a
+// session's primary rendition is the one it fetched most segments of in
+// that hour.
+type deliveryRollup struct {
+	Hour            time.Time `json:"hour"`
+	VideoID         string    `json:"videoId"`
+	Workspace       string    `json:"workspace,omitempty"`
+	Rendition       string    `json:"rendition"` // Format, with the variant for ABR
+	Resolution      string    `json:"resolution,omitempty"`
+	Bitrate         string    `json:"bitrate,omitempty"`
+	Requests        int       `json:"requests"`
+	Segments        int       `json:"segments"`
+	Bytes           int64     `json:"bytes"`
+	Sessions        int       `json:"sessions"`
+	PrimarySessions int       `json:"primarySessions"`
+
+	// Segments per session of an hour written before it ended, so the
+	// rollup written for the rest of the hour after a restart can be merged
+	// with it without counting sessions twice
+	SessionSegments map[string]int `json:"sessionSegments,omitempty"`
+}
+
+// deliveryCounter accumulates a rollup of the current hours
+type deliveryCounter struct {
+	deliveryRollup
+	sessions map[string]int // Segments per session
+}
+
+// Counters of the hours not yet written, by hour, video and rendition
+var (
+	deliveryCounters = make(map[string]*deliveryCounter)
+	deliveryMu       sync.Mutex
+)
+
+// deliveryDir holds the rollup files, one JSON lines file per UTC day
+func deliveryDir() string {
+	return filepath.Join(uploadsDir, ".delivery")
+}
+
+// deliveryAccess is a request for a transcoded file, resolved to the
+// rendition it belongs to
+type deliveryAccess struct {
+	videoID    string
+	rendition  string
+	resolution string
+	bitrate    string
+	segment    bool
+}
+
+// recordDelivery is the middleware of the /transcoded routes. It counts
+// every successful GET against the rendition the file belongs to.
+func recordDelivery(c *fiber.Ctx) error {
+	err := c.Next()
+	status := c.Response().StatusCode()
+	if c.Method() != fiber.MethodGet || (status != fiber.StatusOK && status != fiber.StatusPartialContent) {
+		return err
+	}
+
+	access, ok := resolveDelivery(strings.TrimPrefix(c.Path(), "/transcoded/"))
+	if !ok {
+		return err
+	}
+	bytes := int64(c.Response().Header.ContentLength())
+	if bytes < 0 {
+		bytes = int64(len(c.Response().Body()))
+	}
+	sum := sha256.Sum256([]byte(c.IP() + "\x00" + c.Get(fiber.HeaderUserAgent)))
+	countDelivery(time.Now(), access, hex.EncodeToString(sum[:8]), bytes)
+	return err
+}
+
+// countDelivery adds a request to the counters of its hour
+func countDelivery(now time.Time, access deliveryAccess, session string, bytes int64) {
+	hour := now.UTC().Truncate(time.Hour)
+	key := hour.Format(deliveryHourLayout) + "\x00" + access.videoID + "\x00" + access.rendition
+
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+	counter, ok := deliveryCounters[key]
+	if !ok {
+		counter = &deliveryCounter{
+			deliveryRollup: deliveryRollup{
+				Hour:       hour,
+				VideoID:    access.videoID,
+				Workspace:  lookupMetadata(access.videoID).Workspace,
+				Rendition:  access.rendition,
+				Resolution: access.resolution,
+				Bitrate:    access.bitrate,
+			},
+			sessions: make(map[string]int),
+		}
+		deliveryCounters[key] = counter
+	}
+	counter.Requests++
+	counter.Bytes += bytes
+	if access.segment {
+		counter.Segments++
+		counter.sessions[session]++
+	} else if _, ok := counter.sessions[session]; !ok {
+		counter.sessions[session] = 0
+	}
+}
+
+// MP4 renditions are single files named after the video and resolution
+var mp4RenditionPattern = regexp.MustCompile(`^(.+)_(\d+)p\.mp4$`)
+
+// ABR variants are in v<N> directories below the ABR output
+var abrVariantPattern = regexp.MustCompile(`^v(\d+)$`)
+
+// resolveDelivery maps a path below /transcoded to the video and rendition
+// it belongs to
+func resolveDelivery(name string) (deliveryAccess, bool) {
+	segments := strings.Split(name, "/")
+	ext := strings.ToLower(path.Ext(name))
+	access := deliveryAccess{segment: ext == ".ts" || ext == ".m4s" || ext == ".mp4"}
+
+	var base, key string
+	switch {
+	case len(segments) == 1:
+		match := mp4RenditionPattern.FindStringSubmatch(name)
+		if match == nil {
+			return access, false
+		}
+		base, key = match[1], renditionKey("mp4", match[2])
+	case segments[1] == abrDirName:
+		base, key = segments[0], "abr"
+	case segments[1] == cmafDirName:
+		base, key = segments[0], "cmaf"
+	case segments[1] == llhlsDirName:
+		base, key = segments[0], "llhls"
+	case ext == ".mpd" || ext == ".m4s":
+		base, key = segments[0], "dash"
+	default:
+		base, key = segments[0], "hls"
+	}
+
+	access.videoID = videoIDForBase(base)
+	if access.videoID == "" {
+		return access, false
+	}
+	access.rendition = key
+
+	if key == "abr" {
+		// Variants are told apart by their directory; their resolution
+		// and bandwidth are listed in the master playlist
+		if len(segments) > 3 {
+			if match := abrVariantPattern.FindStringSubmatch(segments[2]); match != nil {
+				variant, _ := strconv.Atoi(match[1])
+				access.rendition = "abr/" + segments[2]
+				access.resolution, access.bitrate = abrVariant(filepath.Join(transcodedDir, base, abrDirName), variant)
+			}
+		}
+		return access, true
+	}
+
+	renditionsMu.Lock()
+	if r := renditions[access.videoID][key]; r != nil {
+		access.resolution, access.bitrate = r.Resolution, r.Bitrate
+	}
+	renditionsMu.Unlock()
+	return access, true
+}
+
+// videoIDForBase returns the video whose transcoded outputs are named base
+func videoIDForBase(base string) string {
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+	for id := range renditions {
+		if strings.TrimSuffix(id, filepath.Ext(id)) == base {
+			return id
+		}
+	}
+	return ""
+}
+
+// abrMaster is a parsed ABR master playlist
+type abrMaster struct {
+	modTime  time.Time
+	variants map[int][2]string // Resolution and bitrate per variant
+}
+
+// Parsed master playlists by path, parsed again when they change
+var (
+	abrMasters   = make(map[string]*abrMaster)
+	abrMastersMu sync.Mutex
+)
+
+// abrVariant returns the resolution (height) and bitrate of an ABR
+// variant from the master playlist in dir
+func abrVariant(dir string, variant int) (string, string) {
+	masterPath := filepath.Join(dir, "master.m3u8")
+	info, err := os.Stat(masterPath)
+	if err != nil {
+		return "", ""
+	}
+
+	abrMastersMu.Lock()
+	defer abrMastersMu.Unlock()
+	master := abrMasters[masterPath]
+	if master == nil || !master.modTime.Equal(info.ModTime()) {
+		master = &abrMaster{modTime: info.ModTime(), variants: make(map[int][2]string)}
+		if data, err := os.ReadFile(masterPath); err == nil {
+			var attrs string
+			for _, line := range strings.Split(string(data), "\n") {
+				line = strings.TrimSpace(line)
+				if value, ok := strings.CutPrefix(line, "#EXT-X-STREAM-INF:"); ok {
+					attrs = value
+					continue
+				}
+				if attrs == "" || strings.HasPrefix(line, "#") || line == "" {
+					continue
+				}
+				if match := abrVariantPattern.FindStringSubmatch(strings.Split(line, "/")[0]); match != nil {
+					n, _ := strconv.Atoi(match[1])
+					master.variants[n] = streamInfResolution(attrs)
+				}
+				attrs = ""
+			}
+		}
+		abrMasters[masterPath] = master
+	}
+	v := master.variants[variant]
+	return v[0], v[1]
+}
+
+// streamInfResolution reads the height and bandwidth of an
+// EXT-X-STREAM-INF attribute list
+func streamInfResolution(attrs string) [2]string {
+	var v [2]string
+	for _, attr := range strings.Split(attrs, ",") {
+		name, value, _ := strings.Cut(attr, "=")
+		switch name {
+		case "RESOLUTION":
+			if _, height, ok := strings.Cut(value, "x"); ok {
+				v[0] = height
+			}
+		case "BANDWIDTH":
+			if bandwidth, err := strconv.Atoi(value); err == nil {
+				v[1] = strconv.Itoa(bandwidth/1000) + "k"
+			}
+		}
+	}
+	return v
+}
+
+// rollupKey identifies the rollups of one hour, video and rendition
+func rollupKey(r deliveryRollup) string {
+	return r.Hour.Format(deliveryHourLayout) + "\x00" + r.VideoID + "\x00" + r.Rendition
+}
+
+// primaryRenditions returns the rendition each session fetched the most
+// segments of, per hour and video, over the rollups carrying their sessions
+func primaryRenditions(rollups []deliveryRollup) map[string]map[string]string {
+	best := make(map[string]map[string]int)
+	primary := make(map[string]map[string]string)
+	for _, r := range rollups {
+		group := r.Hour.Format(deliveryHourLayout) + "\x00" + r.VideoID
+		if best[group] == nil {
+			best[group] = make(map[string]int)
+			primary[group] = make(map[string]string)
+		}
+		for session, segments := range r.SessionSegments {
+			previous, seen := best[group][session]
+			if !seen || segments > previous || (segments == previous && r.Rendition < primary[group][session]) {
+				best[group][session] = segments
+				primary[group][session] = r.Rendition
+			}
+		}
+	}
+	return primary
+}
+
+// countSessions adds the sessions of the rollups that carry them to their
+// Sessions and PrimarySessions and drops the session lists
+func countSessions(rollups []deliveryRollup) {
+	primary := primaryRenditions(rollups)
+	for i := range rollups {
+		r := &rollups[i]
+		group := primary[r.Hour.Format(deliveryHourLayout)+"\x00"+r.VideoID]
+		r.Sessions += len(r.SessionSegments)
+		for session := range r.SessionSegments {
+			if group[session] == r.Rendition {
+				r.PrimarySessions++
+			}
+		}
+		r.SessionSegments = nil
+	}
+}
+
+// mergeRollups sums the rollups of the same hour, video and rendition.
+// Sessions listed by more than one of them are counted once; rollups
+// without their sessions add their counts.
+func mergeRollups(rollups []deliveryRollup) []deliveryRollup {
+	index := make(map[string]int)
+	var merged []deliveryRollup
+	for _, r := range rollups {
+		i, ok := index[rollupKey(r)]
+		if !ok {
+			i = len(merged)
+			index[rollupKey(r)] = i
+			merged = append(merged, deliveryRollup{
+				Hour:       r.Hour,
+				VideoID:    r.VideoID,
+				Workspace:  r.Workspace,
+				Rendition:  r.Rendition,
+				Resolution: r.Resolution,
+				Bitrate:    r.Bitrate,
+			})
+		}
+		m := &merged[i]
+		m.Requests += r.Requests
+		m.Segments += r.Segments
+		m.Bytes += r.Bytes
+		if r.SessionSegments == nil {
+			m.Sessions += r.Sessions
+			m.PrimarySessions += r.PrimarySessions
+			continue
+		}
+		if m.SessionSegments == nil {
+			m.SessionSegments = make(map[string]int)
+		}
+		for session, segments := range r.SessionSegments {
+			m.SessionSegments[session] += segments
+		}
+	}
+	countSessions(merged)
+	return merged
+}
+
+// pendingRollupsLocked returns the rollups of the hours not yet written
+// that match keep, with their sessions. deliveryMu must be held.
+func pendingRollupsLocked(keep func(*deliveryCounter) bool) []deliveryRollup {
+	var rollups []deliveryRollup
+	for _, c := range deliveryCounters {
+		if keep(c) {
+			r := c.deliveryRollup
+			r.SessionSegments = maps.Clone(c.sessions)
+			rollups = append(rollups, r)
+		}
+	}
+	return rollups
+}
+
+// flushDelivery writes the rollups of the hours before until and drops
+// their counters. Shutdown flushes everything with a zero until.
+func flushDelivery(until time.Time) error {
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+
+	done := func(c *deliveryCounter) bool { return until.IsZero() || c.Hour.Add(time.Hour).Compare(until) <= 0 }
+	rollups := pendingRollupsLocked(done)
+	if len(rollups) == 0 {
+		return nil
+	}
+	if err := os.MkdirAll(deliveryDir(), os.ModePerm); err != nil {
+		return err
+	}
+
+	byDay := make(map[string][]deliveryRollup)
+	for _, r := range rollups {
+		day := r.Hour.Format(time.DateOnly)
+		byDay[day] = append(byDay[day], r)
+	}
+	now := time.Now()
+	for day, list := range byDay {
+		// Hours that have not ended, or were written before they ended,
+		// keep their sessions so their rollups can be merged when read
+		path := filepath.Join(deliveryDir(), day+".jsonl")
+		partial := partialHours(path)
+		written := slices.Clone(list)
+		countSessions(written)
+		for i, r := range list {
+			if r.Hour.Add(time.Hour).After(now) || partial[r.Hour.Format(deliveryHourLayout)] {
+				written[i].Sessions, written[i].PrimarySessions = 0, 0
+				written[i].SessionSegments = r.SessionSegments
+			}
+		}
+		if err := appendRollups(path, written); err != nil {
+			return err
+		}
+
+		// Counters of a day are dropped as soon as it is written, so a
+		// failure on another day does not write them again
+		for key, c := range deliveryCounters {
+			if done(c) && c.Hour.Format(time.DateOnly) == day {
+				delete(deliveryCounters, key)
+			}
+		}
+	}
+	pruneDeliveryLocked()
+	return nil
+}
+
+// partialHours returns the hours of a day file that were written before
+// they ended
+func partialHours(path string) map[string]bool {
+	hours := make(map[string]bool)
+	file, err := os.Open(path)
+	if err != nil {
+		return hours
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, maxRollupLine)
+	for scanner.Scan() {
+		var r deliveryRollup
+		if err := json.Unmarshal(scanner.Bytes(), &r); err == nil && r.SessionSegments != nil {
+			hours[r.Hour.Format(deliveryHourLayout)] = true
+		}
+	}
+	return hours
+}
+
+// appendRollups appends rollups to a day file
+func appendRollups(path string, rollups []deliveryRollup) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, r := range rollups {
+		line, err := json.Marshal(r)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// pruneDeliveryLocked removes the day files older than the analytics
+// retention. deliveryMu must be held.
+func pruneDeliveryLocked() {
+	cutoff := time.Now().UTC().AddDate(0, 0, -getConfig().Analytics.RetentionDays).Format(time.DateOnly)
+	files, _ := filepath.Glob(filepath.Join(deliveryDir(), "*.jsonl"))
+	for _, file := range files {
+		if strings.TrimSuffix(filepath.Base(file), ".jsonl") < cutoff {
+			os.Remove(file)
+		}
+	}
+}
+
+// runDeliveryFlusher writes completed hours to disk. Shutdown writes the
+// current hour with flushDelivery.
+func runDeliveryFlusher() {
+	ticker := time.NewTicker(deliveryFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := flushDelivery(time.Now().UTC().Truncate(time.Hour)); err != nil {
+			slog.Error("Failed to write delivery rollups", "error", err)
+		}
+	}
+}
+
+// readRollups returns the rollups of the hours in [from, to), written or
+// still in memory, one per hour, video and rendition
+func readRollups(from, to time.Time) ([]deliveryRollup, error) {
+	inRange := func(hour time.Time) bool { return !hour.Before(from.Truncate(time.Hour)) && hour.Before(to) }
+
+	deliveryMu.Lock()
+	rollups := pendingRollupsLocked(func(c *deliveryCounter) bool { return inRange(c.Hour) })
+	deliveryMu.Unlock()
+
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		file, err := os.Open(filepath.Join(deliveryDir(), day.Format(time.DateOnly)+".jsonl"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(nil, maxRollupLine)
+		for scanner.Scan() {
+			var r deliveryRollup
+			if err := json.Unmarshal(scanner.Bytes(), &r); err == nil && inRange(r.Hour) {
+				rollups = append(rollups, r)
+			}
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return mergeRollups(rollups), nil
+}
+
+// renditionUsage sums the delivery of one rendition
+type renditionUsage struct {
+	Rendition       string  `json:"rendition"`
+	Resolution      string  `json:"resolution,omitempty"`
+	Bitrate         string  `json:"bitrate,omitempty"`
+	Requests        int     `json:"requests"`
+	Segments        int     `json:"segments"`
+	Bytes           int64   `json:"bytes"`
+	Sessions        int     `json:"sessions"`
+	PrimarySessions int     `json:"primarySessions"`
+	SegmentShare    float64 `json:"segmentShare"` // Of the segments of the video, or of all videos
+}
+
+// videoDelivery sums the delivery of one video
+type videoDelivery struct {
+	VideoID    string            `json:"videoId"`
+	Workspace  string            `json:"workspace,omitempty"`
+	Requests   int               `json:"requests"`
+	Segments   int               `json:"segments"`
+	Bytes      int64             `json:"bytes"`
+	Sessions   int               `json:"sessions"` // Session hours, each counted at its primary rendition
+	Renditions []*renditionUsage `json:"renditions"`
+}
+
+// workspaceDelivery sums the egress of one workspace
+type workspaceDelivery struct {
+	Workspace string `json:"workspace"`
+	Requests  int    `json:"requests"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// hourlyDelivery sums the egress of one hour
+type hourlyDelivery struct {
+	Hour     time.Time `json:"hour"`
+	Requests int       `json:"requests"`
+	Bytes    int64     `json:"bytes"`
+}
+
+// addUsage adds a rollup to the usage of its rendition in usages
+func addUsage(usages map[string]*renditionUsage, key string, r deliveryRollup) {
+	u, ok := usages[key]
+	if !ok {
+		u = &renditionUsage{Rendition: r.Rendition, Resolution: r.Resolution, Bitrate: r.Bitrate}
+		usages[key] = u
+	}
+	u.Requests += r.Requests
+	u.Segments += r.Segments
+	u.Bytes += r.Bytes
+	u.Sessions += r.Sessions
+	u.PrimarySessions += r.PrimarySessions
+}
+
+// sortedUsages returns usages by segments with their share of total
+func sortedUsages(usages map[string]*renditionUsage, total int) []*renditionUsage {
+	list := make([]*renditionUsage, 0, len(usages))
+	for _, u := range usages {
+		if total > 0 {
+			u.SegmentShare = float64(u.Segments) / float64(total)
+		}
+		list = append(list, u)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		if list[a].Segments != list[b].Segments {
+			return list[a].Segments > list[b].Segments
+		}
+		return list[a].Bytes > list[b].Bytes
+	})
+	return list
+}
+
+// getDeliveryReport reports the rendition usage and egress of transcoded
+// outputs per video, workspace, rendition and hour
+func getDeliveryReport(c *fiber.Ctx) error {
+	from, to, err := reportRange(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	rollups, err := readRollups(from, to)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to read delivery rollups", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to read delivery rollups",
+		})
+	}
+
+	videoID, workspace := c.Query("videoId"), c.Query("workspace")
+	videos := make(map[string]*videoDelivery)
+	videoUsages := make(map[string]map[string]*renditionUsage)
+	workspaces := make(map[string]*workspaceDelivery)
+	hours := make(map[time.Time]*hourlyDelivery)
+	overall := make(map[string]*renditionUsage)
+	totalSegments := 0
+	for _, r := range rollups {
+		if (videoID != "" && r.VideoID != videoID) || (workspace != "" && r.Workspace != workspace) {
+			continue
+		}
+
+		v, ok := videos[r.VideoID]
+		if !ok {
+			v = &videoDelivery{VideoID: r.VideoID, Workspace: r.Workspace}
+			videos[r.VideoID] = v
+			videoUsages[r.VideoID] = make(map[string]*renditionUsage)
+		}
+		v.Requests += r.Requests
+		v.Segments += r.Segments
+		v.Bytes += r.Bytes
+		v.Sessions += r.PrimarySessions
+		addUsage(videoUsages[r.VideoID], r.Rendition, r)
+
+		// Across videos, renditions are compared by format, resolution
+		// and bitrate
+		format, _, _ := strings.Cut(r.Rendition, "/")
+		overallRollup := r
+		overallRollup.Rendition = format
+		addUsage(overall, format+"\x00"+r.Resolution+"\x00"+r.Bitrate, overallRollup)
+		totalSegments += r.Segments
+
+		w, ok := workspaces[r.Workspace]
+		if !ok {
+			w = &workspaceDelivery{Workspace: r.Workspace}
+			workspaces[r.Workspace] = w
+		}
+		w.Requests += r.Requests
+		w.Bytes += r.Bytes
+
+		h, ok := hours[r.Hour]
+		if !ok {
+			h = &hourlyDelivery{Hour: r.Hour}
+			hours[r.Hour] = h
+		}
+		h.Requests += r.Requests
+		h.Bytes += r.Bytes
+	}
+
+	videoList := make([]*videoDelivery, 0, len(videos))
+	for id, v := range videos {
+		v.Renditions = sortedUsages(videoUsages[id], v.Segments)
+		videoList = append(videoList, v)
+	}
+	sort.Slice(videoList, func(a, b int) bool { return videoList[a].Bytes > videoList[b].Bytes })
+	workspaceList := make([]*workspaceDelivery, 0, len(workspaces))
+	for _, w := range workspaces {
+		workspaceList = append(workspaceList, w)
+	}
+	sort.Slice(workspaceList, func(a, b int) bool { return workspaceList[a].Bytes > workspaceList[b].Bytes })
+	hourly := make([]*hourlyDelivery, 0, len(hours))
+	for _, h := range hours {
+		hourly = append(hourly, h)
+	}
+	sort.Slice(hourly, func(a, b int) bool { return hourly[a].Hour.Before(hourly[b].Hour) })
+
+	return c.JSON(fiber.Map{
+		"from":       from,
+		"to":         to,
+		"videos":     videoList,
+		"workspaces": workspaceList,
+		"renditions": sortedUsages(overall, totalSegments),
+		"hourly":     hourly,
+	})
+}
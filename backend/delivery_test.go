@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveDelivery(t *testing.T) {
+	savedDir, savedRenditions := transcodedDir, renditions
+	transcodedDir = t.TempDir()
+	renditionsMu.Lock()
+	renditions = map[string]map[string]*rendition{
+		"intro.mp4": {
+			"mp4-720": {Format: "mp4", Resolution: "720", Bitrate: "2000k"},
+			"hls":     {Format: "hls", Resolution: "480", Bitrate: "1000k"},
+			"dash":    {Format: "dash", Resolution: "360", Bitrate: "500k"},
+		},
+	}
+	renditionsMu.Unlock()
+	t.Cleanup(func() {
+		renditionsMu.Lock()
+		renditions = savedRenditions
+		renditionsMu.Unlock()
+		transcodedDir = savedDir
+	})
+
+	master := "#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720\nv0/playlist.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360\nv1/playlist.m3u8\n"
+	abrDir := filepath.Join(transcodedDir, "intro", abrDirName)
+	os.MkdirAll(abrDir, os.ModePerm)
+	if err := os.WriteFile(filepath.Join(abrDir, "master.m3u8"), []byte(master), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		ok   bool
+		want deliveryAccess
+	}{
+		{"intro_720p.mp4", true, deliveryAccess{"intro.mp4", "mp4-720", "720", "2000k", true}},
+		{"intro/playlist.m3u8", true, deliveryAccess{"intro.mp4", "hls", "480", "1000k", false}},
+		{"intro/playlist3.ts", true, deliveryAccess{"intro.mp4", "hls", "480", "1000k", true}},
+		{"intro/manifest.mpd", true, deliveryAccess{"intro.mp4", "dash", "360", "500k", false}},
+		{"intro/chunk-stream0-00001.m4s", true, deliveryAccess{"intro.mp4", "dash", "360", "500k", true}},
+		{"intro/abr/master.m3u8", true, deliveryAccess{"intro.mp4", "abr", "", "", false}},
+		{"intro/abr/v0/playlist.m3u8", true, deliveryAccess{"intro.mp4", "abr/v0", "720", "2500k", false}},
+		{"intro/abr/v1/segment_00002.ts", true, deliveryAccess{"intro.mp4", "abr/v1", "360", "800k", true}},
+		{"intro/cmaf/video/segment_1.m4s", true, deliveryAccess{"intro.mp4", "cmaf", "", "", true}},
+		{"intro/llhls/playlist.m3u8", true, deliveryAccess{"intro.mp4", "llhls", "", "", false}},
+		{"intro.m3u8", false, deliveryAccess{}},
+		{"other_720p.mp4", false, deliveryAccess{}},
+		{"other/playlist.m3u8", false, deliveryAccess{}},
+	}
+	for _, tt := range tests {
+		got, ok := resolveDelivery(tt.name)
+		if ok != tt.ok {
+			t.Errorf("resolveDelivery(%q) ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && got != tt.want {
+			t.Errorf("resolveDelivery(%q) = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// pastHour returns an hour two days ago, within the retention
+func pastHour() time.Time {
+	return time.Now().UTC().Truncate(time.Hour).Add(-48 * time.Hour)
+}
+
+// useDelivery gives a test empty delivery counters and rollup files
+func useDelivery(t *testing.T) {
+	savedDir := uploadsDir
+	uploadsDir = t.TempDir()
+	deliveryMu.Lock()
+	savedCounters := deliveryCounters
+	deliveryCounters = make(map[string]*deliveryCounter)
+	deliveryMu.Unlock()
+	t.Cleanup(func() {
+		deliveryMu.Lock()
+		deliveryCounters = savedCounters
+		deliveryMu.Unlock()
+		uploadsDir = savedDir
+	})
+}
+
+// restartDelivery drops the counters in memory, as a restart does
+func restartDelivery() {
+	deliveryMu.Lock()
+	deliveryCounters = make(map[string]*deliveryCounter)
+	deliveryMu.Unlock()
+}
+
+// deliveryRequest is a request counted by a test
+type deliveryRequest struct {
+	session   string
+	rendition string
+	segment   bool
+	count     int
+}
+
+// countRequests counts the requests of a test at a time
+func countRequests(at time.Time, requests []deliveryRequest) {
+	for _, r := range requests {
+		access := deliveryAccess{videoID: "intro.mp4", rendition: r.rendition, segment: r.segment}
+		for range r.count {
+			countDelivery(at, access, r.session, 100)
+		}
+	}
+}
+
+// rollupsByRendition reads the rollups of an hour by rendition
+func rollupsByRendition(t *testing.T, hour time.Time) map[string]deliveryRollup {
+	rollups, err := readRollups(hour, hour.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byRendition := make(map[string]deliveryRollup)
+	for _, r := range rollups {
+		if _, ok := byRendition[r.Rendition]; ok {
+			t.Errorf("rendition %s read more than once", r.Rendition)
+		}
+		byRendition[r.Rendition] = r
+	}
+	return byRendition
+}
+
+// rollupLines returns the lines of a rollup day file
+func rollupLines(t *testing.T, day time.Time) []deliveryRollup {
+	file, err := os.Open(filepath.Join(deliveryDir(), day.Format(time.DateOnly)+".jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var lines []deliveryRollup
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var r deliveryRollup
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, r)
+	}
+	return lines
+}
+
+// checkRollup compares the counts of a rollup
+func checkRollup(t *testing.T, name string, got deliveryRollup, requests, segments, sessions, primary int) {
+	t.Helper()
+	if got.Requests != requests || got.Segments != segments || got.Bytes != int64(requests)*100 ||
+		got.Sessions != sessions || got.PrimarySessions != primary {
+		t.Errorf("%s: %d requests, %d segments, %d bytes, %d sessions, %d primary; want %d, %d, %d, %d, %d",
+			name, got.Requests, got.Segments, got.Bytes, got.Sessions, got.PrimarySessions,
+			requests, segments, requests*100, sessions, primary)
+	}
+}
+
+func TestDeliveryRollups(t *testing.T) {
+	useDelivery(t)
+	hour := pastHour()
+	countRequests(hour.Add(5*time.Minute), []deliveryRequest{
+		{"s1", "hls", true, 3},
+		{"s1", "hls", false, 1},
+		{"s1", "dash", true, 1},
+		{"s2", "dash", true, 2},
+		{"s3", "hls", false, 1}, // Fetched a playlist but no segments
+	})
+	// s1 fetched most segments of HLS, s2 of DASH and s3 only fetched HLS
+	check := func(step string) {
+		got := rollupsByRendition(t, hour)
+		checkRollup(t, step+" hls", got["hls"], 5, 3, 2, 2)
+		checkRollup(t, step+" dash", got["dash"], 3, 3, 2, 1)
+	}
+	check("in memory")
+
+	if err := flushDelivery(hour.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	check("written")
+	for _, line := range rollupLines(t, hour) {
+		if line.SessionSegments != nil {
+			t.Errorf("rollup of an ended hour lists its sessions: %+v", line)
+		}
+	}
+	deliveryMu.Lock()
+	pending := len(deliveryCounters)
+	deliveryMu.Unlock()
+	if pending != 0 {
+		t.Errorf("%d counters kept after their hour was written", pending)
+	}
+}
+
+func TestDeliveryRollupsAcrossRestart(t *testing.T) {
+	useDelivery(t)
+	hour := time.Now().UTC().Truncate(time.Hour)
+	countRequests(hour, []deliveryRequest{
+		{"s1", "hls", true, 2},
+		{"s2", "dash", true, 2},
+	})
+
+	// Shutdown writes the hour that has not ended with its sessions
+	if err := flushDelivery(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range rollupLines(t, hour) {
+		if line.SessionSegments == nil {
+			t.Errorf("rollup of a partial hour does not list its sessions: %+v", line)
+		}
+	}
+
+	restartDelivery()
+	countRequests(hour, []deliveryRequest{
+		{"s1", "hls", true, 1},
+		{"s1", "dash", true, 1},
+		{"s3", "hls", true, 1},
+	})
+	// s1 is counted once in HLS and is primary there with 3 segments
+	check := func(step string) {
+		got := rollupsByRendition(t, hour)
+		checkRollup(t, step+" hls", got["hls"], 4, 4, 2, 2)
+		checkRollup(t, step+" dash", got["dash"], 3, 3, 2, 1)
+	}
+	check("merged with memory")
+	if err := flushDelivery(time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	check("merged from file")
+	if lines := rollupLines(t, hour); len(lines) != 4 {
+		t.Errorf("%d rollup lines, want 4", len(lines))
+	}
+}
+
+func TestDeliveryRollupsAfterPartialHour(t *testing.T) {
+	useDelivery(t)
+	hour := pastHour()
+
+	// The first part of the hour was written at a shutdown
+	partial := deliveryRollup{Hour: hour, VideoID: "intro.mp4", Rendition: "hls", Requests: 2, Segments: 2, Bytes: 200,
+		SessionSegments: map[string]int{"s1": 2}}
+	if err := os.MkdirAll(deliveryDir(), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendRollups(filepath.Join(deliveryDir(), hour.Format(time.DateOnly)+".jsonl"), []deliveryRollup{partial}); err != nil {
+		t.Fatal(err)
+	}
+
+	countRequests(hour.Add(50*time.Minute), []deliveryRequest{{"s1", "hls", true, 1}, {"s2", "hls", true, 1}})
+	if err := flushDelivery(hour.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	lines := rollupLines(t, hour)
+	if len(lines) != 2 || lines[1].SessionSegments == nil {
+		t.Fatalf("rest of a partial hour written as %+v, want it to list its sessions", lines)
+	}
+	checkRollup(t, "hls", rollupsByRendition(t, hour)["hls"], 4, 4, 2, 2)
+}
+
+func TestFlushDeliveryDropsWrittenDays(t *testing.T) {
+	useDelivery(t)
+	day1 := pastHour().Truncate(24 * time.Hour).Add(23 * time.Hour)
+	day2 := day1.Add(time.Hour)
+	countRequests(day1, []deliveryRequest{{"s1", "hls", true, 1}})
+	countRequests(day2, []deliveryRequest{{"s1", "hls", true, 1}})
+
+	// The second day's file cannot be written
+	blocked := filepath.Join(deliveryDir(), day2.Format(time.DateOnly)+".jsonl")
+	if err := os.MkdirAll(blocked, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := flushDelivery(day2.Add(time.Hour)); err == nil {
+		t.Fatal("flushDelivery succeeded with an unwritable day file")
+	}
+	os.Remove(blocked)
+	if err := flushDelivery(day2.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, day := range []time.Time{day1, day2} {
+		if lines := rollupLines(t, day); len(lines) != 1 {
+			t.Errorf("%s: %d rollup lines, want 1", day.Format(time.DateOnly), len(lines))
+		}
+	}
+	files, _ := filepath.Glob(filepath.Join(deliveryDir(), "*"))
+	for _, file := range files {
+		if !strings.HasSuffix(file, ".jsonl") {
+			t.Errorf("unexpected file %s", file)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of steps in a filter list
+const maxFilterSteps = 16
+
+// filterStep is one entry of the declarative filter list accepted by
+// transcode requests. Only the fields relevant to Type are used.
+type filterStep struct {
+	Type string `json:"type"` // deinterlace, denoise, crop, rotate, flip, fps, pad
+
+	Method   string `json:"method,omitempty"`   // deinterlace: yadif, bwdif; denoise: hqdn3d, nlmeans
+	Strength string `json:"strength,omitempty"` // denoise: light, medium, strong
+
+	Auto   bool `json:"auto,omitempty"` // crop: detect black bars
+	Width  int  `json:"width,omitempty"`
+	Height int  `json:"height,omitempty"`
+	X      int  `json:"x,omitempty"`
+	Y      int  `json:"y,omitempty"`
+
+	Angle     int     `json:"angle,omitempty"`     // rotate: 90, 180, 270 clockwise
+	Direction string  `json:"direction,omitempty"` // flip: horizontal, vertical
+	FPS       float64 `json:"fps,omitempty"`       // fps: target frame rate
+	Aspect    string  `json:"aspect,omitempty"`    // pad: target aspect ratio such as "16:9"
+}
+
+// Denoise filter parameters per strength
+var denoiseParams = map[string]map[string]string{
+	"hqdn3d": {
+		"light":  "hqdn3d=2:1:2:3",
+		"medium": "hqdn3d=4:3:6:4.5",
+		"strong": "hqdn3d=8:6:12:9",
+	},
+	"nlmeans": {
+		"light":  "nlmeans=s=1.5",
+		"medium": "nlmeans=s=3",
+		"strong": "nlmeans=s=6",
+	},
+}
+
+// Aspect ratios are written as two small integers
+var aspectPattern = regexp.MustCompile(`^([1-9][0-9]?):([1-9][0-9]?)$`)
+
+// parseFilterSteps decodes and validates the filters form field
+func parseFilterSteps(value string) ([]filterStep, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var steps []filterStep
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&steps); err != nil {
+		return nil, fmt.Errorf("filters must be a JSON array of filter steps: %v", err)
+	}
+	if len(steps) > maxFilterSteps {
+		return nil, fmt.Errorf("at most %d filter steps are allowed", maxFilterSteps)
+	}
+
+	for i := range steps {
+		if err := steps[i].validate(); err != nil {
+			return nil, fmt.Errorf("filter %d (%s): %v", i, steps[i].Type, err)
+		}
+	}
+	return steps, nil
+}
+
+// validate checks the step and fills in defaults
+func (s *filterStep) validate() error {
+	s.Type = strings.ToLower(s.Type)
+	s.Method = strings.ToLower(s.Method)
+	s.Strength = strings.ToLower(s.Strength)
+
+	switch s.Type {
+	case "deinterlace":
+		if s.Method == "" {
+			s.Method = "bwdif"
+		}
+		if s.Method != "yadif" && s.Method != "bwdif" {
+			return fmt.Errorf("method must be yadif or bwdif")
+		}
+
+	case "denoise":
+		if s.Method == "" {
+			s.Method = "hqdn3d"
+		}
+		if s.Strength == "" {
+			s.Strength = "medium"
+		}
+		params, ok := denoiseParams[s.Method]
+		if !ok {
+			return fmt.Errorf("method must be hqdn3d or nlmeans")
+		}
+		if _, ok := params[s.Strength]; !ok {
+			return fmt.Errorf("strength must be light, medium or strong")
+		}
+
+	case "crop":
+		if s.Auto {
+			return nil
+		}
+		if s.Width < 16 || s.Height < 16 || s.Width > 8192 || s.Height > 8192 {
+			return fmt.Errorf("width and height must be between 16 and 8192")
+		}
+		if s.X < 0 || s.Y < 0 || s.X > 8192 || s.Y > 8192 {
+			return fmt.Errorf("x and y must be between 0 and 8192")
+		}
+
+	case "rotate":
+		if s.Angle != 90 && s.Angle != 180 && s.Angle != 270 {
+			return fmt.Errorf("angle must be 90, 180 or 270")
+		}
+
+	case "flip":
+		s.Direction = strings.ToLower(s.Direction)
+		if s.Direction != "horizontal" && s.Direction != "vertical" {
+			return fmt.Errorf("direction must be horizontal or vertical")
+		}
+
+	case "fps":
+		if s.FPS < 1 || s.FPS > 120 {
+			return fmt.Errorf("fps must be between 1 and 120")
+		}
+
+	case "pad":
+		if !aspectPattern.MatchString(s.Aspect) {
+			return fmt.Errorf("aspect must look like 16:9")
+		}
+
+	default:
+		return fmt.Errorf("unknown filter type")
+	}
+	return nil
+}
+
+// compileFilterSteps turns validated steps into ffmpeg filters. Every
+// filter string is assembled from validated numbers and fixed names only.
+func compileFilterSteps(ctx context.Context, steps []filterStep, sourcePath string, duration float64) ([]string, error) {
+	var filters []string
+	for _, s := range steps {
+		switch s.Type {
+		case "deinterlace":
+			// Only frames flagged as interlaced are processed
+			filters = append(filters, s.Method+"=mode=send_frame:deint=interlaced")
+
+		case "denoise":
+			filters = append(filters, denoiseParams[s.Method][s.Strength])
+
+		case "crop":
+			if s.Auto {
+				crop, err := detectCrop(ctx, sourcePath, duration)
+				if err != nil {
+					return nil, err
+				}
+				if crop != "" {
+					filters = append(filters, crop)
+				}
+				continue
+			}
+			filters = append(filters, fmt.Sprintf("crop=%d:%d:%d:%d", s.Width, s.Height, s.X, s.Y))
+
+		case "rotate":
+			switch s.Angle {
+			case 90:
+				filters = append(filters, "transpose=clock")
+			case 180:
+				filters = append(filters, "hflip", "vflip")
+			case 270:
+				filters = append(filters, "transpose=cclock")
+			}
+
+		case "flip":
+			if s.Direction == "horizontal" {
+				filters = append(filters, "hflip")
+			} else {
+				filters = append(filters, "vflip")
+			}
+
+		case "fps":
+			filters = append(filters, "fps="+strconv.FormatFloat(s.FPS, 'f', -1, 64))
+
+		case "pad":
+			m := aspectPattern.FindStringSubmatch(s.Aspect)
+			w, h := m[1], m[2]
+			filters = append(filters, fmt.Sprintf(
+				"pad=w='max(iw,ceil(ih*%[1]s/%[2]s/2)*2)':h='max(ih,ceil(iw*%[2]s/%[1]s/2)*2)':x=(ow-iw)/2:y=(oh-ih)/2:color=black",
+				w, h), "setsar=1")
+		}
+	}
+	return filters, nil
+}
+
+// Matches the crop suggestion printed by cropdetect
+var cropdetectPattern = regexp.MustCompile(`crop=(\d+):(\d+):(\d+):(\d+)`)
+
+// detectCrop runs cropdetect over a sample of the source and returns the
+// most frequently suggested crop filter, or "" when nothing is cropped
+func detectCrop(ctx context.Context, sourcePath string, duration float64) (string, error) {
+	// Skip the start, which is often a black intro, and sample 60 seconds
+	start := 0.0
+	if duration > 0 {
+		start = duration * 0.1
+	}
+
+	cmd := exec.Command("ffmpeg",
+		"-ss", formatSeconds(start),
+		"-i", sourcePath,
+		"-t", "60",
+		"-an",
+		"-vf", "select='not(mod(n,10))',cropdetect=limit=24:round=2:reset=0",
+		"-f", "null", "-")
+	_, span := startCommand(ctx, cmd)
+	output, err := cmd.CombinedOutput()
+	endCommand(span, cmd, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "cropdetect failed", "error", err)
+		return "", fmt.Errorf("automatic crop detection failed: %v", err)
+	}
+
+	counts := make(map[string]int)
+	best := ""
+	for _, m := range cropdetectPattern.FindAllStringSubmatch(string(output), -1) {
+		counts[m[0]]++
+		if counts[m[0]] > counts[best] {
+			best = m[0]
+		}
+	}
+	if best == "" {
+		return "", nil
+	}
+
+	// No black bars found when the suggestion covers the whole frame
+	if probe, err := probeVideo(ctx, sourcePath); err == nil {
+		if best == fmt.Sprintf("crop=%d:%d:0:0", probe.Width, probe.Height) {
+			return "", nil
+		}
+	}
+
+	slog.InfoContext(ctx, "Detected crop", "path", sourcePath, "crop", best)
+	return best, nil
+}
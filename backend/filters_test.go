@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseFilterSteps(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []filterStep
+		wantErr string
+	}{
+		{name: "empty", value: "  "},
+		{name: "empty list", value: "[]", want: []filterStep{}},
+		{
+			name:  "defaults filled in",
+			value: `[{"type":"deinterlace"},{"type":"denoise"}]`,
+			want: []filterStep{
+				{Type: "deinterlace", Method: "bwdif"},
+				{Type: "denoise", Method: "hqdn3d", Strength: "medium"},
+			},
+		},
+		{
+			name:  "case folded",
+			value: `[{"type":"DENOISE","method":"NLMeans","strength":"Strong"},{"type":"Flip","direction":"Vertical"}]`,
+			want: []filterStep{
+				{Type: "denoise", Method: "nlmeans", Strength: "strong"},
+				{Type: "flip", Direction: "vertical"},
+			},
+		},
+		{
+			name:  "crop, rotate, fps and pad",
+			value: `[{"type":"crop","width":640,"height":360,"x":0,"y":60},{"type":"rotate","angle":270},{"type":"fps","fps":29.97},{"type":"pad","aspect":"16:9"}]`,
+			want: []filterStep{
+				{Type: "crop", Width: 640, Height: 360, Y: 60},
+				{Type: "rotate", Angle: 270},
+				{Type: "fps", FPS: 29.97},
+				{Type: "pad", Aspect: "16:9"},
+			},
+		},
+		{name: "automatic crop", value: `[{"type":"crop","auto":true}]`, want: []filterStep{{Type: "crop", Auto: true}}},
+		{name: "not an array", value: `{"type":"flip"}`, wantErr: "JSON array"},
+		{name: "unknown field", value: `[{"type":"flip","direction":"vertical","command":"rm"}]`, wantErr: "JSON array"},
+		{name: "unknown type", value: `[{"type":"drawtext"}]`, wantErr: "filter 0 (drawtext): unknown filter type"},
+		{name: "bad deinterlace method", value: `[{"type":"deinterlace","method":"w3fdif"}]`, wantErr: "yadif or bwdif"},
+		{name: "bad denoise strength", value: `[{"type":"denoise","strength":"max"}]`, wantErr: "light, medium or strong"},
+		{name: "crop too small", value: `[{"type":"crop","width":8,"height":360}]`, wantErr: "between 16 and 8192"},
+		{name: "crop offset negative", value: `[{"type":"crop","width":640,"height":360,"x":-1}]`, wantErr: "x and y"},
+		{name: "rotate angle", value: `[{"type":"rotate","angle":45}]`, wantErr: "90, 180 or 270"},
+		{name: "flip direction", value: `[{"type":"flip","direction":"diagonal"}]`, wantErr: "horizontal or vertical"},
+		{name: "fps range", value: `[{"type":"fps","fps":240}]`, wantErr: "between 1 and 120"},
+		{name: "pad aspect", value: `[{"type":"pad","aspect":"16:9:1"}]`, wantErr: "16:9"},
+		{name: "pad aspect injection", value: `[{"type":"pad","aspect":"16:9,drawtext"}]`, wantErr: "16:9"},
+		{name: "second step reported", value: `[{"type":"flip","direction":"vertical"},{"type":"fps"}]`, wantErr: "filter 1 (fps)"},
+		{
+			name:    "too many steps",
+			value:   "[" + strings.Repeat(`{"type":"flip","direction":"vertical"},`, maxFilterSteps) + `{"type":"fps","fps":30}]`,
+			wantErr: fmt.Sprintf("at most %d", maxFilterSteps),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFilterSteps(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.want) || (got == nil) != (tt.want == nil) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompileFilterSteps(t *testing.T) {
+	steps, err := parseFilterSteps(`[{"type":"deinterlace","method":"yadif"},{"type":"denoise","strength":"light"},{"type":"crop","width":640,"height":360,"x":0,"y":60},{"type":"rotate","angle":180},{"type":"flip","direction":"horizontal"},{"type":"fps","fps":29.97},{"type":"pad","aspect":"4:3"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := compileFilterSteps(context.Background(), steps, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"yadif=mode=send_frame:deint=interlaced",
+		"hqdn3d=2:1:2:3",
+		"crop=640:360:0:60",
+		"hflip", "vflip",
+		"hflip",
+		"fps=29.97",
+		"pad=w='max(iw,ceil(ih*4/3/2)*2)':h='max(ih,ceil(iw*3/4/2)*2)':x=(ow-iw)/2:y=(oh-ih)/2:color=black", "setsar=1",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q\nwant %q", got, want)
+	}
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/bits"
+	"mime/multipart"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// What uploads identical to an existing video do
+const (
+	duplicateReject = "reject" // Refused with 409 naming the existing video
+	duplicateLink   = "link"   // Answered with the existing video, nothing is stored
+	duplicateAllow  = "allow"  // Stored as another video
+)
+
+var duplicatePolicies = []string{duplicateReject, duplicateLink, duplicateAllow}
+
+// Perceptual fingerprints hash one frame every fingerprintInterval seconds
+// of the first fingerprintSeconds of a video
+const (
+	fingerprintInterval = 2
+	fingerprintSeconds  = 600
+)
+
+// Frames whose hashes differ in at most this many of 64 bits match
+const frameMatchDistance = 10
+
+// Near-duplicates share at least this share of their frames unless the
+// request sets its own threshold
+const defaultSimilarity = 0.8
+
+// Fewer sampled frames than this say too little to compare
+const minFingerprintFrames = 3
+
+// Frame hashes are bucketed by each of their 16-bit quarters. Frames that
+// match rarely differ in every quarter, so only videos with a frame in a
+// bucket of the video's frames are compared frame by frame.
+const (
+	frameBucketBits  = 16
+	frameBucketCount = 64 / frameBucketBits
+)
+
+// fingerprint identifies the content of a video: exactly by its SHA-256,
+// approximately by the difference hashes of frames sampled every
+// fingerprintInterval seconds
+type fingerprint struct {
+	SHA256     string    `json:"sha256,omitempty"`
+	Frames     []uint64  `json:"frames,omitempty"`
+	ComputedAt time.Time `json:"computedAt,omitzero"` // Of the frame hashes
+}
+
+// Fingerprints per video ID, persisted next to the uploads
+var (
+	fingerprints   = make(map[string]*fingerprint)
+	fingerprintsMu sync.Mutex
+)
+
+// pendingUpload is an upload between its duplicate check and being saved
+type pendingUpload struct {
+	sum      string
+	filename string
+}
+
+// Pending uploads per staging path, guarded by fingerprintsMu
+var pendingUploads = make(map[string]pendingUpload)
+
+// fingerprintsFile is where fingerprints are stored
+func fingerprintsFile() string {
+	return filepath.Join(uploadsDir, ".fingerprints.json")
+}
+
+// loadFingerprints reads the stored fingerprints
+func loadFingerprints() error {
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+	return readJSONFile(fingerprintsFile(), &fingerprints)
+}
+
+// updateFingerprint changes the fingerprint of a video with update and
+// stores it
+func updateFingerprint(videoID string, update func(*fingerprint)) {
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+	f := fingerprints[videoID]
+	if f == nil {
+		f = &fingerprint{}
+		fingerprints[videoID] = f
+	}
+	update(f)
+	if err := writeJSONFile(fingerprintsFile(), fingerprints); err != nil {
+		slog.Error("Failed to save fingerprints", "error", err)
+	}
+}
+
+// forgetFingerprint removes the fingerprint of a deleted video
+func forgetFingerprint(videoID string) {
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+	if _, ok := fingerprints[videoID]; !ok {
+		return
+	}
+	delete(fingerprints, videoID)
+	if err := writeJSONFile(fingerprintsFile(), fingerprints); err != nil {
+		slog.Error("Failed to save fingerprints", "error", err)
+	}
+}
+
+// reserveContentHash returns another video with the given SHA-256, saved
+// or still being uploaded, and records the upload at path as pending under
+// filename until releaseContentHash. Checking and recording under one lock
+// lets identical uploads arriving together see each other.
+func reserveContentHash(path, sum, filename string) string {
+	fingerprintsMu.Lock()
+	defer fingerprintsMu.Unlock()
+	pendingUploads[path] = pendingUpload{sum: sum, filename: filename}
+	for id, f := range fingerprints {
+		if id != filename && f.SHA256 == sum && videoExists(id) {
+			return id
+		}
+	}
+	for other, p := range pendingUploads {
+		if other != path && p.filename != filename && p.sum == sum {
+			return p.filename
+		}
+	}
+	return ""
+}
+
+// releaseContentHash ends the pending state of an upload once it is saved,
+// with its hash recorded, or refused
+func releaseContentHash(path string) {
+	fingerprintsMu.Lock()
+	delete(pendingUploads, path)
+	fingerprintsMu.Unlock()
+}
+
+// saveHashedUpload streams an upload to a staging file of uploadsDir while
+// hashing it. The caller moves the file into place or removes it.
+func saveHashedUpload(upload *multipart.FileHeader) (string, string, error) {
+	src, err := upload.Open()
+	if err != nil {
+		return "", "", err
+	}
+	defer src.Close()
+
+	dir := filepath.Join(uploadsDir, stagingDirName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return "", "", err
+	}
+	file, err := os.CreateTemp(dir, "upload-*")
+	if err != nil {
+		return "", "", err
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), src); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", "", err
+	}
+	return file.Name(), hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashFile returns the SHA-256 of a file
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// backfillContentHashes hashes the videos uploaded before content hashes
+// were recorded, so new uploads are checked against them too
+func backfillContentHashes() {
+	entries, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		id := entry.Name()
+		if entry.IsDir() || !getConfig().allowsExtension(filepath.Ext(id)) {
+			continue
+		}
+		fingerprintsMu.Lock()
+		known := fingerprints[id] != nil && fingerprints[id].SHA256 != ""
+		fingerprintsMu.Unlock()
+		if known {
+			continue
+		}
+		sum, err := hashFile(filepath.Join(uploadsDir, id))
+		if err != nil {
+			slog.Warn("Failed to hash video", "video_id", id, "error", err)
+			continue
+		}
+		updateFingerprint(id, func(f *fingerprint) { f.SHA256 = sum })
+	}
+}
+
+// enqueueFingerprint queues the perceptual fingerprint of a video
+func enqueueFingerprint(ctx context.Context, videoID string) *job {
+	return enqueueJob(ctx, &job{
+		Kind:    "fingerprint",
+		VideoID: videoID,
+	}, jobSpec{
+		ProgressID: "fingerprint-" + videoID,
+		Duration:   min(videoDuration(ctx, videoID), fingerprintSeconds),
+		OutputDir:  newStagingDir(transcodedDir),
+		Source:     filepath.Join(uploadsDir, videoID),
+	})
+}
+
+// computeFingerprint runs a fingerprint job: ffmpeg scales the sampled
+// frames down to 9x8 grey pixels, from which the difference hashes are
+// taken. Videos made by clips and concatenations are hashed here too.
+func computeFingerprint(ctx context.Context, j *job) error {
+	defer os.RemoveAll(j.spec.OutputDir)
+	if err := os.MkdirAll(j.spec.OutputDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	sum, err := hashFile(j.spec.Source)
+	if err != nil {
+		return err
+	}
+
+	framesPath := filepath.Join(j.spec.OutputDir, "frames.gray")
+	err = runFFmpeg(ctx, exec.Command("ffmpeg", "-y",
+		"-t", strconv.Itoa(fingerprintSeconds),
+		"-i", j.spec.Source,
+		"-an",
+		"-vf", fmt.Sprintf("fps=1/%d,scale=9:8:flags=area,format=gray", fingerprintInterval),
+		"-f", "rawvideo",
+		"-progress", "pipe:1",
+		framesPath), j.spec.ProgressID, j.spec.Duration)
+	if err != nil {
+		return fmt.Errorf("frame sampling failed: %v", err)
+	}
+	pixels, err := os.ReadFile(framesPath)
+	if err != nil {
+		return err
+	}
+
+	frames := make([]uint64, 0, len(pixels)/72)
+	for offset := 0; offset+72 <= len(pixels); offset += 72 {
+		frames = append(frames, differenceHash(pixels[offset:offset+72]))
+	}
+	updateFingerprint(j.VideoID, func(f *fingerprint) {
+		f.SHA256 = sum
+		f.Frames = frames
+		f.ComputedAt = time.Now()
+	})
+	slog.InfoContext(ctx, "Fingerprint computed", "video_id", j.VideoID, "frames", len(frames))
+	return nil
+}
+
+// differenceHash returns the dHash of a 9x8 grey frame: one bit per pair of
+// horizontally adjacent pixels, set when the left one is brighter
+func differenceHash(pixels []byte) uint64 {
+	var hash uint64
+	for y := range 8 {
+		for x := range 8 {
+			hash <<= 1
+			if pixels[y*9+x] > pixels[y*9+x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash
+}
+
+// frameSimilarity returns the share of the shorter sequence of frame
+// hashes that matches the other one, at the best alignment. Trimmed copies
+// match at an offset; uniform frames, whose hash is 0, never match.
+func frameSimilarity(a, b []uint64) float64 {
+	if len(a) < minFingerprintFrames || len(b) < minFingerprintFrames {
+		return 0
+	}
+	best := 0
+	for shift := -len(b) + 1; shift < len(a); shift++ {
+		matches := 0
+		for j := max(0, -shift); j < len(b) && j+shift < len(a); j++ {
+			x, y := a[j+shift], b[j]
+			if x != 0 && y != 0 && bits.OnesCount64(x^y) <= frameMatchDistance {
+				matches++
+			}
+		}
+		best = max(best, matches)
+	}
+	return float64(best) / float64(min(len(a), len(b)))
+}
+
+// frameBucket returns the bucket of the quarter q of a frame hash
+func frameBucket(hash uint64, q int) uint64 {
+	return uint64(q)<<frameBucketBits | hash>>(q*frameBucketBits)&(1<<frameBucketBits-1)
+}
+
+// frameBuckets returns the buckets of frames, skipping uniform ones
+func frameBuckets(frames []uint64) map[uint64]bool {
+	buckets := make(map[uint64]bool, len(frames)*frameBucketCount)
+	for _, hash := range frames {
+		if hash == 0 {
+			continue
+		}
+		for q := range frameBucketCount {
+			buckets[frameBucket(hash, q)] = true
+		}
+	}
+	return buckets
+}
+
+// sharesFrameBucket reports whether a frame falls in one of buckets
+func sharesFrameBucket(frames []uint64, buckets map[uint64]bool) bool {
+	for _, hash := range frames {
+		if hash == 0 {
+			continue
+		}
+		for q := range frameBucketCount {
+			if buckets[frameBucket(hash, q)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// fingerprintVideo queues the perceptual fingerprint of a video, for
+// videos uploaded before fingerprints were computed
+func fingerprintVideo(c *fiber.Ctx) error {
+	if err := checkFFmpeg(); err != nil {
+		slog.ErrorContext(c.UserContext(), "FFmpeg not available", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("FFmpeg error: %v", err),
+		})
+	}
+
+	id := c.Params("id")
+	if !videoExists(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Source video not found",
+		})
+	}
+	j := enqueueFingerprint(c.UserContext(), id)
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"success": true,
+		"videoId": id,
+		"jobId":   j.ID,
+	})
+}
+
+// getSimilarVideos lists the exact duplicates and near-duplicates of a
+// video, such as re-encodes and trims, most similar first
+func getSimilarVideos(c *fiber.Ctx) error {
+	id := c.Params("id")
+	threshold := defaultSimilarity
+	if value := c.Query("threshold"); value != "" {
+		var err error
+		if threshold, err = strconv.ParseFloat(value, 64); err != nil || threshold <= 0 || threshold > 1 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "threshold must be above 0 and at most 1",
+			})
+		}
+	}
+
+	// Fingerprints are copied, as jobs update them in place
+	fingerprintsMu.Lock()
+	var target fingerprint
+	stored := fingerprints[id]
+	var others map[string]fingerprint
+	if stored != nil {
+		target = *stored
+		others = make(map[string]fingerprint, len(fingerprints))
+		for other, f := range fingerprints {
+			if other != id {
+				others[other] = *f
+			}
+		}
+	}
+	fingerprintsMu.Unlock()
+
+	if stored == nil || !videoExists(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video has no fingerprint yet",
+		})
+	}
+
+	// The frames of a video are compared only when they share a bucket,
+	// so a lookup costs one pass over the library's frames rather than
+	// aligning the frames of every video
+	buckets := frameBuckets(target.Frames)
+	similar := make([]fiber.Map, 0)
+	for other, f := range others {
+		exact := target.SHA256 != "" && f.SHA256 == target.SHA256
+		similarity := 1.0
+		if !exact {
+			if !sharesFrameBucket(f.Frames, buckets) {
+				continue
+			}
+			similarity = frameSimilarity(target.Frames, f.Frames)
+		}
+		if similarity < threshold || !videoExists(other) {
+			continue
+		}
+		similar = append(similar, fiber.Map{
+			"id":         other,
+			"name":       lookupMetadata(other).displayName(other),
+			"url":        "/videos/" + other,
+			"similarity": similarity,
+			"exact":      exact,
+		})
+	}
+	sort.Slice(similar, func(a, b int) bool {
+		if similar[a]["similarity"] != similar[b]["similarity"] {
+			return similar[a]["similarity"].(float64) > similar[b]["similarity"].(float64)
+		}
+		return similar[a]["id"].(string) < similar[b]["id"].(string)
+	})
+
+	return c.JSON(fiber.Map{
+		"videoId":         id,
+		"fingerprintedAt": target.ComputedAt,
+		"threshold":       threshold,
+		"similar":         similar,
+	})
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// grayFrame builds a 9x8 grey frame from a pixel function
+func grayFrame(pixel func(x, y int) byte) []byte {
+	frame := make([]byte, 72)
+	for y := range 8 {
+		for x := range 9 {
+			frame[y*9+x] = pixel(x, y)
+		}
+	}
+	return frame
+}
+
+func TestDifferenceHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  uint64
+	}{
+		{"uniform", grayFrame(func(x, y int) byte { return 128 }), 0},
+		{"brightening to the right", grayFrame(func(x, y int) byte { return byte(x * 20) }), 0},
+		{"darkening to the right", grayFrame(func(x, y int) byte { return byte(200 - x*20) }), math.MaxUint64},
+		{"top row darkening", grayFrame(func(x, y int) byte {
+			if y == 0 {
+				return byte(200 - x*20)
+			}
+			return 50
+		}), 0xff00000000000000},
+		{"first pair of the last row", grayFrame(func(x, y int) byte {
+			if y == 7 && x == 0 {
+				return 255
+			}
+			return 0
+		}), 0x80},
+	}
+	for _, tt := range tests {
+		if got := differenceHash(tt.frame); got != tt.want {
+			t.Errorf("%s: got %#x, want %#x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Frame hashes of a video, a re-encode of it and an unrelated video
+var (
+	base      = []uint64{0x0f0f0f0f0f0f0f0f, 0x00ff00ff00ff00ff, 0x123456789abcdef0, 0xfedcba9876543210, 0xaaaaaaaaaaaaaaaa, 0x5555555555555555}
+	reencoded = flipBits(base, 0x1010100000000001)
+	unrelated = []uint64{0xffffffff00000000, 0x00000000ffffffff, 0xf0f0f0f0f0f0f0f0, 0x0123012301230123, 0x3333333333333333, 0xcccccccccccccccc}
+)
+
+// flipBits flips the same bits of every hash, as a re-encode does
+func flipBits(frames []uint64, mask uint64) []uint64 {
+	flipped := make([]uint64, len(frames))
+	for i, h := range frames {
+		flipped[i] = h ^ mask
+	}
+	return flipped
+}
+
+func TestFrameSimilarity(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b []uint64
+		want float64
+	}{
+		{"identical", base, base, 1},
+		{"re-encoded", base, reencoded, 1},
+		{"trimmed start", base, base[2:], 1},
+		{"trimmed end", base[:4], base, 1},
+		{"unrelated", base, unrelated, 0},
+		{"half replaced", base, append(append([]uint64{}, base[:3]...), unrelated[3:]...), 0.5},
+		{"uniform frames never match", []uint64{0, 0, 0, 0}, []uint64{0, 0, 0, 0}, 0},
+		{"too few frames", base[:2], base[:2], 0},
+	}
+	for _, tt := range tests {
+		if got := frameSimilarity(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+		if got, reversed := frameSimilarity(tt.a, tt.b), frameSimilarity(tt.b, tt.a); got != reversed {
+			t.Errorf("%s: not symmetric, %v and %v", tt.name, got, reversed)
+		}
+	}
+}
+
+func TestSharesFrameBucket(t *testing.T) {
+	buckets := frameBuckets(base)
+	tests := []struct {
+		name   string
+		frames []uint64
+		want   bool
+	}{
+		{"identical", base, true},
+		{"re-encoded", reencoded, true},
+		{"trimmed", base[3:], true},
+		{"unrelated", unrelated, false},
+		{"uniform frames", []uint64{0, 0, 0}, false},
+		{"no frames", nil, false},
+	}
+	for _, tt := range tests {
+		if got := sharesFrameBucket(tt.frames, buckets); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if sharesFrameBucket(base, frameBuckets([]uint64{0, 0})) {
+		t.Error("uniform frames share a bucket")
+	}
+}
+
+func TestGetSimilarVideos(t *testing.T) {
+	savedDir, savedFingerprints := uploadsDir, fingerprints
+	uploadsDir = t.TempDir()
+	fingerprintsMu.Lock()
+	fingerprints = map[string]*fingerprint{
+		"target.mp4":    {SHA256: "a", Frames: base},
+		"copy.mp4":      {SHA256: "a"}, // Same content, frames not sampled yet
+		"reencode.mp4":  {SHA256: "b", Frames: reencoded},
+		"trim.mp4":      {SHA256: "c", Frames: base[2:]},
+		"unrelated.mp4": {SHA256: "d", Frames: unrelated},
+		"deleted.mp4":   {SHA256: "e", Frames: base},
+	}
+	fingerprintsMu.Unlock()
+	t.Cleanup(func() {
+		fingerprintsMu.Lock()
+		fingerprints = savedFingerprints
+		fingerprintsMu.Unlock()
+		uploadsDir = savedDir
+	})
+	for _, id := range []string{"target.mp4", "copy.mp4", "reencode.mp4", "trim.mp4", "unrelated.mp4"} {
+		if err := os.WriteFile(filepath.Join(uploadsDir, id), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	app := fiber.New()
+	app.Get("/videos/:id/similar", getSimilarVideos)
+	resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/videos/target.mp4/similar", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Similar []struct {
+			ID    string `json:"id"`
+			Exact bool   `json:"exact"`
+		} `json:"similar"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, s := range body.Similar {
+		got = append(got, s.ID)
+		if s.Exact != (s.ID == "copy.mp4") {
+			t.Errorf("%s: exact %v", s.ID, s.Exact)
+		}
+	}
+	if want := []string{"copy.mp4", "reencode.mp4", "trim.mp4"}; !slices.Equal(got, want) {
+		t.Errorf("similar videos %v, want %v", got, want)
+	}
+
+	resp, err = app.Test(httptest.NewRequest(http.MethodGet, "/videos/unknown.mp4/similar", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("unknown video: status %d, want %d", resp.StatusCode, fiber.StatusNotFound)
+	}
+}
+
+func TestReserveContentHash(t *testing.T) {
+	savedDir, savedFingerprints := uploadsDir, fingerprints
+	uploadsDir = t.TempDir()
+	fingerprints = map[string]*fingerprint{"old.mp4": {SHA256: "saved"}}
+	t.Cleanup(func() { uploadsDir, fingerprints = savedDir, savedFingerprints })
+	if err := os.WriteFile(filepath.Join(uploadsDir, "old.mp4"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := reserveContentHash("tmp-1", "saved", "copy.mp4"); got != "old.mp4" {
+		t.Errorf("saved duplicate = %q, want old.mp4", got)
+	}
+	releaseContentHash("tmp-1")
+	if got := reserveContentHash("tmp-2", "saved", "old.mp4"); got != "" {
+		t.Errorf("re-upload under the same name = %q, want none", got)
+	}
+	releaseContentHash("tmp-2")
+
+	// Identical uploads at the same time: exactly one is not a duplicate
+	var wg sync.WaitGroup
+	originals := make([]string, 8)
+	for i := range originals {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			originals[i] = reserveContentHash(filepath.Join("tmp", string(rune('a'+i))), "new", string(rune('a'+i))+".mp4")
+		}()
+	}
+	wg.Wait()
+	first := 0
+	for _, original := range originals {
+		if original == "" {
+			first++
+		}
+	}
+	if first != 1 {
+		t.Errorf("%d concurrent uploads passed the duplicate check, want 1: %q", first, originals)
+	}
+
+	for i := range originals {
+		releaseContentHash(filepath.Join("tmp", string(rune('a'+i))))
+	}
+	if got := reserveContentHash("tmp-3", "new", "z.mp4"); got != "" {
+		t.Errorf("released upload still reserved as %q", got)
+	}
+	releaseContentHash("tmp-3")
+	if len(pendingUploads) != 0 {
+		t.Errorf("pending uploads left: %v", pendingUploads)
+	}
+}
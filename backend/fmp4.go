@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Set in ISO BMFF sample flags when a sample is not a sync sample
+const sampleIsNonSync = 0x10000
+
+// mp4Boxes calls fn with the type and body of each box in data, stopping
+// early when fn returns false. Truncated boxes end the walk.
+func mp4Boxes(data []byte, fn func(typ string, body []byte) bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return
+		}
+		if !fn(typ, data[header:size]) {
+			return
+		}
+		data = data[size:]
+	}
+}
+
+// childBox returns the body of the first child box of the given type
+func childBox(data []byte, typ string) []byte {
+	var found []byte
+	mp4Boxes(data, func(t string, body []byte) bool {
+		if t == typ {
+			found = body
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// trackDefaultFlags reads the default sample flags of each track from the
+// trex boxes of an fMP4 init segment
+func trackDefaultFlags(init []byte) map[uint32]uint32 {
+	defaults := make(map[uint32]uint32)
+	mvex := childBox(childBox(init, "moov"), "mvex")
+	mp4Boxes(mvex, func(typ string, body []byte) bool {
+		// version/flags, track_ID, description index, duration, size, flags
+		if typ == "trex" && len(body) >= 24 {
+			defaults[binary.BigEndian.Uint32(body[4:])] = binary.BigEndian.Uint32(body[20:])
+		}
+		return true
+	})
+	return defaults
+}
+
+// fragmentStartsWithSync reports whether every track of an fMP4 fragment
+// starts with a sync sample, so decoding can begin at it. Flags are taken
+// from the trun, then the tfhd, then the trex defaults of the init segment.
+func fragmentStartsWithSync(fragment []byte, defaults map[uint32]uint32) (bool, error) {
+	moof := childBox(fragment, "moof")
+	if moof == nil {
+		return false, fmt.Errorf("no moof box")
+	}
+
+	tracks := 0
+	independent := true
+	var err error
+	mp4Boxes(moof, func(typ string, traf []byte) bool {
+		if typ != "traf" {
+			return true
+		}
+		tracks++
+
+		tfhd := childBox(traf, "tfhd")
+		if len(tfhd) < 8 {
+			err = fmt.Errorf("traf without tfhd")
+			return false
+		}
+		tfhdFlags := binary.BigEndian.Uint32(tfhd) & 0xffffff
+		flags := defaults[binary.BigEndian.Uint32(tfhd[4:])]
+		offset := 8
+		for _, field := range []struct {
+			flag uint32
+			size int
+		}{{0x1, 8}, {0x2, 4}, {0x8, 4}, {0x10, 4}} {
+			if tfhdFlags&field.flag != 0 {
+				offset += field.size
+			}
+		}
+		if tfhdFlags&0x20 != 0 {
+			if len(tfhd) < offset+4 {
+				err = fmt.Errorf("truncated tfhd")
+				return false
+			}
+			flags = binary.BigEndian.Uint32(tfhd[offset:])
+		}
+
+		trun := childBox(traf, "trun")
+		if len(trun) < 8 || binary.BigEndian.Uint32(trun[4:]) == 0 {
+			return true // No samples in this track
+		}
+		trunFlags := binary.BigEndian.Uint32(trun) & 0xffffff
+		offset = 8
+		if trunFlags&0x1 != 0 {
+			offset += 4 // data_offset
+		}
+		switch {
+		case trunFlags&0x4 != 0:
+			if len(trun) < offset+4 {
+				err = fmt.Errorf("truncated trun")
+				return false
+			}
+			flags = binary.BigEndian.Uint32(trun[offset:])
+		case trunFlags&0x400 != 0:
+			// Per-sample flags follow the duration and size of the first sample
+			offset += 4
+			if trunFlags&0x100 != 0 {
+				offset += 4
+			}
+			if trunFlags&0x200 != 0 {
+				offset += 4
+			}
+			if len(trun) < offset+4 {
+				err = fmt.Errorf("truncated trun")
+				return false
+			}
+			flags = binary.BigEndian.Uint32(trun[offset:])
+		}
+		if flags&sampleIsNonSync != 0 {
+			independent = false
+		}
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+	if tracks == 0 {
+		return false, fmt.Errorf("moof without traf")
+	}
+	return independent, nil
+}
+
+// partSync holds which parts of one LL-HLS encode start with a sync
+// sample. Parts do not change once ffmpeg lists them; a new encode writes a
+// new init segment, which replaces the entries of the previous one.
+type partSync struct {
+	initModTime time.Time
+	defaults    map[uint32]uint32
+	parts       map[string]bool
+}
+
+// Sync results of LL-HLS parts per output directory
+var (
+	partSyncCache   = make(map[string]*partSync)
+	partSyncCacheMu sync.Mutex
+)
+
+// markIndependentParts sets which parts of an LL-HLS directory can be
+// decoded on their own, reading each part only the first time it is seen
+func markIndependentParts(dir string, parts []llhlsPart) {
+	partSyncCacheMu.Lock()
+	defer partSyncCacheMu.Unlock()
+
+	initPath := filepath.Join(dir, llhlsInitSegment)
+	info, err := os.Stat(initPath)
+	if err != nil {
+		return
+	}
+	cache := partSyncCache[dir]
+	if cache == nil || !cache.initModTime.Equal(info.ModTime()) {
+		init, err := os.ReadFile(initPath)
+		if err != nil {
+			return
+		}
+		cache = &partSync{
+			initModTime: info.ModTime(),
+			defaults:    trackDefaultFlags(init),
+			parts:       make(map[string]bool),
+		}
+		partSyncCache[dir] = cache
+	}
+
+	for i := range parts {
+		independent, ok := cache.parts[parts[i].uri]
+		if !ok {
+			data, err := os.ReadFile(filepath.Join(dir, parts[i].uri))
+			if err != nil {
+				continue
+			}
+			// Parts that cannot be parsed are not cached, in case they
+			// were read while being written
+			if independent, err = fragmentStartsWithSync(data, cache.defaults); err != nil {
+				continue
+			}
+			cache.parts[parts[i].uri] = independent
+		}
+		parts[i].independent = independent
+	}
+}
+
+// forgetPartSync drops the cached parts of an LL-HLS directory that is
+// encoded again or deleted
+func forgetPartSync(dir string) {
+	partSyncCacheMu.Lock()
+	delete(partSyncCache, dir)
+	partSyncCacheMu.Unlock()
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Directory holding the ffmpeg output of each job
+var jobLogsDir = "./uploads/logs"
+
+// A job log is rotated once it reaches this size, keeping one previous
+// file, so at most twice this much is stored per job
+const maxJobLogSize = 4 * 1024 * 1024 // 4MB
+
+// Default number of lines returned by the logs endpoint
+const defaultLogTail = 200
+
+// jobLog appends lines to the log file of a job
+type jobLog struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+	size int64
+}
+
+// jobLogPath returns the current log file of a job
+func jobLogPath(jobID string) string {
+	return filepath.Join(jobLogsDir, jobID+".log")
+}
+
+// openJobLog opens the log of a job for appending
+func openJobLog(jobID string) (*jobLog, error) {
+	if err := os.MkdirAll(jobLogsDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	path := jobLogPath(jobID)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &jobLog{path: path, file: file, size: info.Size()}, nil
+}
+
+// WriteLine appends one line, rotating the file when it grows too large
+func (l *jobLog) WriteLine(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.size+int64(len(line))+1 > maxJobLogSize {
+		l.file.Close()
+		os.Rename(l.path, l.path+".1")
+		file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			slog.Error("Failed to rotate job log", "path", l.path, "error", err)
+			l.file = nil
+			return
+		}
+		l.file = file
+		l.size = 0
+	}
+	if l.file == nil {
+		return
+	}
+
+	n, _ := l.file.WriteString(line + "\n")
+	l.size += int64(n)
+}
+
+// Close closes the log file
+func (l *jobLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
+
+// removeJobLogs deletes the log files of a job
+func removeJobLogs(jobID string) {
+	os.Remove(jobLogPath(jobID))
+	os.Remove(jobLogPath(jobID) + ".1")
+}
+
+// scanLines splits ffmpeg output on \n as well as the bare \r that ffmpeg
+// uses to redraw its status line
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		advance = i + 1
+		if data[i] == '\r' && i+1 < len(data) && data[i+1] == '\n' {
+			advance++
+		}
+		return advance, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// readJobLogTail returns the last n lines of a job's log, including the
+// rotated file when needed
+func readJobLogTail(jobID string, n int) ([]string, int64, error) {
+	path := jobLogPath(jobID)
+	current, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	data := current
+	if previous, err := os.ReadFile(path + ".1"); err == nil {
+		data = append(previous, current...)
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if n > 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, int64(len(current)), nil
+}
+
+// getJobLogs returns the ffmpeg output of a job as plain text. With
+// follow=true the response stays open and streams new lines until the job
+// has finished.
+func getJobLogs(c *fiber.Ctx) error {
+	jobID := c.Params("jobId")
+
+	jobsMu.Lock()
+	j, known := jobs[jobID]
+	jobsMu.Unlock()
+
+	tail := defaultLogTail
+	if value := c.Query("tail"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "tail must be a non-negative number of lines",
+			})
+		}
+		tail = n
+	}
+
+	lines, offset, err := readJobLogTail(jobID, tail)
+	if err != nil {
+		if !known {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "Job not found",
+			})
+		}
+		// The job has not written any output yet
+		lines, offset = nil, 0
+	}
+
+	c.Set(fiber.HeaderContentType, fiber.MIMETextPlainCharsetUTF8)
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+
+	if c.Query("follow") != "true" || !known {
+		var b bytes.Buffer
+		for _, line := range lines {
+			b.WriteString(line + "\n")
+		}
+		return c.Send(b.Bytes())
+	}
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		for _, line := range lines {
+			w.WriteString(line + "\n")
+		}
+		if w.Flush() != nil {
+			return
+		}
+
+		for {
+			finished := false
+			select {
+			case <-j.done:
+				finished = true
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			offset = copyJobLogFrom(w, jobID, offset)
+			if w.Flush() != nil || finished {
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// copyJobLogFrom writes everything appended to a job log since offset and
+// returns the new offset. A rotation restarts the file from zero.
+func copyJobLogFrom(w io.Writer, jobID string, offset int64) int64 {
+	file, err := os.Open(jobLogPath(jobID))
+	if err != nil {
+		return offset
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return offset
+	}
+	if info.Size() < offset {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return offset
+	}
+	n, _ := io.Copy(w, file)
+	return offset + n
+}
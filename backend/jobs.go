@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+// Directory of job inputs such as overlay text and concat lists. It lives
+// next to the other persisted state so recovered jobs still find them.
+var jobInputsDir = "./uploads/inputs"
+
+// createJobInput creates a file in jobInputsDir named after pattern
+func createJobInput(pattern string) (*os.File, error) {
+	if err := os.MkdirAll(jobInputsDir, 0755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(jobInputsDir, pattern)
+}
+
+// Maximum number of jobs running ffmpeg at the same time, set from the
+// configuration
+var maxConcurrentJobs = 2
+
+// Finished jobs are kept this long for the jobs API
+const jobRetention = 24 * time.Hour
+
+// job is a unit of ffmpeg work such as a transcode, clip, concat, ladder
+// or scene analysis, or chapter generation
+type job struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	VideoID     string    `json:"videoId"`
+	Format      string    `json:"format,omitempty"`
+	Resolution  string    `json:"resolution,omitempty"`
+	Bitrate     string    `json:"bitrate,omitempty"`
+	RateControl string    `json:"rateControl,omitempty"`
+	State       string    `json:"state"`
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	StartedAt   time.Time `json:"startedAt,omitzero"`
+	FinishedAt  time.Time `json:"finishedAt,omitzero"`
+
+	// Of the output, when quality metrics were measured
+	Quality *qualityScores `json:"quality,omitempty"`
+
+	spec   jobSpec
+	ctx    context.Context // Carries the trace of the request that created the job
+	cancel context.CancelFunc
+	done   chan struct{} // Closed when the job has finished or was interrupted
+}
+
+// jobSpec describes the ffmpeg run of a job. It is stored with the job so
+// that an interrupted job can be started again after a restart.
+type jobSpec struct {
+	Args       []string `json:"args"`
+	ProgressID string   `json:"progressId"` // Key in transcodingProgress
+	Duration   float64  `json:"duration"`   // Of the output, for progress
+	OutputDir  string   `json:"outputDir"`  // Created before ffmpeg runs
+	Outputs    []string `json:"outputs"`    // Globs of the written files, removed unless the job succeeds
+	TempFiles  []string `json:"tempFiles,omitempty"`
+
+	// Two-pass encodes run FirstPass before Args. Both passes share the
+	// statistics in PassLogDir, which is removed when the job finishes.
+	FirstPass  []string `json:"firstPass,omitempty"`
+	PassLogDir string   `json:"passLogDir,omitempty"`
+
+	// Output written to StagingDir is validated and moved into PublishDir
+	// once ffmpeg has succeeded. Output is the main file, relative to
+	// StagingDir, and URL where it is served once published.
+	StagingDir string `json:"stagingDir,omitempty"`
+	PublishDir string `json:"publishDir,omitempty"`
+	Output     string `json:"output,omitempty"`
+	URL        string `json:"url,omitempty"`
+
+	// A transcode is verified against its Source before it is published,
+	// measuring the quality Metrics
+	Source  string   `json:"source,omitempty"`
+	Metrics []string `json:"metrics,omitempty"`
+
+	// Recorded for the output video once the job has succeeded
+	Derived    string      `json:"derived,omitempty"`
+	Derivation *derivation `json:"derivation,omitempty"`
+}
+
+// Job registry and queue. Fields of a job are only changed with jobsMu held.
+var (
+	jobs         = make(map[string]*job)
+	jobQueue     []*job
+	jobsRunning  int
+	jobsStopping bool // Set on shutdown; no further jobs are started
+	jobsMu       sync.Mutex
+)
+
+// enqueueJob registers j and queues its ffmpeg run described by spec. ctx
+// links the job's spans to the trace of the request that created it.
+func enqueueJob(ctx context.Context, j *job, spec jobSpec) *job {
+	j.ID = utils.UUIDv4()
+	j.State = jobQueued
+	j.CreatedAt = time.Now()
+	j.spec = spec
+	j.ctx = context.WithoutCancel(ctx)
+	j.done = make(chan struct{})
+	setTranscodingProgress(spec.ProgressID, 0)
+
+	jobsMu.Lock()
+	pruneJobsLocked()
+	jobs[j.ID] = j
+	jobQueue = append(jobQueue, j)
+	saveJobsLocked()
+	jobsMu.Unlock()
+
+	updateRendition(j, renditionProcessing, nil)
+	dispatchJobs()
+	return j
+}
+
+// setMaxConcurrentJobs changes the concurrency limit. Running jobs are not
+// interrupted when it is lowered.
+func setMaxConcurrentJobs(n int) {
+	jobsMu.Lock()
+	maxConcurrentJobs = n
+	jobsMu.Unlock()
+
+	dispatchJobs()
+}
+
+// dispatchJobs starts queued jobs while there is capacity
+func dispatchJobs() {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	if jobsStopping {
+		return
+	}
+	started := false
+	for jobsRunning < maxConcurrentJobs && len(jobQueue) > 0 {
+		j := jobQueue[0]
+		jobQueue = jobQueue[1:]
+		jobsRunning++
+		j.State = jobRunning
+		j.StartedAt = time.Now()
+		j.ctx, j.cancel = context.WithCancel(j.ctx)
+		go runJob(j)
+		started = true
+	}
+	if started {
+		saveJobsLocked()
+	}
+}
+
+// runJob executes a job and records its outcome
+func runJob(j *job) {
+	ctx, span := startStage(withJobID(j.ctx, j.ID), "job "+j.Kind,
+		attribute.String("job.id", j.ID),
+		attribute.String("job.kind", j.Kind),
+		attribute.String("video.id", j.VideoID),
+		attribute.String("job.format", j.Format),
+		attribute.String("job.resolution", j.Resolution),
+		attribute.Float64("job.queue_wait_seconds", time.Since(j.CreatedAt).Seconds()),
+	)
+	slog.InfoContext(ctx, "Job started", "kind", j.Kind, "video_id", j.VideoID)
+	emitEvent(ctx, eventJobStarted, fiber.Map{"job": j.snapshot()})
+	if j.Format == "llhls" {
+		updateRendition(j, renditionLive, nil)
+	}
+	stopProgress := make(chan struct{})
+	go watchJobProgress(ctx, j, stopProgress)
+	quality, err := j.execute(ctx)
+	close(stopProgress)
+	endStage(span, err)
+
+	// A job cancelled by shutdown is put back in the queue to be resumed
+	// after the restart
+	if err != nil && ctx.Err() != nil {
+		slog.WarnContext(ctx, "Job interrupted by shutdown", "kind", j.Kind, "video_id", j.VideoID)
+		j.removeOutputs()
+
+		jobsMu.Lock()
+		j.State = jobQueued
+		j.StartedAt = time.Time{}
+		jobsRunning--
+		saveJobsLocked()
+		jobsMu.Unlock()
+
+		close(j.done)
+		return
+	}
+
+	jobsMu.Lock()
+	j.Quality = quality
+	jobsMu.Unlock()
+
+	if err != nil {
+		slog.ErrorContext(ctx, "Job failed", "kind", j.Kind, "video_id", j.VideoID, "error", err)
+		j.removeOutputs()
+		updateRendition(j, renditionFailed, err)
+	} else {
+		slog.InfoContext(ctx, "Job succeeded", "kind", j.Kind, "video_id", j.VideoID)
+		if j.spec.Derivation != nil {
+			recordDerivation(j.spec.Derived, *j.spec.Derivation)
+			indexVideo(ctx, j.spec.Derived)
+			enqueueFingerprint(ctx, j.spec.Derived)
+		}
+		updateRendition(j, renditionReady, nil)
+	}
+	for _, name := range j.spec.TempFiles {
+		os.Remove(name)
+	}
+	if j.spec.PassLogDir != "" {
+		os.RemoveAll(j.spec.PassLogDir)
+	}
+
+	jobsMu.Lock()
+	j.FinishedAt = time.Now()
+	if err != nil {
+		j.State = jobFailed
+		j.Error = err.Error()
+	} else {
+		j.State = jobSucceeded
+	}
+	jobsRunning--
+	saveJobsLocked()
+	jobsMu.Unlock()
+	if j.spec.Derived != "" {
+		releaseUploadName(j.spec.Derived)
+	}
+
+	if err != nil {
+		emitEvent(ctx, eventJobFailed, fiber.Map{"job": j.snapshot()})
+	} else {
+		emitEvent(ctx, eventJobSucceeded, fiber.Map{"job": j.snapshot()})
+	}
+	observeJob(j)
+	close(j.done)
+	dispatchJobs()
+}
+
+// execute runs the ffmpeg command of the job and returns the quality
+// scores of its output, if they were measured
+func (j *job) execute(ctx context.Context) (*qualityScores, error) {
+	if j.Kind == "ladder" {
+		return nil, analyzeLadder(ctx, j)
+	}
+	if j.Kind == "scenes" {
+		return nil, analyzeScenes(ctx, j)
+	}
+	if j.Kind == "chapters" {
+		return nil, generateChapters(ctx, j)
+	}
+	if j.Kind == "fingerprint" {
+		return nil, computeFingerprint(ctx, j)
+	}
+
+	encodeCtx, span := startStage(ctx, j.Kind+".encode",
+		attribute.String(j.Kind+".format", j.Format),
+		attribute.String(j.Kind+".resolution", j.Resolution),
+		attribute.String(j.Kind+".bitrate", j.Bitrate))
+
+	err := os.MkdirAll(j.spec.OutputDir, os.ModePerm)
+	if err == nil && len(j.spec.FirstPass) > 0 {
+		err = os.MkdirAll(j.spec.PassLogDir, os.ModePerm)
+		if err == nil {
+			err = runFFmpeg(encodeCtx, exec.Command("ffmpeg", j.spec.FirstPass...), j.spec.ProgressID, j.spec.Duration)
+		}
+	}
+	if err == nil {
+		err = runFFmpeg(encodeCtx, exec.Command("ffmpeg", j.spec.Args...), j.spec.ProgressID, j.spec.Duration)
+	}
+	endStage(span, err)
+	if err != nil || j.spec.StagingDir == "" {
+		return nil, err
+	}
+
+	// Only complete outputs are moved into place
+	output := filepath.Join(j.spec.StagingDir, j.spec.Output)
+	var quality *qualityScores
+	verifyCtx, span := startStage(ctx, j.Kind+".verify")
+	err = validateOutput(verifyCtx, output)
+	if err == nil && j.spec.Source != "" {
+		quality, err = verifyOutput(verifyCtx, output, j.spec.Source, j.spec.Metrics)
+	}
+	if err != nil {
+		err = fmt.Errorf("output failed validation: %v", err)
+	}
+	endStage(span, err)
+	if err != nil {
+		return quality, err
+	}
+
+	_, span = startStage(ctx, j.Kind+".publish")
+	err = publishStaged(j.spec.StagingDir, j.spec.PublishDir, formatFiles[j.Format])
+	endStage(span, err)
+	return quality, err
+}
+
+// removeOutputs deletes the staging directory of a job and the files and
+// directories matching its output globs
+func (j *job) removeOutputs() {
+	if j.spec.StagingDir != "" {
+		os.RemoveAll(j.spec.StagingDir)
+	}
+	if j.spec.PassLogDir != "" {
+		os.RemoveAll(j.spec.PassLogDir)
+	}
+	for _, pattern := range j.spec.Outputs {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			os.RemoveAll(match)
+		}
+	}
+}
+
+// err returns the error of a job whose done channel is closed
+func (j *job) err() error {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	switch j.State {
+	case jobSucceeded:
+		return nil
+	case jobFailed:
+		return errors.New(j.Error)
+	default:
+		return errors.New("interrupted by shutdown, the job will resume after the restart")
+	}
+}
+
+// snapshot returns a copy of the job that is safe to read
+func (j *job) snapshot() job {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return *j
+}
+
+// pruneJobsLocked forgets jobs that finished longer than jobRetention ago.
+// jobsMu must be held.
+func pruneJobsLocked() {
+	cutoff := time.Now().Add(-jobRetention)
+	for id, j := range jobs {
+		if !j.FinishedAt.IsZero() && j.FinishedAt.Before(cutoff) {
+			delete(jobs, id)
+			removeJobLogs(id)
+		}
+	}
+}
+
+// jobCounts returns the number of known jobs per state
+func jobCounts() map[string]int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+
+	counts := map[string]int{jobQueued: 0, jobRunning: 0, jobSucceeded: 0, jobFailed: 0}
+	for _, j := range jobs {
+		counts[j.State]++
+	}
+	return counts
+}
+
+// queueDepth returns the number of jobs waiting to start
+func queueDepth() int {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	return len(jobQueue)
+}
+
+// getJobs returns known jobs, newest first, optionally filtered by state
+func getJobs(c *fiber.Ctx) error {
+	state := c.Query("state")
+
+	jobsMu.Lock()
+	list := make([]job, 0, len(jobs))
+	for _, j := range jobs {
+		if state == "" || j.State == state {
+			list = append(list, *j)
+		}
+	}
+	jobsMu.Unlock()
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt.After(list[b].CreatedAt)
+	})
+	return c.JSON(list)
+}
+
+// getJob returns a single job
+func getJob(c *fiber.Ctx) error {
+	jobsMu.Lock()
+	j, ok := jobs[c.Params("jobId")]
+	jobsMu.Unlock()
+
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Job not found",
+		})
+	}
+	return c.JSON(j.snapshot())
+}
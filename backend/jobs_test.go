@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// useJobs gives a test a job registry holding jobs and an empty queue
+func useJobs(t *testing.T, list ...*job) {
+	jobsMu.Lock()
+	savedJobs, savedQueue := jobs, jobQueue
+	jobs, jobQueue = make(map[string]*job), nil
+	for _, j := range list {
+		jobs[j.ID] = j
+		if j.State == jobQueued {
+			jobQueue = append(jobQueue, j)
+		}
+	}
+	jobsMu.Unlock()
+	t.Cleanup(func() {
+		jobsMu.Lock()
+		jobs, jobQueue = savedJobs, savedQueue
+		jobsMu.Unlock()
+	})
+}
+
+func TestGetJobs(t *testing.T) {
+	now := time.Now()
+	useJobs(t,
+		&job{ID: "a", State: jobSucceeded, CreatedAt: now.Add(-3 * time.Minute)},
+		&job{ID: "b", State: jobFailed, CreatedAt: now.Add(-2 * time.Minute)},
+		&job{ID: "c", State: jobQueued, CreatedAt: now.Add(-time.Minute)},
+		&job{ID: "d", State: jobSucceeded, CreatedAt: now},
+	)
+	app := fiber.New()
+	app.Get("/jobs", getJobs)
+	app.Get("/jobs/:jobId", getJob)
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/jobs", []string{"d", "c", "b", "a"}},
+		{"/jobs?state=succeeded", []string{"d", "a"}},
+		{"/jobs?state=running", []string{}},
+	}
+	for _, tt := range tests {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var list []job
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		got := []string{}
+		for _, j := range list {
+			got = append(got, j.ID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	for id, want := range map[string]int{"b": fiber.StatusOK, "missing": fiber.StatusNotFound} {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, "/jobs/"+id, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != want {
+			t.Errorf("job %s: status %d, want %d", id, resp.StatusCode, want)
+		}
+	}
+}
+
+func TestPruneJobs(t *testing.T) {
+	now := time.Now()
+	useJobs(t,
+		&job{ID: "old", State: jobFailed, FinishedAt: now.Add(-jobRetention - time.Minute)},
+		&job{ID: "recent", State: jobSucceeded, FinishedAt: now.Add(-time.Hour)},
+		&job{ID: "queued", State: jobQueued, CreatedAt: now.Add(-2 * jobRetention)},
+	)
+	jobsMu.Lock()
+	pruneJobsLocked()
+	var kept []string
+	for id := range jobs {
+		kept = append(kept, id)
+	}
+	jobsMu.Unlock()
+	slices.Sort(kept)
+	if want := []string{"queued", "recent"}; !slices.Equal(kept, want) {
+		t.Errorf("kept %v, want %v", kept, want)
+	}
+}
+
+// gaugeValues returns the values of a gauge family by the value of label
+func gaugeValues(t *testing.T, name, label string) map[string]float64 {
+	t.Helper()
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			key := ""
+			for _, pair := range m.GetLabel() {
+				if pair.GetName() == label {
+					key = pair.GetValue()
+				}
+			}
+			values[key] = m.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestJobMetrics(t *testing.T) {
+	useJobs(t,
+		&job{ID: "a", State: jobQueued},
+		&job{ID: "b", State: jobQueued},
+		&job{ID: "c", State: jobRunning},
+		&job{ID: "d", State: jobFailed},
+	)
+	want := map[string]float64{jobQueued: 2, jobRunning: 1, jobSucceeded: 0, jobFailed: 1}
+	if got := gaugeValues(t, "videostreaming_jobs", "state"); !maps.Equal(got, want) {
+		t.Errorf("jobs by state = %v, want %v", got, want)
+	}
+	if got := gaugeValues(t, "videostreaming_job_queue_depth", ""); got[""] != 2 {
+		t.Errorf("queue depth = %v, want 2", got[""])
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]int{"a.mp4": 100, "sub/b.ts": 50, "sub/deeper/c.m4s": 7}
+	for name, size := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), os.ModePerm)
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := dirSize(root); got != 157 {
+		t.Errorf("dirSize = %d, want 157", got)
+	}
+	if got := dirSize(filepath.Join(root, "missing")); got != 0 {
+		t.Errorf("dirSize of a missing directory = %d, want 0", got)
+	}
+}
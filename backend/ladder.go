@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Subdirectory of transcodedDir/<baseName> holding the ABR package
+const abrDirName = "abr"
+
+// Segment duration of the ABR package in seconds. Every variant gets a
+// keyframe at each segment start, so players can switch between them.
+const abrSegmentDuration = 6
+
+// Minimum bitrate step between two rungs of an analyzed ladder
+const ladderStepRatio = 1.5
+
+// ladderRung is one variant of an ABR ladder
+type ladderRung struct {
+	Resolution string  `json:"resolution"`
+	Bitrate    string  `json:"bitrate"`
+	Score      float64 `json:"score,omitempty"` // Of the trial encode the rung was taken from
+}
+
+// Ladder used for videos that were not analyzed, from the lowest rung up
+var defaultLadder = []ladderRung{
+	{Resolution: "240", Bitrate: "400k"},
+	{Resolution: "360", Bitrate: "800k"},
+	{Resolution: "480", Bitrate: "1400k"},
+	{Resolution: "720", Bitrate: "2800k"},
+	{Resolution: "1080", Bitrate: "5000k"},
+	{Resolution: "1440", Bitrate: "9000k"},
+	{Resolution: "2160", Bitrate: "16000k"},
+}
+
+// ladderPoint is one trial encode of the analysis
+type ladderPoint struct {
+	Resolution  string  `json:"resolution"`
+	CRF         int     `json:"crf"`
+	BitrateKbps int     `json:"bitrateKbps"`
+	Score       float64 `json:"score"`
+	OnHull      bool    `json:"onHull"` // On the convex hull of score over bitrate
+}
+
+// ladderAnalysis is the stored result of a per-title ladder analysis
+type ladderAnalysis struct {
+	VideoID       string        `json:"videoId"`
+	JobID         string        `json:"jobId"`
+	Metric        string        `json:"metric"`
+	SampleStart   float64       `json:"sampleStart"` // Seconds into the source
+	SampleSeconds float64       `json:"sampleSeconds"`
+	Points        []ladderPoint `json:"points"`
+	Ladder        []ladderRung  `json:"ladder"`
+	AnalyzedAt    time.Time     `json:"analyzedAt"`
+}
+
+// Ladder analyses per video ID
+var (
+	ladders   = make(map[string]*ladderAnalysis)
+	laddersMu sync.Mutex
+)
+
+// laddersFile is where ladder analyses are stored
+func laddersFile() string {
+	return filepath.Join(transcodedDir, ".ladders.json")
+}
+
+// loadLadders reads the stored ladder analyses
+func loadLadders() error {
+	laddersMu.Lock()
+	defer laddersMu.Unlock()
+
+	data, err := os.ReadFile(laddersFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &ladders)
+}
+
+// saveLaddersLocked writes the ladder analyses. laddersMu must be held.
+func saveLaddersLocked() error {
+	data, err := json.MarshalIndent(ladders, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := laddersFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, laddersFile())
+}
+
+// lookupLadder returns the ladder analysis of a video
+func lookupLadder(videoID string) (*ladderAnalysis, bool) {
+	laddersMu.Lock()
+	defer laddersMu.Unlock()
+	analysis, ok := ladders[videoID]
+	return analysis, ok
+}
+
+// forgetLadder removes the ladder analysis of a deleted video
+func forgetLadder(videoID string) {
+	laddersMu.Lock()
+	defer laddersMu.Unlock()
+	if _, ok := ladders[videoID]; !ok {
+		return
+	}
+	delete(ladders, videoID)
+	if err := saveLaddersLocked(); err != nil {
+		slog.Error("Failed to save ladders", "error", err)
+	}
+}
+
+// abrLadder returns the rungs to package a video with: its analyzed ladder,
+// or the default rungs up to the source height
+func abrLadder(videoID string, sourceHeight int) []ladderRung {
+	if analysis, ok := lookupLadder(videoID); ok && len(analysis.Ladder) > 0 {
+		return analysis.Ladder
+	}
+	var rungs []ladderRung
+	for _, rung := range defaultLadder {
+		height, _ := strconv.Atoi(rung.Resolution)
+		if sourceHeight > 0 && height > sourceHeight && len(rungs) > 0 {
+			break
+		}
+		rungs = append(rungs, rung)
+	}
+	return rungs
+}
+
+// abrArgs builds the ffmpeg arguments for an HLS package with one variant
+// per rung. The source is decoded and filtered once, then scaled and
+// encoded for every variant; master.m3u8 in outputDir lists them all.
+func abrArgs(sourcePath, outputDir string, preFilters []string, rungs []ladderRung, rate rateControl, hasAudio bool) []string {
+	var graph strings.Builder
+	graph.WriteString("[0:v]")
+	for _, filter := range preFilters {
+		graph.WriteString(filter + ",")
+	}
+	fmt.Fprintf(&graph, "split=%d", len(rungs))
+	for i := range rungs {
+		fmt.Fprintf(&graph, "[s%d]", i)
+	}
+	for i, rung := range rungs {
+		fmt.Fprintf(&graph, ";[s%d]scale=-2:%s[v%d]", i, rung.Resolution, i)
+	}
+
+	args := []string{"-i", sourcePath, "-filter_complex", graph.String()}
+	var streams []string
+	for i, rung := range rungs {
+		args = append(args, "-map", fmt.Sprintf("[v%d]", i))
+		args = append(args, rate.withBitrate(rung.Bitrate).args(fmt.Sprintf(":%d", i))...)
+		stream := fmt.Sprintf("v:%d", i)
+		if hasAudio {
+			stream += fmt.Sprintf(",a:%d", i)
+		}
+		streams = append(streams, stream)
+	}
+	if hasAudio {
+		for range rungs {
+			args = append(args, "-map", "0:a:0")
+		}
+		args = append(args, "-c:a", "aac", "-b:a", "128k")
+	}
+	args = append(args,
+		"-c:v", "libx264",
+		"-preset", "fast")
+	args = append(args, keyframeArgs(abrSegmentDuration)...)
+	return append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(abrSegmentDuration),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outputDir, "v%v", "segment_%05d.ts"),
+		"-master_pl_name", "master.m3u8",
+		"-var_stream_map", strings.Join(streams, " "),
+		"-progress", "pipe:1", // Output progress to stdout
+		filepath.Join(outputDir, "v%v", "playlist.m3u8"))
+}
+
+// analyzeLadder runs the per-title analysis of a ladder job. A sample of
+// the source is encoded at every preset resolution up to the source height
+// with each configured CRF, and every trial is scored against the sample.
+// The rungs are picked from the convex hull of score over bitrate.
+func analyzeLadder(ctx context.Context, j *job) error {
+	settings := getConfig().Ladder
+	workDir := j.spec.OutputDir
+	defer os.RemoveAll(workDir)
+	if err := os.MkdirAll(workDir, os.ModePerm); err != nil {
+		return err
+	}
+
+	source, err := probeVideo(ctx, j.spec.Source)
+	if err != nil {
+		return err
+	}
+	if !source.HasVideo {
+		return fmt.Errorf("source has no video stream")
+	}
+
+	// Trial resolutions: the presets up to the source height
+	var resolutions []string
+	for _, resolution := range getConfig().Presets.Resolutions {
+		if height, _ := strconv.Atoi(resolution); source.Height == 0 || height <= source.Height {
+			resolutions = append(resolutions, resolution)
+		}
+	}
+	if len(resolutions) == 0 {
+		return fmt.Errorf("the source is smaller than every preset resolution")
+	}
+	sort.Slice(resolutions, func(a, b int) bool {
+		ha, _ := strconv.Atoi(resolutions[a])
+		hb, _ := strconv.Atoi(resolutions[b])
+		return ha < hb
+	})
+
+	// The sample is taken from the middle of the source and stored
+	// losslessly, so the trials are scored against the original frames
+	sampleSeconds := math.Min(float64(settings.SampleSeconds), source.Duration)
+	if sampleSeconds <= 0 {
+		sampleSeconds = float64(settings.SampleSeconds)
+	}
+	sampleStart := math.Max(0, (source.Duration-sampleSeconds)/2)
+	samplePath := filepath.Join(workDir, "sample.mkv")
+	err = runFFmpeg(ctx, exec.Command("ffmpeg", "-y",
+		"-ss", formatSeconds(sampleStart),
+		"-i", j.spec.Source,
+		"-t", formatSeconds(sampleSeconds),
+		"-map", "0:v:0",
+		"-c:v", "libx264", "-preset", "ultrafast", "-qp", "0",
+		samplePath), j.spec.ProgressID, 0)
+	if err != nil {
+		return fmt.Errorf("could not extract the sample: %v", err)
+	}
+	sample, err := probeVideo(ctx, samplePath)
+	if err != nil {
+		return err
+	}
+	if sample.Duration > 0 {
+		sampleSeconds = sample.Duration
+	}
+
+	total := len(resolutions)*len(settings.CRFs) + 1
+	done := 1
+	setTranscodingProgress(j.spec.ProgressID, done*100/total)
+
+	var points []ladderPoint
+	for _, resolution := range resolutions {
+		for _, crf := range settings.CRFs {
+			point, err := runLadderTrial(ctx, j, samplePath, sample, sampleSeconds, resolution, crf, settings.Metric)
+			if err != nil {
+				return err
+			}
+			points = append(points, point)
+			done++
+			setTranscodingProgress(j.spec.ProgressID, done*100/total)
+		}
+	}
+
+	hull := convexHull(points)
+	for _, i := range hull {
+		points[i].OnHull = true
+	}
+	analysis := &ladderAnalysis{
+		VideoID:       j.VideoID,
+		JobID:         j.ID,
+		Metric:        settings.Metric,
+		SampleStart:   sampleStart,
+		SampleSeconds: sampleSeconds,
+		Points:        points,
+		Ladder:        selectRungs(points, hull, settings.MaxRungs, settings.TargetQuality),
+		AnalyzedAt:    time.Now(),
+	}
+	slog.InfoContext(ctx, "Ladder analyzed", "video_id", j.VideoID, "trials", len(points), "rungs", len(analysis.Ladder))
+
+	laddersMu.Lock()
+	defer laddersMu.Unlock()
+	ladders[j.VideoID] = analysis
+	return saveLaddersLocked()
+}
+
+// runLadderTrial encodes the sample at one resolution and CRF and scores
+// the result
+func runLadderTrial(ctx context.Context, j *job, samplePath string, sample *videoProbe, sampleSeconds float64, resolution string, crf int, metric string) (ladderPoint, error) {
+	point := ladderPoint{Resolution: resolution, CRF: crf}
+	trialPath := filepath.Join(j.spec.OutputDir, fmt.Sprintf("trial_%sp_crf%d.mp4", resolution, crf))
+	defer os.Remove(trialPath)
+
+	err := runFFmpeg(ctx, exec.Command("ffmpeg", "-y",
+		"-i", samplePath,
+		"-vf", "scale=-2:"+resolution,
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", strconv.Itoa(crf),
+		trialPath), j.spec.ProgressID, 0)
+	if err != nil {
+		return point, fmt.Errorf("trial encode at %sp CRF %d failed: %v", resolution, crf, err)
+	}
+
+	info, err := os.Stat(trialPath)
+	if err != nil {
+		return point, err
+	}
+	point.BitrateKbps = int(float64(info.Size()) * 8 / sampleSeconds / 1000)
+
+	scores, err := measureQuality(ctx, trialPath, samplePath, sample, []string{metric})
+	if err != nil {
+		return point, err
+	}
+	switch metric {
+	case "vmaf":
+		point.Score = *scores.VMAF
+	case "psnr":
+		point.Score = *scores.PSNR
+	case "ssim":
+		point.Score = *scores.SSIM
+	}
+	return point, nil
+}
+
+// convexHull returns the indices of the points on the upper convex hull of
+// score over log bitrate, from the lowest bitrate up to the best score.
+// Points below the hull are beaten by another resolution at that bitrate.
+func convexHull(points []ladderPoint) []int {
+	order := make([]int, len(points))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		pa, pb := points[order[a]], points[order[b]]
+		if pa.BitrateKbps != pb.BitrateKbps {
+			return pa.BitrateKbps < pb.BitrateKbps
+		}
+		return pa.Score > pb.Score
+	})
+
+	x := func(i int) float64 { return math.Log(math.Max(float64(points[i].BitrateKbps), 1)) }
+	y := func(i int) float64 { return points[i].Score }
+
+	var hull []int
+	for _, i := range order {
+		if len(hull) > 0 && points[hull[len(hull)-1]].BitrateKbps == points[i].BitrateKbps {
+			continue
+		}
+		// Drop points that do not make a clockwise turn
+		for len(hull) >= 2 {
+			o, a := hull[len(hull)-2], hull[len(hull)-1]
+			if (x(a)-x(o))*(y(i)-y(o))-(y(a)-y(o))*(x(i)-x(o)) < 0 {
+				break
+			}
+			hull = hull[:len(hull)-1]
+		}
+		hull = append(hull, i)
+	}
+	if len(hull) == 0 {
+		return nil
+	}
+
+	// Beyond the best score more bitrate buys nothing
+	best := 0
+	for k, i := range hull {
+		if y(i) > y(hull[best]) {
+			best = k
+		}
+	}
+	return hull[:best+1]
+}
+
+// selectRungs picks the ladder from the hull: its lowest point, then every
+// point at least ladderStepRatio times the bitrate of the previous rung,
+// until the target quality is reached or maxRungs are taken
+func selectRungs(points []ladderPoint, hull []int, maxRungs int, targetQuality float64) []ladderRung {
+	var rungs []ladderRung
+	previous := 0
+	for _, i := range hull {
+		p := points[i]
+		if len(rungs) > 0 && float64(p.BitrateKbps) < float64(previous)*ladderStepRatio {
+			continue
+		}
+		rungs = append(rungs, ladderRung{
+			Resolution: p.Resolution,
+			Bitrate:    fmt.Sprintf("%dk", max(p.BitrateKbps, 1)),
+			Score:      p.Score,
+		})
+		previous = p.BitrateKbps
+		if len(rungs) == maxRungs || p.Score >= targetQuality {
+			break
+		}
+	}
+	return rungs
+}
+
+// analyzeVideoLadder queues a per-title ladder analysis of a video. The
+// analysis runs many trial encodes, so the request does not wait for it.
+func analyzeVideoLadder(c *fiber.Ctx) error {
+	if err := checkFFmpeg(); err != nil {
+		slog.ErrorContext(c.UserContext(), "FFmpeg not available", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("FFmpeg error: %v", err),
+		})
+	}
+
+	id := c.Params("id")
+	sourcePath := filepath.Join(uploadsDir, id)
+	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
+		slog.InfoContext(c.UserContext(), "Source video not found", "path", sourcePath)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Source video not found",
+		})
+	}
+	slog.InfoContext(c.UserContext(), "Ladder analysis requested", "video_id", id)
+
+	j := enqueueJob(c.UserContext(), &job{
+		Kind:    "ladder",
+		VideoID: id,
+	}, jobSpec{
+		ProgressID: id,
+		OutputDir:  newStagingDir(transcodedDir),
+		Source:     sourcePath,
+	})
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"success": true,
+		"videoId": id,
+		"jobId":   j.ID,
+	})
+}
+
+// getVideoLadder returns the ladder analysis of a video
+func getVideoLadder(c *fiber.Ctx) error {
+	id := c.Params("id")
+	analysis, ok := lookupLadder(id)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Ladder not analyzed",
+		})
+	}
+	return c.JSON(analysis)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestConvexHull(t *testing.T) {
+	tests := []struct {
+		name   string
+		points []ladderPoint
+		want   []int
+	}{
+		{name: "no points"},
+		{
+			name:   "single point",
+			points: []ladderPoint{{Resolution: "720", BitrateKbps: 1000, Score: 80}},
+			want:   []int{0},
+		},
+		{
+			name: "resolutions beaten at the same bitrate",
+			points: []ladderPoint{
+				{Resolution: "360", BitrateKbps: 500, Score: 60},
+				{Resolution: "360", BitrateKbps: 1000, Score: 70},
+				{Resolution: "720", BitrateKbps: 1000, Score: 75},
+				{Resolution: "720", BitrateKbps: 2000, Score: 85},
+				{Resolution: "1080", BitrateKbps: 2000, Score: 80},
+				{Resolution: "1080", BitrateKbps: 4000, Score: 92},
+			},
+			want: []int{0, 2, 3, 5},
+		},
+		{
+			name: "points under the hull",
+			points: []ladderPoint{
+				{Resolution: "360", BitrateKbps: 500, Score: 60},
+				{Resolution: "480", BitrateKbps: 1000, Score: 62},
+				{Resolution: "720", BitrateKbps: 2000, Score: 80},
+			},
+			want: []int{0, 2},
+		},
+		{
+			name: "more bitrate without a better score",
+			points: []ladderPoint{
+				{Resolution: "1080", BitrateKbps: 8000, Score: 92},
+				{Resolution: "1080", BitrateKbps: 4000, Score: 92},
+				{Resolution: "720", BitrateKbps: 2000, Score: 85},
+				{Resolution: "1080", BitrateKbps: 16000, Score: 91},
+			},
+			want: []int{2, 1},
+		},
+		{
+			name: "zero bitrate",
+			points: []ladderPoint{
+				{Resolution: "240", BitrateKbps: 0, Score: 30},
+				{Resolution: "360", BitrateKbps: 500, Score: 60},
+			},
+			want: []int{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := convexHull(tt.points); !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectRungs(t *testing.T) {
+	points := []ladderPoint{
+		{Resolution: "360", BitrateKbps: 500, Score: 60},
+		{Resolution: "360", BitrateKbps: 600, Score: 64},
+		{Resolution: "480", BitrateKbps: 800, Score: 70},
+		{Resolution: "720", BitrateKbps: 1200, Score: 80},
+		{Resolution: "720", BitrateKbps: 2400, Score: 88},
+		{Resolution: "1080", BitrateKbps: 4800, Score: 95},
+	}
+	hull := []int{0, 1, 2, 3, 4, 5}
+	tests := []struct {
+		name          string
+		maxRungs      int
+		targetQuality float64
+		want          []string
+	}{
+		{"steps below the ratio skipped", 10, 100, []string{"360@500k", "480@800k", "720@1200k", "720@2400k", "1080@4800k"}},
+		{"stops at the target quality", 10, 85, []string{"360@500k", "480@800k", "720@1200k", "720@2400k"}},
+		{"target reached by the lowest rung", 10, 50, []string{"360@500k"}},
+		{"limited rungs", 3, 100, []string{"360@500k", "480@800k", "720@1200k"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, r := range selectRungs(points, hull, tt.maxRungs, tt.targetQuality) {
+				got = append(got, r.Resolution+"@"+r.Bitrate)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if rungs := selectRungs(points, nil, 6, 90); rungs != nil {
+		t.Errorf("empty hull gave %v", rungs)
+	}
+	zero := []ladderPoint{{Resolution: "240", BitrateKbps: 0, Score: 30}}
+	if rungs := selectRungs(zero, []int{0}, 6, 90); len(rungs) != 1 || rungs[0].Bitrate != "1k" {
+		t.Errorf("zero bitrate rung = %v, want 1k", rungs)
+	}
+}
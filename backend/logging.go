@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Context keys for the IDs attached to log records
+type logContextKey int
+
+const (
+	requestIDKey logContextKey = iota
+	jobIDKey
+)
+
+// initLogging installs a JSON slog handler as the default logger. The level
+// is read from LOG_LEVEL (debug, info, warn or error; info by default).
+func initLogging() {
+	level := slog.LevelInfo
+	switch strings.ToLower(os.Getenv("LOG_LEVEL")) {
+	case "debug":
+		level = slog.LevelDebug
+	case "warn":
+		level = slog.LevelWarn
+	case "error":
+		level = slog.LevelError
+	}
+
+	handler := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+}
+
+// contextHandler adds the request ID, job ID and trace ID carried by the
+// context to every record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := ctx.Value(requestIDKey).(string); ok {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if id, ok := ctx.Value(jobIDKey).(string); ok {
+		r.AddAttrs(slog.String("job_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		r.AddAttrs(slog.String("trace_id", span.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// withJobID returns a context whose log records carry the job ID
+func withJobID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, jobIDKey, id)
+}
+
+// jobIDFromContext returns the job ID carried by ctx, or ""
+func jobIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(jobIDKey).(string)
+	return id
+}
+
+// requestLogger assigns every request an ID, echoed in X-Request-ID, and
+// writes a structured access log record once the request has been handled.
+// It must run after tracingMiddleware so the request context is kept.
+func requestLogger(c *fiber.Ctx) error {
+	start := time.Now()
+
+	id := c.Get(fiber.HeaderXRequestID)
+	if id == "" || len(id) > 128 {
+		id = utils.UUIDv4()
+	}
+	c.Set(fiber.HeaderXRequestID, id)
+	c.SetUserContext(context.WithValue(c.UserContext(), requestIDKey, id))
+
+	err := c.Next()
+	if err != nil {
+		// Let the error handler set the status before it is logged
+		if handlerErr := c.App().ErrorHandler(c, err); handlerErr != nil {
+			c.Status(fiber.StatusInternalServerError)
+		}
+	}
+
+	// Streamed bodies are not buffered, so only their declared length is known
+	size := c.Response().Header.ContentLength()
+	if !c.Response().IsBodyStream() {
+		size = len(c.Response().Body())
+	}
+
+	status := c.Response().StatusCode()
+	level := slog.LevelInfo
+	if status >= 500 {
+		level = slog.LevelError
+	}
+	slog.Log(c.UserContext(), level, "Request handled",
+		"method", c.Method(),
+		"path", c.Path(),
+		"status", status,
+		"latency_ms", time.Since(start).Milliseconds(),
+		"ip", c.IP(),
+		"bytes", size,
+	)
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// captureLogs sends the default logger's records to a buffer as JSON
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	saved := slog.Default()
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}))
+	t.Cleanup(func() { slog.SetDefault(saved) })
+	return &buf
+}
+
+// logRecords decodes the JSON records of a buffer
+func logRecords(t *testing.T, buf *bytes.Buffer) []map[string]any {
+	var records []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var r map[string]any
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			t.Fatalf("log line %q: %v", line, err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestContextHandler(t *testing.T) {
+	buf := captureLogs(t)
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(),
+		trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}))
+	ctx = withJobID(context.WithValue(ctx, requestIDKey, "req-1"), "job-1")
+
+	slog.InfoContext(ctx, "With IDs")
+	slog.Info("Without IDs")
+
+	records := logRecords(t, buf)
+	if len(records) != 2 {
+		t.Fatalf("%d records, want 2", len(records))
+	}
+	want := map[string]string{"request_id": "req-1", "job_id": "job-1", "trace_id": traceID.String()}
+	for key, value := range want {
+		if records[0][key] != value {
+			t.Errorf("%s = %v, want %s", key, records[0][key], value)
+		}
+		if _, ok := records[1][key]; ok {
+			t.Errorf("record without context has %s", key)
+		}
+	}
+	if got := jobIDFromContext(ctx); got != "job-1" {
+		t.Errorf("jobIDFromContext = %q, want job-1", got)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	buf := captureLogs(t)
+	app := fiber.New()
+	app.Use(requestLogger)
+	app.Get("/ok", func(c *fiber.Ctx) error { return c.SendString("hello") })
+	app.Get("/fail", func(c *fiber.Ctx) error { return fiber.NewError(fiber.StatusBadGateway, "upstream") })
+
+	tests := []struct {
+		path      string
+		requestID string
+		status    int
+		level     string
+		keepID    bool
+	}{
+		{"/ok", "abc-123", fiber.StatusOK, "INFO", true},
+		{"/ok", strings.Repeat("x", 129), fiber.StatusOK, "INFO", false},
+		{"/fail", "", fiber.StatusBadGateway, "ERROR", false},
+	}
+	for _, tt := range tests {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		if tt.requestID != "" {
+			req.Header.Set(fiber.HeaderXRequestID, tt.requestID)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := resp.Header.Get(fiber.HeaderXRequestID)
+		if id == "" || (id == tt.requestID) != tt.keepID {
+			t.Errorf("%s: request ID %q for %q", tt.path, id, tt.requestID)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, resp.StatusCode, tt.status)
+		}
+
+		records := logRecords(t, buf)
+		if len(records) != 1 {
+			t.Fatalf("%s: %d records, want 1", tt.path, len(records))
+		}
+		r := records[0]
+		if r["request_id"] != id || r["path"] != tt.path || r["status"] != float64(tt.status) || r["level"] != tt.level {
+			t.Errorf("%s: logged %v", tt.path, r)
+		}
+	}
+}
+
+func TestScanLines(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("frame=1\rframe=2\r\nStream #0\nlast"))
+	scanner.Split(scanLines)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if want := []string{"frame=1", "frame=2", "Stream #0", "last"}; !slices.Equal(lines, want) {
+		t.Errorf("lines %q, want %q", lines, want)
+	}
+}
+
+// useJobLogs gives a test an empty job logs directory
+func useJobLogs(t *testing.T) {
+	saved := jobLogsDir
+	jobLogsDir = t.TempDir()
+	t.Cleanup(func() { jobLogsDir = saved })
+}
+
+func TestJobLogRotation(t *testing.T) {
+	useJobLogs(t)
+	log, err := openJobLog("job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lines of 1024 bytes with their newline, numbered
+	lines := maxJobLogSize/1024 + 10
+	for i := range lines {
+		log.WriteLine(fmt.Sprintf("%04d %s", i, strings.Repeat("x", 1018)))
+	}
+	log.Close()
+
+	if info, err := os.Stat(jobLogPath("job") + ".1"); err != nil || info.Size() > maxJobLogSize {
+		t.Fatalf("rotated log: %v", err)
+	}
+	tail, offset, err := readJobLogTail("job", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if offset != 10*1024 {
+		t.Errorf("offset %d in the current file, want %d", offset, 10*1024)
+	}
+	for i, got := range tail {
+		if want := fmt.Sprintf("%04d ", lines-3+i); !strings.HasPrefix(got, want) {
+			t.Errorf("tail line %d starts with %q, want %q", i, got[:5], want)
+		}
+	}
+	all, _, _ := readJobLogTail("job", 0)
+	if len(all) != lines {
+		t.Errorf("%d lines across both files, want %d", len(all), lines)
+	}
+
+	removeJobLogs("job")
+	if _, _, err := readJobLogTail("job", 0); err == nil {
+		t.Error("log still readable after removal")
+	}
+}
+
+func TestGetJobLogs(t *testing.T) {
+	useJobLogs(t)
+	useJobs(t, &job{ID: "running", State: jobRunning}, &job{ID: "silent", State: jobQueued})
+	log, err := openJobLog("running")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"one", "two", "three"} {
+		log.WriteLine(line)
+	}
+	log.Close()
+
+	app := fiber.New()
+	app.Get("/jobs/:jobId/logs", getJobLogs)
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/jobs/running/logs", fiber.StatusOK, "one\ntwo\nthree\n"},
+		{"/jobs/running/logs?tail=2", fiber.StatusOK, "two\nthree\n"},
+		{"/jobs/silent/logs", fiber.StatusOK, ""},
+		{"/jobs/running/logs?tail=-1", fiber.StatusBadRequest, ""},
+		{"/jobs/missing/logs", fiber.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		resp, err := app.Test(httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.path, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status == fiber.StatusOK && string(body) != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.path, body, tt.body)
+		}
+	}
+}
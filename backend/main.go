@@ -1,65 +1,256 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
 	"github.com/gofiber/fiber/v2/middleware/cors"
-	"github.com/gofiber/fiber/v2/middleware/logger"
 	"github.com/gofiber/websocket/v2"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Define global directory for videos
 var uploadsDir = "./uploads/videos"
 var transcodedDir = "./uploads/transcoded"
 
-// Map to store transcoding progress
-var transcodingProgress = make(map[string]int)
+// Map to store transcoding progress, written by jobs and read by handlers
+var (
+	transcodingProgress   = make(map[string]int)
+	transcodingProgressMu sync.RWMutex
+)
+
+// getTranscodingProgress returns the progress of a job by its progress ID
+func getTranscodingProgress(id string) (int, bool) {
+	transcodingProgressMu.RLock()
+	defer transcodingProgressMu.RUnlock()
+	progress, exists := transcodingProgress[id]
+	return progress, exists
+}
+
+// setTranscodingProgress records the progress of a job by its progress ID
+func setTranscodingProgress(id string, progress int) {
+	transcodingProgressMu.Lock()
+	transcodingProgress[id] = progress
+	transcodingProgressMu.Unlock()
+}
+
+// setDataDirs places the directories of watermarks, covers, thumbnails,
+// logs, job inputs and rejected uploads next to the configured uploads directory
+func setDataDirs(uploads string) {
+	root := filepath.Dir(filepath.Clean(uploads))
+	watermarksDir = filepath.Join(root, "watermarks")
+	playlistCoversDir = filepath.Join(root, "playlists")
+	chaptersDir = filepath.Join(root, "chapters")
+	scenesDir = filepath.Join(root, "scenes")
+	quarantineDir = filepath.Join(root, "quarantine")
+	jobLogsDir = filepath.Join(root, "logs")
+	jobInputsDir = filepath.Join(root, "inputs")
+}
 
 func main() {
+	// Structured JSON logs, level chosen with LOG_LEVEL
+	initLogging()
+
+	// Configuration from file, environment and flags
+	configArgs = os.Args[1:]
+	cfg, printConfig, err := loadConfig(configArgs)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(2)
+	}
+	if printConfig {
+		if err := cfg.print(os.Stdout); err != nil {
+			slog.Error("Failed to print configuration", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+	currentConfig = cfg
+	uploadsDir = cfg.UploadsDir
+	transcodedDir = cfg.TranscodedDir
+	setDataDirs(uploadsDir)
+	setMaxConcurrentJobs(cfg.MaxConcurrentJobs)
+	watchConfigReload()
+
 	app := fiber.New(fiber.Config{
-		BodyLimit: 2000 * 1024 * 1024, // 2GB for video uploads
+		BodyLimit: cfg.MaxUploadMB * 1024 * 1024,
+		// Params and form values outlive the request as job fields and
+		// map keys, so they must not share fasthttp's reused buffers
+		Immutable: true,
 	})
 
+	// Tracing exporter is chosen with OTEL_TRACES_EXPORTER
+	shutdownTracing, err := initTracing()
+	if err != nil {
+		slog.Error("Failed to initialize tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Middleware
-	app.Use(logger.New())
+	app.Use(tracingMiddleware)
+	app.Use(requestLogger)
 	app.Use(cors.New(cors.Config{
-		AllowOrigins:     "http://localhost:3000", // Next.js frontend
-		AllowHeaders:     "Origin, Content-Type, Accept, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization",
-		AllowMethods:     "GET, POST, PUT, DELETE, OPTIONS",
+		// Origins are looked up on every request so they can be reloaded
+		AllowOriginsFunc: func(origin string) bool {
+			return getConfig().allowsOrigin(origin)
+		},
+		AllowHeaders:     "Origin, Content-Type, Accept, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, X-User-ID, Range, If-Range, If-None-Match, If-Modified-Since",
+		AllowMethods:     "GET, POST, PUT, PATCH, DELETE, OPTIONS",
 		AllowCredentials: true,
-		ExposeHeaders:    "Content-Length, Content-Type",
+		ExposeHeaders:    "Content-Length, Content-Type, Content-Range, Accept-Ranges, ETag, Last-Modified, Link, X-Total-Count, X-Next-Cursor",
 		MaxAge:           86400, // 24 hours
 	}))
 
 	// Log uploads directory
-	log.Printf("Using uploads directory: %s", uploadsDir)
+	slog.Info("Using uploads directory", "path", uploadsDir)
 	absPath, err := filepath.Abs(uploadsDir)
 	if err == nil {
-		log.Printf("Absolute path: %s", absPath)
+		slog.Info("Absolute uploads path", "path", absPath)
 	}
 
 	// Ensure videos directory exists
 	if err := os.MkdirAll(uploadsDir, os.ModePerm); err != nil {
-		log.Fatal("Failed to create videos directory:", err)
+		slog.Error("Failed to create videos directory", "error", err)
+		os.Exit(1)
 	}
 
 	// Ensure transcoded directory exists
 	if err := os.MkdirAll(transcodedDir, os.ModePerm); err != nil {
-		log.Fatal("Failed to create transcoded directory:", err)
+		slog.Error("Failed to create transcoded directory", "error", err)
+		os.Exit(1)
+	}
+
+	// Ensure watermarks directory exists
+	if err := os.MkdirAll(watermarksDir, os.ModePerm); err != nil {
+		slog.Error("Failed to create watermarks directory", "error", err)
+		os.Exit(1)
+	}
+
+	// Ensure playlist covers directory exists
+	if err := os.MkdirAll(playlistCoversDir, os.ModePerm); err != nil {
+		slog.Error("Failed to create playlist covers directory", "error", err)
+		os.Exit(1)
+	}
+
+	// Ensure chapter thumbnails directory exists
+	if err := os.MkdirAll(chaptersDir, os.ModePerm); err != nil {
+		slog.Error("Failed to create chapters directory", "error", err)
+		os.Exit(1)
 	}
 
-	// Static files serving
-	app.Static("/videos", uploadsDir)
-	app.Static("/transcoded", transcodedDir)
+	// Ensure shot keyframes directory exists
+	if err := os.MkdirAll(scenesDir, os.ModePerm); err != nil {
+		slog.Error("Failed to create scenes directory", "error", err)
+		os.Exit(1)
+	}
+
+	// Ensure quarantine directory exists
+	if err := os.MkdirAll(quarantineDir, os.ModePerm); err != nil {
+		slog.Error("Failed to create quarantine directory", "error", err)
+		os.Exit(1)
+	}
+
+	// Ensure job logs directory exists
+	if err := os.MkdirAll(jobLogsDir, os.ModePerm); err != nil {
+		slog.Error("Failed to create job logs directory", "error", err)
+		os.Exit(1)
+	}
+
+	// Load records of clipped and concatenated videos
+	if err := loadDerivations(); err != nil {
+		slog.Warn("Failed to load derived video records", "error", err)
+	}
+
+	// Load the states of transcoded renditions
+	if err := loadRenditions(); err != nil {
+		slog.Warn("Failed to load rendition states", "error", err)
+	}
+
+	// Load the per-title ladder analyses
+	if err := loadLadders(); err != nil {
+		slog.Warn("Failed to load ladder analyses", "error", err)
+	}
+
+	// Load the edited video metadata and workspace schemas
+	if err := loadMetadata(); err != nil {
+		slog.Warn("Failed to load video metadata", "error", err)
+	}
+
+	// Load scene analyses
+	if err := loadScenes(); err != nil {
+		slog.Warn("Failed to load scene analyses", "error", err)
+	}
+
+	// Load the watch progress of viewers
+	if err := loadProgress(); err != nil {
+		slog.Warn("Failed to load watch progress", "error", err)
+	}
+
+	// Load video chapters
+	if err := loadChapters(); err != nil {
+		slog.Warn("Failed to load chapters", "error", err)
+	}
+
+	// Load the content hashes and frame fingerprints of videos
+	if err := loadFingerprints(); err != nil {
+		slog.Warn("Failed to load fingerprints", "error", err)
+	}
+
+	// Load the records of rejected uploads
+	if err := loadQuarantine(); err != nil {
+		slog.Warn("Failed to load quarantine records", "error", err)
+	}
+
+	// Load playlists
+	if err := loadPlaylists(); err != nil {
+		slog.Warn("Failed to load playlists", "error", err)
+	}
+
+	// Build the search index of the video list
+	if err := loadIndex(context.Background()); err != nil {
+		slog.Warn("Failed to build search index", "error", err)
+	}
+
+	// Load webhooks and resume their pending deliveries
+	if err := loadWebhooks(); err != nil {
+		slog.Warn("Failed to load webhooks", "error", err)
+	}
+
+	// Resume jobs interrupted by the last shutdown or crash
+	if err := recoverJobs(); err != nil {
+		slog.Error("Failed to recover jobs", "error", err)
+	}
+
+	// Hash videos uploaded before duplicates were detected
+	go backfillContentHashes()
+
+	// Count the segments and bytes served per rendition
+	app.Use("/transcoded", recordDelivery)
+	go runDeliveryFlusher()
+
+	// LL-HLS playlists and segments are generated on request
+	app.Get("/transcoded/:base/"+llhlsDirName+"/:file", serveLLHLS)
+
+	// Media files serving, with range and conditional request support
+	app.Get("/videos/*", mediaHandler(uploadsDir))
+	app.Get("/transcoded/*", mediaHandler(transcodedDir))
 
 	// Websocket route for transcoding progress
 	app.Use("/ws", func(c *fiber.Ctx) error {
@@ -74,9 +265,12 @@ func main() {
 		// Get video ID from URL
 		videoId := c.Params("id")
 
+		websocketConnections.Inc()
+		defer websocketConnections.Dec()
+
 		// Send progress updates to the client
 		for {
-			progress, exists := transcodingProgress[videoId]
+			progress, exists := getTranscodingProgress(videoId)
 			if !exists {
 				progress = 0
 			}
@@ -85,7 +279,7 @@ func main() {
 				"videoId":  videoId,
 				"progress": progress,
 			}); err != nil {
-				log.Println("Error writing to websocket:", err)
+				slog.Debug("Error writing to websocket", "video_id", videoId, "error", err)
 				break
 			}
 
@@ -100,6 +294,9 @@ func main() {
 		}
 	}))
 
+	// Prometheus metrics
+	app.Get("/metrics", adaptor.HTTPHandler(promhttp.Handler()))
+
 	// API Routes
 	api := app.Group("/api")
 
@@ -108,13 +305,87 @@ func main() {
 	videos.Get("/", getVideos)
 	videos.Get("/:id", getVideo)
 	videos.Post("/", uploadVideo)
+	videos.Post("/concat", concatVideos)
+	videos.Post("/:id/clips", createClip)
+	videos.Patch("/:id", updateVideoMetadata)
 	videos.Delete("/:id", deleteVideo)
 	videos.Post("/transcode/:id", transcodeVideo)
+	videos.Post("/:id/ladder", analyzeVideoLadder)
+	videos.Get("/:id/ladder", getVideoLadder)
+	videos.Post("/:id/scenes", analyzeVideoScenes)
+	videos.Get("/:id/scenes", getVideoScenes)
+	videos.Get("/:id/scenes/:index/keyframe", getShotKeyframe)
+	videos.Get("/:id/thumbnail", getVideoThumbnail)
+	videos.Post("/:id/fingerprint", fingerprintVideo)
+	videos.Get("/:id/similar", getSimilarVideos)
+	videos.Put("/:id/progress", putVideoProgress)
+	videos.Delete("/:id/progress", deleteVideoProgress)
+	videos.Get("/:id/chapters", getVideoChapters)
+	videos.Put("/:id/chapters", putVideoChapters)
+	videos.Delete("/:id/chapters", deleteVideoChapters)
+	videos.Post("/:id/chapters/generate", generateVideoChapters)
+	videos.Get("/:id/chapters.vtt", getVideoChaptersVTT)
+	videos.Put("/:id/chapters/:chapterId/thumbnail", putChapterThumbnail)
+	videos.Get("/:id/chapters/:chapterId/thumbnail", getChapterThumbnail)
+
+	// Workspace watermark routes
+	workspaces := api.Group("/workspaces")
+	workspaces.Put("/:workspace/watermark", uploadWorkspaceWatermark)
+	workspaces.Get("/:workspace/watermark", getWorkspaceWatermark)
+	workspaces.Delete("/:workspace/watermark", deleteWorkspaceWatermark)
+	workspaces.Put("/:workspace/schema", putWorkspaceSchema)
+	workspaces.Get("/:workspace/schema", getWorkspaceSchema)
+	workspaces.Delete("/:workspace/schema", deleteWorkspaceSchema)
+
+	// Watch history routes of the viewer named by X-User-ID
+	api.Get("/history/continue-watching", getContinueWatching)
+	api.Get("/history/recently-watched", getRecentlyWatched)
+
+	// Playback analytics routes
+	analytics := api.Group("/analytics")
+	analytics.Post("/events", collectPlaybackEvents)
+	analytics.Get("/videos", getAnalyticsVideos)
+	analytics.Get("/videos/:id", getAnalyticsVideo)
+	analytics.Get("/delivery", getDeliveryReport)
+
+	// Rejected upload routes
+	api.Get("/quarantine", getQuarantine)
+	api.Delete("/quarantine/:quarantineId", deleteQuarantined)
+
+	// Job routes
+	api.Get("/jobs", getJobs)
+	api.Get("/jobs/:jobId", getJob)
+	api.Get("/jobs/:jobId/logs", getJobLogs)
+
+	// Playlist routes
+	lists := api.Group("/playlists")
+	lists.Post("/", createPlaylist)
+	lists.Get("/", getPlaylists)
+	lists.Get("/:playlistId", getPlaylist)
+	lists.Patch("/:playlistId", updatePlaylist)
+	lists.Delete("/:playlistId", deletePlaylist)
+	lists.Post("/:playlistId/items", addPlaylistItem)
+	lists.Delete("/:playlistId/items/:videoId", removePlaylistItem)
+	lists.Put("/:playlistId/order", reorderPlaylist)
+	lists.Put("/:playlistId/cover", uploadPlaylistCover)
+	lists.Get("/:playlistId/cover", getPlaylistCover)
+	lists.Delete("/:playlistId/cover", deletePlaylistCover)
+	lists.Get("/:playlistId/playlist.m3u8", getPlaylistHLS)
+	lists.Get("/:playlistId/feed.json", getPlaylistFeed)
+
+	// Webhook routes
+	hooks := api.Group("/webhooks")
+	hooks.Post("/", createWebhook)
+	hooks.Get("/", getWebhooks)
+	hooks.Get("/:webhookId", getWebhook)
+	hooks.Delete("/:webhookId", deleteWebhook)
+	hooks.Get("/:webhookId/deliveries", getWebhookDeliveries)
+	hooks.Post("/:webhookId/deliveries/:deliveryId/redeliver", redeliverWebhook)
 
 	// Progress endpoint for polling
 	api.Get("/transcode/progress/:id", func(c *fiber.Ctx) error {
 		videoId := c.Params("id")
-		progress, exists := transcodingProgress[videoId]
+		progress, exists := getTranscodingProgress(videoId)
 		if !exists {
 			progress = 0
 		}
@@ -126,8 +397,38 @@ func main() {
 	})
 
 	// Start server
-	log.Printf("Starting server on port 8080")
-	log.Fatal(app.Listen(":8080"))
+	slog.Info("Starting server", "port", cfg.Port)
+	go func() {
+		if err := app.Listen(fmt.Sprintf(":%d", cfg.Port)); err != nil {
+			slog.Error("Server stopped", "error", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Shut down on SIGINT or SIGTERM: stop accepting connections, let
+	// running jobs finish or interrupt them, then wait for open requests
+	signals, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-signals.Done()
+	stop()
+	slog.Info("Shutting down")
+
+	timeout := time.Duration(cfg.ShutdownTimeoutSeconds) * time.Second
+	serverStopped := make(chan struct{})
+	go func() {
+		if err := app.ShutdownWithTimeout(timeout + ffmpegKillGrace + 5*time.Second); err != nil {
+			slog.Warn("Open connections were closed", "error", err)
+		}
+		close(serverStopped)
+	}()
+	stopJobs(timeout)
+	<-serverStopped
+	if err := flushDelivery(time.Time{}); err != nil {
+		slog.Error("Failed to write delivery rollups", "error", err)
+	}
+	if err := flushProgress(); err != nil {
+		slog.Error("Failed to save watch progress", "error", err)
+	}
+	slog.Info("Shutdown complete")
 }
 
 // checkFFmpeg checks if FFmpeg is installed
@@ -165,9 +466,12 @@ func parseProgress(output string, duration float64) int {
 }
 
 // getDuration gets the duration of a video file in seconds
-func getDuration(filePath string) (float64, error) {
+func getDuration(ctx context.Context, filePath string) (float64, error) {
 	cmd := exec.Command("ffmpeg", "-i", filePath)
+	_, span := startCommand(ctx, cmd)
+	// ffmpeg exits with an error without an output file; that is expected
 	output, _ := cmd.CombinedOutput()
+	endCommand(span, cmd, nil)
 
 	// Find duration in output
 	re := regexp.MustCompile(`Duration: (\d+):(\d+):(\d+\.\d+)`)
@@ -184,11 +488,152 @@ func getDuration(filePath string) (float64, error) {
 	return float64(hours*3600+minutes*60) + seconds, nil
 }
 
+// runFFmpeg starts cmd, feeds its -progress output into transcodingProgress
+// for id and waits for it to finish
+func runFFmpeg(ctx context.Context, cmd *exec.Cmd, id string, duration float64) (err error) {
+	slog.InfoContext(ctx, "Running FFmpeg", "video_id", id, "command", cmd.String())
+
+	_, span := startCommand(ctx, cmd)
+	defer func() { endCommand(span, cmd, err) }()
+
+	// Run the command and capture output for progress
+	stdoutPipe, err := cmd.StdoutPipe()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create stdout pipe", "error", err)
+		return fmt.Errorf("failed to create pipe: %v", err)
+	}
+
+	stderrPipe, err := cmd.StderrPipe()
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to create stderr pipe", "error", err)
+		return fmt.Errorf("failed to create pipe: %v", err)
+	}
+
+	// Start the command
+	if err := cmd.Start(); err != nil {
+		slog.ErrorContext(ctx, "Failed to start FFmpeg", "error", err)
+		return fmt.Errorf("failed to start FFmpeg: %v", err)
+	}
+
+	// Read output and update progress in a goroutine
+	var readers sync.WaitGroup
+	var speed float64
+	readers.Add(2)
+	go func() {
+		defer readers.Done()
+		buffer := make([]byte, 1024)
+		for {
+			n, err := stdoutPipe.Read(buffer)
+			if n > 0 {
+				output := string(buffer[:n])
+				progress := parseProgress(output, duration)
+				if progress > 0 && progress <= 100 {
+					setTranscodingProgress(id, progress)
+				}
+				if s := parseSpeed(output); s > 0 {
+					speed = s
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+	}()
+
+	// ffmpeg's stderr goes to the job log line by line. The last lines are
+	// kept to explain a failure in the server log.
+	var output *jobLog
+	if jobID := jobIDFromContext(ctx); jobID != "" {
+		if l, err := openJobLog(jobID); err != nil {
+			slog.WarnContext(ctx, "Failed to open job log", "error", err)
+		} else {
+			output = l
+			defer output.Close()
+			output.WriteLine("$ " + cmd.String())
+		}
+	}
+	var lastLines []string
+	go func() {
+		defer readers.Done()
+		scanner := bufio.NewScanner(stderrPipe)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		scanner.Split(scanLines)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if line == "" {
+				continue
+			}
+			if output != nil {
+				output.WriteLine(line)
+			} else {
+				slog.DebugContext(ctx, "FFmpeg output", "line", line)
+			}
+			lastLines = append(lastLines, line)
+			if len(lastLines) > 20 {
+				lastLines = lastLines[1:]
+			}
+		}
+		// Keep draining so ffmpeg never blocks on a full pipe
+		io.Copy(io.Discard, stderrPipe)
+	}()
+
+	// Cancelling ctx stops ffmpeg, giving it time to exit cleanly first
+	exited := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			cmd.Process.Signal(syscall.SIGTERM)
+			select {
+			case <-exited:
+			case <-time.After(ffmpegKillGrace):
+				cmd.Process.Kill()
+			}
+		case <-exited:
+		}
+	}()
+
+	// The pipes must be drained before waiting for the command
+	readers.Wait()
+	err = cmd.Wait()
+	close(exited)
+	observeFFmpegExit(cmd.ProcessState.ExitCode(), speed)
+
+	if err != nil && ctx.Err() != nil {
+		slog.WarnContext(ctx, "FFmpeg stopped", "video_id", id, "error", err)
+		setTranscodingProgress(id, -1)
+		return err
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "FFmpeg failed", "video_id", id, "error", err,
+			"output", strings.Join(lastLines, "\n"))
+		setTranscodingProgress(id, -1) // -1 means error
+		return err
+	}
+
+	// Set progress to 100% when done
+	setTranscodingProgress(id, 100)
+	return nil
+}
+
+// parseSpeed extracts the last encode speed, as a multiple of realtime,
+// from FFmpeg -progress output
+func parseSpeed(output string) float64 {
+	matches := speedPattern.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return 0
+	}
+	speed, _ := strconv.ParseFloat(matches[len(matches)-1][1], 64)
+	return speed
+}
+
+// Matches the speed field of FFmpeg -progress output
+var speedPattern = regexp.MustCompile(`speed=\s*([\d.]+)x`)
+
 // transcodeVideo converts a video to streaming-friendly format
 func transcodeVideo(c *fiber.Ctx) error {
 	// Check if FFmpeg is installed
 	if err := checkFFmpeg(); err != nil {
-		log.Printf("FFmpeg error: %v", err)
+		slog.ErrorContext(c.UserContext(), "FFmpeg not available", "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("FFmpeg error: %v", err),
 		})
@@ -196,35 +641,81 @@ func transcodeVideo(c *fiber.Ctx) error {
 
 	// Get video ID from params
 	id := c.Params("id")
-	log.Printf("Transcoding request received for video: %s", id)
+	slog.InfoContext(c.UserContext(), "Transcoding request received", "video_id", id)
 
 	// Get transcoding options from form
 	format := c.FormValue("format", "mp4")
-	resolution := c.FormValue("resolution", "720")
-	bitrate := c.FormValue("bitrate", "1000k")
+	resolution := c.FormValue("resolution")
+	bitrate := c.FormValue("bitrate")
 
 	// Validate format
 	format = strings.ToLower(format)
-	if format != "mp4" && format != "hls" && format != "dash" {
+	if format != "mp4" && format != "hls" && format != "dash" && format != "cmaf" && format != "llhls" && format != "abr" {
 		format = "mp4" // Default to MP4
 	}
 
-	// Validate resolution
-	validResolutions := map[string]bool{
-		"240": true, "360": true, "480": true, "720": true,
-		"1080": true, "1440": true, "2160": true,
+	// Validate resolution and bitrate against the configured presets
+	presets := getConfig().Presets
+	if !slices.Contains(presets.Resolutions, resolution) {
+		resolution = presets.DefaultResolution
+	}
+	if !slices.Contains(presets.Bitrates, bitrate) {
+		bitrate = presets.DefaultBitrate
+	}
+
+	// Rate control: a bitrate target, CRF, capped CRF, two-pass or CBR
+	rate, err := parseRateControl(c.FormValue("rateControl"), c.FormValue("crf"), bitrate)
+	if err == nil && rate.Mode == rateTwoPass && (format == "llhls" || format == "abr") {
+		err = fmt.Errorf("two-pass encoding is not supported for %s", format)
+	}
+	if err != nil {
+		slog.InfoContext(c.UserContext(), "Invalid rate control", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid rate control: %v", err),
+		})
 	}
-	if !validResolutions[resolution] {
-		resolution = "720" // Default to 720p
+
+	// Declarative filter list, compiled once the source is known
+	filterSteps, err := parseFilterSteps(c.FormValue("filters"))
+	if err != nil {
+		slog.InfoContext(c.UserContext(), "Invalid filters", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid filters: %v", err),
+		})
 	}
 
-	// Validate bitrate
-	validBitrates := map[string]bool{
-		"500k": true, "1000k": true, "2000k": true,
-		"4000k": true, "8000k": true, "16000k": true,
+	// Watermark and text overlays to burn in
+	overlay, err := parseOverlayOptions(c)
+	if err != nil {
+		slog.InfoContext(c.UserContext(), "Invalid overlay options", "error", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid overlay options: %v", err),
+		})
 	}
-	if !validBitrates[bitrate] {
-		bitrate = "1000k" // Default to 1000k
+	filter := &videoFilter{resolution: resolution, overlay: overlay}
+
+	// LL-HLS encodes run at real-time speed, so like requests asking for
+	// async processing they are not waited for
+	async := format == "llhls" || c.FormValue("async") == "true"
+
+	// Temporary overlay files are removed by the job once ffmpeg is done
+	// with them, or here when no job gets queued
+	enqueued := false
+	defer func() {
+		if !enqueued {
+			overlay.cleanup()
+		}
+	}()
+
+	// Quality metrics to measure against the source before publishing
+	metrics := getConfig().Verification.Metrics
+	if value := c.FormValue("metrics"); value != "" {
+		if metrics, err = parseQualityMetrics(value); err != nil {
+			slog.InfoContext(c.UserContext(), "Invalid quality metrics", "error", err)
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid quality metrics: %v", err),
+			})
+		}
 	}
 
 	// Create source and destination paths
@@ -232,152 +723,130 @@ func transcodeVideo(c *fiber.Ctx) error {
 
 	// Check if source file exists
 	if _, err := os.Stat(sourcePath); os.IsNotExist(err) {
-		log.Printf("Source video not found: %s", sourcePath)
+		slog.InfoContext(c.UserContext(), "Source video not found", "path", sourcePath)
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Source video not found",
 		})
 	}
 
 	// Get the duration of the video
-	duration, err := getDuration(sourcePath)
+	probeCtx, probeSpan := startStage(c.UserContext(), "transcode.probe")
+	duration, err := getDuration(probeCtx, sourcePath)
+	endStage(probeSpan, err)
 	if err != nil {
-		log.Printf("Failed to get video duration: %v", err)
+		slog.ErrorContext(c.UserContext(), "Failed to get video duration", "error", err)
 		// Continue anyway, progress will be estimated
 	}
 
+	// Compile the filter list; automatic cropping inspects the source
+	if filter.preFilters, err = compileFilterSteps(c.UserContext(), filterSteps, sourcePath, duration); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to compile filters", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to compile filters: %v", err),
+		})
+	}
+
 	// Initialize progress for this video
-	transcodingProgress[id] = 0
+	setTranscodingProgress(id, 0)
 
 	// Create base name without extension
 	baseName := strings.TrimSuffix(id, filepath.Ext(id))
 
+	// Outputs are written to a staging directory and moved into
+	// publishDir once they are complete, so players never see a partial
+	// rendition. LL-HLS is the exception: it is played while it is written.
+	stagingDir := newStagingDir(transcodedDir)
+	publishDir := filepath.Join(transcodedDir, baseName)
+
 	// Set output path based on format
 	var outputPath string
 	var outputUrl string
+	var outputDir string
+	var outputs []string // Files written outside staging, removed if ffmpeg fails
+	var args []string
+	var chapterFile string // FFMETADATA chapters embedded in MP4 output
+	var rungs []ladderRung
+
+	// Input and video encoder options, shared with the first pass of a
+	// two-pass encode
+	input := append([]string{"-i", sourcePath}, filter.inputArgs()...)
+	var video []string
+	var passLogDir string
+	if rate.Mode == rateTwoPass {
+		passLogDir = stagingDir + "-passlog"
+		rate.PassLogFile = filepath.Join(passLogDir, "ffmpeg2pass")
+	}
 
 	switch format {
-	case "hls":
-		// For HLS, create a directory and output segments
-		outputPath = filepath.Join(transcodedDir, baseName, "playlist.m3u8")
-		outputDir := filepath.Join(transcodedDir, baseName)
-
-		// Create directory
-		if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-			log.Printf("Failed to create transcoded directory for HLS: %v", err)
+	case "abr":
+		// For ABR, package one HLS variant per ladder rung behind a master
+		// playlist, using the video's analyzed ladder when there is one
+		if overlay != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Overlays are not supported for ABR packaging",
+			})
+		}
+		source, err := probeVideo(c.UserContext(), sourcePath)
+		if err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to probe source", "error", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create transcoded directory: %v", err),
+				"error": fmt.Sprintf("Failed to probe source: %v", err),
 			})
 		}
+		rungs = abrLadder(id, source.Height)
+		resolution, bitrate = "", ""
+
+		outputDir = filepath.Join(stagingDir, abrDirName)
+		outputPath = filepath.Join(outputDir, "master.m3u8")
+		args = abrArgs(sourcePath, outputDir, filter.preFilters, rungs, rate, source.HasAudio)
+
+		// Quality is measured per rung by the ladder analysis
+		metrics = nil
+
+		outputUrl = fmt.Sprintf("/transcoded/%s/%s/master.m3u8", baseName, abrDirName)
+
+	case "hls":
+		// For HLS, output the playlist and its segments
+		outputDir = stagingDir
+		outputPath = filepath.Join(outputDir, "playlist.m3u8")
 
 		// FFmpeg command for HLS with progress
-		cmd := exec.Command("ffmpeg", "-i", sourcePath,
+		video = append([]string{
+			"-c:v", "libx264",
 			"-profile:v", "baseline",
-			"-level", "3.0",
+			"-level", "3.0"},
+			keyframeArgs(hlsSegmentDuration)...)
+		video = append(video, filter.outputArgs()...)
+		args = append(input, video...)
+		args = append(args, rate.args("")...)
+		args = append(args,
 			"-start_number", "0",
-			"-hls_time", "10",
+			"-hls_time", strconv.Itoa(hlsSegmentDuration),
 			"-hls_list_size", "0",
 			"-f", "hls",
-			"-vf", fmt.Sprintf("scale=-2:%s", resolution),
-			"-b:v", bitrate,
 			"-progress", "pipe:1", // Output progress to stdout
 			outputPath)
 
-		log.Printf("Running FFmpeg command: %v", cmd.String())
-
-		// Run the command and capture output for progress
-		stdoutPipe, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Printf("Failed to create stdout pipe: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create pipe: %v", err),
-			})
-		}
-
-		stderrPipe, err := cmd.StderrPipe()
-		if err != nil {
-			log.Printf("Failed to create stderr pipe: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create pipe: %v", err),
-			})
-		}
-
-		// Start the command
-		if err := cmd.Start(); err != nil {
-			log.Printf("Failed to start FFmpeg: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to start FFmpeg: %v", err),
-			})
-		}
-
-		// Read output and update progress in a goroutine
-		go func() {
-			buffer := make([]byte, 1024)
-			for {
-				n, err := stdoutPipe.Read(buffer)
-				if n > 0 {
-					output := string(buffer[:n])
-					progress := parseProgress(output, duration)
-					if progress > 0 && progress <= 100 {
-						transcodingProgress[id] = progress
-					}
-				}
-				if err != nil {
-					break
-				}
-			}
-		}()
-
-		go func() {
-			buffer := make([]byte, 1024)
-			allOutput := ""
-			for {
-				n, err := stderrPipe.Read(buffer)
-				if n > 0 {
-					output := string(buffer[:n])
-					allOutput += output
-				}
-				if err != nil {
-					break
-				}
-			}
-			// Store the full output for debugging
-			log.Printf("FFmpeg stderr: %s", allOutput)
-		}()
-
-		// Wait for the command to finish
-		if err := cmd.Wait(); err != nil {
-			log.Printf("FFmpeg transcoding failed: %v", err)
-			transcodingProgress[id] = -1 // -1 means error
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Transcoding failed: %v", err),
-			})
-		}
-
-		// Set progress to 100% when done
-		transcodingProgress[id] = 100
 		outputUrl = fmt.Sprintf("/transcoded/%s/playlist.m3u8", baseName)
 
 	case "dash":
-		// For DASH, create a directory and output MPD file
-		outputPath = filepath.Join(transcodedDir, baseName, "manifest.mpd")
-		outputDir := filepath.Join(transcodedDir, baseName)
-
-		// Create directory
-		if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
-			log.Printf("Failed to create transcoded directory for DASH: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create transcoded directory: %v", err),
-			})
-		}
+		// For DASH, output the MPD file and its segments
+		outputDir = stagingDir
+		outputPath = filepath.Join(outputDir, "manifest.mpd")
 
 		// FFmpeg command for DASH with progress
-		cmd := exec.Command("ffmpeg", "-i", sourcePath,
+		video = append([]string{
+			"-c:v", "libx264",
 			"-profile:v", "baseline",
 			"-level", "3.0",
-			"-bf", "0",
+			"-bf", "0"},
+			keyframeArgs(dashSegmentDuration)...)
+		video = append(video, filter.outputArgs()...)
+		args = append(input, video...)
+		args = append(args, rate.args("")...)
+		args = append(args,
 			"-f", "dash",
-			"-vf", fmt.Sprintf("scale=-2:%s", resolution),
-			"-b:v", bitrate,
+			"-seg_duration", strconv.Itoa(dashSegmentDuration),
 			"-use_timeline", "1",
 			"-use_template", "1",
 			"-window_size", "5",
@@ -385,237 +854,278 @@ func transcodeVideo(c *fiber.Ctx) error {
 			"-progress", "pipe:1", // Output progress to stdout
 			outputPath)
 
-		log.Printf("Running FFmpeg command: %v", cmd.String())
+		outputUrl = fmt.Sprintf("/transcoded/%s/manifest.mpd", baseName)
 
-		stdoutPipe, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Printf("Failed to create stdout pipe: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create pipe: %v", err),
-			})
-		}
+	case "cmaf":
+		// For CMAF, package fMP4 segments once and describe them with
+		// both an MPD and an HLS playlist. The whole directory replaces
+		// the previous one when it is published.
+		outputDir = filepath.Join(stagingDir, cmafDirName)
+		outputPath = filepath.Join(outputDir, "master.m3u8")
 
-		stderrPipe, err := cmd.StderrPipe()
-		if err != nil {
-			log.Printf("Failed to create stderr pipe: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create pipe: %v", err),
-			})
-		}
+		video = cmafVideoArgs(filter)
+		args = cmafArgs(input, video, rate, filepath.Join(outputDir, "manifest.mpd"))
 
-		if err := cmd.Start(); err != nil {
-			log.Printf("Failed to start FFmpeg: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to start FFmpeg: %v", err),
-			})
-		}
+		outputUrl = fmt.Sprintf("/transcoded/%s/%s/master.m3u8", baseName, cmafDirName)
 
-		go func() {
-			buffer := make([]byte, 1024)
-			for {
-				n, err := stdoutPipe.Read(buffer)
-				if n > 0 {
-					output := string(buffer[:n])
-					progress := parseProgress(output, duration)
-					if progress > 0 && progress <= 100 {
-						transcodingProgress[id] = progress
-					}
-				}
-				if err != nil {
-					break
-				}
-			}
-		}()
-
-		go func() {
-			buffer := make([]byte, 1024)
-			allOutput := ""
-			for {
-				n, err := stderrPipe.Read(buffer)
-				if n > 0 {
-					output := string(buffer[:n])
-					allOutput += output
-				}
-				if err != nil {
-					break
-				}
-			}
-			log.Printf("FFmpeg stderr: %s", allOutput)
-		}()
+	case "llhls":
+		// For LL-HLS, ffmpeg writes short fMP4 parts and the server builds
+		// the low-latency playlist from them while the encode is running
+		stagingDir = ""
+		outputDir = filepath.Join(transcodedDir, baseName, llhlsDirName)
 
-		if err := cmd.Wait(); err != nil {
-			log.Printf("FFmpeg transcoding failed: %v", err)
-			transcodingProgress[id] = -1
+		os.RemoveAll(outputDir)
+		forgetPartSync(outputDir)
+		if err := os.MkdirAll(outputDir, os.ModePerm); err != nil {
+			slog.ErrorContext(c.UserContext(), "Failed to create transcoded directory", "format", format, "error", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Transcoding failed: %v", err),
+				"error": fmt.Sprintf("Failed to create transcoded directory: %v", err),
 			})
 		}
 
-		transcodingProgress[id] = 100
-		outputUrl = fmt.Sprintf("/transcoded/%s/manifest.mpd", baseName)
+		args = llhlsArgs(sourcePath, outputDir, filter, rate)
+		outputs = []string{outputDir}
+
+		// The encode runs at real-time speed, so it is not waited for.
+		// Players can join the stream as soon as the first part is written.
+		outputUrl = fmt.Sprintf("/transcoded/%s/%s/playlist.m3u8", baseName, llhlsDirName)
 
 	default: // mp4
 		// For MP4, just output to a file
-		outputPath = filepath.Join(transcodedDir, fmt.Sprintf("%s_%sp.mp4", baseName, resolution))
+		outputDir = stagingDir
+		publishDir = transcodedDir
+		outputPath = filepath.Join(outputDir, fmt.Sprintf("%s_%sp.mp4", baseName, resolution))
 
 		// FFmpeg command for MP4 with progress
-		cmd := exec.Command("ffmpeg", "-i", sourcePath,
+		video = append([]string{
 			"-c:v", "libx264",
-			"-preset", "fast",
-			"-c:a", "aac",
-			"-vf", fmt.Sprintf("scale=-2:%s", resolution),
-			"-b:v", bitrate,
-			"-movflags", "+faststart",
-			"-progress", "pipe:1", // Output progress to stdout
-			outputPath)
-
-		log.Printf("Running FFmpeg command: %v", cmd.String())
-
-		stdoutPipe, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Printf("Failed to create stdout pipe: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create pipe: %v", err),
-			})
-		}
+			"-preset", "fast"},
+			filter.outputArgs()...)
+		args = slices.Clone(input)
 
-		stderrPipe, err := cmd.StderrPipe()
+		// Embed the chapters of the video, read from an extra FFMETADATA
+		// input
+		chapterFile, err = writeChapterMetadata(c.UserContext(), id)
 		if err != nil {
-			log.Printf("Failed to create stderr pipe: %v", err)
+			slog.ErrorContext(c.UserContext(), "Failed to write chapter metadata", "video_id", id, "error", err)
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to create pipe: %v", err),
+				"error": fmt.Sprintf("Failed to write chapter metadata: %v", err),
 			})
 		}
-
-		if err := cmd.Start(); err != nil {
-			log.Printf("Failed to start FFmpeg: %v", err)
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Failed to start FFmpeg: %v", err),
-			})
-		}
-
-		go func() {
-			buffer := make([]byte, 1024)
-			for {
-				n, err := stdoutPipe.Read(buffer)
-				if n > 0 {
-					output := string(buffer[:n])
-					progress := parseProgress(output, duration)
-					if progress > 0 && progress <= 100 {
-						transcodingProgress[id] = progress
-					}
-				}
-				if err != nil {
-					break
+		if chapterFile != "" {
+			// The metadata input follows the source and overlay inputs
+			inputs := 0
+			for _, arg := range input {
+				if arg == "-i" {
+					inputs++
 				}
 			}
-		}()
-
-		go func() {
-			buffer := make([]byte, 1024)
-			allOutput := ""
-			for {
-				n, err := stderrPipe.Read(buffer)
-				if n > 0 {
-					output := string(buffer[:n])
-					allOutput += output
-				}
-				if err != nil {
-					break
-				}
-			}
-			log.Printf("FFmpeg stderr: %s", allOutput)
-		}()
-
-		if err := cmd.Wait(); err != nil {
-			log.Printf("FFmpeg transcoding failed: %v", err)
-			transcodingProgress[id] = -1
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-				"error": fmt.Sprintf("Transcoding failed: %v", err),
-			})
+			args = append(args, "-i", chapterFile, "-map_chapters", strconv.Itoa(inputs))
 		}
+		args = append(args, video...)
+		args = append(args, rate.args("")...)
+		args = append(args,
+			"-c:a", "aac",
+			"-movflags", "+faststart",
+			"-progress", "pipe:1", // Output progress to stdout
+			outputPath)
 
-		transcodingProgress[id] = 100
 		outputUrl = fmt.Sprintf("/transcoded/%s_%sp.mp4", baseName, resolution)
 	}
 
+	// The main output relative to the staging directory is validated
+	// before publishing
+	var output, source string
+	if stagingDir != "" {
+		output, _ = filepath.Rel(stagingDir, outputPath)
+		source = sourcePath
+	} else {
+		metrics = nil
+	}
+
+	var tempFiles []string
+	if overlay != nil {
+		tempFiles = overlay.tempFiles
+	}
+	if chapterFile != "" {
+		tempFiles = append(tempFiles, chapterFile)
+	}
+
+	var firstPass []string
+	if rate.Mode == rateTwoPass {
+		firstPass = rate.firstPass(input, video)
+	}
+
+	// Run the encode through the job queue. A single ffmpeg run encodes
+	// and packages the output.
+	j := enqueueJob(c.UserContext(), &job{
+		Kind:        "transcode",
+		VideoID:     id,
+		Format:      format,
+		Resolution:  resolution,
+		Bitrate:     bitrate,
+		RateControl: rate.Mode,
+	}, jobSpec{
+		Args:       args,
+		ProgressID: id,
+		Duration:   duration,
+		OutputDir:  outputDir,
+		Outputs:    outputs,
+		TempFiles:  tempFiles,
+		FirstPass:  firstPass,
+		PassLogDir: passLogDir,
+		StagingDir: stagingDir,
+		PublishDir: publishDir,
+		Output:     output,
+		URL:        outputUrl,
+		Source:     source,
+		Metrics:    metrics,
+	})
+	enqueued = true
+
+	if async {
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"success":    true,
+			"videoId":    id,
+			"jobId":      j.ID,
+			"format":     format,
+			"resolution": resolution,
+			"url":        outputUrl,
+		})
+	}
+
+	<-j.done
+	if err := j.err(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":   fmt.Sprintf("Transcoding failed: %v", err),
+			"jobId":   j.ID,
+			"quality": j.Quality,
+		})
+	}
+
 	// Return success response after transcoding is complete
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
-		"success":    true,
-		"videoId":    id,
-		"format":     format,
-		"resolution": resolution,
-		"url":        outputUrl,
+		"success":     true,
+		"videoId":     id,
+		"jobId":       j.ID,
+		"format":      format,
+		"resolution":  resolution,
+		"rateControl": rate.Mode,
+		"url":         outputUrl,
+		"quality":     j.Quality,
+		"ladder":      rungs,
 	})
 }
 
-// getVideos returns a list of all videos
+// getVideos returns a page of the videos matching the search, filter and
+// sort parameters, from the search index
 func getVideos(c *fiber.Ctx) error {
-	// Read videos directory
-	files, err := os.ReadDir(uploadsDir)
+	q, err := parseVideoQuery(c)
 	if err != nil {
-		log.Printf("Failed to read videos directory: %v", err)
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to read videos directory",
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid query: %v", err),
 		})
 	}
 
-	var videos []fiber.Map
-	for _, file := range files {
-		if !file.IsDir() {
-			ext := filepath.Ext(file.Name())
-			if ext == ".mp4" || ext == ".webm" || ext == ".mov" {
-				videoName := file.Name()
-				videoId := file.Name()
-
-				// Check if it has transcoded versions
-				baseName := strings.TrimSuffix(videoId, filepath.Ext(videoId))
-				hasHLS := false
-				hasDASH := false
-				hasMP4 := false
-
-				// Check for HLS version
-				hlsPath := filepath.Join(transcodedDir, baseName, "playlist.m3u8")
-				if _, err := os.Stat(hlsPath); err == nil {
-					hasHLS = true
-				}
+	results, total, next := searchVideos(q)
+	videos := make([]fiber.Map, 0, len(results))
+	for _, result := range results {
+		videos = append(videos, videoListItem(result.entry))
+	}
 
-				// Check for DASH version
-				dashPath := filepath.Join(transcodedDir, baseName, "manifest.mpd")
-				if _, err := os.Stat(dashPath); err == nil {
-					hasDASH = true
-				}
+	// The list stays a plain array; the page is described by headers
+	c.Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		c.Set("X-Next-Cursor", next)
+		c.Set(fiber.HeaderLink, fmt.Sprintf("<%s>; rel=\"next\"", nextPageLink(c, next)))
+	}
+	slog.DebugContext(c.UserContext(), "Returning videos", "count", len(videos), "total", total)
+	return c.JSON(videos)
+}
+
+// videoListItem describes a video in the video list
+func videoListItem(e indexEntry) fiber.Map {
+	videoId := e.id
 
-				// Look for MP4 versions
-				mp4Files, _ := filepath.Glob(filepath.Join(transcodedDir, fmt.Sprintf("%s_*p.mp4", baseName)))
-				hasMP4 = len(mp4Files) > 0
-
-				videos = append(videos, fiber.Map{
-					"id":      videoId,
-					"name":    videoName,
-					"url":     "/videos/" + videoId,
-					"hasHLS":  hasHLS,
-					"hasDASH": hasDASH,
-					"hasMP4":  hasMP4,
-					"hlsUrl": func() string {
-						if hasHLS {
-							return fmt.Sprintf("/transcoded/%s/playlist.m3u8", baseName)
-						}
-						return ""
-					}(),
-					"dashUrl": func() string {
-						if hasDASH {
-							return fmt.Sprintf("/transcoded/%s/manifest.mpd", baseName)
-						}
-						return ""
-					}(),
-				})
+	// Check if it has transcoded versions
+	baseName := strings.TrimSuffix(videoId, filepath.Ext(videoId))
+	hasHLS := false
+	hasDASH := false
+	hasMP4 := false
+
+	// Only published renditions are reported, never ones still being
+	// written or left behind by a failed transcode
+	hasHLS = renditionPlayable(videoId, "hls")
+	hasDASH = renditionPlayable(videoId, "dash")
+	hasCMAF := renditionPlayable(videoId, "cmaf")
+	hasLLHLS := renditionPlayable(videoId, "llhls")
+	hasABR := renditionPlayable(videoId, "abr")
+
+	// Look for MP4 versions
+	hasMP4 = len(readyMP4URLs(videoId)) > 0
+
+	video := fiber.Map{
+		"id":         videoId,
+		"url":        "/videos/" + videoId,
+		"size":       e.Size,
+		"duration":   e.Duration,
+		"uploadedAt": e.UploadedAt,
+		"status":     videoStatus(videoId),
+		"hasHLS":     hasHLS,
+		"hasDASH":    hasDASH,
+		"hasMP4":     hasMP4,
+		"hasCMAF":    hasCMAF,
+		"hasLLHLS":   hasLLHLS,
+		"hasABR":     hasABR,
+		"hlsUrl": func() string {
+			if hasHLS {
+				return fmt.Sprintf("/transcoded/%s/playlist.m3u8", baseName)
 			}
-		}
+			return ""
+		}(),
+		"dashUrl": func() string {
+			if hasDASH {
+				return fmt.Sprintf("/transcoded/%s/manifest.mpd", baseName)
+			}
+			return ""
+		}(),
+		"cmafHlsUrl": func() string {
+			if hasCMAF {
+				return fmt.Sprintf("/transcoded/%s/%s/master.m3u8", baseName, cmafDirName)
+			}
+			return ""
+		}(),
+		"cmafDashUrl": func() string {
+			if hasCMAF {
+				return fmt.Sprintf("/transcoded/%s/%s/manifest.mpd", baseName, cmafDirName)
+			}
+			return ""
+		}(),
+		"llhlsUrl": func() string {
+			if hasLLHLS {
+				return fmt.Sprintf("/transcoded/%s/%s/playlist.m3u8", baseName, llhlsDirName)
+			}
+			return ""
+		}(),
+		"abrUrl": func() string {
+			if hasABR {
+				return fmt.Sprintf("/transcoded/%s/%s/master.m3u8", baseName, abrDirName)
+			}
+			return ""
+		}(),
 	}
 
-	log.Printf("Returning %d videos", len(videos))
-	return c.JSON(videos)
+	// Title, description, tags and custom fields are edited through PATCH
+	// and stored apart from the file
+	for key, value := range e.metadata.fields(videoId) {
+		video[key] = value
+	}
+
+	// The thumbnail is a keyframe picked by the scene analysis
+	if a, ok := lookupScenes(videoId); ok && a.posterShot() >= 0 {
+		video["thumbnailUrl"] = fmt.Sprintf("/api/videos/%s/thumbnail", videoId)
+	}
+	return video
 }
 
 // getVideo returns a specific video by ID
@@ -626,7 +1136,7 @@ func getVideo(c *fiber.Ctx) error {
 	// Check if file exists
 	_, err := os.Stat(videoPath)
 	if os.IsNotExist(err) {
-		log.Printf("Video not found: %s", id)
+		slog.InfoContext(c.UserContext(), "Video not found", "video_id", id)
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Video not found",
 		})
@@ -640,31 +1150,29 @@ func getVideo(c *fiber.Ctx) error {
 	hasDASH := false
 	var mp4Versions []string
 
-	// Check for HLS version
-	hlsPath := filepath.Join(transcodedDir, baseName, "playlist.m3u8")
-	if _, err := os.Stat(hlsPath); err == nil {
-		hasHLS = true
-	}
-
-	// Check for DASH version
-	dashPath := filepath.Join(transcodedDir, baseName, "manifest.mpd")
-	if _, err := os.Stat(dashPath); err == nil {
-		hasDASH = true
-	}
+	// Only published renditions are reported, never ones still being
+	// written or left behind by a failed transcode
+	hasHLS = renditionPlayable(id, "hls")
+	hasDASH = renditionPlayable(id, "dash")
+	hasCMAF := renditionPlayable(id, "cmaf")
+	hasLLHLS := renditionPlayable(id, "llhls")
+	hasABR := renditionPlayable(id, "abr")
 
 	// Look for MP4 versions
-	mp4Files, _ := filepath.Glob(filepath.Join(transcodedDir, fmt.Sprintf("%s_*p.mp4", baseName)))
-	for _, file := range mp4Files {
-		fileName := filepath.Base(file)
-		mp4Versions = append(mp4Versions, "/transcoded/"+fileName)
+	mp4Versions = readyMP4URLs(id)
+
+	// Include the source videos of clips and concatenations
+	var derivedFrom interface{}
+	if d, ok := lookupDerivation(id); ok {
+		derivedFrom = d
 	}
 
 	// Return video info
-	log.Printf("Returning video info: %s", id)
-	return c.JSON(fiber.Map{
+	slog.DebugContext(c.UserContext(), "Returning video info", "video_id", id)
+	video := fiber.Map{
 		"id":      id,
-		"name":    id,
 		"url":     "/videos/" + id,
+		"status":  videoStatus(id),
 		"hasHLS":  hasHLS,
 		"hasDASH": hasDASH,
 		"hlsUrl": func() string {
@@ -679,8 +1187,56 @@ func getVideo(c *fiber.Ctx) error {
 			}
 			return ""
 		}(),
+		"hasCMAF":  hasCMAF,
+		"hasLLHLS": hasLLHLS,
+		"hasABR":   hasABR,
+		"cmafHlsUrl": func() string {
+			if hasCMAF {
+				return fmt.Sprintf("/transcoded/%s/%s/master.m3u8", baseName, cmafDirName)
+			}
+			return ""
+		}(),
+		"cmafDashUrl": func() string {
+			if hasCMAF {
+				return fmt.Sprintf("/transcoded/%s/%s/manifest.mpd", baseName, cmafDirName)
+			}
+			return ""
+		}(),
+		"llhlsUrl": func() string {
+			if hasLLHLS {
+				return fmt.Sprintf("/transcoded/%s/%s/playlist.m3u8", baseName, llhlsDirName)
+			}
+			return ""
+		}(),
+		"abrUrl": func() string {
+			if hasABR {
+				return fmt.Sprintf("/transcoded/%s/%s/master.m3u8", baseName, abrDirName)
+			}
+			return ""
+		}(),
 		"mp4Versions": mp4Versions,
-	})
+		"renditions":  videoRenditions(id),
+		"derivedFrom": derivedFrom,
+	}
+	m := lookupMetadata(id)
+	for key, value := range m.fields(id) {
+		video[key] = value
+	}
+	if !m.UpdatedAt.IsZero() {
+		video["updatedAt"] = m.UpdatedAt
+	}
+	if a, ok := lookupScenes(id); ok && a.posterShot() >= 0 {
+		video["thumbnailUrl"] = fmt.Sprintf("/api/videos/%s/thumbnail", id)
+	}
+	if userID, _ := requestUserID(c, false); userID != "" {
+		if p, ok := lookupProgress(userID, id); ok {
+			video["progress"] = p
+		}
+	}
+	if len(lookupChapters(id)) > 0 {
+		video["chaptersUrl"] = fmt.Sprintf("/api/videos/%s/chapters.vtt", id)
+	}
+	return c.JSON(video)
 }
 
 // uploadVideo handles video file uploads
@@ -688,60 +1244,162 @@ func uploadVideo(c *fiber.Ctx) error {
 	// Get file from request
 	file, err := c.FormFile("video")
 	if err != nil {
-		log.Printf("No video file provided or error parsing form: %v", err)
+		slog.InfoContext(c.UserContext(), "No video file provided or error parsing form", "error", err)
+		uploadsTotal.WithLabelValues("rejected").Inc()
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": fmt.Sprintf("No video file provided or error parsing form: %v", err),
 		})
 	}
 
+	// The owner is stored with the video metadata for filtering the list
+	owner := strings.TrimSpace(c.FormValue("owner"))
+	if len(owner) > maxOwnerLength {
+		uploadsTotal.WithLabelValues("rejected").Inc()
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("owner must be at most %d characters", maxOwnerLength),
+		})
+	}
+
 	// Validate file size
-	maxSize := 2000 * 1024 * 1024 // 2GB
+	cfg := getConfig()
+	maxSize := cfg.MaxUploadMB * 1024 * 1024
 	if file.Size > int64(maxSize) {
-		log.Printf("File too large: %d bytes (max %d bytes)", file.Size, maxSize)
+		slog.InfoContext(c.UserContext(), "File too large", "size", file.Size, "max_size", maxSize)
+		uploadsTotal.WithLabelValues("rejected").Inc()
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": fmt.Sprintf("File too large: %d bytes (max %d bytes)", file.Size, maxSize),
 		})
 	}
 
-	// Get filename and extension
-	filename := file.Filename
-	ext := filepath.Ext(filename)
-
-	// If extension is empty or not supported, use default extension
-	if ext == "" || (ext != ".mp4" && ext != ".webm" && ext != ".mov") {
-		log.Printf("Using default extension for file: %s", filename)
-		filename = filename + ".mp4"
-		ext = ".mp4"
+	// Uploads are probed before they are accepted
+	if err := ffprobeAvailable(); err != nil {
+		slog.ErrorContext(c.UserContext(), "FFprobe not available", "error", err)
+		uploadsTotal.WithLabelValues("failed").Inc()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("FFprobe error: %v", err),
+		})
 	}
 
 	// Ensure directory exists
 	if err := os.MkdirAll(uploadsDir, os.ModePerm); err != nil {
-		log.Printf("Failed to create uploads directory: %v", err)
+		slog.ErrorContext(c.UserContext(), "Failed to create uploads directory", "error", err)
+		uploadsTotal.WithLabelValues("failed").Inc()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to create uploads directory: %v", err),
 		})
 	}
 
-	// Save file
-	savePath := filepath.Join(uploadsDir, filename)
-	log.Printf("Saving video to: %s", savePath)
+	// Save file, hashing it on the way to catch re-uploads under another name
+	policy := cfg.DuplicateUploads
+	if value := c.FormValue("onDuplicate"); value != "" {
+		if !slices.Contains(duplicatePolicies, value) {
+			uploadsTotal.WithLabelValues("rejected").Inc()
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("onDuplicate must be one of %s", strings.Join(duplicatePolicies, ", ")),
+			})
+		}
+		policy = value
+	}
 
-	if err := c.SaveFile(file, savePath); err != nil {
-		log.Printf("Failed to save video: %v", err)
+	tmpPath, sum, err := saveHashedUpload(file)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save video", "error", err)
+		uploadsTotal.WithLabelValues("failed").Inc()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to save video: %v", err),
 		})
 	}
+	rejected := quarantinedUpload{Filename: file.Filename, Owner: owner, Size: file.Size, SHA256: sum}
+
+	// The extension follows the container found in the content, not the
+	// name the client sent
+	container, err := sniffContainer(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		slog.ErrorContext(c.UserContext(), "Failed to read upload", "error", err)
+		uploadsTotal.WithLabelValues("failed").Inc()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to read upload: %v", err),
+		})
+	}
+	if container == "" {
+		rejected.Reason = "not a recognised video container"
+		return rejectUpload(c, tmpPath, rejected)
+	}
+	rejected.Container = container
+	filename, err := uploadFilename(file.Filename, container, cfg)
+	if err != nil {
+		rejected.Reason = err.Error()
+		return rejectUpload(c, tmpPath, rejected)
+	}
+	if filename != file.Filename {
+		slog.InfoContext(c.UserContext(), "Renamed upload after its container", "filename", file.Filename, "container", container, "video_id", filename)
+	}
+
+	savePath := filepath.Join(uploadsDir, filename)
+	slog.InfoContext(c.UserContext(), "Saving video", "path", savePath)
+
+	// Identical uploads running at the same time count as duplicates of the
+	// first one checked
+	original := reserveContentHash(tmpPath, sum, filename)
+	defer releaseContentHash(tmpPath)
+	if original != "" && policy != duplicateAllow {
+		os.Remove(tmpPath)
+		slog.InfoContext(c.UserContext(), "Duplicate upload", "filename", filename, "duplicate_of", original, "policy", policy)
+		uploadsTotal.WithLabelValues("duplicate").Inc()
+		if policy == duplicateReject {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error":       fmt.Sprintf("This file was already uploaded as %s", original),
+				"duplicateOf": original,
+				"url":         "/videos/" + original,
+			})
+		}
+		// The original has the same content, so the same size, even while
+		// it is still being saved
+		return c.Status(fiber.StatusOK).JSON(fiber.Map{
+			"id":          original,
+			"name":        original,
+			"url":         "/videos/" + original,
+			"size":        file.Size,
+			"duplicateOf": original,
+		})
+	}
 
-	// Verify file was saved
-	if _, err := os.Stat(savePath); os.IsNotExist(err) {
-		log.Printf("File was not saved properly: %v", err)
+	if probe, reason := checkUploadProbe(c.UserContext(), tmpPath, cfg.UploadLimits); reason != "" {
+		rejected.Probe = probe
+		rejected.Reason = reason
+		return rejectUpload(c, tmpPath, rejected)
+	}
+
+	if err := os.Rename(tmpPath, savePath); err != nil {
+		os.Remove(tmpPath)
+		slog.ErrorContext(c.UserContext(), "Failed to save video", "error", err)
+		uploadsTotal.WithLabelValues("failed").Inc()
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "File was not saved properly after upload",
+			"error": fmt.Sprintf("Failed to save video: %v", err),
 		})
 	}
+	updateFingerprint(filename, func(f *fingerprint) {
+		if f.SHA256 != sum {
+			f.Frames = nil
+			f.ComputedAt = time.Time{}
+		}
+		f.SHA256 = sum
+	})
 
-	log.Printf("Video uploaded successfully: %s (%d bytes)", filename, file.Size)
+	slog.InfoContext(c.UserContext(), "Video uploaded", "video_id", filename, "size", file.Size)
+	uploadsTotal.WithLabelValues("success").Inc()
+	uploadBytesTotal.Add(float64(file.Size))
+	if owner != "" {
+		setVideoOwner(filename, owner)
+	}
+	indexVideo(c.UserContext(), filename)
+	enqueueFingerprint(c.UserContext(), filename)
+	emitEvent(c.UserContext(), eventVideoUploaded, fiber.Map{
+		"id":   filename,
+		"url":  "/videos/" + filename,
+		"size": file.Size,
+	})
 	return c.Status(fiber.StatusOK).JSON(fiber.Map{
 		"id":   filename,
 		"name": filename,
@@ -753,15 +1411,14 @@ func uploadVideo(c *fiber.Ctx) error {
 // deleteVideo deletes a video by ID
 func deleteVideo(c *fiber.Ctx) error {
 	id := c.Params("id")
-	log.Printf("Delete request received for video: %s", id)
+	slog.InfoContext(c.UserContext(), "Delete request received", "video_id", id)
 
 	videoPath := filepath.Join(uploadsDir, id)
-	log.Printf("Video path: %s", videoPath)
 
 	// Check if file exists
 	_, err := os.Stat(videoPath)
 	if os.IsNotExist(err) {
-		log.Printf("Video not found at path: %s", videoPath)
+		slog.InfoContext(c.UserContext(), "Video not found", "path", videoPath)
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
 			"error": "Video not found",
 		})
@@ -769,7 +1426,7 @@ func deleteVideo(c *fiber.Ctx) error {
 
 	// Delete file
 	if err := os.Remove(videoPath); err != nil {
-		log.Printf("Failed to delete video: %v", err)
+		slog.ErrorContext(c.UserContext(), "Failed to delete video", "video_id", id, "error", err)
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": fmt.Sprintf("Failed to delete video: %v", err),
 		})
@@ -780,7 +1437,8 @@ func deleteVideo(c *fiber.Ctx) error {
 
 	// Delete HLS directory if exists
 	hlsDir := filepath.Join(transcodedDir, baseName)
-	os.RemoveAll(hlsDir) // Ignore errors
+	removePublished(hlsDir) // Ignore errors
+	forgetPartSync(filepath.Join(hlsDir, llhlsDirName))
 
 	// Delete any MP4 versions
 	mp4Files, _ := filepath.Glob(filepath.Join(transcodedDir, fmt.Sprintf("%s_*p.mp4", baseName)))
@@ -788,6 +1446,18 @@ func deleteVideo(c *fiber.Ctx) error {
 		os.Remove(file) // Ignore errors
 	}
 
-	log.Printf("Video and transcoded versions successfully deleted: %s", id)
+	forgetDerivation(id)
+	forgetRenditions(id)
+	forgetLadder(id)
+	forgetMetadata(id)
+	unindexVideo(id)
+	removeVideoFromPlaylists(id)
+	forgetChapters(id)
+	forgetScenes(id)
+	forgetFingerprint(id)
+	forgetProgress(id)
+
+	slog.InfoContext(c.UserContext(), "Video and transcoded versions deleted", "video_id", id)
+	emitEvent(c.UserContext(), eventVideoDeleted, fiber.Map{"id": id})
 	return c.SendStatus(fiber.StatusNoContent)
 }
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Content types for the files served from uploadsDir and transcodedDir
+var mediaContentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+	".mov":  "video/quicktime",
+	".m4a":  "audio/mp4",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".mpd":  "application/dash+xml",
+	".m4s":  "video/iso.segment",
+	".ts":   "video/mp2t",
+	".vtt":  "text/vtt; charset=utf-8",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".json": "application/json",
+}
+
+// Cache-Control policies. Manifests change while an encode is running, so
+// they are only cached briefly; segments never change once written.
+const (
+	manifestCacheControl = "public, max-age=2"
+	segmentCacheControl  = "public, max-age=31536000, immutable"
+	defaultCacheControl  = "public, max-age=3600"
+)
+
+// mediaContentType returns the MIME type for a media file name
+func mediaContentType(name string) string {
+	if contentType, ok := mediaContentTypes[strings.ToLower(filepath.Ext(name))]; ok {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// mediaCacheControl returns the Cache-Control policy for a media file name
+func mediaCacheControl(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".m3u8", ".mpd":
+		return manifestCacheControl
+	case ".m4s", ".ts":
+		return segmentCacheControl
+	}
+	return defaultCacheControl
+}
+
+// mediaHandler serves files below root with range and conditional request
+// support. It replaces app.Static for the playback routes.
+func mediaHandler(root string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		name := c.Params("*")
+		if name == "" || strings.Contains(name, "..") || hasHiddenSegment(name) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+				"error": "File not found",
+			})
+		}
+		return sendMedia(c, filepath.Join(root, filepath.FromSlash(name)))
+	}
+}
+
+// hasHiddenSegment reports whether a path contains a dot file or directory,
+// such as the staging directories and the stored job and rendition states
+func hasHiddenSegment(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// sendMedia writes the file at path to the response, honouring Range,
+// If-Range, If-None-Match and If-Modified-Since
+func sendMedia(c *fiber.Ctx, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		file.Close()
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "File not found",
+		})
+	}
+
+	size := info.Size()
+	modTime := info.ModTime().UTC().Truncate(time.Second)
+	etag := fmt.Sprintf(`"%x-%x"`, size, info.ModTime().UnixNano())
+
+	c.Set(fiber.HeaderContentType, mediaContentType(path))
+	c.Set(fiber.HeaderCacheControl, mediaCacheControl(path))
+	c.Set(fiber.HeaderETag, etag)
+	c.Set(fiber.HeaderLastModified, modTime.Format(http.TimeFormat))
+	c.Set(fiber.HeaderAcceptRanges, "bytes")
+
+	if notModified(c, etag, modTime) {
+		file.Close()
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	start, length := int64(0), size
+	rangeHeader := c.Get(fiber.HeaderRange)
+	if rangeHeader != "" && ifRangeMatches(c.Get(fiber.HeaderIfRange), etag, modTime) {
+		var ok bool
+		start, length, ok = parseByteRange(rangeHeader, size)
+		if !ok {
+			file.Close()
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes */%d", size))
+			return c.SendStatus(fiber.StatusRequestedRangeNotSatisfiable)
+		}
+		if length != size {
+			c.Status(fiber.StatusPartialContent)
+			c.Set(fiber.HeaderContentRange, fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+		}
+	}
+
+	if c.Method() == fiber.MethodHead {
+		file.Close()
+		c.Context().Response.Header.SetContentLength(int(length))
+		c.Context().Response.SkipBody = true
+		return nil
+	}
+
+	servedBytesTotal.WithLabelValues(c.Route().Path).Add(float64(length))
+
+	// fasthttp closes the file once the body has been written
+	c.Context().SetBodyStream(&sectionReadCloser{
+		SectionReader: io.NewSectionReader(file, start, length),
+		file:          file,
+	}, int(length))
+	return nil
+}
+
+// sectionReadCloser closes the underlying file of a SectionReader
+type sectionReadCloser struct {
+	*io.SectionReader
+	file *os.File
+}
+
+func (s *sectionReadCloser) Close() error {
+	return s.file.Close()
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since
+func notModified(c *fiber.Ctx, etag string, modTime time.Time) bool {
+	if match := c.Get(fiber.HeaderIfNoneMatch); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if since := c.Get(fiber.HeaderIfModifiedSince); since != "" {
+		t, err := http.ParseTime(since)
+		if err == nil && !modTime.After(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// ifRangeMatches reports whether a Range header should be honoured given
+// the If-Range validator. An empty validator always matches.
+func ifRangeMatches(validator, etag string, modTime time.Time) bool {
+	if validator == "" {
+		return true
+	}
+	if strings.HasPrefix(validator, `"`) {
+		// Only strong ETags can be used with If-Range
+		return validator == etag
+	}
+	t, err := http.ParseTime(validator)
+	return err == nil && modTime.Equal(t)
+}
+
+// parseByteRange parses a single "bytes=" range against a file of the given
+// size. Multiple ranges are not supported and result in the whole file.
+func parseByteRange(header string, size int64) (start, length int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return 0, size, true
+	}
+	if strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+
+	from, to, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+
+	if from == "" {
+		// Suffix range: the last n bytes
+		n, ok := parseRangeNumber(to)
+		if !ok || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true
+	}
+
+	start, ok = parseRangeNumber(from)
+	if !ok || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if to != "" {
+		end, ok = parseRangeNumber(to)
+		if !ok || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, true
+}
+
+// parseRangeNumber parses a byte position, which may only hold digits
+func parseRangeNumber(s string) (int64, bool) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	return n, err == nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseByteRange(t *testing.T) {
+	tests := []struct {
+		header        string
+		size          int64
+		start, length int64
+		ok            bool
+	}{
+		{"", 1000, 0, 1000, true},
+		{"items=0-10", 1000, 0, 1000, true},
+		{"bytes=0-99", 1000, 0, 100, true},
+		{"bytes=500-", 1000, 500, 500, true},
+		{"bytes=999-999", 1000, 999, 1, true},
+		{"bytes= 10-19", 1000, 10, 10, true},
+		{"bytes=900-5000", 1000, 900, 100, true},  // End clamped to the file
+		{"bytes=-100", 1000, 900, 100, true},      // Last 100 bytes
+		{"bytes=-5000", 1000, 0, 1000, true},      // Suffix longer than the file
+		{"bytes=0-10,20-30", 1000, 0, 1000, true}, // Multiple ranges serve everything
+		{"bytes=1000-", 1000, 0, 0, false},        // Starts past the end
+		{"bytes=0-", 0, 0, 0, false},              // Empty file
+		{"bytes=-0", 1000, 0, 0, false},
+		{"bytes=-10", 0, 0, 0, false},
+		{"bytes=20-10", 1000, 0, 0, false},
+		{"bytes=10", 1000, 0, 0, false},
+		{"bytes=-", 1000, 0, 0, false},
+		{"bytes=a-b", 1000, 0, 0, false},
+		{"bytes=+5-10", 1000, 0, 0, false},
+		{"bytes=5-+10", 1000, 0, 0, false},
+		{"bytes=--5", 1000, 0, 0, false},
+		{"bytes=0x10-20", 1000, 0, 0, false},
+		{"bytes=99999999999999999999-", 1000, 0, 0, false}, // Overflows int64
+	}
+	for _, tt := range tests {
+		start, length, ok := parseByteRange(tt.header, tt.size)
+		if ok != tt.ok || (ok && (start != tt.start || length != tt.length)) {
+			t.Errorf("parseByteRange(%q, %d) = %d, %d, %v; want %d, %d, %v",
+				tt.header, tt.size, start, length, ok, tt.start, tt.length, tt.ok)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	modTime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	etag := `"abc-123"`
+	tests := []struct {
+		validator string
+		want      bool
+	}{
+		{"", true},
+		{`"abc-123"`, true},
+		{`"other"`, false},
+		{`W/"abc-123"`, false}, // Weak validators never match
+		{"Wed, 01 May 2024 12:00:00 GMT", true},
+		{"Wed, 01 May 2024 12:00:01 GMT", false},
+		{"not a date", false},
+	}
+	for _, tt := range tests {
+		if got := ifRangeMatches(tt.validator, etag, modTime); got != tt.want {
+			t.Errorf("ifRangeMatches(%q) = %v, want %v", tt.validator, got, tt.want)
+		}
+	}
+}
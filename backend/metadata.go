@@ -0,0 +1,494 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Limits of the editable metadata of a video
+const (
+	maxTitleLength       = 200
+	maxDescriptionLength = 5000
+	maxCategoryLength    = 100
+	maxOwnerLength       = 100
+	maxTags              = 50
+	maxTagLength         = 50
+	maxCustomFieldsSize  = 16 * 1024 // Of the encoded custom fields, in bytes
+)
+
+// videoMetadata is the editable description of a video. The filename
+// stays the ID of the video; Title replaces it as the display name.
+type videoMetadata struct {
+	Title        string                 `json:"title,omitempty"`
+	Description  string                 `json:"description,omitempty"`
+	Tags         []string               `json:"tags,omitempty"`
+	Category     string                 `json:"category,omitempty"`
+	Owner        string                 `json:"owner,omitempty"`
+	Workspace    string                 `json:"workspace,omitempty"`
+	CustomFields map[string]interface{} `json:"customFields,omitempty"`
+	UpdatedAt    time.Time              `json:"updatedAt,omitzero"`
+}
+
+// Custom field types of a workspace schema
+const (
+	fieldString  = "string"
+	fieldNumber  = "number"
+	fieldInteger = "integer"
+	fieldBoolean = "boolean"
+	fieldDate    = "date" // YYYY-MM-DD
+	fieldEnum    = "enum" // One of Values
+	fieldList    = "list" // List of strings
+)
+
+var fieldTypes = []string{fieldString, fieldNumber, fieldInteger, fieldBoolean, fieldDate, fieldEnum, fieldList}
+
+// schemaField describes a custom field of a workspace
+type schemaField struct {
+	Type     string   `json:"type"`
+	Required bool     `json:"required,omitempty"`
+	Values   []string `json:"values,omitempty"` // Allowed values of an enum
+}
+
+// Video metadata and the custom field schemas of workspaces, persisted
+// next to the uploads
+var (
+	metadata   = make(map[string]videoMetadata)
+	schemas    = make(map[string]map[string]schemaField)
+	metadataMu sync.Mutex
+)
+
+// metadataFile returns the path of the video metadata file
+func metadataFile() string {
+	return filepath.Join(uploadsDir, ".metadata.json")
+}
+
+// schemasFile returns the path of the workspace schemas file
+func schemasFile() string {
+	return filepath.Join(uploadsDir, ".schemas.json")
+}
+
+// loadMetadata reads the video metadata and workspace schemas from disk
+func loadMetadata() error {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	if err := readJSONFile(metadataFile(), &metadata); err != nil {
+		return err
+	}
+	return readJSONFile(schemasFile(), &schemas)
+}
+
+// readJSONFile decodes a state file into v, leaving v alone if the file
+// does not exist
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSONFile atomically replaces a state file with v
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lookupMetadata returns the metadata of a video, which is empty if it was
+// never edited
+func lookupMetadata(id string) videoMetadata {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	return metadata[id]
+}
+
+// forgetMetadata removes the metadata of a deleted video
+func forgetMetadata(id string) {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	if _, ok := metadata[id]; !ok {
+		return
+	}
+	delete(metadata, id)
+	if err := writeJSONFile(metadataFile(), metadata); err != nil {
+		slog.Error("Failed to save video metadata", "error", err)
+	}
+}
+
+// setVideoOwner records the owner of an uploaded video
+func setVideoOwner(id, owner string) {
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	m := metadata[id]
+	m.Owner = owner
+	m.UpdatedAt = time.Now()
+	metadata[id] = m
+	if err := writeJSONFile(metadataFile(), metadata); err != nil {
+		slog.Error("Failed to save video metadata", "error", err)
+	}
+}
+
+// displayName is the title of a video, or its filename if it has none
+func (m videoMetadata) displayName(id string) string {
+	if m.Title != "" {
+		return m.Title
+	}
+	return id
+}
+
+// fields returns the metadata as fields of a video response
+func (m videoMetadata) fields(id string) fiber.Map {
+	tags := m.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	custom := m.CustomFields
+	if custom == nil {
+		custom = map[string]interface{}{}
+	}
+	return fiber.Map{
+		"name":         m.displayName(id),
+		"title":        m.Title,
+		"description":  m.Description,
+		"tags":         tags,
+		"category":     m.Category,
+		"owner":        m.Owner,
+		"workspace":    m.Workspace,
+		"customFields": custom,
+	}
+}
+
+// applyPatch updates m with the fields present in patch. A null field is
+// cleared; custom fields are merged key by key, a null value removing the
+// key.
+func (m *videoMetadata) applyPatch(patch map[string]json.RawMessage) error {
+	for key, raw := range patch {
+		null := string(raw) == "null"
+		var err error
+		switch key {
+		case "title":
+			m.Title, err = patchString(raw, null, key, maxTitleLength)
+		case "description":
+			m.Description, err = patchString(raw, null, key, maxDescriptionLength)
+		case "category":
+			m.Category, err = patchString(raw, null, key, maxCategoryLength)
+		case "owner":
+			m.Owner, err = patchString(raw, null, key, maxOwnerLength)
+		case "workspace":
+			m.Workspace, err = patchString(raw, null, key, 64)
+			if err == nil && m.Workspace != "" && !workspacePattern.MatchString(m.Workspace) {
+				err = fmt.Errorf("invalid workspace %q", m.Workspace)
+			}
+		case "tags":
+			m.Tags = nil
+			if !null {
+				var tags []string
+				if err := json.Unmarshal(raw, &tags); err != nil {
+					return fmt.Errorf("tags must be a list of strings")
+				}
+				m.Tags, err = normalizeTags(tags)
+			}
+		case "customFields":
+			if null {
+				m.CustomFields = nil
+				break
+			}
+			var fields map[string]interface{}
+			if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+				return fmt.Errorf("customFields must be an object")
+			}
+			if m.CustomFields == nil {
+				m.CustomFields = make(map[string]interface{})
+			}
+			for name, value := range fields {
+				if value == nil {
+					delete(m.CustomFields, name)
+				} else {
+					m.CustomFields[name] = value
+				}
+			}
+		default:
+			return fmt.Errorf("unknown field %q", key)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// patchString decodes a string field of a patch, trimmed and limited to
+// max characters
+func patchString(raw json.RawMessage, null bool, name string, max int) (string, error) {
+	if null {
+		return "", nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", fmt.Errorf("%s must be a string", name)
+	}
+	s = strings.TrimSpace(s)
+	if utf8.RuneCountInString(s) > max {
+		return "", fmt.Errorf("%s must be at most %d characters", name, max)
+	}
+	return s, nil
+}
+
+// normalizeTags trims, lowercases and de-duplicates tags, keeping their
+// order
+func normalizeTags(tags []string) ([]string, error) {
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" {
+			return nil, fmt.Errorf("tags must not be empty")
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tag %q is longer than %d characters", tag, maxTagLength)
+		}
+		if !slices.Contains(normalized, tag) {
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("at most %d tags are allowed", maxTags)
+	}
+	return normalized, nil
+}
+
+// validateCustomFields checks custom fields against the schema of the
+// workspace. Without a schema any JSON values are accepted.
+func validateCustomFields(fields map[string]interface{}, schema map[string]schemaField) error {
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxCustomFieldsSize {
+		return fmt.Errorf("customFields must be at most %d bytes", maxCustomFieldsSize)
+	}
+	if schema == nil {
+		return nil
+	}
+
+	for name, value := range fields {
+		field, ok := schema[name]
+		if !ok {
+			return fmt.Errorf("custom field %q is not in the workspace schema", name)
+		}
+		if !field.accepts(value) {
+			if field.Type == fieldEnum {
+				return fmt.Errorf("custom field %q must be one of %s", name, strings.Join(field.Values, ", "))
+			}
+			return fmt.Errorf("custom field %q must be of type %s", name, field.Type)
+		}
+	}
+	for name, field := range schema {
+		if _, ok := fields[name]; field.Required && !ok {
+			return fmt.Errorf("custom field %q is required", name)
+		}
+	}
+	return nil
+}
+
+// accepts reports whether value, as decoded from JSON, has the type of the
+// field
+func (f schemaField) accepts(value interface{}) bool {
+	switch f.Type {
+	case fieldString:
+		_, ok := value.(string)
+		return ok
+	case fieldNumber:
+		_, ok := value.(float64)
+		return ok
+	case fieldInteger:
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case fieldBoolean:
+		_, ok := value.(bool)
+		return ok
+	case fieldDate:
+		s, ok := value.(string)
+		if !ok {
+			return false
+		}
+		_, err := time.Parse(time.DateOnly, s)
+		return err == nil
+	case fieldEnum:
+		s, ok := value.(string)
+		return ok && slices.Contains(f.Values, s)
+	case fieldList:
+		list, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, item := range list {
+			if _, ok := item.(string); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// updateVideoMetadata edits the title, description, tags, category,
+// workspace and custom fields of a video. Only the fields present in the
+// JSON body change.
+func updateVideoMetadata(c *fiber.Ctx) error {
+	id := c.Params("id")
+	if _, err := os.Stat(filepath.Join(uploadsDir, id)); os.IsNotExist(err) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video not found",
+		})
+	}
+
+	var patch map[string]json.RawMessage
+	if err := c.BodyParser(&patch); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	metadataMu.Lock()
+	m := metadata[id]
+	m.Tags = slices.Clone(m.Tags)
+	if m.CustomFields != nil {
+		custom := make(map[string]interface{}, len(m.CustomFields))
+		for name, value := range m.CustomFields {
+			custom[name] = value
+		}
+		m.CustomFields = custom
+	}
+	err := m.applyPatch(patch)
+	if err == nil {
+		err = validateCustomFields(m.CustomFields, schemas[m.Workspace])
+	}
+	if err != nil {
+		metadataMu.Unlock()
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid metadata: %v", err),
+		})
+	}
+	m.UpdatedAt = time.Now()
+	metadata[id] = m
+	err = writeJSONFile(metadataFile(), metadata)
+	metadataMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save video metadata", "video_id", id, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save video metadata",
+		})
+	}
+
+	slog.InfoContext(c.UserContext(), "Video metadata updated", "video_id", id)
+	indexVideo(c.UserContext(), id)
+	response := m.fields(id)
+	response["id"] = id
+	response["updatedAt"] = m.UpdatedAt
+	emitEvent(c.UserContext(), eventVideoUpdated, response)
+	return c.JSON(response)
+}
+
+// putWorkspaceSchema replaces the custom field schema of a workspace. It
+// applies to later edits; stored metadata is not revalidated.
+func putWorkspaceSchema(c *fiber.Ctx) error {
+	workspace := c.Params("workspace")
+	if !workspacePattern.MatchString(workspace) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid workspace name",
+		})
+	}
+
+	var req struct {
+		Fields map[string]schemaField `json:"fields"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Fields == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	for name, field := range req.Fields {
+		var err error
+		switch {
+		case strings.TrimSpace(name) == "" || len(name) > 64:
+			err = fmt.Errorf("field names must be 1 to 64 characters")
+		case !slices.Contains(fieldTypes, field.Type):
+			err = fmt.Errorf("type of %q must be one of %s", name, strings.Join(fieldTypes, ", "))
+		case field.Type == fieldEnum && len(field.Values) == 0:
+			err = fmt.Errorf("enum %q must list its values", name)
+		case field.Type != fieldEnum && len(field.Values) > 0:
+			err = fmt.Errorf("only enum fields have values")
+		}
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Invalid schema: %v", err),
+			})
+		}
+	}
+
+	metadataMu.Lock()
+	schemas[workspace] = req.Fields
+	err := writeJSONFile(schemasFile(), schemas)
+	metadataMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save workspace schema", "workspace", workspace, "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save workspace schema",
+		})
+	}
+
+	slog.InfoContext(c.UserContext(), "Workspace schema updated", "workspace", workspace, "fields", len(req.Fields))
+	return c.JSON(fiber.Map{"workspace": workspace, "fields": req.Fields})
+}
+
+// getWorkspaceSchema returns the custom field schema of a workspace
+func getWorkspaceSchema(c *fiber.Ctx) error {
+	workspace := c.Params("workspace")
+	metadataMu.Lock()
+	fields, ok := schemas[workspace]
+	metadataMu.Unlock()
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Workspace has no schema",
+		})
+	}
+	return c.JSON(fiber.Map{"workspace": workspace, "fields": fields})
+}
+
+// deleteWorkspaceSchema removes the custom field schema of a workspace
+func deleteWorkspaceSchema(c *fiber.Ctx) error {
+	workspace := c.Params("workspace")
+	metadataMu.Lock()
+	defer metadataMu.Unlock()
+	if _, ok := schemas[workspace]; !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Workspace has no schema",
+		})
+	}
+	delete(schemas, workspace)
+	if err := writeJSONFile(schemasFile(), schemas); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save workspace schemas", "error", err)
+	}
+	slog.InfoContext(c.UserContext(), "Workspace schema removed", "workspace", workspace)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestApplyPatch(t *testing.T) {
+	current := videoMetadata{
+		Title:        "Launch",
+		Tags:         []string{"demo"},
+		Category:     "product",
+		CustomFields: map[string]interface{}{"client": "acme", "year": float64(2025)},
+	}
+	tests := []struct {
+		name    string
+		patch   string
+		want    videoMetadata
+		wantErr string
+	}{
+		{
+			name:  "absent fields kept",
+			patch: `{"description":"  First cut  "}`,
+			want: videoMetadata{Title: "Launch", Description: "First cut", Tags: []string{"demo"}, Category: "product",
+				CustomFields: map[string]interface{}{"client": "acme", "year": float64(2025)}},
+		},
+		{
+			name:  "null clears",
+			patch: `{"title":null,"tags":null,"customFields":null}`,
+			want:  videoMetadata{Category: "product"},
+		},
+		{
+			name:  "tags normalized",
+			patch: `{"tags":[" Demo","launch","DEMO"]}`,
+			want: videoMetadata{Title: "Launch", Tags: []string{"demo", "launch"}, Category: "product",
+				CustomFields: map[string]interface{}{"client": "acme", "year": float64(2025)}},
+		},
+		{
+			name:  "custom fields merged",
+			patch: `{"customFields":{"year":null,"reviewed":true}}`,
+			want: videoMetadata{Title: "Launch", Tags: []string{"demo"}, Category: "product",
+				CustomFields: map[string]interface{}{"client": "acme", "reviewed": true}},
+		},
+		{name: "title too long", patch: `{"title":"` + strings.Repeat("é", maxTitleLength+1) + `"}`, wantErr: "at most 200 characters"},
+		{name: "title not a string", patch: `{"title":5}`, wantErr: "title must be a string"},
+		{name: "empty tag", patch: `{"tags":["a"," "]}`, wantErr: "must not be empty"},
+		{name: "invalid workspace", patch: `{"workspace":"a/b"}`, wantErr: "invalid workspace"},
+		{name: "custom fields not an object", patch: `{"customFields":[1]}`, wantErr: "must be an object"},
+		{name: "unknown field", patch: `{"name":"x"}`, wantErr: `unknown field "name"`},
+	}
+	for _, tt := range tests {
+		var patch map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(tt.patch), &patch); err != nil {
+			t.Fatal(err)
+		}
+		m := current
+		m.Tags = append([]string(nil), current.Tags...)
+		m.CustomFields = map[string]interface{}{"client": "acme", "year": float64(2025)}
+		err := m.applyPatch(patch)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(m, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, m, tt.want)
+		}
+	}
+}
+
+func TestValidateCustomFields(t *testing.T) {
+	schema := map[string]schemaField{
+		"client":   {Type: fieldString, Required: true},
+		"budget":   {Type: fieldNumber},
+		"episode":  {Type: fieldInteger},
+		"approved": {Type: fieldBoolean},
+		"airDate":  {Type: fieldDate},
+		"rating":   {Type: fieldEnum, Values: []string{"G", "PG"}},
+		"cast":     {Type: fieldList},
+	}
+	tests := []struct {
+		name    string
+		fields  string
+		schema  map[string]schemaField
+		wantErr string
+	}{
+		{name: "no schema", fields: `{"anything":[1,{"a":null}]}`},
+		{name: "all types", fields: `{"client":"acme","budget":12.5,"episode":3,"approved":false,` +
+			`"airDate":"2025-03-01","rating":"PG","cast":["a","b"]}`, schema: schema},
+		{name: "required missing", fields: `{"budget":1}`, schema: schema, wantErr: `"client" is required`},
+		{name: "not in schema", fields: `{"client":"a","owner":"b"}`, schema: schema, wantErr: "not in the workspace schema"},
+		{name: "fractional integer", fields: `{"client":"a","episode":1.5}`, schema: schema, wantErr: "must be of type integer"},
+		{name: "invalid date", fields: `{"client":"a","airDate":"01/03/2025"}`, schema: schema, wantErr: "must be of type date"},
+		{name: "enum value", fields: `{"client":"a","rating":"R"}`, schema: schema, wantErr: "must be one of G, PG"},
+		{name: "list of numbers", fields: `{"client":"a","cast":[1]}`, schema: schema, wantErr: "must be of type list"},
+		{name: "too large", fields: `{"notes":"` + strings.Repeat("x", maxCustomFieldsSize) + `"}`, wantErr: "at most 16384 bytes"},
+	}
+	for _, tt := range tests {
+		var fields map[string]interface{}
+		if err := json.Unmarshal([]byte(tt.fields), &fields); err != nil {
+			t.Fatal(err)
+		}
+		err := validateCustomFields(fields, tt.schema)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// useMetadata gives a test an uploads directory holding videos and no
+// metadata or schemas
+func useMetadata(t *testing.T, videos ...string) {
+	dir := t.TempDir()
+	for _, name := range videos {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadataMu.Lock()
+	savedDir, savedMetadata, savedSchemas := uploadsDir, metadata, schemas
+	uploadsDir = dir
+	metadata, schemas = make(map[string]videoMetadata), make(map[string]map[string]schemaField)
+	metadataMu.Unlock()
+	t.Cleanup(func() {
+		metadataMu.Lock()
+		uploadsDir, metadata, schemas = savedDir, savedMetadata, savedSchemas
+		metadataMu.Unlock()
+	})
+}
+
+func TestUpdateVideoMetadata(t *testing.T) {
+	useMetadata(t, "a.mp4")
+	// As in main, handlers keep route parameters beyond the request
+	app := fiber.New(fiber.Config{Immutable: true})
+	app.Patch("/videos/:id", updateVideoMetadata)
+	app.Put("/workspaces/:workspace/schema", putWorkspaceSchema)
+
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"title set", http.MethodPatch, "/videos/a.mp4", `{"title":"Launch","tags":["Demo"]}`, fiber.StatusOK},
+		{"unknown video", http.MethodPatch, "/videos/b.mp4", `{"title":"x"}`, fiber.StatusNotFound},
+		{"invalid body", http.MethodPatch, "/videos/a.mp4", `[1]`, fiber.StatusBadRequest},
+		{"schema without type", http.MethodPut, "/workspaces/news/schema", `{"fields":{"desk":{}}}`, fiber.StatusBadRequest},
+		{"enum without values", http.MethodPut, "/workspaces/news/schema", `{"fields":{"desk":{"type":"enum"}}}`, fiber.StatusBadRequest},
+		{"schema set", http.MethodPut, "/workspaces/news/schema",
+			`{"fields":{"desk":{"type":"enum","values":["sports","politics"],"required":true}}}`, fiber.StatusOK},
+		{"required field missing", http.MethodPatch, "/videos/a.mp4", `{"workspace":"news"}`, fiber.StatusBadRequest},
+		{"field outside the schema", http.MethodPatch, "/videos/a.mp4",
+			`{"workspace":"news","customFields":{"desk":"sports","owner":"me"}}`, fiber.StatusBadRequest},
+		{"workspace and fields set", http.MethodPatch, "/videos/a.mp4",
+			`{"workspace":"news","customFields":{"desk":"sports"}}`, fiber.StatusOK},
+	}
+	for _, step := range steps {
+		req := httptest.NewRequest(step.method, step.path, bytes.NewReader([]byte(step.body)))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != step.status {
+			t.Errorf("%s: status %d, want %d", step.name, resp.StatusCode, step.status)
+		}
+	}
+
+	// Rejected edits left the metadata as the last accepted one stored it
+	want := videoMetadata{Title: "Launch", Tags: []string{"demo"}, Workspace: "news",
+		CustomFields: map[string]interface{}{"desk": "sports"}}
+	got := lookupMetadata("a.mp4")
+	got.UpdatedAt = want.UpdatedAt
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("metadata %+v, want %+v", got, want)
+	}
+	var saved map[string]videoMetadata
+	if err := readJSONFile(metadataFile(), &saved); err != nil || saved["a.mp4"].Title != "Launch" {
+		t.Errorf("saved metadata %v: %v", saved, err)
+	}
+
+	forgetMetadata("a.mp4")
+	if m := lookupMetadata("a.mp4"); m.Title != "" {
+		t.Errorf("metadata kept after the video was forgotten: %+v", m)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics exposed on /metrics
+var (
+	uploadsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "videostreaming_uploads_total",
+		Help: "Video uploads by result.",
+	}, []string{"result"})
+
+	uploadBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "videostreaming_upload_bytes_total",
+		Help: "Bytes of successfully uploaded videos.",
+	})
+
+	jobDurationSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "videostreaming_job_duration_seconds",
+		Help:    "Wall time of finished jobs from start to finish.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 14), // 1s to ~2.3h
+	}, []string{"kind", "format", "resolution", "state"})
+
+	ffmpegExitsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "videostreaming_ffmpeg_exits_total",
+		Help: "Finished ffmpeg processes by exit code.",
+	}, []string{"code"})
+
+	ffmpegSpeed = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "videostreaming_ffmpeg_encode_speed",
+		Help:    "Encode speed reported by ffmpeg at the end of a run, as a multiple of realtime.",
+		Buckets: []float64{0.25, 0.5, 1, 1.5, 2, 4, 8, 16, 32},
+	})
+
+	servedBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "videostreaming_served_bytes_total",
+		Help: "Media bytes sent to clients by route.",
+	}, []string{"route"})
+
+	websocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "videostreaming_websocket_connections",
+		Help: "Open progress websocket connections.",
+	})
+)
+
+func init() {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "videostreaming_job_queue_depth",
+		Help: "Jobs waiting for a free worker.",
+	}, func() float64 {
+		return float64(queueDepth())
+	})
+
+	prometheus.MustRegister(
+		jobStateCollector{
+			desc: prometheus.NewDesc("videostreaming_jobs", "Known jobs by state.", []string{"state"}, nil),
+		},
+		diskUsageCollector{
+			desc: prometheus.NewDesc("videostreaming_disk_usage_bytes", "Bytes stored below a data directory.", []string{"dir"}, nil),
+		},
+	)
+}
+
+// jobStateCollector reports the job registry at scrape time
+type jobStateCollector struct {
+	desc *prometheus.Desc
+}
+
+func (c jobStateCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c jobStateCollector) Collect(ch chan<- prometheus.Metric) {
+	for state, n := range jobCounts() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(n), state)
+	}
+}
+
+// diskUsageCollector reports the size of uploadsDir and transcodedDir.
+// Walking the directories is expensive, so results are cached briefly.
+type diskUsageCollector struct {
+	desc *prometheus.Desc
+}
+
+// How long a measured directory size is reused
+const diskUsageCacheTTL = 30 * time.Second
+
+var (
+	diskUsageCache   = make(map[string]int64)
+	diskUsageCacheAt time.Time
+	diskUsageMu      sync.Mutex
+)
+
+func (c diskUsageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c diskUsageCollector) Collect(ch chan<- prometheus.Metric) {
+	diskUsageMu.Lock()
+	defer diskUsageMu.Unlock()
+
+	if time.Since(diskUsageCacheAt) > diskUsageCacheTTL {
+		diskUsageCache = map[string]int64{
+			"uploads":    dirSize(uploadsDir),
+			"transcoded": dirSize(transcodedDir),
+		}
+		diskUsageCacheAt = time.Now()
+	}
+	for dir, size := range diskUsageCache {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(size), dir)
+	}
+}
+
+// dirSize returns the total size of the regular files below root
+func dirSize(root string) int64 {
+	var total int64
+	filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// observeJob records the duration of a finished job
+func observeJob(j *job) {
+	s := j.snapshot()
+	jobDurationSeconds.
+		WithLabelValues(s.Kind, s.Format, s.Resolution, s.State).
+		Observe(s.FinishedAt.Sub(s.StartedAt).Seconds())
+}
+
+// observeFFmpegExit records the exit code and final speed of an ffmpeg run
+func observeFFmpegExit(exitCode int, speed float64) {
+	ffmpegExitsTotal.WithLabelValues(strconv.Itoa(exitCode)).Inc()
+	if speed > 0 {
+		ffmpegSpeed.Observe(speed)
+	}
+}
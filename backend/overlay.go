@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Directory holding the watermark image of each workspace
+var watermarksDir = "./uploads/watermarks"
+
+// Workspace names are used as directory names
+var workspacePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Maximum watermark image size
+const maxWatermarkSize = 5 * 1024 * 1024 // 5MB
+
+// Maximum length of a burned-in text line
+const maxOverlayTextLength = 200
+
+// Overlay positions and their x:y expressions for the overlay filter.
+// {margin} is replaced with the distance from the frame edge.
+var overlayPositions = map[string]string{
+	"top-left":     "{margin}:{margin}",
+	"top-right":    "main_w-overlay_w-{margin}:{margin}",
+	"bottom-left":  "{margin}:main_h-overlay_h-{margin}",
+	"bottom-right": "main_w-overlay_w-{margin}:main_h-overlay_h-{margin}",
+	"center":       "(main_w-overlay_w)/2:(main_h-overlay_h)/2",
+}
+
+// Same positions expressed for drawtext. {offset} moves each additional
+// text line away from the edge.
+var textPositions = map[string]string{
+	"top-left":     "x={margin}:y={margin}+{offset}",
+	"top-right":    "x=w-text_w-{margin}:y={margin}+{offset}",
+	"bottom-left":  "x={margin}:y=h-text_h-{margin}-{offset}",
+	"bottom-right": "x=w-text_w-{margin}:y=h-text_h-{margin}-{offset}",
+	"center":       "x=(w-text_w)/2:y=(h-text_h)/2+{offset}",
+}
+
+// overlayOptions describes what gets burned into the video
+type overlayOptions struct {
+	watermarkPath     string
+	watermarkPosition string
+	watermarkOpacity  float64
+	watermarkScale    float64 // Fraction of the video width
+
+	title        string
+	timestamp    bool
+	viewerID     string
+	textPosition string
+	textOpacity  float64
+	textFiles    []string // Files holding the text lines
+	tempFiles    []string // Removed by cleanup
+}
+
+// hasWatermark reports whether an image is overlaid
+func (o *overlayOptions) hasWatermark() bool {
+	return o != nil && o.watermarkPath != ""
+}
+
+// cleanup removes temporary files created for the overlay
+func (o *overlayOptions) cleanup() {
+	if o == nil {
+		return
+	}
+	for _, name := range o.tempFiles {
+		os.Remove(name)
+	}
+}
+
+// videoFilter is the video filtergraph of a transcode: the compiled
+// filter list, scaling to the target height and the burned-in overlays
+type videoFilter struct {
+	resolution string
+	preFilters []string
+	overlay    *overlayOptions
+}
+
+// inputArgs returns extra ffmpeg inputs. They must directly follow the
+// source input so the overlay image is input #1.
+func (f *videoFilter) inputArgs() []string {
+	if f.overlay.hasWatermark() {
+		return []string{"-i", f.overlay.watermarkPath}
+	}
+	return nil
+}
+
+// outputArgs returns the ffmpeg options applying the filtergraph
+func (f *videoFilter) outputArgs() []string {
+	chain := append([]string{}, f.preFilters...)
+	chain = append(chain, fmt.Sprintf("scale=-2:%s", f.resolution))
+	chain = append(chain, f.textFilters()...)
+
+	if !f.overlay.hasWatermark() {
+		return []string{"-vf", strings.Join(chain, ",")}
+	}
+
+	o := f.overlay
+	position := strings.ReplaceAll(overlayPositions[o.watermarkPosition], "{margin}", strconv.Itoa(f.margin()))
+	graph := fmt.Sprintf("[0:v]%s[base];", strings.Join(chain, ",")) +
+		fmt.Sprintf("[1:v]format=rgba,colorchannelmixer=aa=%.2f[wmraw];", o.watermarkOpacity) +
+		fmt.Sprintf("[wmraw][base]scale2ref=w=main_w*%.3f:h=ow/a[wm][main];", o.watermarkScale) +
+		fmt.Sprintf("[main][wm]overlay=%s[vout]", position)
+
+	return []string{"-filter_complex", graph, "-map", "[vout]", "-map", "0:a?"}
+}
+
+// margin is the distance in pixels between overlays and the frame edge
+func (f *videoFilter) margin() int {
+	height, _ := strconv.Atoi(f.resolution)
+	return height / 30
+}
+
+// textFilters returns one drawtext filter per text line. User supplied
+// text is read from files with expansion disabled, so it never becomes
+// part of the filtergraph syntax.
+func (f *videoFilter) textFilters() []string {
+	o := f.overlay
+	if o == nil {
+		return nil
+	}
+
+	height, _ := strconv.Atoi(f.resolution)
+	fontSize := height / 24
+	lineHeight := fontSize * 3 / 2
+	margin := f.margin()
+	style := fmt.Sprintf("fontsize=%d:fontcolor=white@%.2f:box=1:boxcolor=black@%.2f:boxborderw=%d",
+		fontSize, o.textOpacity, o.textOpacity*0.5, fontSize/4)
+
+	var filters []string
+	line := 0
+	position := func() string {
+		p := strings.NewReplacer(
+			"{margin}", strconv.Itoa(margin),
+			"{offset}", strconv.Itoa(line*lineHeight),
+		).Replace(textPositions[o.textPosition])
+		line++
+		return p
+	}
+
+	for _, name := range o.textFiles {
+		filters = append(filters, fmt.Sprintf("drawtext=textfile='%s':expansion=none:%s:%s",
+			escapeFilterPath(name), style, position()))
+	}
+	if o.timestamp {
+		filters = append(filters, fmt.Sprintf(`drawtext=text='%%{pts\:hms}':%s:%s`, style, position()))
+	}
+	return filters
+}
+
+// escapeFilterPath quotes a file path for use inside a filter option
+func escapeFilterPath(path string) string {
+	path = filepath.ToSlash(path)
+	path = strings.ReplaceAll(path, `\`, `\\`)
+	path = strings.ReplaceAll(path, `'`, `'\''`)
+	return strings.ReplaceAll(path, ":", `\:`)
+}
+
+// parseOverlayOptions reads the watermark and text overlay form fields of
+// a transcode request. It returns nil when nothing should be burned in.
+func parseOverlayOptions(c *fiber.Ctx) (*overlayOptions, error) {
+	o := &overlayOptions{
+		watermarkPosition: strings.ToLower(c.FormValue("watermarkPosition", "bottom-right")),
+		textPosition:      strings.ToLower(c.FormValue("overlayPosition", "top-left")),
+		title:             c.FormValue("overlayTitle"),
+		viewerID:          c.FormValue("overlayViewerId"),
+		timestamp:         c.FormValue("overlayTimestamp") == "true",
+	}
+
+	var err error
+	if o.watermarkOpacity, err = parseFraction(c.FormValue("watermarkOpacity", "0.8"), 0, 1); err != nil {
+		return nil, fmt.Errorf("invalid watermarkOpacity: %v", err)
+	}
+	if o.watermarkScale, err = parseFraction(c.FormValue("watermarkScale", "0.15"), 0.01, 1); err != nil {
+		return nil, fmt.Errorf("invalid watermarkScale: %v", err)
+	}
+	if o.textOpacity, err = parseFraction(c.FormValue("overlayOpacity", "0.9"), 0, 1); err != nil {
+		return nil, fmt.Errorf("invalid overlayOpacity: %v", err)
+	}
+	if _, ok := overlayPositions[o.watermarkPosition]; !ok {
+		return nil, fmt.Errorf("invalid watermarkPosition %q", o.watermarkPosition)
+	}
+	if _, ok := textPositions[o.textPosition]; !ok {
+		return nil, fmt.Errorf("invalid overlayPosition %q", o.textPosition)
+	}
+
+	// A watermark uploaded with the request wins over the workspace one
+	if file, err := c.FormFile("watermark"); err == nil {
+		if err := os.MkdirAll(jobInputsDir, 0755); err != nil {
+			return nil, err
+		}
+		path, err := saveWatermarkUpload(file, jobInputsDir, "")
+		if err != nil {
+			return nil, err
+		}
+		o.watermarkPath = path
+		o.tempFiles = append(o.tempFiles, path)
+	} else if workspace := c.FormValue("workspace"); workspace != "" {
+		if !workspacePattern.MatchString(workspace) {
+			return nil, fmt.Errorf("invalid workspace %q", workspace)
+		}
+		o.watermarkPath = findWorkspaceWatermark(workspace)
+	}
+
+	for _, text := range []string{o.title, o.viewerID} {
+		if text == "" {
+			continue
+		}
+		if err := validateOverlayText(text); err != nil {
+			o.cleanup()
+			return nil, err
+		}
+		file, err := createJobInput("overlay-*.txt")
+		if err != nil {
+			o.cleanup()
+			return nil, err
+		}
+		file.WriteString(text)
+		file.Close()
+		o.textFiles = append(o.textFiles, file.Name())
+		o.tempFiles = append(o.tempFiles, file.Name())
+	}
+
+	if o.watermarkPath == "" && o.title == "" && o.viewerID == "" && !o.timestamp {
+		return nil, nil
+	}
+	return o, nil
+}
+
+// parseFraction parses a float and checks it lies within [min, max]
+func parseFraction(value string, min, max float64) (float64, error) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", value)
+	}
+	if f < min || f > max {
+		return 0, fmt.Errorf("%v is outside %v-%v", f, min, max)
+	}
+	return f, nil
+}
+
+// validateOverlayText rejects overly long text and control characters
+func validateOverlayText(text string) error {
+	if len(text) > maxOverlayTextLength {
+		return fmt.Errorf("overlay text longer than %d characters", maxOverlayTextLength)
+	}
+	for _, r := range text {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("overlay text contains control characters")
+		}
+	}
+	return nil
+}
+
+// saveWatermarkUpload checks that an upload is a PNG or JPEG image and
+// stores it in dir. When name is empty a temporary file name is used.
+func saveWatermarkUpload(upload *multipart.FileHeader, dir, name string) (string, error) {
+	return saveImageUpload(upload, dir, name, "watermark")
+}
+
+// saveImageUpload stores a PNG or JPEG upload of up to maxWatermarkSize
+// in dir. kind names the image in errors and temporary file names.
+func saveImageUpload(upload *multipart.FileHeader, dir, name, kind string) (string, error) {
+	src, err := upload.Open()
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	data, err := io.ReadAll(io.LimitReader(src, maxWatermarkSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxWatermarkSize {
+		return "", fmt.Errorf("%s image larger than %d bytes", kind, maxWatermarkSize)
+	}
+
+	// Trust the content rather than the file name
+	var ext string
+	switch http.DetectContentType(data) {
+	case "image/png":
+		ext = ".png"
+	case "image/jpeg":
+		ext = ".jpg"
+	default:
+		return "", fmt.Errorf("%s %s must be a PNG or JPEG image", kind, upload.Filename)
+	}
+
+	var file *os.File
+	if name == "" {
+		file, err = os.CreateTemp(dir, kind+"-*"+ext)
+	} else {
+		file, err = os.Create(filepath.Join(dir, name+ext))
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// findWorkspaceWatermark returns the watermark image of a workspace, or ""
+func findWorkspaceWatermark(workspace string) string {
+	matches, _ := filepath.Glob(filepath.Join(watermarksDir, workspace, "watermark.*"))
+	if len(matches) == 0 {
+		return ""
+	}
+	return matches[0]
+}
+
+// uploadWorkspaceWatermark stores the watermark image of a workspace
+func uploadWorkspaceWatermark(c *fiber.Ctx) error {
+	workspace := c.Params("workspace")
+	if !workspacePattern.MatchString(workspace) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid workspace name",
+		})
+	}
+
+	file, err := c.FormFile("image")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("No image file provided or error parsing form: %v", err),
+		})
+	}
+
+	dir := filepath.Join(watermarksDir, workspace)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to create watermark directory", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to create watermark directory: %v", err),
+		})
+	}
+
+	// Replace the previous image, which may have another extension
+	previous := findWorkspaceWatermark(workspace)
+	path, err := saveWatermarkUpload(file, dir, "watermark.new")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if previous != "" {
+		os.Remove(previous)
+	}
+	finalPath := filepath.Join(dir, "watermark"+filepath.Ext(path))
+	if err := os.Rename(path, finalPath); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to store watermark", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to store watermark: %v", err),
+		})
+	}
+
+	slog.InfoContext(c.UserContext(), "Watermark updated", "workspace", workspace)
+	return c.JSON(fiber.Map{
+		"workspace": workspace,
+		"url":       fmt.Sprintf("/api/workspaces/%s/watermark", workspace),
+	})
+}
+
+// getWorkspaceWatermark returns the watermark image of a workspace
+func getWorkspaceWatermark(c *fiber.Ctx) error {
+	workspace := c.Params("workspace")
+	path := ""
+	if workspacePattern.MatchString(workspace) {
+		path = findWorkspaceWatermark(workspace)
+	}
+	if path == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Watermark not found",
+		})
+	}
+	return sendMedia(c, path)
+}
+
+// deleteWorkspaceWatermark removes the watermark image of a workspace
+func deleteWorkspaceWatermark(c *fiber.Ctx) error {
+	workspace := c.Params("workspace")
+	path := ""
+	if workspacePattern.MatchString(workspace) {
+		path = findWorkspaceWatermark(workspace)
+	}
+	if path == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Watermark not found",
+		})
+	}
+	if err := os.Remove(path); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to delete watermark", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to delete watermark: %v", err),
+		})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
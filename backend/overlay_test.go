@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestVideoFilterArgs(t *testing.T) {
+	style := "fontsize=30:fontcolor=white@0.90:box=1:boxcolor=black@0.45:boxborderw=7"
+	tests := []struct {
+		name    string
+		overlay *overlayOptions
+		inputs  []string
+		output  []string
+	}{
+		{
+			name:   "scale only",
+			output: []string{"-vf", "scale=-2:720"},
+		},
+		{
+			name: "text lines stack from the corner",
+			overlay: &overlayOptions{textPosition: "bottom-right", textOpacity: 0.9, timestamp: true,
+				textFiles: []string{"/tmp/title.txt"}},
+			output: []string{"-vf", "scale=-2:720," +
+				"drawtext=textfile='/tmp/title.txt':expansion=none:" + style + ":x=w-text_w-24:y=h-text_h-24-0," +
+				`drawtext=text='%{pts\:hms}':` + style + ":x=w-text_w-24:y=h-text_h-24-45"},
+		},
+		{
+			name: "watermark",
+			overlay: &overlayOptions{watermarkPath: "/tmp/wm.png", watermarkPosition: "top-right",
+				watermarkOpacity: 0.5, watermarkScale: 0.2},
+			inputs: []string{"-i", "/tmp/wm.png"},
+			output: []string{"-filter_complex", "[0:v]scale=-2:720[base];" +
+				"[1:v]format=rgba,colorchannelmixer=aa=0.50[wmraw];" +
+				"[wmraw][base]scale2ref=w=main_w*0.200:h=ow/a[wm][main];" +
+				"[main][wm]overlay=main_w-overlay_w-24:24[vout]",
+				"-map", "[vout]", "-map", "0:a?"},
+		},
+	}
+	for _, tt := range tests {
+		f := &videoFilter{resolution: "720", overlay: tt.overlay}
+		if got := f.inputArgs(); !slices.Equal(got, tt.inputs) {
+			t.Errorf("%s: inputs %q, want %q", tt.name, got, tt.inputs)
+		}
+		if got := f.outputArgs(); !slices.Equal(got, tt.output) {
+			t.Errorf("%s: outputs\n%q\nwant\n%q", tt.name, got, tt.output)
+		}
+	}
+}
+
+func TestEscapeFilterPath(t *testing.T) {
+	tests := []struct{ path, want string }{
+		{"/tmp/overlay-1.txt", "/tmp/overlay-1.txt"},
+		{"/tmp/it's:here.txt", `/tmp/it'\''s\:here.txt`},
+		{`/tmp/back\slash`, `/tmp/back\\slash`},
+	}
+	for _, tt := range tests {
+		if got := escapeFilterPath(tt.path); got != tt.want {
+			t.Errorf("escapeFilterPath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestParseOverlayOptions(t *testing.T) {
+	saved := watermarksDir
+	watermarksDir = t.TempDir()
+	t.Cleanup(func() { watermarksDir = saved })
+	workspaceWatermark := filepath.Join(watermarksDir, "acme", "watermark.png")
+	os.MkdirAll(filepath.Dir(workspaceWatermark), os.ModePerm)
+	if err := os.WriteFile(workspaceWatermark, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var got *overlayOptions
+	app := fiber.New()
+	app.Post("/", func(c *fiber.Ctx) error {
+		o, err := parseOverlayOptions(c)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString(err.Error())
+		}
+		got = o
+		return nil
+	})
+
+	tests := []struct {
+		name    string
+		fields  map[string]string
+		wantErr string
+		check   func(*overlayOptions) bool
+	}{
+		{"nothing to burn in", map[string]string{"watermarkOpacity": "0.5"}, "",
+			func(o *overlayOptions) bool { return o == nil }},
+		{"timestamp with defaults", map[string]string{"overlayTimestamp": "true"}, "",
+			func(o *overlayOptions) bool {
+				return o.timestamp && o.textPosition == "top-left" && o.textOpacity == 0.9 && !o.hasWatermark()
+			}},
+		{"workspace watermark", map[string]string{"workspace": "acme", "watermarkPosition": "Center"}, "",
+			func(o *overlayOptions) bool {
+				return o.watermarkPath == workspaceWatermark && o.watermarkPosition == "center" && o.watermarkScale == 0.15
+			}},
+		{"workspace without watermark", map[string]string{"workspace": "other"}, "",
+			func(o *overlayOptions) bool { return o == nil }},
+		{"bad workspace", map[string]string{"workspace": "../acme"}, "invalid workspace", nil},
+		{"opacity out of range", map[string]string{"watermarkOpacity": "1.5"}, "invalid watermarkOpacity", nil},
+		{"scale not a number", map[string]string{"watermarkScale": "big"}, "invalid watermarkScale", nil},
+		{"unknown position", map[string]string{"overlayPosition": "middle"}, "invalid overlayPosition", nil},
+		{"control characters", map[string]string{"overlayTitle": "a\nb"}, "control characters", nil},
+		{"text too long", map[string]string{"overlayViewerId": strings.Repeat("x", maxOverlayTextLength+1)}, "longer than", nil},
+	}
+	for _, tt := range tests {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		for name, value := range tt.fields {
+			form.WriteField(name, value)
+		}
+		form.Close()
+		req := httptest.NewRequest("POST", "/", &body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+
+		got = nil
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var message bytes.Buffer
+		message.ReadFrom(resp.Body)
+		if tt.wantErr != "" {
+			if resp.StatusCode != fiber.StatusBadRequest || !strings.Contains(message.String(), tt.wantErr) {
+				t.Errorf("%s: status %d %q, want an error containing %q", tt.name, resp.StatusCode, message.String(), tt.wantErr)
+			}
+			continue
+		}
+		if resp.StatusCode != fiber.StatusOK {
+			t.Errorf("%s: status %d %q", tt.name, resp.StatusCode, message.String())
+			continue
+		}
+		if !tt.check(got) {
+			t.Errorf("%s: got %+v", tt.name, got)
+		}
+	}
+}
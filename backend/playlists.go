@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log/slog"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Directory holding the cover image of each playlist
+var playlistCoversDir = "./uploads/playlists"
+
+// Playlist visibilities. There are no accounts, so they decide what is
+// listed and exported rather than who may edit.
+const (
+	visibilityPublic   = "public"   // Listed and exported
+	visibilityUnlisted = "unlisted" // Exported, but only listed on request
+	visibilityPrivate  = "private"  // Neither listed nor exported
+)
+
+var playlistVisibilities = []string{visibilityPublic, visibilityUnlisted, visibilityPrivate}
+
+// Maximum number of videos in a playlist
+const maxPlaylistItems = 1000
+
+// playlist is an ordered collection of videos, such as a course or series
+type playlist struct {
+	ID          string         `json:"id"`
+	Title       string         `json:"title"`
+	Description string         `json:"description,omitempty"`
+	Visibility  string         `json:"visibility"`
+	Cover       string         `json:"cover,omitempty"` // File name in the playlist's cover directory
+	Items       []playlistItem `json:"items"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+}
+
+// playlistItem is a video of a playlist. A video appears at most once.
+type playlistItem struct {
+	VideoID string    `json:"videoId"`
+	AddedAt time.Time `json:"addedAt"`
+}
+
+// Playlists by ID, persisted next to the uploads
+var (
+	playlists   = make(map[string]*playlist)
+	playlistsMu sync.Mutex
+)
+
+// playlistsFile is where playlists are stored
+func playlistsFile() string {
+	return filepath.Join(uploadsDir, ".playlists.json")
+}
+
+// loadPlaylists reads the stored playlists
+func loadPlaylists() error {
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	return readJSONFile(playlistsFile(), &playlists)
+}
+
+// savePlaylistsLocked writes the playlists to disk. playlistsMu must be
+// held.
+func savePlaylistsLocked() error {
+	return writeJSONFile(playlistsFile(), playlists)
+}
+
+// removeVideoFromPlaylists drops a deleted video from every playlist
+func removeVideoFromPlaylists(videoID string) {
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	changed := false
+	for _, p := range playlists {
+		if i := p.indexOf(videoID); i >= 0 {
+			p.Items = slices.Delete(p.Items, i, i+1)
+			p.UpdatedAt = time.Now()
+			changed = true
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := savePlaylistsLocked(); err != nil {
+		slog.Error("Failed to save playlists", "error", err)
+	}
+}
+
+// indexOf returns the position of a video in the playlist, or -1
+func (p *playlist) indexOf(videoID string) int {
+	return slices.IndexFunc(p.Items, func(item playlistItem) bool {
+		return item.VideoID == videoID
+	})
+}
+
+// coverURL returns the URL of the cover image, or ""
+func (p *playlist) coverURL() string {
+	if p.Cover == "" {
+		return ""
+	}
+	return fmt.Sprintf("/api/playlists/%s/cover", p.ID)
+}
+
+// response describes a playlist with the title and URL of its videos
+func (p *playlist) response() fiber.Map {
+	items := make([]fiber.Map, 0, len(p.Items))
+	for i, item := range p.Items {
+		items = append(items, fiber.Map{
+			"position": i,
+			"videoId":  item.VideoID,
+			"name":     lookupMetadata(item.VideoID).displayName(item.VideoID),
+			"url":      "/videos/" + item.VideoID,
+			"addedAt":  item.AddedAt,
+		})
+	}
+	return fiber.Map{
+		"id":          p.ID,
+		"title":       p.Title,
+		"description": p.Description,
+		"visibility":  p.Visibility,
+		"coverUrl":    p.coverURL(),
+		"items":       items,
+		"createdAt":   p.CreatedAt,
+		"updatedAt":   p.UpdatedAt,
+		"hlsUrl":      fmt.Sprintf("/api/playlists/%s/playlist.m3u8", p.ID),
+		"feedUrl":     fmt.Sprintf("/api/playlists/%s/feed.json", p.ID),
+	}
+}
+
+// playlistRequest holds the editable fields of a playlist. Nil fields are
+// left unchanged by an update.
+type playlistRequest struct {
+	Title       *string  `json:"title"`
+	Description *string  `json:"description"`
+	Visibility  *string  `json:"visibility"`
+	VideoIDs    []string `json:"videoIds"`
+}
+
+// apply validates the request and sets its fields on p
+func (req playlistRequest) apply(p *playlist) error {
+	if req.Title != nil {
+		title := strings.TrimSpace(*req.Title)
+		if title == "" || utf8.RuneCountInString(title) > maxTitleLength {
+			return fmt.Errorf("title must be 1 to %d characters", maxTitleLength)
+		}
+		p.Title = title
+	}
+	if req.Description != nil {
+		description := strings.TrimSpace(*req.Description)
+		if utf8.RuneCountInString(description) > maxDescriptionLength {
+			return fmt.Errorf("description must be at most %d characters", maxDescriptionLength)
+		}
+		p.Description = description
+	}
+	if req.Visibility != nil {
+		if !slices.Contains(playlistVisibilities, *req.Visibility) {
+			return fmt.Errorf("visibility must be one of %s", strings.Join(playlistVisibilities, ", "))
+		}
+		p.Visibility = *req.Visibility
+	}
+	return nil
+}
+
+// validatePlaylistVideos checks that videos exist and are listed once
+func validatePlaylistVideos(videoIDs []string) error {
+	if len(videoIDs) > maxPlaylistItems {
+		return fmt.Errorf("a playlist holds at most %d videos", maxPlaylistItems)
+	}
+	seen := make(map[string]bool)
+	for _, id := range videoIDs {
+		if seen[id] {
+			return fmt.Errorf("video %s is listed twice", id)
+		}
+		seen[id] = true
+		if !videoExists(id) {
+			return fmt.Errorf("video %s not found", id)
+		}
+	}
+	return nil
+}
+
+// videoExists reports whether id is an uploaded video
+func videoExists(id string) bool {
+	if !validVideoID(id) {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(uploadsDir, id))
+	return err == nil && !info.IsDir()
+}
+
+// validVideoID reports whether id can name a file of uploadsDir: a single
+// path element that is not hidden
+func validVideoID(id string) bool {
+	return id != "" && id == filepath.Base(id) && !strings.HasPrefix(id, ".")
+}
+
+// createPlaylist creates a playlist from a title, optional description,
+// visibility and initial videos
+func createPlaylist(c *fiber.Ctx) error {
+	var req playlistRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Title == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid playlist: title is required",
+		})
+	}
+
+	now := time.Now()
+	p := &playlist{
+		ID:         utils.UUIDv4(),
+		Visibility: visibilityPublic,
+		Items:      []playlistItem{},
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	err := req.apply(p)
+	if err == nil {
+		err = validatePlaylistVideos(req.VideoIDs)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid playlist: %v", err),
+		})
+	}
+	for _, id := range req.VideoIDs {
+		p.Items = append(p.Items, playlistItem{VideoID: id, AddedAt: now})
+	}
+
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	playlists[p.ID] = p
+	if err := savePlaylistsLocked(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save playlists", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save playlist",
+		})
+	}
+	slog.InfoContext(c.UserContext(), "Playlist created", "playlist_id", p.ID, "videos", len(p.Items))
+	return c.Status(fiber.StatusCreated).JSON(p.response())
+}
+
+// getPlaylists lists playlists, newest first. Only public playlists are
+// listed unless the visibility parameter asks for others, or "all".
+func getPlaylists(c *fiber.Ctx) error {
+	visibility := c.Query("visibility", visibilityPublic)
+	if visibility != "all" && !slices.Contains(playlistVisibilities, visibility) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("visibility must be all or one of %s", strings.Join(playlistVisibilities, ", ")),
+		})
+	}
+	video := c.Query("videoId")
+
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	var matching []*playlist
+	for _, p := range playlists {
+		if (visibility == "all" || p.Visibility == visibility) && (video == "" || p.indexOf(video) >= 0) {
+			matching = append(matching, p)
+		}
+	}
+	sort.Slice(matching, func(a, b int) bool {
+		return matching[a].CreatedAt.After(matching[b].CreatedAt)
+	})
+	list := make([]fiber.Map, 0, len(matching))
+	for _, p := range matching {
+		list = append(list, p.response())
+	}
+	return c.JSON(list)
+}
+
+// getPlaylist returns a playlist with its videos in order
+func getPlaylist(c *fiber.Ctx) error {
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	p, ok := playlists[c.Params("playlistId")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+	return c.JSON(p.response())
+}
+
+// updatePlaylist changes the title, description or visibility of a
+// playlist, and replaces its videos if videoIds is given
+func updatePlaylist(c *fiber.Ctx) error {
+	var req playlistRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	p, ok := playlists[c.Params("playlistId")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+	updated := *p
+	err := req.apply(&updated)
+	if err == nil && req.VideoIDs != nil {
+		err = validatePlaylistVideos(req.VideoIDs)
+	}
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("Invalid playlist: %v", err),
+		})
+	}
+	if req.VideoIDs != nil {
+		items := make([]playlistItem, 0, len(req.VideoIDs))
+		for _, id := range req.VideoIDs {
+			item := playlistItem{VideoID: id, AddedAt: time.Now()}
+			if i := p.indexOf(id); i >= 0 {
+				item.AddedAt = p.Items[i].AddedAt
+			}
+			items = append(items, item)
+		}
+		updated.Items = items
+	}
+	updated.UpdatedAt = time.Now()
+	*p = updated
+
+	if err := savePlaylistsLocked(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save playlists", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save playlist",
+		})
+	}
+	slog.InfoContext(c.UserContext(), "Playlist updated", "playlist_id", p.ID)
+	return c.JSON(p.response())
+}
+
+// deletePlaylist removes a playlist and its cover image. The videos are
+// kept.
+func deletePlaylist(c *fiber.Ctx) error {
+	id := c.Params("playlistId")
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	if _, ok := playlists[id]; !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+	delete(playlists, id)
+	if err := savePlaylistsLocked(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save playlists", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete playlist",
+		})
+	}
+	os.RemoveAll(filepath.Join(playlistCoversDir, id))
+
+	slog.InfoContext(c.UserContext(), "Playlist deleted", "playlist_id", id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// addPlaylistItem adds a video to a playlist, at the end or at position
+func addPlaylistItem(c *fiber.Ctx) error {
+	var req struct {
+		VideoID  string `json:"videoId"`
+		Position *int   `json:"position"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if !videoExists(req.VideoID) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Video not found",
+		})
+	}
+
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	p, ok := playlists[c.Params("playlistId")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+	if p.indexOf(req.VideoID) >= 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Video is already in the playlist",
+		})
+	}
+	if len(p.Items) >= maxPlaylistItems {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("A playlist holds at most %d videos", maxPlaylistItems),
+		})
+	}
+	position := len(p.Items)
+	if req.Position != nil {
+		if *req.Position < 0 || *req.Position > len(p.Items) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("position must be between 0 and %d", len(p.Items)),
+			})
+		}
+		position = *req.Position
+	}
+	p.Items = slices.Insert(p.Items, position, playlistItem{VideoID: req.VideoID, AddedAt: time.Now()})
+	p.UpdatedAt = time.Now()
+
+	if err := savePlaylistsLocked(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save playlists", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save playlist",
+		})
+	}
+	slog.InfoContext(c.UserContext(), "Video added to playlist", "playlist_id", p.ID, "video_id", req.VideoID, "position", position)
+	return c.JSON(p.response())
+}
+
+// removePlaylistItem removes a video from a playlist
+func removePlaylistItem(c *fiber.Ctx) error {
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	p, ok := playlists[c.Params("playlistId")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+	i := p.indexOf(c.Params("videoId"))
+	if i < 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video is not in the playlist",
+		})
+	}
+	p.Items = slices.Delete(p.Items, i, i+1)
+	p.UpdatedAt = time.Now()
+
+	if err := savePlaylistsLocked(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save playlists", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save playlist",
+		})
+	}
+	return c.JSON(p.response())
+}
+
+// reorderPlaylist puts the videos of a playlist in a new order. videoIds
+// must list every video of the playlist exactly once.
+func reorderPlaylist(c *fiber.Ctx) error {
+	var req struct {
+		VideoIDs []string `json:"videoIds"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	p, ok := playlists[c.Params("playlistId")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+	current := make([]string, 0, len(p.Items))
+	for _, item := range p.Items {
+		current = append(current, item.VideoID)
+	}
+	requested := slices.Clone(req.VideoIDs)
+	slices.Sort(current)
+	slices.Sort(requested)
+	if !slices.Equal(current, requested) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "videoIds must list every video of the playlist exactly once",
+		})
+	}
+
+	items := make([]playlistItem, 0, len(p.Items))
+	for _, id := range req.VideoIDs {
+		items = append(items, p.Items[p.indexOf(id)])
+	}
+	p.Items = items
+	p.UpdatedAt = time.Now()
+
+	if err := savePlaylistsLocked(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save playlists", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to save playlist",
+		})
+	}
+	slog.InfoContext(c.UserContext(), "Playlist reordered", "playlist_id", p.ID)
+	return c.JSON(p.response())
+}
+
+// uploadPlaylistCover stores the PNG/JPEG cover image of a playlist
+func uploadPlaylistCover(c *fiber.Ctx) error {
+	id := c.Params("playlistId")
+	playlistsMu.Lock()
+	_, ok := playlists[id]
+	playlistsMu.Unlock()
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+
+	file, err := c.FormFile("image")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("No image file provided or error parsing form: %v", err),
+		})
+	}
+	dir := filepath.Join(playlistCoversDir, id)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to create cover directory", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to create cover directory: %v", err),
+		})
+	}
+	tmp, err := saveImageUpload(file, dir, "", "cover")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	name := "cover" + filepath.Ext(tmp)
+	if err := os.Rename(tmp, filepath.Join(dir, name)); err != nil {
+		os.Remove(tmp)
+		slog.ErrorContext(c.UserContext(), "Failed to store cover", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to store cover: %v", err),
+		})
+	}
+
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	p, ok := playlists[id]
+	if !ok {
+		os.RemoveAll(dir)
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+	// A cover with the other extension is replaced
+	if p.Cover != "" && p.Cover != name {
+		os.Remove(filepath.Join(dir, p.Cover))
+	}
+	p.Cover = name
+	p.UpdatedAt = time.Now()
+	if err := savePlaylistsLocked(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save playlists", "error", err)
+	}
+
+	slog.InfoContext(c.UserContext(), "Playlist cover updated", "playlist_id", id)
+	return c.JSON(p.response())
+}
+
+// getPlaylistCover returns the cover image of a playlist
+func getPlaylistCover(c *fiber.Ctx) error {
+	playlistsMu.Lock()
+	p, ok := playlists[c.Params("playlistId")]
+	cover := ""
+	if ok && p.Cover != "" {
+		cover = filepath.Join(playlistCoversDir, p.ID, p.Cover)
+	}
+	playlistsMu.Unlock()
+	if cover == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Cover not found",
+		})
+	}
+	return sendMedia(c, cover)
+}
+
+// deletePlaylistCover removes the cover image of a playlist
+func deletePlaylistCover(c *fiber.Ctx) error {
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	p, ok := playlists[c.Params("playlistId")]
+	if !ok || p.Cover == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Cover not found",
+		})
+	}
+	os.Remove(filepath.Join(playlistCoversDir, p.ID, p.Cover))
+	p.Cover = ""
+	p.UpdatedAt = time.Now()
+	if err := savePlaylistsLocked(); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save playlists", "error", err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// exportablePlaylist returns a copy of a playlist unless it is missing or
+// private
+func exportablePlaylist(id string) (playlist, bool) {
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	p, ok := playlists[id]
+	if !ok || p.Visibility == visibilityPrivate {
+		return playlist{}, false
+	}
+	exported := *p
+	exported.Items = slices.Clone(p.Items)
+	return exported, true
+}
+
+// getPlaylistFeed exports a playlist as a JSON feed for the player: every
+// video in order with its metadata and playable sources
+func getPlaylistFeed(c *fiber.Ctx) error {
+	p, ok := exportablePlaylist(c.Params("playlistId"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+
+	items := make([]fiber.Map, 0, len(p.Items))
+	for _, item := range p.Items {
+		m := lookupMetadata(item.VideoID)
+		sources := []fiber.Map{}
+		for _, r := range videoRenditions(item.VideoID) {
+			if r.Status != renditionReady && r.Status != renditionLive {
+				continue
+			}
+			source := fiber.Map{"format": r.Format, "url": r.URL, "type": mediaType(r.URL)}
+			if r.Resolution != "" {
+				source["resolution"] = r.Resolution
+			}
+			sources = append(sources, source)
+		}
+		sources = append(sources, fiber.Map{
+			"format": "original",
+			"url":    "/videos/" + item.VideoID,
+			"type":   mediaType(item.VideoID),
+		})
+
+		entry := fiber.Map{
+			"id":          item.VideoID,
+			"title":       m.displayName(item.VideoID),
+			"description": m.Description,
+			"tags":        m.fields(item.VideoID)["tags"],
+			"sources":     sources,
+		}
+		if e, ok := lookupIndexEntry(item.VideoID); ok {
+			entry["duration"] = e.Duration
+		}
+		items = append(items, entry)
+	}
+
+	return c.JSON(fiber.Map{
+		"id":          p.ID,
+		"title":       p.Title,
+		"description": p.Description,
+		"coverUrl":    p.coverURL(),
+		"updatedAt":   p.UpdatedAt,
+		"items":       items,
+	})
+}
+
+// mediaType returns the MIME type of a media URL by its extension
+func mediaType(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".webm":
+		return "video/webm"
+	case ".mov":
+		return "video/quicktime"
+	case ".mkv":
+		return "video/x-matroska"
+	default:
+		return "video/mp4"
+	}
+}
+
+// getPlaylistHLS exports a playlist as a single HLS media playlist that
+// plays the HLS renditions of its videos one after another, separated by
+// discontinuities. Videos without a ready HLS rendition are skipped.
+func getPlaylistHLS(c *fiber.Ctx) error {
+	p, ok := exportablePlaylist(c.Params("playlistId"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Playlist not found",
+		})
+	}
+
+	var body strings.Builder
+	targetDuration := 1.0
+	videos := 0
+	for _, item := range p.Items {
+		if !renditionPlayable(item.VideoID, "hls") {
+			continue
+		}
+		baseName := strings.TrimSuffix(item.VideoID, filepath.Ext(item.VideoID))
+		segments, maxDuration, err := readHLSSegments(filepath.Join(transcodedDir, baseName, "playlist.m3u8"))
+		if err != nil {
+			slog.WarnContext(c.UserContext(), "Skipping video in playlist export", "playlist_id", p.ID, "video_id", item.VideoID, "error", err)
+			continue
+		}
+		if videos > 0 {
+			body.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		for _, segment := range segments {
+			fmt.Fprintf(&body, "#EXTINF:%s,\n/transcoded/%s/%s\n", segment.duration, baseName, segment.uri)
+		}
+		targetDuration = max(targetDuration, maxDuration)
+		videos++
+	}
+	if videos == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No video of the playlist has an HLS rendition",
+		})
+	}
+
+	c.Set(fiber.HeaderContentType, "application/vnd.apple.mpegurl")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	return c.SendString(fmt.Sprintf("#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:%d\n#EXT-X-MEDIA-SEQUENCE:0\n%s#EXT-X-ENDLIST\n",
+		int(math.Ceil(targetDuration)), body.String()))
+}
+
+// hlsSegment is a segment of an HLS media playlist
+type hlsSegment struct {
+	duration string // As written in the EXTINF tag
+	uri      string
+}
+
+// readHLSSegments returns the segments of a finished HLS media playlist and
+// the longest segment duration
+func readHLSSegments(playlistPath string) ([]hlsSegment, float64, error) {
+	file, err := os.Open(playlistPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	var segments []hlsSegment
+	longest := 0.0
+	duration := ""
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			duration, _, _ = strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			if d, err := strconv.ParseFloat(duration, 64); err == nil {
+				longest = max(longest, d)
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			if duration == "" || strings.Contains(line, "/") {
+				return nil, 0, fmt.Errorf("unexpected playlist entry %q", line)
+			}
+			segments = append(segments, hlsSegment{duration: duration, uri: line})
+			duration = ""
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	if len(segments) == 0 {
+		return nil, 0, fmt.Errorf("playlist has no segments")
+	}
+	return segments, longest, nil
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// usePlaylists gives a test uploaded videos without renditions, and no
+// playlists or covers
+func usePlaylists(t *testing.T, videos ...string) {
+	useMetadata(t, videos...)
+	savedCovers, savedTranscoded := playlistCoversDir, transcodedDir
+	playlistCoversDir, transcodedDir = t.TempDir(), t.TempDir()
+	playlistsMu.Lock()
+	savedPlaylists := playlists
+	playlists = make(map[string]*playlist)
+	playlistsMu.Unlock()
+	renditionsMu.Lock()
+	savedRenditions := renditions
+	renditions = make(map[string]map[string]*rendition)
+	renditionsMu.Unlock()
+
+	t.Cleanup(func() {
+		renditionsMu.Lock()
+		renditions = savedRenditions
+		renditionsMu.Unlock()
+		playlistsMu.Lock()
+		playlists = savedPlaylists
+		playlistsMu.Unlock()
+		playlistCoversDir, transcodedDir = savedCovers, savedTranscoded
+	})
+}
+
+func playlistApp() *fiber.App {
+	app := fiber.New()
+	app.Post("/playlists", createPlaylist)
+	app.Get("/playlists/:playlistId", getPlaylist)
+	app.Delete("/playlists/:playlistId", deletePlaylist)
+	app.Post("/playlists/:playlistId/items", addPlaylistItem)
+	app.Delete("/playlists/:playlistId/items/:videoId", removePlaylistItem)
+	app.Put("/playlists/:playlistId/order", reorderPlaylist)
+	app.Get("/playlists/:playlistId/playlist.m3u8", getPlaylistHLS)
+	app.Get("/playlists/:playlistId/feed.json", getPlaylistFeed)
+	return app
+}
+
+// callPlaylists sends a request with a JSON body and returns the status
+// and response body
+func callPlaylists(t *testing.T, app *fiber.App, method, path, body string) (int, []byte) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, data
+}
+
+// createTestPlaylist creates a playlist and returns its ID
+func createTestPlaylist(t *testing.T, app *fiber.App, body string) string {
+	t.Helper()
+	status, data := callPlaylists(t, app, http.MethodPost, "/playlists", body)
+	if status != fiber.StatusCreated {
+		t.Fatalf("creating a playlist: status %d: %s", status, data)
+	}
+	var p struct{ ID string }
+	json.Unmarshal(data, &p)
+	return p.ID
+}
+
+// playlistOrder returns the videos of a stored playlist in order
+func playlistOrder(id string) []string {
+	playlistsMu.Lock()
+	defer playlistsMu.Unlock()
+	order := []string{}
+	for _, item := range playlists[id].Items {
+		order = append(order, item.VideoID)
+	}
+	return order
+}
+
+func TestPlaylistItems(t *testing.T) {
+	usePlaylists(t, "a.mp4", "b.mp4", "c.mp4")
+	app := playlistApp()
+	if status, _ := callPlaylists(t, app, http.MethodPost, "/playlists", `{"title":"Course","videoIds":["a.mp4","a.mp4"]}`); status != fiber.StatusBadRequest {
+		t.Errorf("duplicate videos: status %d, want 400", status)
+	}
+	id := createTestPlaylist(t, app, `{"title":"Course","videoIds":["a.mp4","b.mp4"]}`)
+	items := "/playlists/" + id + "/items"
+	order := "/playlists/" + id + "/order"
+
+	steps := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		want   []string
+	}{
+		{"position past the end", http.MethodPost, items, `{"videoId":"c.mp4","position":3}`, fiber.StatusBadRequest, []string{"a.mp4", "b.mp4"}},
+		{"added at a position", http.MethodPost, items, `{"videoId":"c.mp4","position":0}`, fiber.StatusOK, []string{"c.mp4", "a.mp4", "b.mp4"}},
+		{"added twice", http.MethodPost, items, `{"videoId":"a.mp4"}`, fiber.StatusConflict, []string{"c.mp4", "a.mp4", "b.mp4"}},
+		{"unknown video", http.MethodPost, items, `{"videoId":"d.mp4"}`, fiber.StatusBadRequest, []string{"c.mp4", "a.mp4", "b.mp4"}},
+		{"reorder missing a video", http.MethodPut, order, `{"videoIds":["b.mp4","a.mp4"]}`, fiber.StatusBadRequest, []string{"c.mp4", "a.mp4", "b.mp4"}},
+		{"reorder repeating a video", http.MethodPut, order, `{"videoIds":["b.mp4","a.mp4","a.mp4"]}`, fiber.StatusBadRequest, []string{"c.mp4", "a.mp4", "b.mp4"}},
+		{"reordered", http.MethodPut, order, `{"videoIds":["b.mp4","c.mp4","a.mp4"]}`, fiber.StatusOK, []string{"b.mp4", "c.mp4", "a.mp4"}},
+		{"removed", http.MethodDelete, items + "/c.mp4", "", fiber.StatusOK, []string{"b.mp4", "a.mp4"}},
+		{"removed twice", http.MethodDelete, items + "/c.mp4", "", fiber.StatusNotFound, []string{"b.mp4", "a.mp4"}},
+	}
+	for _, step := range steps {
+		if status, body := callPlaylists(t, app, step.method, step.path, step.body); status != step.status {
+			t.Errorf("%s: status %d, want %d: %s", step.name, status, step.status, body)
+		}
+		if got := playlistOrder(id); !slices.Equal(got, step.want) {
+			t.Errorf("%s: order %v, want %v", step.name, got, step.want)
+		}
+	}
+
+	// Deleting a video drops it from the playlists holding it
+	removeVideoFromPlaylists("b.mp4")
+	if got := playlistOrder(id); !slices.Equal(got, []string{"a.mp4"}) {
+		t.Errorf("after deleting b.mp4: order %v, want [a.mp4]", got)
+	}
+	var saved map[string]*playlist
+	if err := readJSONFile(playlistsFile(), &saved); err != nil || len(saved[id].Items) != 1 {
+		t.Errorf("saved playlists %v: %v", saved, err)
+	}
+}
+
+// useHLSRendition gives a video a ready HLS rendition with a media playlist
+func useHLSRendition(t *testing.T, videoID, mediaPlaylist string) {
+	baseName := videoID[:len(videoID)-len(filepath.Ext(videoID))]
+	dir := filepath.Join(transcodedDir, baseName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "playlist.m3u8"), []byte(mediaPlaylist), 0644); err != nil {
+		t.Fatal(err)
+	}
+	renditionsMu.Lock()
+	renditions[videoID] = map[string]*rendition{
+		"hls": {Format: "hls", Status: renditionReady, URL: "/transcoded/" + baseName + "/playlist.m3u8"},
+	}
+	renditionsMu.Unlock()
+}
+
+func TestPlaylistExports(t *testing.T) {
+	usePlaylists(t, "a.mp4", "b.mov", "c.mp4")
+	useHLSRendition(t, "a.mp4", "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4.000,\nplaylist0.ts\n#EXTINF:2.5,\nplaylist1.ts\n#EXT-X-ENDLIST\n")
+	useHLSRendition(t, "b.mov", "#EXTM3U\n#EXT-X-TARGETDURATION:7\n#EXTINF:6.006,\nplaylist0.ts\n#EXT-X-ENDLIST\n")
+	metadataMu.Lock()
+	metadata["a.mp4"] = videoMetadata{Title: "Intro", Tags: []string{"basics"}}
+	metadataMu.Unlock()
+
+	app := playlistApp()
+	id := createTestPlaylist(t, app, `{"title":"Course","videoIds":["a.mp4","c.mp4","b.mov"]}`)
+
+	// c.mp4 has no HLS rendition and is skipped
+	status, body := callPlaylists(t, app, http.MethodGet, "/playlists/"+id+"/playlist.m3u8", "")
+	want := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:7\n#EXT-X-MEDIA-SEQUENCE:0\n" +
+		"#EXTINF:4.000,\n/transcoded/a/playlist0.ts\n#EXTINF:2.5,\n/transcoded/a/playlist1.ts\n" +
+		"#EXT-X-DISCONTINUITY\n#EXTINF:6.006,\n/transcoded/b/playlist0.ts\n#EXT-X-ENDLIST\n"
+	if status != fiber.StatusOK || string(body) != want {
+		t.Errorf("HLS export: status %d:\n%s\nwant:\n%s", status, body, want)
+	}
+
+	status, body = callPlaylists(t, app, http.MethodGet, "/playlists/"+id+"/feed.json", "")
+	var feed struct {
+		Title string
+		Items []struct {
+			ID      string
+			Title   string
+			Tags    []string
+			Sources []struct{ Format, URL, Type string }
+		}
+	}
+	if err := json.Unmarshal(body, &feed); err != nil || status != fiber.StatusOK {
+		t.Fatalf("JSON export: status %d: %v", status, err)
+	}
+	var got []string
+	for _, item := range feed.Items {
+		for _, s := range item.Sources {
+			got = append(got, item.ID+" "+item.Title+" "+s.Format+" "+s.URL+" "+s.Type)
+		}
+	}
+	wantSources := []string{
+		"a.mp4 Intro hls /transcoded/a/playlist.m3u8 application/vnd.apple.mpegurl",
+		"a.mp4 Intro original /videos/a.mp4 video/mp4",
+		"c.mp4 c.mp4 original /videos/c.mp4 video/mp4",
+		"b.mov b.mov hls /transcoded/b/playlist.m3u8 application/vnd.apple.mpegurl",
+		"b.mov b.mov original /videos/b.mov video/quicktime",
+	}
+	if feed.Title != "Course" || !slices.Equal(got, wantSources) || !slices.Equal(feed.Items[0].Tags, []string{"basics"}) {
+		t.Errorf("JSON export %q with sources:\n%q\nwant:\n%q", feed.Title, got, wantSources)
+	}
+
+	// Private playlists are not exported
+	playlistsMu.Lock()
+	playlists[id].Visibility = visibilityPrivate
+	playlistsMu.Unlock()
+	for _, export := range []string{"playlist.m3u8", "feed.json"} {
+		if status, _ := callPlaylists(t, app, http.MethodGet, "/playlists/"+id+"/"+export, ""); status != fiber.StatusNotFound {
+			t.Errorf("private %s: status %d, want 404", export, status)
+		}
+	}
+}
+
+func TestReadHLSSegments(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		playlist string
+		want     []hlsSegment
+		longest  float64
+		wantErr  bool
+	}{
+		{"segments", "#EXTM3U\n#EXTINF:2.002,title\nseg0.ts\n\n#EXTINF:3,\nseg1.ts\n#EXT-X-ENDLIST\n",
+			[]hlsSegment{{"2.002", "seg0.ts"}, {"3", "seg1.ts"}}, 3, false},
+		{"no segments", "#EXTM3U\n#EXT-X-ENDLIST\n", nil, 0, true},
+		{"nested path", "#EXTM3U\n#EXTINF:2,\n../other/seg0.ts\n", nil, 0, true},
+		{"entry without duration", "#EXTM3U\nseg0.ts\n", nil, 0, true},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "playlist.m3u8")
+		if err := os.WriteFile(path, []byte(tt.playlist), 0644); err != nil {
+			t.Fatal(err)
+		}
+		got, longest, err := readHLSSegments(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) || longest != tt.longest {
+			t.Errorf("%s: %v longest %g, want %v longest %g", tt.name, got, longest, tt.want, tt.longest)
+		}
+	}
+}
+
+func TestDeletePlaylist(t *testing.T) {
+	usePlaylists(t, "a.mp4")
+	app := playlistApp()
+	id := createTestPlaylist(t, app, `{"title":"Course","videoIds":["a.mp4"]}`)
+	cover := filepath.Join(playlistCoversDir, id, "cover.png")
+	os.MkdirAll(filepath.Dir(cover), os.ModePerm)
+	if err := os.WriteFile(cover, []byte("png"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	playlistsMu.Lock()
+	playlists[id].Cover = "cover.png"
+	playlistsMu.Unlock()
+
+	if status, _ := callPlaylists(t, app, http.MethodDelete, "/playlists/"+id, ""); status != fiber.StatusNoContent {
+		t.Fatalf("delete: status %d, want 204", status)
+	}
+	if _, err := os.Stat(filepath.Dir(cover)); !os.IsNotExist(err) {
+		t.Errorf("cover directory kept: %v", err)
+	}
+	if !videoExists("a.mp4") {
+		t.Error("video of the playlist deleted")
+	}
+	if status, _ := callPlaylists(t, app, http.MethodGet, "/playlists/"+id, ""); status != fiber.StatusNotFound {
+		t.Errorf("deleted playlist: status %d, want 404", status)
+	}
+	if status, _ := callPlaylists(t, app, http.MethodDelete, "/playlists/"+id, ""); status != fiber.StatusNotFound {
+		t.Errorf("deleted twice: status %d, want 404", status)
+	}
+	var saved map[string]*playlist
+	if err := readJSONFile(playlistsFile(), &saved); err != nil || len(saved) != 0 {
+		t.Errorf("saved playlists %v: %v", saved, err)
+	}
+}
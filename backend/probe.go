@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// videoProbe holds the stream properties read by ffprobe
+type videoProbe struct {
+	Duration   float64 `json:"duration"`
+	Width      int     `json:"width"`
+	Height     int     `json:"height"`
+	FrameRate  float64 `json:"frameRate"`
+	Frames     int64   `json:"frames"` // As written in the container, 0 when unknown
+	VideoCodec string  `json:"videoCodec"`
+	AudioCodec string  `json:"audioCodec"`
+	HasVideo   bool    `json:"hasVideo"`
+	HasAudio   bool    `json:"hasAudio"`
+}
+
+// ffprobeOutput mirrors the parts of `ffprobe -of json` that are used
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType    string `json:"codec_type"`
+		CodecName    string `json:"codec_name"`
+		Width        int    `json:"width"`
+		Height       int    `json:"height"`
+		AvgFrameRate string `json:"avg_frame_rate"`
+		RFrameRate   string `json:"r_frame_rate"`
+		NbFrames     string `json:"nb_frames"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+	} `json:"format"`
+}
+
+// probeVideo reads duration and stream information of a media file
+func probeVideo(ctx context.Context, filePath string) (*videoProbe, error) {
+	cmd := exec.Command("ffprobe",
+		"-v", "error",
+		"-show_entries", "format=duration:stream=codec_type,codec_name,width,height,avg_frame_rate,r_frame_rate,nb_frames",
+		"-of", "json",
+		filePath)
+	_, span := startCommand(ctx, cmd)
+	output, err := cmd.Output()
+	endCommand(span, cmd, err)
+	if err != nil {
+		return nil, fmt.Errorf("ffprobe failed: %v", err)
+	}
+
+	var parsed ffprobeOutput
+	if err := json.Unmarshal(output, &parsed); err != nil {
+		return nil, fmt.Errorf("could not parse ffprobe output: %v", err)
+	}
+
+	probe := &videoProbe{}
+	probe.Duration, _ = strconv.ParseFloat(parsed.Format.Duration, 64)
+	for _, stream := range parsed.Streams {
+		switch stream.CodecType {
+		case "video":
+			if probe.HasVideo {
+				continue
+			}
+			probe.HasVideo = true
+			probe.VideoCodec = stream.CodecName
+			probe.Width = stream.Width
+			probe.Height = stream.Height
+			probe.Frames, _ = strconv.ParseInt(stream.NbFrames, 10, 64)
+			probe.FrameRate = parseFrameRate(stream.AvgFrameRate)
+			if probe.FrameRate == 0 {
+				probe.FrameRate = parseFrameRate(stream.RFrameRate)
+			}
+		case "audio":
+			if probe.HasAudio {
+				continue
+			}
+			probe.HasAudio = true
+			probe.AudioCodec = stream.CodecName
+		}
+	}
+	return probe, nil
+}
+
+// parseFrameRate converts an ffprobe rational such as "30000/1001"
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0
+	}
+	if !found {
+		return n
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0
+	}
+	return n / d
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Header naming the viewer whose watch progress is read or saved
+const userIDHeader = "X-User-ID"
+
+// Maximum length of user IDs
+const maxUserIDLength = 100
+
+// Progress updates are kept in memory and written at most this often
+const progressSaveInterval = 10 * time.Second
+
+// A video counts as finished when less than this share of it is left
+const progressCompletedShare = 0.05
+
+// Positions before this many seconds are not worth resuming from
+const minResumeSeconds = 5
+
+// Default and maximum length of the watch history lists
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+// watchProgress is how far a viewer got in a video
+type watchProgress struct {
+	Position  float64   `json:"position"` // Seconds, 0 once completed
+	Duration  float64   `json:"duration,omitzero"`
+	Completed bool      `json:"completed"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// Watch progress per user ID and video ID, persisted next to the uploads
+var (
+	progress        = make(map[string]map[string]*watchProgress)
+	progressMu      sync.Mutex
+	progressPending bool // A save is scheduled
+)
+
+// progressFile is where watch progress is stored
+func progressFile() string {
+	return filepath.Join(uploadsDir, ".progress.json")
+}
+
+// loadProgress reads the stored watch progress
+func loadProgress() error {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	return readJSONFile(progressFile(), &progress)
+}
+
+// scheduleProgressSaveLocked writes the progress once progressSaveInterval
+// has passed, coalescing the updates received meanwhile. progressMu must be
+// held.
+func scheduleProgressSaveLocked() {
+	if progressPending {
+		return
+	}
+	progressPending = true
+	time.AfterFunc(progressSaveInterval, func() {
+		if err := flushProgress(); err != nil {
+			slog.Error("Failed to save watch progress", "error", err)
+		}
+	})
+}
+
+// flushProgress writes the watch progress if it has unsaved updates. A
+// failed write is tried again after progressSaveInterval.
+func flushProgress() error {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if !progressPending {
+		return nil
+	}
+	progressPending = false
+	if err := writeJSONFile(progressFile(), progress); err != nil {
+		scheduleProgressSaveLocked()
+		return err
+	}
+	return nil
+}
+
+// lookupProgress returns the progress of a user in a video
+func lookupProgress(userID, videoID string) (watchProgress, bool) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	p, ok := progress[userID][videoID]
+	if !ok {
+		return watchProgress{}, false
+	}
+	return *p, true
+}
+
+// forgetProgress removes the progress of every user in a deleted video
+func forgetProgress(videoID string) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	changed := false
+	for userID, videos := range progress {
+		if _, ok := videos[videoID]; ok {
+			delete(videos, videoID)
+			changed = true
+		}
+		if len(videos) == 0 {
+			delete(progress, userID)
+		}
+	}
+	if changed {
+		scheduleProgressSaveLocked()
+	}
+}
+
+// requestUserID returns the user of a request, or "" without one unless
+// it is required
+func requestUserID(c *fiber.Ctx, required bool) (string, error) {
+	userID := c.Get(userIDHeader)
+	if len(userID) > maxUserIDLength {
+		return "", fmt.Errorf("%s must be up to %d characters", userIDHeader, maxUserIDLength)
+	}
+	if required && userID == "" {
+		return "", fmt.Errorf("%s header is required", userIDHeader)
+	}
+	return userID, nil
+}
+
+// putVideoProgress saves the playback position of the requesting user.
+// Players may call it every few seconds; disk writes are batched.
+func putVideoProgress(c *fiber.Ctx) error {
+	userID, err := requestUserID(c, true)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	id := c.Params("id")
+	if !videoExists(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video not found",
+		})
+	}
+
+	var req struct {
+		Position *float64 `json:"position"`
+	}
+	if err := c.BodyParser(&req); err != nil || req.Position == nil || *req.Position < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "position must be a non-negative number of seconds",
+		})
+	}
+
+	p := watchProgress{
+		Position:  *req.Position,
+		Duration:  videoDuration(c.UserContext(), id),
+		UpdatedAt: time.Now(),
+	}
+	if p.Duration > 0 {
+		p.Position = min(p.Position, p.Duration)
+		if p.Duration-p.Position < p.Duration*progressCompletedShare {
+			p.Completed = true
+			p.Position = 0
+		}
+	}
+
+	progressMu.Lock()
+	if progress[userID] == nil {
+		progress[userID] = make(map[string]*watchProgress)
+	}
+	progress[userID][id] = &p
+	scheduleProgressSaveLocked()
+	progressMu.Unlock()
+
+	return c.JSON(p)
+}
+
+// deleteVideoProgress clears the progress of the requesting user
+func deleteVideoProgress(c *fiber.Ctx) error {
+	userID, err := requestUserID(c, true)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	id := c.Params("id")
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	if _, ok := progress[userID][id]; !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "No progress saved for this video",
+		})
+	}
+	delete(progress[userID], id)
+	if len(progress[userID]) == 0 {
+		delete(progress, userID)
+	}
+	scheduleProgressSaveLocked()
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// historyEntry is a video in a watch history list
+type historyEntry struct {
+	videoID  string
+	progress watchProgress
+}
+
+// userHistory returns the videos a user has progress in that keep
+// accepts, most recently watched first
+func userHistory(userID string, keep func(watchProgress) bool) []historyEntry {
+	progressMu.Lock()
+	var entries []historyEntry
+	for videoID, p := range progress[userID] {
+		if keep(*p) {
+			entries = append(entries, historyEntry{videoID: videoID, progress: *p})
+		}
+	}
+	progressMu.Unlock()
+
+	sort.Slice(entries, func(a, b int) bool {
+		return entries[a].progress.UpdatedAt.After(entries[b].progress.UpdatedAt)
+	})
+	return entries
+}
+
+// sendHistory responds with a page of watch history entries, each as a
+// video list item with its progress
+func sendHistory(c *fiber.Ctx, keep func(watchProgress) bool) error {
+	userID, err := requestUserID(c, true)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	limit := defaultHistoryLimit
+	if value := c.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > maxHistoryLimit {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit),
+			})
+		}
+	}
+
+	videos := make([]fiber.Map, 0, limit)
+	for _, entry := range userHistory(userID, keep) {
+		if len(videos) == limit {
+			break
+		}
+		e, ok := lookupIndexEntry(entry.videoID)
+		if !ok {
+			continue
+		}
+		item := videoListItem(e)
+		item["progress"] = entry.progress
+		videos = append(videos, item)
+	}
+	return c.JSON(videos)
+}
+
+// getContinueWatching lists the videos the requesting user started and has
+// not finished, most recently watched first
+func getContinueWatching(c *fiber.Ctx) error {
+	return sendHistory(c, func(p watchProgress) bool {
+		return !p.Completed && p.Position >= minResumeSeconds
+	})
+}
+
+// getRecentlyWatched lists every video the requesting user has watched,
+// finished or not, most recently watched first
+func getRecentlyWatched(c *fiber.Ctx) error {
+	return sendHistory(c, func(watchProgress) bool { return true })
+}
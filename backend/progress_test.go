@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// useProgress gives a test empty watch progress and uploaded videos with
+// the durations in the search index
+func useProgress(t *testing.T, durations map[string]float64) {
+	dir := t.TempDir()
+	for id := range durations {
+		if err := os.WriteFile(filepath.Join(dir, id), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	savedDir := uploadsDir
+	uploadsDir = dir
+	indexMu.Lock()
+	savedIndex := index
+	index = make(map[string]*indexEntry)
+	for id, duration := range durations {
+		index[id] = &indexEntry{id: id, Duration: duration}
+	}
+	indexMu.Unlock()
+	progressMu.Lock()
+	savedProgress, savedPending := progress, progressPending
+	progress, progressPending = make(map[string]map[string]*watchProgress), false
+	progressMu.Unlock()
+
+	t.Cleanup(func() {
+		progressMu.Lock()
+		progress, progressPending = savedProgress, savedPending
+		progressMu.Unlock()
+		indexMu.Lock()
+		index = savedIndex
+		indexMu.Unlock()
+		uploadsDir = savedDir
+	})
+}
+
+func progressApp() *fiber.App {
+	app := fiber.New()
+	app.Put("/videos/:id/progress", putVideoProgress)
+	app.Get("/history/continue-watching", getContinueWatching)
+	app.Get("/history/recently-watched", getRecentlyWatched)
+	return app
+}
+
+func TestPutVideoProgress(t *testing.T) {
+	useProgress(t, map[string]float64{"a.mp4": 100, "unprobed.mp4": 0})
+	app := progressApp()
+
+	tests := []struct {
+		name      string
+		video     string
+		user      string
+		body      string
+		status    int
+		position  float64
+		completed bool
+	}{
+		{"midway", "a.mp4", "u", `{"position": 50}`, fiber.StatusOK, 50, false},
+		{"more than the last share left", "a.mp4", "u", `{"position": 94}`, fiber.StatusOK, 94, false},
+		{"less than the last share left", "a.mp4", "u", `{"position": 95.5}`, fiber.StatusOK, 0, true},
+		{"at the end", "a.mp4", "u", `{"position": 100}`, fiber.StatusOK, 0, true},
+		{"past the end is clamped", "a.mp4", "u", `{"position": 250}`, fiber.StatusOK, 0, true},
+		{"unknown duration", "unprobed.mp4", "u", `{"position": 250}`, fiber.StatusOK, 250, false},
+		{"negative position", "a.mp4", "u", `{"position": -1}`, fiber.StatusBadRequest, 0, false},
+		{"missing position", "a.mp4", "u", `{}`, fiber.StatusBadRequest, 0, false},
+		{"missing user", "a.mp4", "", `{"position": 10}`, fiber.StatusBadRequest, 0, false},
+		{"unknown video", "b.mp4", "u", `{"position": 10}`, fiber.StatusNotFound, 0, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/videos/"+tt.video+"/progress", bytes.NewReader([]byte(tt.body)))
+		req.Header.Set("Content-Type", "application/json")
+		if tt.user != "" {
+			req.Header.Set(userIDHeader, tt.user)
+		}
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, resp.StatusCode, tt.status)
+			continue
+		}
+		if tt.status != fiber.StatusOK {
+			continue
+		}
+		saved, ok := lookupProgress(tt.user, tt.video)
+		if !ok || saved.Position != tt.position || saved.Completed != tt.completed {
+			t.Errorf("%s: saved %+v, want position %v and completed %v", tt.name, saved, tt.position, tt.completed)
+		}
+	}
+}
+
+func TestWatchHistoryLists(t *testing.T) {
+	durations := map[string]float64{"a.mp4": 100, "b.mp4": 100, "c.mp4": 100, "d.mp4": 100, "e.mp4": 100}
+	useProgress(t, durations)
+	now := time.Now()
+	progressMu.Lock()
+	progress["u"] = map[string]*watchProgress{
+		"a.mp4": {Position: 3, UpdatedAt: now},                                // Too early to resume
+		"b.mp4": {Position: 50, UpdatedAt: now.Add(-time.Minute)},             // Started
+		"c.mp4": {Completed: true, UpdatedAt: now.Add(-2 * time.Minute)},      // Finished
+		"d.mp4": {Position: minResumeSeconds, UpdatedAt: now.Add(-time.Hour)}, // Just worth resuming
+		"e.mp4": {Position: 80, UpdatedAt: now.Add(-3 * time.Minute)},         // Deleted since
+		"x.mp4": {Position: 80, UpdatedAt: now.Add(-4 * time.Minute)},         // Not in the index
+	}
+	progress["other"] = map[string]*watchProgress{"a.mp4": {Position: 60, UpdatedAt: now}}
+	progressMu.Unlock()
+	indexMu.Lock()
+	delete(index, "e.mp4")
+	indexMu.Unlock()
+	app := progressApp()
+
+	tests := []struct {
+		path string
+		want []string
+	}{
+		{"/history/continue-watching", []string{"b.mp4", "d.mp4"}},
+		{"/history/recently-watched", []string{"a.mp4", "b.mp4", "c.mp4", "d.mp4"}},
+		{"/history/recently-watched?limit=2", []string{"a.mp4", "b.mp4"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set(userIDHeader, "u")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var items []struct {
+			ID string `json:"id"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&items); err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		var got []string
+		for _, item := range items {
+			got = append(got, item.ID)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestFlushProgressRetries(t *testing.T) {
+	useProgress(t, nil)
+	progressMu.Lock()
+	progress["u"] = map[string]*watchProgress{"a.mp4": {Position: 30}}
+	progressPending = true
+	progressMu.Unlock()
+
+	// The write fails while the directory is missing
+	dir := uploadsDir
+	uploadsDir = filepath.Join(dir, "missing")
+	if err := flushProgress(); err == nil {
+		t.Fatal("flushProgress succeeded without a directory")
+	}
+	progressMu.Lock()
+	pending := progressPending
+	progressMu.Unlock()
+	if !pending {
+		t.Fatal("updates of a failed write are no longer pending")
+	}
+
+	uploadsDir = dir
+	if err := flushProgress(); err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]map[string]*watchProgress
+	if err := readJSONFile(progressFile(), &saved); err != nil {
+		t.Fatal(err)
+	}
+	if p := saved["u"]["a.mp4"]; p == nil || p.Position != 30 {
+		t.Errorf("saved progress %+v, want position 30", saved)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Quality metrics that can be measured against the source
+var qualityMetrics = []string{"vmaf", "psnr", "ssim"}
+
+// qualityScores compares a rendition with its source. Only the measured
+// metrics are set.
+type qualityScores struct {
+	VMAF *float64 `json:"vmaf,omitempty"` // 0 to 100
+	PSNR *float64 `json:"psnr,omitempty"` // Average in dB
+	SSIM *float64 `json:"ssim,omitempty"` // 0 to 1
+}
+
+// Summary lines ffmpeg prints for each metric filter
+var (
+	vmafScorePattern = regexp.MustCompile(`VMAF score: ([0-9.]+)`)
+	psnrScorePattern = regexp.MustCompile(`PSNR y:.* average:([0-9.]+|inf)`)
+	ssimScorePattern = regexp.MustCompile(`SSIM Y:.* All:([0-9.]+)`)
+)
+
+// parseQualityMetrics reads a comma separated list of metrics. "all"
+// selects every metric and "none" measures nothing.
+func parseQualityMetrics(value string) ([]string, error) {
+	var metrics []string
+	for _, metric := range splitList(strings.ToLower(value)) {
+		switch metric {
+		case "all":
+			return qualityMetrics, nil
+		case "none":
+			return nil, nil
+		}
+		if !slices.Contains(qualityMetrics, metric) {
+			return nil, fmt.Errorf("unknown quality metric %q, use vmaf, psnr or ssim", metric)
+		}
+		if !slices.Contains(metrics, metric) {
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics, nil
+}
+
+// verifyOutput checks a finished transcode against its source before it is
+// published: the duration must match within the configured tolerance and
+// the streams of the source must be present. The requested metrics are
+// measured and compared with the configured thresholds; the scores are
+// returned even when they fall short.
+func verifyOutput(ctx context.Context, outputPath, sourcePath string, metrics []string) (*qualityScores, error) {
+	settings := getConfig().Verification
+
+	output, err := probeVideo(ctx, outputPath)
+	if err != nil {
+		return nil, err
+	}
+	source, err := probeVideo(ctx, sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if !output.HasVideo {
+		return nil, fmt.Errorf("output has no video stream")
+	}
+	if source.HasAudio && !output.HasAudio {
+		return nil, fmt.Errorf("output has no audio stream")
+	}
+	if source.Duration > 0 {
+		if diff := math.Abs(output.Duration - source.Duration); diff > settings.DurationToleranceSeconds {
+			return nil, fmt.Errorf("output lasts %.2fs, the source %.2fs", output.Duration, source.Duration)
+		}
+	}
+
+	if len(metrics) == 0 {
+		return nil, nil
+	}
+	scores, err := measureQuality(ctx, outputPath, sourcePath, source, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case scores.VMAF != nil && *scores.VMAF < settings.MinVMAF:
+		err = fmt.Errorf("VMAF %.2f is below the minimum of %.2f", *scores.VMAF, settings.MinVMAF)
+	case scores.PSNR != nil && *scores.PSNR < settings.MinPSNR:
+		err = fmt.Errorf("PSNR %.2fdB is below the minimum of %.2fdB", *scores.PSNR, settings.MinPSNR)
+	case scores.SSIM != nil && *scores.SSIM < settings.MinSSIM:
+		err = fmt.Errorf("SSIM %.4f is below the minimum of %.4f", *scores.SSIM, settings.MinSSIM)
+	}
+	return scores, err
+}
+
+// measureQuality runs ffmpeg's libvmaf, psnr and ssim filters over the
+// output and the source. The output is scaled to the source's size, so
+// every frame is compared at the original resolution.
+func measureQuality(ctx context.Context, outputPath, sourcePath string, source *videoProbe, metrics []string) (*qualityScores, error) {
+	var graph strings.Builder
+	fmt.Fprintf(&graph, "[0:v]scale=%d:%d:flags=bicubic,format=yuv420p,setpts=PTS-STARTPTS,split=%d", source.Width, source.Height, len(metrics))
+	for i := range metrics {
+		fmt.Fprintf(&graph, "[dist%d]", i)
+	}
+	fmt.Fprintf(&graph, ";[1:v]format=yuv420p,setpts=PTS-STARTPTS,split=%d", len(metrics))
+	for i := range metrics {
+		fmt.Fprintf(&graph, "[ref%d]", i)
+	}
+	for i, metric := range metrics {
+		filter := metric
+		if metric == "vmaf" {
+			filter = "libvmaf"
+		}
+		fmt.Fprintf(&graph, ";[dist%d][ref%d]%s", i, i, filter)
+	}
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-hide_banner", "-nostats",
+		"-i", outputPath,
+		"-i", sourcePath,
+		"-lavfi", graph.String(),
+		"-f", "null", "-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	_, span := startCommand(ctx, cmd)
+	err := cmd.Run()
+	endCommand(span, cmd, err)
+	if err != nil {
+		if strings.Contains(stderr.String(), "No such filter: 'libvmaf'") {
+			return nil, fmt.Errorf("VMAF needs an ffmpeg built with libvmaf")
+		}
+		return nil, fmt.Errorf("quality measurement failed: %v", err)
+	}
+
+	scores := &qualityScores{}
+	for _, metric := range metrics {
+		var pattern *regexp.Regexp
+		var score **float64
+		switch metric {
+		case "vmaf":
+			pattern, score = vmafScorePattern, &scores.VMAF
+		case "psnr":
+			pattern, score = psnrScorePattern, &scores.PSNR
+		case "ssim":
+			pattern, score = ssimScorePattern, &scores.SSIM
+		}
+		match := pattern.FindSubmatch(stderr.Bytes())
+		if match == nil {
+			return nil, fmt.Errorf("ffmpeg reported no %s score", strings.ToUpper(metric))
+		}
+		// Identical frames have an infinite PSNR, stored as 100dB
+		value, err := strconv.ParseFloat(string(match[1]), 64)
+		if err != nil || math.IsInf(value, 0) {
+			value = 100
+		}
+		*score = &value
+	}
+	return scores, nil
+}
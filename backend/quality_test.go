@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseQualityMetrics(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"vmaf", []string{"vmaf"}, false},
+		{"SSIM, psnr,ssim", []string{"ssim", "psnr"}, false},
+		{"psnr,all", qualityMetrics, false},
+		{"none", nil, false},
+		{"vmaf,bitrate", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseQualityMetrics(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseQualityMetrics(%q) error = %v, want error %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseQualityMetrics(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+// fakeFFmpeg puts ffprobe and ffmpeg scripts first in PATH. ffprobe prints
+// the contents of <file>.probe next to the probed file, ffmpeg prints
+// stderr to its standard error and exits with code.
+func fakeFFmpeg(t *testing.T, stderr string, code string) {
+	bin := t.TempDir()
+	scripts := map[string]string{
+		"ffprobe": "#!/bin/sh\nfor last; do :; done\ncat \"$last.probe\"\n",
+		"ffmpeg":  "#!/bin/sh\ncat " + filepath.Join(bin, "stderr") + " >&2\nexit " + code + "\n",
+		"stderr":  stderr,
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// probed writes the ffprobe output of a fake media file
+func probed(t *testing.T, dir, name, duration string, streams ...string) string {
+	path := filepath.Join(dir, name)
+	var list []string
+	for _, s := range streams {
+		list = append(list, `{"codec_type":"`+s+`","width":1920,"height":1080}`)
+	}
+	output := `{"streams":[` + strings.Join(list, ",") + `],"format":{"duration":"` + duration + `"}}`
+	if err := os.WriteFile(path+".probe", []byte(output), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// useVerification sets the verification settings of the configuration
+func useVerification(t *testing.T, v verifyConfig) {
+	cfg := *defaultConfig()
+	cfg.Verification = v
+	configMu.Lock()
+	saved := currentConfig
+	currentConfig = &cfg
+	configMu.Unlock()
+	t.Cleanup(func() {
+		configMu.Lock()
+		currentConfig = saved
+		configMu.Unlock()
+	})
+}
+
+func TestVerifyOutput(t *testing.T) {
+	useVerification(t, verifyConfig{DurationToleranceSeconds: 1, MinVMAF: 90, MinSSIM: 0.95})
+	dir := t.TempDir()
+	source := probed(t, dir, "source.mp4", "60.0", "video", "audio")
+	outputs := map[string]string{
+		"good":     probed(t, dir, "good.mp4", "60.8", "video", "audio"),
+		"short":    probed(t, dir, "short.mp4", "58.5", "video", "audio"),
+		"silent":   probed(t, dir, "silent.mp4", "60.0", "video"),
+		"no video": probed(t, dir, "audio.mp4", "60.0", "audio"),
+	}
+	scores := "[Parsed_libvmaf_4] VMAF score: 93.512\n" +
+		"[Parsed_psnr_5] PSNR y:inf u:inf v:inf average:inf min:inf max:inf\n" +
+		"[Parsed_ssim_6] SSIM Y:0.93 (11.5) U:0.95 V:0.96 All:0.940000 (12.2)\n"
+
+	tests := []struct {
+		name    string
+		output  string
+		metrics []string
+		stderr  string
+		code    string
+		wantErr string
+		want    *qualityScores
+	}{
+		{name: "checks pass", output: "good"},
+		{name: "duration differs", output: "short", wantErr: "lasts 58.50s"},
+		{name: "audio dropped", output: "silent", wantErr: "no audio stream"},
+		{name: "video dropped", output: "no video", wantErr: "no video stream"},
+		{name: "scores above minimums", output: "good", metrics: []string{"vmaf", "psnr"}, stderr: scores, code: "0",
+			want: &qualityScores{VMAF: ptr(93.512), PSNR: ptr(100)}},
+		{name: "score below minimum", output: "good", metrics: qualityMetrics, stderr: scores, code: "0",
+			wantErr: "SSIM 0.9400 is below the minimum of 0.9500",
+			want:    &qualityScores{VMAF: ptr(93.512), PSNR: ptr(100), SSIM: ptr(0.94)}},
+		{name: "score missing", output: "good", metrics: []string{"ssim"}, stderr: "no summary\n", code: "0",
+			wantErr: "no SSIM score"},
+		{name: "ffmpeg without libvmaf", output: "good", metrics: []string{"vmaf"},
+			stderr: "[AVFilterGraph] No such filter: 'libvmaf'\n", code: "1", wantErr: "needs an ffmpeg built with libvmaf"},
+	}
+	for _, tt := range tests {
+		fakeFFmpeg(t, tt.stderr, tt.code)
+		got, err := verifyOutput(t.Context(), outputs[tt.output], source, tt.metrics)
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+		if !sameScores(got, tt.want) {
+			t.Errorf("%s: scores %s, want %s", tt.name, formatScores(got), formatScores(tt.want))
+		}
+	}
+}
+
+func ptr(f float64) *float64 {
+	return &f
+}
+
+// sameScores compares the measured metrics of two results
+func sameScores(a, b *qualityScores) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	same := func(x, y *float64) bool { return (x == nil && y == nil) || (x != nil && y != nil && *x == *y) }
+	return same(a.VMAF, b.VMAF) && same(a.PSNR, b.PSNR) && same(a.SSIM, b.SSIM)
+}
+
+// formatScores prints scores for test failures
+func formatScores(s *qualityScores) string {
+	if s == nil {
+		return "none"
+	}
+	var parts []string
+	for name, v := range map[string]*float64{"vmaf": s.VMAF, "psnr": s.PSNR, "ssim": s.SSIM} {
+		if v != nil {
+			parts = append(parts, fmt.Sprintf("%s=%g", name, *v))
+		}
+	}
+	slices.Sort(parts)
+	return strings.Join(parts, " ")
+}
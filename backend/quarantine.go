@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Define global directory for rejected uploads
+var quarantineDir = "./uploads/quarantine"
+
+// Bytes read from the start of uploads to recognise their container
+const sniffLength = 512
+
+// Extensions each sniffed container may be stored under, the usual one
+// first
+var containerExtensions = map[string][]string{
+	"mp4":      {".mp4", ".m4v", ".mov"},
+	"mov":      {".mov"},
+	"3gp":      {".3gp", ".3g2"},
+	"webm":     {".webm", ".mkv"},
+	"matroska": {".mkv"},
+	"avi":      {".avi"},
+	"flv":      {".flv"},
+	"ogg":      {".ogv", ".ogg"},
+	"asf":      {".wmv", ".asf"},
+	"mpeg-ps":  {".mpg", ".mpeg"},
+	"mpeg-ts":  {".ts"},
+}
+
+// sniffContainer recognises the container of a file from its first bytes.
+// It returns "" for content that is not a known video container.
+func sniffContainer(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	head := make([]byte, sniffLength)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	return detectContainer(head[:n]), nil
+}
+
+// detectContainer matches the magic bytes of the containers ffmpeg reads
+// that uploads may use
+func detectContainer(head []byte) string {
+	at := func(offset int, magic string) bool {
+		return len(head) >= offset+len(magic) && string(head[offset:offset+len(magic)]) == magic
+	}
+
+	switch {
+	case at(4, "ftyp"):
+		// ISO base media files name their brand after the box type
+		switch {
+		case at(8, "qt  "):
+			return "mov"
+		case at(8, "3g"):
+			return "3gp"
+		default:
+			return "mp4"
+		}
+	case at(4, "moov"), at(4, "mdat"), at(4, "free"), at(4, "skip"), at(4, "wide"), at(4, "pnot"):
+		// QuickTime files from before the ftyp box
+		return "mov"
+	case at(0, "\x1a\x45\xdf\xa3"):
+		// The EBML header names the document type
+		if bytes.Contains(head[:min(64, len(head))], []byte("webm")) {
+			return "webm"
+		}
+		return "matroska"
+	case at(0, "RIFF") && at(8, "AVI "):
+		return "avi"
+	case at(0, "FLV\x01"):
+		return "flv"
+	case at(0, "OggS"):
+		return "ogg"
+	case at(0, "\x30\x26\xb2\x75\x8e\x66\xcf\x11"):
+		return "asf"
+	case at(0, "\x00\x00\x01\xba"):
+		return "mpeg-ps"
+	case at(0, "\x47") && at(188, "\x47") && at(376, "\x47"):
+		return "mpeg-ts"
+	}
+	return ""
+}
+
+// containsFold reports whether list holds s, ignoring case
+func containsFold(list []string, s string) bool {
+	return slices.ContainsFunc(list, func(item string) bool {
+		return strings.EqualFold(item, s)
+	})
+}
+
+// knownVideoExtension reports whether ext belongs to any sniffed container
+func knownVideoExtension(ext string) bool {
+	for _, extensions := range containerExtensions {
+		if containsFold(extensions, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// uploadFilename names an upload after its content: an extension that fits
+// the sniffed container is kept, a video extension that does not is
+// replaced, and anything else gets the usual extension of the container
+// appended. It fails when no allowed extension fits.
+func uploadFilename(filename, container string, cfg *config) (string, error) {
+	extensions := containerExtensions[container]
+	ext := filepath.Ext(filename)
+	if containsFold(extensions, ext) && cfg.allowsExtension(ext) {
+		return filename, nil
+	}
+	base := filename
+	if cfg.allowsExtension(ext) || knownVideoExtension(ext) {
+		base = strings.TrimSuffix(filename, ext)
+	}
+	for _, candidate := range extensions {
+		if cfg.allowsExtension(candidate) {
+			return base + candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s files are not accepted (allowed: %s)", container, strings.Join(cfg.AllowedExtensions, ", "))
+}
+
+// checkUploadProbe reads an upload with ffprobe and returns why it is
+// refused, or "" when it is within the limits. Files that would take
+// excessive memory or time to decode are refused before any job sees them.
+func checkUploadProbe(ctx context.Context, path string, limits uploadLimits) (*videoProbe, string) {
+	probe, err := probeVideo(ctx, path)
+	if err != nil {
+		return nil, fmt.Sprintf("not a readable video: %v", err)
+	}
+	return probe, checkProbeLimits(probe, limits)
+}
+
+// checkProbeLimits returns why a probed upload is refused, or "" when it
+// is within the limits
+func checkProbeLimits(probe *videoProbe, limits uploadLimits) string {
+	if !probe.HasVideo {
+		return "no video stream"
+	}
+	if probe.Width <= 0 || probe.Height <= 0 {
+		return "video stream has no dimensions"
+	}
+	if probe.Duration <= 0 {
+		return "duration is unknown"
+	}
+	if probe.Duration > limits.MaxDurationSeconds {
+		return fmt.Sprintf("duration %.0fs exceeds the limit of %.0fs", probe.Duration, limits.MaxDurationSeconds)
+	}
+	// Limits are landscape; portrait videos are checked turned sideways
+	long, short := max(probe.Width, probe.Height), min(probe.Width, probe.Height)
+	if long > limits.MaxWidth || short > limits.MaxHeight {
+		return fmt.Sprintf("resolution %dx%d exceeds the limit of %dx%d", probe.Width, probe.Height, limits.MaxWidth, limits.MaxHeight)
+	}
+	frames := probe.Frames
+	if estimate := int64(probe.Duration * probe.FrameRate); estimate > frames {
+		frames = estimate
+	}
+	if frames > limits.MaxFrames {
+		return fmt.Sprintf("%d frames exceed the limit of %d", frames, limits.MaxFrames)
+	}
+	return ""
+}
+
+// ffprobeAvailable reports whether uploads can be probed
+func ffprobeAvailable() error {
+	if _, err := exec.LookPath("ffprobe"); err != nil {
+		return fmt.Errorf("ffprobe not found: %v", err)
+	}
+	return nil
+}
+
+// quarantinedUpload is a rejected upload kept for inspection
+type quarantinedUpload struct {
+	ID            string      `json:"id"`
+	Filename      string      `json:"filename"` // As sent by the client
+	Owner         string      `json:"owner,omitempty"`
+	Size          int64       `json:"size"`
+	SHA256        string      `json:"sha256"`
+	Container     string      `json:"container,omitempty"` // Sniffed from the magic bytes
+	Probe         *videoProbe `json:"probe,omitempty"`
+	Reason        string      `json:"reason"`
+	QuarantinedAt time.Time   `json:"quarantinedAt"`
+}
+
+// Quarantined uploads per ID, persisted in the quarantine directory
+var (
+	quarantine   = make(map[string]*quarantinedUpload)
+	quarantineMu sync.Mutex
+)
+
+// quarantineFile is where the quarantine records are stored
+func quarantineFile() string {
+	return filepath.Join(quarantineDir, ".quarantine.json")
+}
+
+// loadQuarantine reads the quarantine records
+func loadQuarantine() error {
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	return readJSONFile(quarantineFile(), &quarantine)
+}
+
+// quarantineUpload moves a rejected upload out of the uploads directory and
+// records why it was rejected. Files are stored without an extension under
+// a generated ID so they are never served or mistaken for videos.
+func quarantineUpload(ctx context.Context, tmpPath string, record quarantinedUpload) (*quarantinedUpload, error) {
+	record.ID = utils.UUIDv4()
+	record.QuarantinedAt = time.Now()
+	path := filepath.Join(quarantineDir, record.ID)
+	if err := os.Rename(tmpPath, path); err != nil {
+		// The quarantine may be on another file system than the uploads
+		err = copyFile(tmpPath, path)
+		os.Remove(tmpPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	quarantineMu.Lock()
+	quarantine[record.ID] = &record
+	err := writeJSONFile(quarantineFile(), quarantine)
+	quarantineMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	slog.WarnContext(ctx, "Upload quarantined", "quarantine_id", record.ID, "filename", record.Filename, "reason", record.Reason)
+	return &record, nil
+}
+
+// rejectUpload quarantines an upload and responds with the reason
+func rejectUpload(c *fiber.Ctx, tmpPath string, record quarantinedUpload) error {
+	uploadsTotal.WithLabelValues("quarantined").Inc()
+	stored, err := quarantineUpload(c.UserContext(), tmpPath, record)
+	if err != nil {
+		os.Remove(tmpPath)
+		slog.ErrorContext(c.UserContext(), "Failed to quarantine upload", "error", err)
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+			"error": fmt.Sprintf("Upload rejected: %s", record.Reason),
+		})
+	}
+	return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{
+		"error":        fmt.Sprintf("Upload rejected: %s", record.Reason),
+		"reason":       record.Reason,
+		"quarantineId": stored.ID,
+	})
+}
+
+// getQuarantine lists the rejected uploads, newest first
+func getQuarantine(c *fiber.Ctx) error {
+	quarantineMu.Lock()
+	list := make([]quarantinedUpload, 0, len(quarantine))
+	for _, record := range quarantine {
+		list = append(list, *record)
+	}
+	quarantineMu.Unlock()
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].QuarantinedAt.After(list[b].QuarantinedAt)
+	})
+	return c.JSON(list)
+}
+
+// deleteQuarantined removes a rejected upload and its record
+func deleteQuarantined(c *fiber.Ctx) error {
+	id := c.Params("quarantineId")
+	quarantineMu.Lock()
+	defer quarantineMu.Unlock()
+	if _, ok := quarantine[id]; !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Quarantined upload not found",
+		})
+	}
+	if err := os.Remove(filepath.Join(quarantineDir, id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("Failed to delete quarantined upload: %v", err),
+		})
+	}
+	delete(quarantine, id)
+	if err := writeJSONFile(quarantineFile(), quarantine); err != nil {
+		slog.ErrorContext(c.UserContext(), "Failed to save quarantine records", "error", err)
+	}
+	slog.InfoContext(c.UserContext(), "Quarantined upload deleted", "quarantine_id", id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
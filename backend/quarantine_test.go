@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// tsPackets returns n MPEG-TS packets of 188 bytes
+func tsPackets(n int) []byte {
+	packet := append([]byte{0x47}, bytes.Repeat([]byte{0xff}, 187)...)
+	return bytes.Repeat(packet, n)
+}
+
+func TestDetectContainer(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"mp4", []byte("\x00\x00\x00\x20ftypisom\x00\x00\x02\x00"), "mp4"},
+		{"m4v brand", []byte("\x00\x00\x00\x18ftypM4V \x00\x00\x00\x01"), "mp4"},
+		{"quicktime brand", []byte("\x00\x00\x00\x14ftypqt  \x00\x00\x02\x00"), "mov"},
+		{"3gp brand", []byte("\x00\x00\x00\x18ftyp3gp5\x00\x00\x00\x00"), "3gp"},
+		{"quicktime without ftyp", []byte("\x00\x00\x00\x08wide\x00\x01\x00\x00mdat"), "mov"},
+		{"quicktime starting with moov", []byte("\x00\x00\x01\x00moov"), "mov"},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), "webm"},
+		{"matroska", []byte("\x1a\x45\xdf\xa3\xa3\x42\x86\x81\x01\x42\x82\x88matroska"), "matroska"},
+		{"avi", []byte("RIFF\x00\x10\x00\x00AVI LIST"), "avi"},
+		{"wav is not avi", []byte("RIFF\x00\x10\x00\x00WAVEfmt "), ""},
+		{"flv", []byte("FLV\x01\x05\x00\x00\x00\x09"), "flv"},
+		{"ogg", []byte("OggS\x00\x02"), "ogg"},
+		{"asf", []byte("\x30\x26\xb2\x75\x8e\x66\xcf\x11\xa6\xd9"), "asf"},
+		{"mpeg program stream", []byte("\x00\x00\x01\xba\x44\x00"), "mpeg-ps"},
+		{"mpeg transport stream", tsPackets(3), "mpeg-ts"},
+		{"single sync byte", tsPackets(1), ""},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), ""},
+		{"png", []byte("\x89PNG\r\n\x1a\n"), ""},
+		{"script", []byte("#!/bin/sh\nrm -rf /\n"), ""},
+		{"html", []byte("<html><body>ftyp</body></html>"), ""},
+		{"empty", nil, ""},
+		{"truncated box header", []byte("\x00\x00\x00"), ""},
+	}
+	for _, tt := range tests {
+		if got := detectContainer(tt.head); got != tt.want {
+			t.Errorf("%s: detectContainer = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSniffContainer(t *testing.T) {
+	dir := t.TempDir()
+	short := filepath.Join(dir, "short")
+	if err := os.WriteFile(short, []byte("OggS"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sniffContainer(short); err != nil || got != "ogg" {
+		t.Errorf("short file: got %q, %v", got, err)
+	}
+	empty := filepath.Join(dir, "empty")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sniffContainer(empty); err != nil || got != "" {
+		t.Errorf("empty file: got %q, %v", got, err)
+	}
+	if _, err := sniffContainer(filepath.Join(dir, "missing")); err == nil {
+		t.Error("missing file sniffed")
+	}
+}
+
+func TestUploadFilename(t *testing.T) {
+	cfg := &config{AllowedExtensions: []string{".mp4", ".webm", ".mov"}}
+	tests := []struct {
+		filename, container string
+		want                string
+		wantErr             bool
+	}{
+		{"holiday.mp4", "mp4", "holiday.mp4", false},
+		{"holiday.MP4", "mp4", "holiday.MP4", false},
+		{"phone.mov", "mp4", "phone.mov", false},
+		{"phone.MOV", "mov", "phone.MOV", false},
+		{"wrong.webm", "mp4", "wrong.mp4", false},
+		{"wrong.mp4", "webm", "wrong.webm", false},
+		{"video.mkv", "webm", "video.webm", false},
+		{"noext", "mp4", "noext.mp4", false},
+		{"archive.tar", "webm", "archive.tar.webm", false},
+		{"screen.mov", "matroska", "", true},
+		{"clip.avi", "avi", "", true},
+	}
+	for _, tt := range tests {
+		got, err := uploadFilename(tt.filename, tt.container, cfg)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("uploadFilename(%q, %q) = %q, %v; want %q, error %v", tt.filename, tt.container, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckProbeLimits(t *testing.T) {
+	limits := uploadLimits{MaxDurationSeconds: 3600, MaxWidth: 1920, MaxHeight: 1080, MaxFrames: 100000}
+	ok := videoProbe{HasVideo: true, Width: 1280, Height: 720, Duration: 60, FrameRate: 30, Frames: 1800}
+	with := func(change func(p *videoProbe)) *videoProbe {
+		p := ok
+		change(&p)
+		return &p
+	}
+	tests := []struct {
+		name  string
+		probe *videoProbe
+		want  string
+	}{
+		{"within limits", &ok, ""},
+		{"at the limits", with(func(p *videoProbe) {
+			p.Width, p.Height, p.Duration, p.FrameRate, p.Frames = 1920, 1080, 3200, 31.25, 100000
+		}), ""},
+		{"portrait turned sideways", with(func(p *videoProbe) { p.Width, p.Height = 1080, 1920 }), ""},
+		{"audio only", with(func(p *videoProbe) { p.HasVideo = false }), "no video stream"},
+		{"no dimensions", with(func(p *videoProbe) { p.Width = 0 }), "no dimensions"},
+		{"unknown duration", with(func(p *videoProbe) { p.Duration = 0 }), "duration is unknown"},
+		{"too long", with(func(p *videoProbe) { p.Duration = 3601 }), "duration 3601s exceeds the limit of 3600s"},
+		{"too wide", with(func(p *videoProbe) { p.Width = 2560 }), "resolution 2560x720 exceeds the limit of 1920x1080"},
+		{"portrait too tall", with(func(p *videoProbe) { p.Width, p.Height = 1080, 2560 }), "resolution 1080x2560"},
+		{"square above the short side", with(func(p *videoProbe) { p.Width, p.Height = 1200, 1200 }), "resolution 1200x1200"},
+		{"frame count in the container", with(func(p *videoProbe) { p.Frames = 100001 }), "100001 frames exceed"},
+		{"frames estimated from the rate", with(func(p *videoProbe) { p.Frames, p.Duration, p.FrameRate = 0, 3000, 60 }), "180000 frames exceed"},
+		{"understated frame count", with(func(p *videoProbe) { p.Frames, p.Duration, p.FrameRate = 10, 1000, 1000 }), "1000000 frames exceed"},
+	}
+	for _, tt := range tests {
+		got := checkProbeLimits(tt.probe, limits)
+		if (tt.want == "") != (got == "") || !strings.Contains(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
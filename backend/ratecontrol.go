@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Rate control modes of a transcode
+const (
+	rateBitrate   = "bitrate"    // Average bitrate target, as -b:v alone
+	rateCRF       = "crf"        // Constant quality
+	rateCappedCRF = "capped-crf" // Constant quality, peaks capped at the bitrate
+	rateTwoPass   = "two-pass"   // Average bitrate, distributed by a first analysis pass
+	rateCBR       = "cbr"        // Constant bitrate with a one second buffer, for live-like delivery
+)
+
+var rateControlModes = []string{rateBitrate, rateCRF, rateCappedCRF, rateTwoPass, rateCBR}
+
+// rateControl selects how the encoder spends bits
+type rateControl struct {
+	Mode    string
+	Bitrate string // Target, or the cap of capped CRF
+	CRF     int
+
+	// Statistics file prefix shared by both passes of a two-pass encode
+	PassLogFile string
+}
+
+// parseRateControl reads the rate control mode and CRF of a request,
+// falling back to the configured defaults
+func parseRateControl(mode, crf, bitrate string) (rateControl, error) {
+	presets := getConfig().Presets
+	r := rateControl{Mode: strings.ToLower(mode), Bitrate: bitrate, CRF: presets.DefaultCRF}
+	if r.Mode == "" {
+		r.Mode = presets.DefaultRateControl
+	}
+	if !slices.Contains(rateControlModes, r.Mode) {
+		return r, fmt.Errorf("rate control must be one of %s", strings.Join(rateControlModes, ", "))
+	}
+	if crf != "" {
+		n, err := strconv.Atoi(crf)
+		if err != nil || n < 0 || n > 51 {
+			return r, fmt.Errorf("crf must be between 0 and 51")
+		}
+		r.CRF = n
+	}
+	return r, nil
+}
+
+// withBitrate returns r targeting another bitrate, as used for the
+// variants of an ABR package
+func (r rateControl) withBitrate(bitrate string) rateControl {
+	r.Bitrate = bitrate
+	return r
+}
+
+// args returns the encoder options for the video streams selected by
+// stream: "" for every video stream, or a specifier such as ":0"
+func (r rateControl) args(stream string) []string {
+	opt := func(name string) string { return "-" + name + ":v" + stream }
+	kbps, _ := strconv.Atoi(strings.TrimSuffix(r.Bitrate, "k"))
+
+	switch r.Mode {
+	case rateCRF:
+		return []string{opt("crf"), strconv.Itoa(r.CRF)}
+	case rateCappedCRF:
+		return []string{
+			opt("crf"), strconv.Itoa(r.CRF),
+			opt("maxrate"), r.Bitrate,
+			opt("bufsize"), fmt.Sprintf("%dk", kbps*2),
+		}
+	case rateCBR:
+		return []string{
+			opt("b"), r.Bitrate,
+			opt("minrate"), r.Bitrate,
+			opt("maxrate"), r.Bitrate,
+			opt("bufsize"), r.Bitrate,
+			opt("x264-params"), "nal-hrd=cbr",
+		}
+	case rateTwoPass:
+		return []string{opt("b"), r.Bitrate, "-pass", "2", "-passlogfile", r.PassLogFile}
+	default:
+		return []string{opt("b"), r.Bitrate}
+	}
+}
+
+// firstPass returns the ffmpeg arguments of the analysis pass of a
+// two-pass encode. It reads the same input with the same video options as
+// the final encode; only the statistics file is kept.
+func (r rateControl) firstPass(input, video []string) []string {
+	args := append([]string{"-y"}, input...)
+	args = append(args, video...)
+	return append(args,
+		"-b:v", r.Bitrate,
+		"-pass", "1",
+		"-passlogfile", r.PassLogFile,
+		"-an",
+		"-f", "null", os.DevNull)
+}
+
+// Segment durations of the HLS and DASH outputs in seconds
+const (
+	hlsSegmentDuration  = 10
+	dashSegmentDuration = 5
+)
+
+// keyframeArgs forces a keyframe at the start of every segment, so HLS and
+// DASH segments are cut at exactly the segment duration
+func keyframeArgs(segmentDuration float64) []string {
+	return []string{"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%g)", segmentDuration)}
+}
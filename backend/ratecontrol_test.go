@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestKeyframeArgs(t *testing.T) {
+	tests := []struct {
+		duration float64
+		want     string
+	}{
+		{hlsSegmentDuration, "expr:gte(t,n_forced*10)"},
+		{dashSegmentDuration, "expr:gte(t,n_forced*5)"},
+		{llhlsPartDuration, "expr:gte(t,n_forced*0.5)"},
+		{abrSegmentDuration, "expr:gte(t,n_forced*6)"},
+	}
+	for _, tt := range tests {
+		got := keyframeArgs(tt.duration)
+		if !slices.Equal(got, []string{"-force_key_frames", tt.want}) {
+			t.Errorf("keyframeArgs(%g) = %q, want %q", tt.duration, got, tt.want)
+		}
+	}
+}
+
+func TestParseRateControl(t *testing.T) {
+	saved := currentConfig
+	currentConfig = defaultConfig()
+	t.Cleanup(func() { currentConfig = saved })
+
+	tests := []struct {
+		mode, crf string
+		want      rateControl
+		wantErr   bool
+	}{
+		{"", "", rateControl{Mode: rateBitrate, Bitrate: "2000k", CRF: 23}, false},
+		{"CRF", "18", rateControl{Mode: rateCRF, Bitrate: "2000k", CRF: 18}, false},
+		{"capped-crf", "0", rateControl{Mode: rateCappedCRF, Bitrate: "2000k", CRF: 0}, false},
+		{"two-pass", "", rateControl{Mode: rateTwoPass, Bitrate: "2000k", CRF: 23}, false},
+		{"vbr", "", rateControl{}, true},
+		{"crf", "52", rateControl{}, true},
+		{"crf", "-1", rateControl{}, true},
+		{"crf", "twenty", rateControl{}, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRateControl(tt.mode, tt.crf, "2000k")
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseRateControl(%q, %q) error = %v, want error %v", tt.mode, tt.crf, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got != tt.want {
+			t.Errorf("parseRateControl(%q, %q) = %+v, want %+v", tt.mode, tt.crf, got, tt.want)
+		}
+	}
+}
+
+func TestRateControlArgs(t *testing.T) {
+	tests := []struct {
+		rate   rateControl
+		stream string
+		want   []string
+	}{
+		{rateControl{Mode: rateBitrate, Bitrate: "2000k"}, "", []string{"-b:v", "2000k"}},
+		{rateControl{Mode: rateCRF, Bitrate: "2000k", CRF: 20}, "", []string{"-crf:v", "20"}},
+		{rateControl{Mode: rateCappedCRF, Bitrate: "3000k", CRF: 23}, ":1",
+			[]string{"-crf:v:1", "23", "-maxrate:v:1", "3000k", "-bufsize:v:1", "6000k"}},
+		{rateControl{Mode: rateCBR, Bitrate: "1000k"}, "",
+			[]string{"-b:v", "1000k", "-minrate:v", "1000k", "-maxrate:v", "1000k", "-bufsize:v", "1000k", "-x264-params:v", "nal-hrd=cbr"}},
+		{rateControl{Mode: rateTwoPass, Bitrate: "4000k", PassLogFile: "/tmp/pass"}, "",
+			[]string{"-b:v", "4000k", "-pass", "2", "-passlogfile", "/tmp/pass"}},
+	}
+	for _, tt := range tests {
+		if got := tt.rate.args(tt.stream); !slices.Equal(got, tt.want) {
+			t.Errorf("%s args(%q) = %q, want %q", tt.rate.Mode, tt.stream, got, tt.want)
+		}
+	}
+
+	r := rateControl{Mode: rateTwoPass, Bitrate: "4000k", PassLogFile: "/tmp/pass"}
+	got := r.firstPass([]string{"-i", "in.mp4"}, []string{"-c:v", "libx264"})
+	want := []string{"-y", "-i", "in.mp4", "-c:v", "libx264", "-b:v", "4000k", "-pass", "1", "-passlogfile", "/tmp/pass", "-an", "-f", "null", os.DevNull}
+	if !slices.Equal(got, want) {
+		t.Errorf("firstPass = %q, want %q", got, want)
+	}
+}
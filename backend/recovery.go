@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Time ffmpeg gets to exit after SIGTERM before it is killed
+const ffmpegKillGrace = 5 * time.Second
+
+// jobRecord is the stored form of a job
+type jobRecord struct {
+	job
+	Spec jobSpec `json:"spec"`
+}
+
+// jobsFile is where jobs are stored so they survive a restart
+func jobsFile() string {
+	return filepath.Join(uploadsDir, ".jobs.json")
+}
+
+// saveJobsLocked writes all known jobs to jobsFile. jobsMu must be held.
+func saveJobsLocked() {
+	records := make([]jobRecord, 0, len(jobs))
+	for _, j := range jobs {
+		records = append(records, jobRecord{job: *j, Spec: j.spec})
+	}
+	sort.Slice(records, func(a, b int) bool {
+		return records[a].CreatedAt.Before(records[b].CreatedAt)
+	})
+
+	data, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		slog.Error("Failed to encode jobs", "error", err)
+		return
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn file
+	tmp := jobsFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		slog.Error("Failed to save jobs", "error", err)
+		return
+	}
+	if err := os.Rename(tmp, jobsFile()); err != nil {
+		slog.Error("Failed to save jobs", "error", err)
+	}
+}
+
+// recoverJobs loads the stored jobs. Jobs that were queued or running when
+// the server stopped have their partial output removed and are queued again.
+func recoverJobs() error {
+	// Interrupted jobs start over, so nothing in the staging directories
+	// is needed any more
+	clearStaging()
+
+	data, err := os.ReadFile(jobsFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var records []jobRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return err
+	}
+
+	jobsMu.Lock()
+	for _, r := range records {
+		j := r.job
+		j.spec = r.Spec
+		j.ctx = context.Background()
+		j.done = make(chan struct{})
+		jobs[j.ID] = &j
+
+		if j.State == jobSucceeded || j.State == jobFailed {
+			close(j.done)
+			continue
+		}
+
+		slog.Info("Resuming interrupted job", "job_id", j.ID, "kind", j.Kind, "video_id", j.VideoID, "state", j.State)
+		j.removeOutputs()
+		j.State = jobQueued
+		j.StartedAt = time.Time{}
+		if j.spec.Derived != "" {
+			holdUploadName(j.spec.Derived)
+		}
+		setTranscodingProgress(j.spec.ProgressID, 0)
+		jobQueue = append(jobQueue, &j)
+	}
+	pruneJobsLocked()
+	saveJobsLocked()
+	jobsMu.Unlock()
+
+	dispatchJobs()
+	return nil
+}
+
+// stopJobs stops starting jobs and waits up to timeout for the running ones
+// to finish. Jobs still running then are cancelled, which terminates their
+// ffmpeg process and puts them back in the queue for the next start.
+func stopJobs(timeout time.Duration) {
+	jobsMu.Lock()
+	jobsStopping = true
+	var running []*job
+	for _, j := range jobs {
+		if j.State == jobRunning {
+			running = append(running, j)
+		}
+	}
+	jobsMu.Unlock()
+
+	if len(running) > 0 {
+		slog.Info("Waiting for running jobs", "count", len(running), "timeout", timeout.String())
+	}
+	deadline := time.After(timeout)
+	for _, j := range running {
+		select {
+		case <-j.done:
+		case <-deadline:
+			slog.Warn("Running jobs did not finish in time, interrupting them")
+			jobsMu.Lock()
+			for _, j := range running {
+				j.cancel()
+			}
+			jobsMu.Unlock()
+		}
+	}
+	for _, j := range running {
+		<-j.done
+	}
+
+	// Requests waiting for queued jobs are released; the jobs themselves
+	// stay stored and run after the restart
+	jobsMu.Lock()
+	for _, j := range jobQueue {
+		select {
+		case <-j.done:
+		default:
+			close(j.done)
+		}
+	}
+	saveJobsLocked()
+	jobsMu.Unlock()
+}
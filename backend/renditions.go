@@ -0,0 +1,556 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Rendition states
+const (
+	renditionProcessing = "processing"
+	renditionLive       = "live" // LL-HLS encode in progress, playable while it grows
+	renditionReady      = "ready"
+	renditionFailed     = "failed"
+)
+
+// Name of the staging directory inside uploadsDir and transcodedDir. Jobs
+// write there and their output is moved into place once it is complete.
+const stagingDirName = ".staging"
+
+// rendition is one transcoded output of a video
+type rendition struct {
+	Format      string         `json:"format"`
+	Resolution  string         `json:"resolution,omitempty"`
+	Bitrate     string         `json:"bitrate,omitempty"` // Target, unless the encode was constant quality
+	Status      string         `json:"status"`
+	URL         string         `json:"url"`
+	JobID       string         `json:"jobId,omitempty"`
+	Error       string         `json:"error,omitempty"` // Of the last attempt
+	Quality     *qualityScores `json:"quality,omitempty"`
+	UpdatedAt   time.Time      `json:"updatedAt"`
+	PublishedAt time.Time      `json:"publishedAt,omitzero"`
+}
+
+// Renditions per video ID and rendition key
+var (
+	renditions   = make(map[string]map[string]*rendition)
+	renditionsMu sync.Mutex
+)
+
+// renditionsFile is where rendition states are stored
+func renditionsFile() string {
+	return filepath.Join(transcodedDir, ".renditions.json")
+}
+
+// renditionKey identifies a rendition of a video. MP4 outputs are stored
+// per resolution, the other formats replace each other.
+func renditionKey(format, resolution string) string {
+	if format == "mp4" {
+		return "mp4-" + resolution
+	}
+	return format
+}
+
+// loadRenditions reads the stored rendition states. Without a stored file
+// the renditions already present in transcodedDir are recorded as ready.
+func loadRenditions() error {
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+
+	data, err := os.ReadFile(renditionsFile())
+	if os.IsNotExist(err) {
+		seedRenditionsLocked()
+		return saveRenditionsLocked()
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &renditions)
+}
+
+// seedRenditionsLocked records the outputs written before rendition states
+// were tracked. renditionsMu must be held.
+func seedRenditionsLocked() {
+	files, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || strings.HasPrefix(file.Name(), ".") {
+			continue
+		}
+		id := file.Name()
+		baseName := strings.TrimSuffix(id, filepath.Ext(id))
+		existing := map[string]string{
+			"hls":  filepath.Join(baseName, "playlist.m3u8"),
+			"dash": filepath.Join(baseName, "manifest.mpd"),
+			"cmaf": filepath.Join(baseName, cmafDirName, "master.m3u8"),
+		}
+		for format, path := range existing {
+			if _, err := os.Stat(filepath.Join(transcodedDir, path)); err == nil {
+				setRenditionLocked(id, format, rendition{
+					Format: format,
+					Status: renditionReady,
+					URL:    "/transcoded/" + filepath.ToSlash(path),
+				})
+			}
+		}
+		mp4Files, _ := filepath.Glob(filepath.Join(transcodedDir, baseName+"_*p.mp4"))
+		for _, path := range mp4Files {
+			name := filepath.Base(path)
+			resolution := strings.TrimSuffix(strings.TrimPrefix(name, baseName+"_"), "p.mp4")
+			setRenditionLocked(id, renditionKey("mp4", resolution), rendition{
+				Format:     "mp4",
+				Resolution: resolution,
+				Status:     renditionReady,
+				URL:        "/transcoded/" + name,
+			})
+		}
+	}
+}
+
+// saveRenditionsLocked writes the rendition states. renditionsMu must be held.
+func saveRenditionsLocked() error {
+	data, err := json.MarshalIndent(renditions, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := renditionsFile() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, renditionsFile())
+}
+
+// setRenditionLocked stores r for a video. renditionsMu must be held.
+func setRenditionLocked(videoID, key string, r rendition) {
+	if renditions[videoID] == nil {
+		renditions[videoID] = make(map[string]*rendition)
+	}
+	r.UpdatedAt = time.Now()
+	if r.Status == renditionReady && r.PublishedAt.IsZero() {
+		r.PublishedAt = r.UpdatedAt
+	}
+	renditions[videoID][key] = &r
+}
+
+// updateRendition records the state of the rendition produced by a
+// transcode job. A ready rendition stays ready while it is re-encoded, and
+// when the re-encode fails, since its published files are untouched.
+func updateRendition(j *job, status string, jobErr error) {
+	if j.Kind != "transcode" {
+		return
+	}
+
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+
+	key := renditionKey(j.Format, j.Resolution)
+	r := rendition{
+		Format:     j.Format,
+		Resolution: j.Resolution,
+		Status:     status,
+		URL:        j.spec.URL,
+		JobID:      j.ID,
+		Quality:    j.Quality,
+	}
+	if j.RateControl != rateCRF && j.Format != "abr" {
+		r.Bitrate = j.Bitrate
+	}
+	if jobErr != nil {
+		r.Error = jobErr.Error()
+	}
+	if previous := renditions[j.VideoID][key]; previous != nil && previous.Status == renditionReady &&
+		status != renditionReady && j.Format != "llhls" {
+		previous.JobID = j.ID
+		previous.Error = r.Error
+		previous.UpdatedAt = time.Now()
+	} else {
+		setRenditionLocked(j.VideoID, key, r)
+	}
+	if err := saveRenditionsLocked(); err != nil {
+		slog.Error("Failed to save renditions", "error", err)
+	}
+}
+
+// renditionPlayable reports whether a rendition can be played: it is ready,
+// or it is a live LL-HLS stream
+func renditionPlayable(videoID, key string) bool {
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+	r := renditions[videoID][key]
+	return r != nil && (r.Status == renditionReady || r.Status == renditionLive)
+}
+
+// readyMP4URLs returns the URLs of the ready MP4 renditions of a video
+func readyMP4URLs(videoID string) []string {
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+	var urls []string
+	for _, r := range renditions[videoID] {
+		if r.Format == "mp4" && r.Status == renditionReady {
+			urls = append(urls, r.URL)
+		}
+	}
+	sort.Strings(urls)
+	return urls
+}
+
+// Formats a video can be played in, as filtered by the video list
+var playbackFormats = []string{"mp4", "hls", "dash", "cmaf", "llhls", "abr"}
+
+// playableFormats returns the formats of the playable renditions of a video
+func playableFormats(videoID string) []string {
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+	var formats []string
+	for _, r := range renditions[videoID] {
+		if (r.Status == renditionReady || r.Status == renditionLive) && !slices.Contains(formats, r.Format) {
+			formats = append(formats, r.Format)
+		}
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// Video states, derived from the states of its renditions
+const (
+	videoUploaded   = "uploaded"   // Never transcoded
+	videoProcessing = "processing" // A rendition is being encoded
+	videoReady      = "ready"      // A rendition can be played
+	videoFailed     = "failed"     // Every rendition failed
+)
+
+var videoStatuses = []string{videoUploaded, videoProcessing, videoReady, videoFailed}
+
+// videoStatus summarizes the rendition states of a video
+func videoStatus(videoID string) string {
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+	status := videoUploaded
+	for _, r := range renditions[videoID] {
+		switch {
+		case r.Status == renditionProcessing || r.Status == renditionLive:
+			return videoProcessing
+		case r.Status == renditionReady:
+			status = videoReady
+		case r.Status == renditionFailed && status == videoUploaded:
+			status = videoFailed
+		}
+	}
+	return status
+}
+
+// videoRenditions returns all renditions of a video
+func videoRenditions(videoID string) []rendition {
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+	list := make([]rendition, 0, len(renditions[videoID]))
+	for _, r := range renditions[videoID] {
+		list = append(list, *r)
+	}
+	sort.Slice(list, func(a, b int) bool {
+		return renditionKey(list[a].Format, list[a].Resolution) < renditionKey(list[b].Format, list[b].Resolution)
+	})
+	return list
+}
+
+// forgetRenditions removes the renditions of a deleted video
+func forgetRenditions(videoID string) {
+	renditionsMu.Lock()
+	defer renditionsMu.Unlock()
+	if _, ok := renditions[videoID]; !ok {
+		return
+	}
+	delete(renditions, videoID)
+	if err := saveRenditionsLocked(); err != nil {
+		slog.Error("Failed to save renditions", "error", err)
+	}
+}
+
+// newStagingDir returns a fresh staging directory below root. It is on the
+// same file system as root, so publishing is a rename.
+func newStagingDir(root string) string {
+	return filepath.Join(root, stagingDirName, utils.UUIDv4())
+}
+
+// clearStaging removes leftover staging directories and unused versions.
+// Jobs interrupted while writing to them start over.
+func clearStaging() {
+	os.RemoveAll(filepath.Join(uploadsDir, stagingDirName))
+	os.RemoveAll(filepath.Join(transcodedDir, stagingDirName))
+	clearVersions(transcodedDir)
+}
+
+// Name of the directory next to published directories holding their
+// versions. A published directory is a symlink to its current version.
+const versionsDirName = ".versions"
+
+// Publishing replaces the current version of a directory, so publishes to
+// the same directory must not interleave
+var publishMu sync.Mutex
+
+// formatFiles are globs of the top level files a format writes to its
+// publish directory. Publishing the format drops all of them from the
+// current version, so segments of a longer earlier encode are not kept.
+// Formats written to a subdirectory replace it as a whole.
+var formatFiles = map[string][]string{
+	"hls":  {"playlist.m3u8", "playlist*.ts"},
+	"dash": {"manifest.mpd", "init-stream*.m4s", "chunk-stream*.m4s"},
+}
+
+// publishStaged moves the contents of a staging directory into dir. A single
+// file is renamed into place. Anything else becomes a new version of dir
+// holding the staged entries and the other entries of the current version,
+// and the symlink dir is switched to it in one rename, so viewers see either
+// the old or the new output but never a mix. Staged subdirectories replace
+// existing ones as a whole, and files of the current version matching the
+// replaces globs are dropped.
+func publishStaged(staging, dir string, replaces []string) error {
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 1 && entries[0].Type().IsRegular() {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return err
+		}
+		name := entries[0].Name()
+		if err := os.Rename(filepath.Join(staging, name), filepath.Join(dir, name)); err != nil {
+			return err
+		}
+		return os.RemoveAll(staging)
+	}
+
+	publishMu.Lock()
+	defer publishMu.Unlock()
+
+	versions := filepath.Join(filepath.Dir(dir), versionsDirName)
+	if err := os.MkdirAll(versions, os.ModePerm); err != nil {
+		return err
+	}
+	version := filepath.Base(dir) + "-" + utils.UUIDv4()
+	next := filepath.Join(versions, version)
+	if err := os.Rename(staging, next); err != nil {
+		return err
+	}
+
+	// Entries of the current version that were not staged or replaced are
+	// carried over as hard links
+	staged := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		staged[entry.Name()] = true
+	}
+	current := ""
+	if info, err := os.Lstat(dir); err == nil {
+		current = dir
+		if info.Mode()&os.ModeSymlink != 0 {
+			current = resolveLink(dir)
+		}
+	}
+	if current != "" {
+		for _, pattern := range replaces {
+			matches, _ := filepath.Glob(filepath.Join(current, pattern))
+			for _, match := range matches {
+				staged[filepath.Base(match)] = true
+			}
+		}
+		if err := linkTree(current, next, staged); err != nil {
+			os.RemoveAll(next)
+			return err
+		}
+	}
+
+	link := filepath.Join(filepath.Dir(dir), ".publish-"+version)
+	if err := os.Symlink(filepath.Join(versionsDirName, version), link); err != nil {
+		os.RemoveAll(next)
+		return err
+	}
+	if current == dir {
+		// A plain directory, from before versions or made by an LL-HLS
+		// encode, cannot be replaced by a rename and is moved aside first
+		current = filepath.Join(versions, version+"-replaced")
+		if err := os.Rename(dir, current); err != nil {
+			os.Remove(link)
+			os.RemoveAll(next)
+			return err
+		}
+	}
+	if err := os.Rename(link, dir); err != nil {
+		os.Remove(link)
+		os.RemoveAll(next)
+		return err
+	}
+
+	if current != "" {
+		// Files an LL-HLS encode wrote to the old version while the new one
+		// was prepared are linked again before it is removed
+		linkTree(current, next, staged)
+		os.RemoveAll(current)
+	}
+	return nil
+}
+
+// linkTree hard links the files of src into dst, except the top level
+// entries in skip and files dst already has. Files are copied when they
+// cannot be linked.
+func linkTree(src, dst string, skip map[string]bool) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if skip[entry.Name()] {
+			continue
+		}
+		from := filepath.Join(src, entry.Name())
+		to := filepath.Join(dst, entry.Name())
+		_, err := os.Lstat(to)
+		if entry.IsDir() {
+			if os.IsNotExist(err) {
+				err = os.Mkdir(to, os.ModePerm)
+			}
+			if err == nil {
+				err = linkTree(from, to, nil)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err == nil {
+			continue
+		}
+		if err := os.Link(from, to); err != nil {
+			if err := copyFile(from, to); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolveLink returns the path a symlink points to
+func resolveLink(path string) string {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return path
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	return target
+}
+
+// removePublished removes a directory written by publishStaged together
+// with its current version
+func removePublished(dir string) error {
+	publishMu.Lock()
+	defer publishMu.Unlock()
+	if info, err := os.Lstat(dir); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		os.RemoveAll(resolveLink(dir))
+		return os.Remove(dir)
+	}
+	return os.RemoveAll(dir)
+}
+
+// clearVersions removes versions no published directory points to, left
+// behind by a publish that was interrupted
+func clearVersions(root string) {
+	versions := filepath.Join(root, versionsDirName)
+	entries, err := os.ReadDir(versions)
+	if err != nil {
+		return
+	}
+	inUse := make(map[string]bool)
+	if published, err := os.ReadDir(root); err == nil {
+		for _, entry := range published {
+			path := filepath.Join(root, entry.Name())
+			if entry.Type()&os.ModeSymlink == 0 {
+				continue
+			}
+			if strings.HasPrefix(entry.Name(), ".publish-") {
+				os.Remove(path)
+				continue
+			}
+			inUse[filepath.Clean(resolveLink(path))] = true
+		}
+	}
+	for _, entry := range entries {
+		path := filepath.Join(versions, entry.Name())
+		if !inUse[filepath.Clean(path)] {
+			os.RemoveAll(path)
+		}
+	}
+}
+
+// validateOutput checks that a finished output is complete before it is
+// published. Playlists must be final and list existing segments, MPDs must
+// be complete documents and media files must have a video stream.
+func validateOutput(ctx context.Context, path string) error {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".m3u8":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.HasPrefix(data, []byte("#EXTM3U")) {
+			return fmt.Errorf("%s is not an HLS playlist", filepath.Base(path))
+		}
+		master := bytes.Contains(data, []byte("#EXT-X-STREAM-INF"))
+		if !master && !bytes.Contains(data, []byte("#EXT-X-ENDLIST")) {
+			return fmt.Errorf("%s is not finished", filepath.Base(path))
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") || strings.Contains(line, "://") {
+				continue
+			}
+			ref := filepath.Join(filepath.Dir(path), filepath.FromSlash(line))
+			if master {
+				if err := validateOutput(ctx, ref); err != nil {
+					return err
+				}
+				continue
+			}
+			if info, err := os.Stat(ref); err != nil || info.Size() == 0 {
+				return fmt.Errorf("segment %s is missing", line)
+			}
+		}
+		return nil
+
+	case ".mpd":
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if !bytes.Contains(data, []byte("<MPD")) || !bytes.Contains(data, []byte("</MPD>")) {
+			return fmt.Errorf("%s is not a complete MPD", filepath.Base(path))
+		}
+		return nil
+
+	default:
+		probe, err := probeVideo(ctx, path)
+		if err != nil {
+			return err
+		}
+		if !probe.HasVideo {
+			return fmt.Errorf("%s has no video stream", filepath.Base(path))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// stage writes files with their contents to a new staging directory
+func stage(t *testing.T, root string, files map[string]string) string {
+	t.Helper()
+	dir := newStagingDir(root)
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// readTree returns the contents of the files below dir by relative path
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		rel, _ := filepath.Rel(dir, path)
+		files[rel] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestPublishStagedVersions(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "video")
+
+	steps := []struct {
+		name   string
+		format string
+		staged map[string]string
+		want   map[string]string
+	}{
+		{
+			name:   "first HLS output",
+			format: "hls",
+			staged: map[string]string{"playlist.m3u8": "v1", "playlist0.ts": "a1", "playlist1.ts": "b1"},
+			want:   map[string]string{"playlist.m3u8": "v1", "playlist0.ts": "a1", "playlist1.ts": "b1"},
+		},
+		{
+			name:   "DASH output kept next to HLS",
+			format: "dash",
+			staged: map[string]string{"manifest.mpd": "d1", "init-stream0.m4s": "i1", "chunk-stream0-00001.m4s": "c1", "chunk-stream0-00002.m4s": "c2"},
+			want: map[string]string{"playlist.m3u8": "v1", "playlist0.ts": "a1", "playlist1.ts": "b1",
+				"manifest.mpd": "d1", "init-stream0.m4s": "i1", "chunk-stream0-00001.m4s": "c1", "chunk-stream0-00002.m4s": "c2"},
+		},
+		{
+			name:   "shorter HLS output replaces all segments",
+			format: "hls",
+			staged: map[string]string{"playlist.m3u8": "v2", "playlist0.ts": "a2"},
+			want: map[string]string{"playlist.m3u8": "v2", "playlist0.ts": "a2",
+				"manifest.mpd": "d1", "init-stream0.m4s": "i1", "chunk-stream0-00001.m4s": "c1", "chunk-stream0-00002.m4s": "c2"},
+		},
+		{
+			name:   "shorter DASH output replaces all segments",
+			format: "dash",
+			staged: map[string]string{"manifest.mpd": "d2", "init-stream0.m4s": "i2", "chunk-stream0-00001.m4s": "c3"},
+			want: map[string]string{"playlist.m3u8": "v2", "playlist0.ts": "a2",
+				"manifest.mpd": "d2", "init-stream0.m4s": "i2", "chunk-stream0-00001.m4s": "c3"},
+		},
+		{
+			name:   "first ABR package",
+			format: "abr",
+			staged: map[string]string{"abr/master.m3u8": "m1", "abr/720p/playlist.m3u8": "p1", "abr/1080p/playlist.m3u8": "q1"},
+			want: map[string]string{"playlist.m3u8": "v2", "playlist0.ts": "a2",
+				"manifest.mpd": "d2", "init-stream0.m4s": "i2", "chunk-stream0-00001.m4s": "c3",
+				"abr/master.m3u8": "m1", "abr/720p/playlist.m3u8": "p1", "abr/1080p/playlist.m3u8": "q1"},
+		},
+		{
+			name:   "ABR package replaced as a whole",
+			format: "abr",
+			staged: map[string]string{"abr/master.m3u8": "m2", "abr/720p/playlist.m3u8": "p2"},
+			want: map[string]string{"playlist.m3u8": "v2", "playlist0.ts": "a2",
+				"manifest.mpd": "d2", "init-stream0.m4s": "i2", "chunk-stream0-00001.m4s": "c3",
+				"abr/master.m3u8": "m2", "abr/720p/playlist.m3u8": "p2"},
+		},
+	}
+	for _, step := range steps {
+		previous := ""
+		if _, err := os.Lstat(dir); err == nil {
+			previous = resolveLink(dir)
+		}
+		if err := publishStaged(stage(t, root, step.staged), dir, formatFiles[step.format]); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		info, err := os.Lstat(dir)
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			t.Fatalf("%s: %s is not a symlink", step.name, dir)
+		}
+		if got := readTree(t, dir+"/"); !maps.Equal(got, step.want) {
+			t.Errorf("%s: got %v, want %v", step.name, got, step.want)
+		}
+		if previous != "" {
+			if _, err := os.Stat(previous); !os.IsNotExist(err) {
+				t.Errorf("%s: previous version %s was not removed", step.name, previous)
+			}
+		}
+		versions, _ := os.ReadDir(filepath.Join(root, versionsDirName))
+		if len(versions) != 1 {
+			t.Errorf("%s: %d versions kept, want 1", step.name, len(versions))
+		}
+	}
+
+	if err := removePublished(dir); err != nil {
+		t.Fatal(err)
+	}
+	versions, _ := os.ReadDir(filepath.Join(root, versionsDirName))
+	if _, err := os.Lstat(dir); !os.IsNotExist(err) || len(versions) != 0 {
+		t.Errorf("removePublished left %s or %d versions", dir, len(versions))
+	}
+}
+
+func TestPublishStagedPlainDirectory(t *testing.T) {
+	// LL-HLS encodes write into a plain directory before anything is
+	// published
+	root := t.TempDir()
+	dir := filepath.Join(root, "video")
+	if err := os.MkdirAll(filepath.Join(dir, "llhls"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "llhls", "part_00000.m4s"), []byte("p"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := publishStaged(stage(t, root, map[string]string{"cmaf/master.m3u8": "c"}), dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"llhls/part_00000.m4s": "p", "cmaf/master.m3u8": "c"}
+	if got := readTree(t, dir+"/"); !maps.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	versions, _ := os.ReadDir(filepath.Join(root, versionsDirName))
+	if len(versions) != 1 {
+		t.Errorf("%d versions kept, want 1", len(versions))
+	}
+}
+
+func TestPublishStagedSingleFile(t *testing.T) {
+	root := t.TempDir()
+	if err := publishStaged(stage(t, root, map[string]string{"video_720p.mp4": "m"}), root, nil); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(filepath.Join(root, "video_720p.mp4"))
+	if err != nil || !info.Mode().IsRegular() {
+		t.Fatalf("single file not renamed into place: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, versionsDirName)); !os.IsNotExist(err) {
+		t.Errorf("single file published as a version")
+	}
+}
+
+func TestClearVersions(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "video")
+	if err := publishStaged(stage(t, root, map[string]string{"a.m3u8": "a", "a0.ts": "0"}), dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	current := filepath.Base(resolveLink(dir))
+	for _, leftover := range []string{"video-interrupted", "other-replaced"} {
+		if err := os.MkdirAll(filepath.Join(root, versionsDirName, leftover), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(versionsDirName, "video-interrupted"), filepath.Join(root, ".publish-video-interrupted")); err != nil {
+		t.Fatal(err)
+	}
+
+	clearVersions(root)
+	entries, _ := os.ReadDir(filepath.Join(root, versionsDirName))
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if !slices.Equal(names, []string{current}) {
+		t.Errorf("versions = %v, want only %s", names, current)
+	}
+	if _, err := os.Lstat(filepath.Join(root, ".publish-video-interrupted")); !os.IsNotExist(err) {
+		t.Errorf("leftover publish link kept")
+	}
+}
+
+func TestValidateOutput(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"media.m3u8":    "#EXTM3U\n#EXTINF:2.0,\nseg0.ts\n#EXTINF:2.0,\nseg1.ts\n#EXT-X-ENDLIST\n",
+		"seg0.ts":       "x",
+		"seg1.ts":       "x",
+		"empty.ts":      "",
+		"missing.m3u8":  "#EXTM3U\n#EXTINF:2.0,\nseg0.ts\n#EXTINF:2.0,\nseg9.ts\n#EXT-X-ENDLIST\n",
+		"zero.m3u8":     "#EXTM3U\n#EXTINF:2.0,\nempty.ts\n#EXT-X-ENDLIST\n",
+		"open.m3u8":     "#EXTM3U\n#EXTINF:2.0,\nseg0.ts\n",
+		"remote.m3u8":   "#EXTM3U\n#EXTINF:2.0,\nhttps://cdn.example/seg.ts\n#EXT-X-ENDLIST\n",
+		"master.m3u8":   "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nmedia.m3u8\n",
+		"broken.m3u8":   "#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\nmedia.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2\nopen.m3u8\n",
+		"text.m3u8":     "seg0.ts\n",
+		"manifest.mpd":  "<?xml version=\"1.0\"?>\n<MPD><Period/></MPD>\n",
+		"truncated.mpd": "<?xml version=\"1.0\"?>\n<MPD><Period>",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		wantErr string
+	}{
+		{"media.m3u8", ""},
+		{"remote.m3u8", ""},
+		{"master.m3u8", ""},
+		{"manifest.mpd", ""},
+		{"missing.m3u8", "seg9.ts is missing"},
+		{"zero.m3u8", "empty.ts is missing"},
+		{"open.m3u8", "not finished"},
+		{"broken.m3u8", "open.m3u8 is not finished"},
+		{"text.m3u8", "not an HLS playlist"},
+		{"truncated.mpd", "not a complete MPD"},
+		{"absent.mpd", "no such file"},
+	}
+	for _, tt := range tests {
+		err := validateOutput(t.Context(), filepath.Join(dir, tt.name))
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: error %v, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUpdateRendition(t *testing.T) {
+	savedDir, savedRenditions := transcodedDir, renditions
+	transcodedDir = t.TempDir()
+	renditionsMu.Lock()
+	renditions = make(map[string]map[string]*rendition)
+	renditionsMu.Unlock()
+	t.Cleanup(func() {
+		renditionsMu.Lock()
+		renditions = savedRenditions
+		renditionsMu.Unlock()
+		transcodedDir = savedDir
+	})
+
+	status := func(key string) (string, string) {
+		renditionsMu.Lock()
+		defer renditionsMu.Unlock()
+		r := renditions["a.mp4"][key]
+		if r == nil {
+			return "", ""
+		}
+		return r.Status, r.Error
+	}
+	encode := func(id, format string) *job {
+		return &job{ID: id, Kind: "transcode", VideoID: "a.mp4", Format: format, Resolution: "720"}
+	}
+
+	steps := []struct {
+		name   string
+		job    *job
+		status string
+		err    error
+		key    string
+		want   string
+	}{
+		{"first encode starts", encode("1", "hls"), renditionProcessing, nil, "hls", renditionProcessing},
+		{"first encode fails", encode("1", "hls"), renditionFailed, os.ErrClosed, "hls", renditionFailed},
+		{"second encode succeeds", encode("2", "hls"), renditionReady, nil, "hls", renditionReady},
+		{"re-encode keeps it ready", encode("3", "hls"), renditionProcessing, nil, "hls", renditionReady},
+		{"failed re-encode keeps it ready", encode("3", "hls"), renditionFailed, os.ErrClosed, "hls", renditionReady},
+		{"MP4 stored per resolution", encode("4", "mp4"), renditionProcessing, nil, "mp4-720", renditionProcessing},
+		{"clips are not renditions", &job{ID: "5", Kind: "clip", VideoID: "a.mp4"}, renditionReady, nil, "", ""},
+	}
+	for _, step := range steps {
+		updateRendition(step.job, step.status, step.err)
+		got, errText := status(step.key)
+		if got != step.want {
+			t.Errorf("%s: status %q, want %q", step.name, got, step.want)
+		}
+		if step.err != nil && errText != step.err.Error() {
+			t.Errorf("%s: error %q, want the job's", step.name, errText)
+		}
+	}
+	if _, err := os.Stat(renditionsFile()); err != nil {
+		t.Errorf("renditions not saved: %v", err)
+	}
+}
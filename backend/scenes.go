@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Directory holding the shot keyframes of each video
+var scenesDir = "./uploads/scenes"
+
+// Width of the keyframes extracted for shots
+const keyframeWidth = 320
+
+// sceneAnalysis lists the shots of a video, split at the frames whose scene
+// score is above Threshold
+type sceneAnalysis struct {
+	Threshold  float64   `json:"threshold"`
+	Duration   float64   `json:"duration"`
+	Shots      []shot    `json:"shots"`
+	AnalyzedAt time.Time `json:"analyzedAt"`
+}
+
+// shot is a continuous take between two cuts
+type shot struct {
+	Start    float64 `json:"start"`
+	End      float64 `json:"end"`
+	Score    float64 `json:"score"`              // Of the cut starting the shot, 0 for the first shot
+	Keyframe string  `json:"keyframe,omitempty"` // File name in the video's scenes directory
+}
+
+// Scene analyses per video ID, persisted next to the uploads
+var (
+	sceneAnalyses = make(map[string]*sceneAnalysis)
+	scenesMu      sync.Mutex
+)
+
+// scenesFile is where scene analyses are stored
+func scenesFile() string {
+	return filepath.Join(uploadsDir, ".scenes.json")
+}
+
+// loadScenes reads the stored scene analyses
+func loadScenes() error {
+	scenesMu.Lock()
+	defer scenesMu.Unlock()
+	return readJSONFile(scenesFile(), &sceneAnalyses)
+}
+
+// lookupScenes returns the scene analysis of a video
+func lookupScenes(videoID string) (*sceneAnalysis, bool) {
+	scenesMu.Lock()
+	defer scenesMu.Unlock()
+	a, ok := sceneAnalyses[videoID]
+	return a, ok
+}
+
+// forgetScenes removes the scene analysis and keyframes of a deleted video
+func forgetScenes(videoID string) {
+	os.RemoveAll(filepath.Join(scenesDir, videoID))
+	scenesMu.Lock()
+	defer scenesMu.Unlock()
+	if _, ok := sceneAnalyses[videoID]; !ok {
+		return
+	}
+	delete(sceneAnalyses, videoID)
+	if err := writeJSONFile(scenesFile(), sceneAnalyses); err != nil {
+		slog.Error("Failed to save scene analyses", "error", err)
+	}
+}
+
+// posterShot returns the index of the shot whose keyframe best represents
+// the video: the longest shot, passing over the first one, which is often
+// a title or fade-in, when there are others
+func (a *sceneAnalysis) posterShot() int {
+	best := -1
+	for i, s := range a.Shots {
+		if s.Keyframe == "" || (i == 0 && len(a.Shots) > 1) {
+			continue
+		}
+		if best < 0 || s.End-s.Start > a.Shots[best].End-a.Shots[best].Start {
+			best = i
+		}
+	}
+	if best < 0 && len(a.Shots) > 0 && a.Shots[0].Keyframe != "" {
+		best = 0
+	}
+	return best
+}
+
+// analyzeVideoScenes queues a scene analysis of a video
+func analyzeVideoScenes(c *fiber.Ctx) error {
+	if err := checkFFmpeg(); err != nil {
+		slog.ErrorContext(c.UserContext(), "FFmpeg not available", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": fmt.Sprintf("FFmpeg error: %v", err),
+		})
+	}
+
+	id := c.Params("id")
+	if !videoExists(id) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Source video not found",
+		})
+	}
+	sourcePath := filepath.Join(uploadsDir, id)
+	slog.InfoContext(c.UserContext(), "Scene analysis requested", "video_id", id)
+
+	j := enqueueJob(c.UserContext(), &job{
+		Kind:    "scenes",
+		VideoID: id,
+	}, jobSpec{
+		ProgressID: id,
+		Duration:   videoDuration(c.UserContext(), id),
+		OutputDir:  newStagingDir(transcodedDir),
+		Source:     sourcePath,
+	})
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"success": true,
+		"videoId": id,
+		"jobId":   j.ID,
+	})
+}
+
+// getVideoScenes returns the shots of a video with their keyframe URLs
+func getVideoScenes(c *fiber.Ctx) error {
+	id := c.Params("id")
+	a, ok := lookupScenes(id)
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Video has no scene analysis",
+		})
+	}
+
+	shots := make([]fiber.Map, 0, len(a.Shots))
+	for i, s := range a.Shots {
+		item := fiber.Map{
+			"index":    i,
+			"start":    s.Start,
+			"end":      s.End,
+			"duration": s.End - s.Start,
+			"score":    s.Score,
+		}
+		if s.Keyframe != "" {
+			item["keyframeUrl"] = fmt.Sprintf("/api/videos/%s/scenes/%d/keyframe", id, i)
+		}
+		shots = append(shots, item)
+	}
+
+	response := fiber.Map{
+		"videoId":    id,
+		"threshold":  a.Threshold,
+		"duration":   a.Duration,
+		"shots":      shots,
+		"analyzedAt": a.AnalyzedAt,
+	}
+	if a.posterShot() >= 0 {
+		response["thumbnailUrl"] = fmt.Sprintf("/api/videos/%s/thumbnail", id)
+	}
+	return c.JSON(response)
+}
+
+// getShotKeyframe returns the keyframe of a shot
+func getShotKeyframe(c *fiber.Ctx) error {
+	id := c.Params("id")
+	a, ok := lookupScenes(id)
+	index, err := strconv.Atoi(c.Params("index"))
+	if !ok || err != nil || index < 0 || index >= len(a.Shots) || a.Shots[index].Keyframe == "" {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Keyframe not found",
+		})
+	}
+	return sendMedia(c, filepath.Join(scenesDir, id, a.Shots[index].Keyframe))
+}
+
+// getVideoThumbnail returns the keyframe picked as thumbnail of a video
+func getVideoThumbnail(c *fiber.Ctx) error {
+	id := c.Params("id")
+	a, ok := lookupScenes(id)
+	if !ok || a.posterShot() < 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Thumbnail not found",
+		})
+	}
+	return sendMedia(c, filepath.Join(scenesDir, id, a.Shots[a.posterShot()].Keyframe))
+}
+
+// analyzeScenes runs a scenes job
+func analyzeScenes(ctx context.Context, j *job) error {
+	defer os.RemoveAll(j.spec.OutputDir)
+	_, err := runSceneAnalysis(ctx, j, getConfig().Scenes.Threshold)
+	return err
+}
+
+// runSceneAnalysis detects the shots of the job's video, extracts their
+// keyframes and stores the analysis, replacing the previous one. The job's
+// output directory is used as scratch space.
+func runSceneAnalysis(ctx context.Context, j *job, threshold float64) (*sceneAnalysis, error) {
+	keyframesDir := filepath.Join(j.spec.OutputDir, "keyframes")
+	if err := os.MkdirAll(keyframesDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	detectCtx, span := startStage(ctx, "scenes.detect")
+	changes, err := detectSceneChanges(detectCtx, j, threshold)
+	endStage(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &sceneAnalysis{
+		Threshold:  threshold,
+		Duration:   j.spec.Duration,
+		Shots:      splitShots(changes, j.spec.Duration, getConfig().Scenes.MinShotSeconds),
+		AnalyzedAt: time.Now(),
+	}
+
+	// The middle of a shot represents it better than its first frame,
+	// which may still be part of a transition
+	keyframeCtx, span := startStage(ctx, "scenes.keyframes")
+	for i := range a.Shots {
+		s := &a.Shots[i]
+		at := s.Start
+		if s.End > s.Start {
+			at = (s.Start + s.End) / 2
+		}
+		s.Keyframe = fmt.Sprintf("shot_%04d.jpg", i)
+		if err = extractFrame(keyframeCtx, j.spec.Source, at, filepath.Join(keyframesDir, s.Keyframe)); err != nil {
+			break
+		}
+	}
+	endStage(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("keyframe extraction failed: %v", err)
+	}
+
+	dir := filepath.Join(scenesDir, j.VideoID)
+	scenesMu.Lock()
+	defer scenesMu.Unlock()
+	os.RemoveAll(dir)
+	if err := os.Rename(keyframesDir, dir); err != nil {
+		return nil, err
+	}
+	sceneAnalyses[j.VideoID] = a
+	if err := writeJSONFile(scenesFile(), sceneAnalyses); err != nil {
+		return nil, err
+	}
+
+	slog.InfoContext(ctx, "Scenes analyzed", "video_id", j.VideoID, "cuts", len(changes), "shots", len(a.Shots))
+	return a, nil
+}
+
+// sceneChange is a frame where the picture changes, with ffmpeg's scene
+// score from 0 to 1
+type sceneChange struct {
+	Time  float64
+	Score float64
+}
+
+// splitShots turns scene changes into shots covering the whole video.
+// Cuts less than minLength after the previous one, such as flashes, are
+// merged into it, keeping the higher score.
+func splitShots(changes []sceneChange, duration, minLength float64) []shot {
+	shots := []shot{{Start: 0}}
+	for _, change := range changes {
+		last := &shots[len(shots)-1]
+		if duration > 0 && change.Time >= duration {
+			continue
+		}
+		if change.Time-last.Start < minLength {
+			if len(shots) > 1 {
+				last.Score = max(last.Score, change.Score)
+			}
+			continue
+		}
+		last.End = change.Time
+		shots = append(shots, shot{Start: change.Time, Score: change.Score})
+	}
+	shots[len(shots)-1].End = max(duration, shots[len(shots)-1].Start)
+	return shots
+}
+
+// detectSceneChanges runs ffmpeg's scene detection over the job's source
+// and returns the frames scoring above threshold
+func detectSceneChanges(ctx context.Context, j *job, threshold float64) ([]sceneChange, error) {
+	metadataPath := filepath.Join(j.spec.OutputDir, "scenes.txt")
+	err := runFFmpeg(ctx, exec.Command("ffmpeg", "-y",
+		"-i", j.spec.Source,
+		"-an",
+		"-vf", fmt.Sprintf("select='gt(scene,%g)',metadata=print:file='%s'", threshold, escapeFilterPath(metadataPath)),
+		"-f", "null",
+		"-progress", "pipe:1",
+		"-"), j.spec.ProgressID, j.spec.Duration)
+	if err != nil {
+		return nil, fmt.Errorf("scene detection failed: %v", err)
+	}
+	return parseSceneMetadata(metadataPath)
+}
+
+// parseSceneMetadata reads the frames printed by the metadata filter:
+// a "frame:N pts:P pts_time:T" line followed by its lavfi.scene_score
+func parseSceneMetadata(path string) ([]sceneChange, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil // No frame was selected
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var changes []sceneChange
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "frame:") {
+			for _, field := range strings.Fields(line) {
+				if value, ok := strings.CutPrefix(field, "pts_time:"); ok {
+					t, err := strconv.ParseFloat(value, 64)
+					if err != nil {
+						return nil, fmt.Errorf("invalid scene time %q", value)
+					}
+					changes = append(changes, sceneChange{Time: t})
+				}
+			}
+		} else if value, ok := strings.CutPrefix(line, "lavfi.scene_score="); ok && len(changes) > 0 {
+			changes[len(changes)-1].Score, _ = strconv.ParseFloat(value, 64)
+		}
+	}
+	return changes, scanner.Err()
+}
+
+// extractFrame writes the frame of a video at the given time as a JPEG
+// keyframe
+func extractFrame(ctx context.Context, sourcePath string, at float64, outputPath string) error {
+	cmd := exec.CommandContext(ctx, "ffmpeg", "-y",
+		"-ss", formatSeconds(at),
+		"-i", sourcePath,
+		"-frames:v", "1",
+		"-vf", fmt.Sprintf("scale=%d:-2", keyframeWidth),
+		"-q:v", "3",
+		outputPath)
+	_, span := startCommand(ctx, cmd)
+	output, err := cmd.CombinedOutput()
+	endCommand(span, cmd, err)
+	if err != nil {
+		return fmt.Errorf("frame extraction at %s failed: %v: %s", formatSeconds(at), err, lastLine(string(output)))
+	}
+	return nil
+}
+
+// lastLine returns the last non-empty line of ffmpeg's output
+func lastLine(output string) string {
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	return lines[len(lines)-1]
+}
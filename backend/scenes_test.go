@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestParseSceneMetadata(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name     string
+		metadata string
+		want     []sceneChange
+		wantErr  bool
+	}{
+		{"frames with scores", "frame:0    pts:12012   pts_time:1.001\nlavfi.scene_score=0.523000\n" +
+			"frame:1    pts:60060   pts_time:5.005\nlavfi.scene_score=0.871000\n",
+			[]sceneChange{{Time: 1.001, Score: 0.523}, {Time: 5.005, Score: 0.871}}, false},
+		{"score before any frame", "lavfi.scene_score=0.9\nframe:0 pts:1 pts_time:2\n", []sceneChange{{Time: 2}}, false},
+		{"invalid time", "frame:0 pts:1 pts_time:abc\n", nil, true},
+		{"no frame selected", "", nil, false},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "scenes.txt")
+		os.Remove(path)
+		if tt.metadata != "" {
+			if err := os.WriteFile(path, []byte(tt.metadata), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := parseSceneMetadata(path)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSplitShots(t *testing.T) {
+	tests := []struct {
+		name      string
+		changes   []sceneChange
+		duration  float64
+		minLength float64
+		want      []shot
+	}{
+		{
+			name:      "cuts",
+			changes:   []sceneChange{{5, 0.6}, {20, 0.7}},
+			duration:  60,
+			minLength: 1,
+			want:      []shot{{Start: 0, End: 5}, {Start: 5, End: 20, Score: 0.6}, {Start: 20, End: 60, Score: 0.7}},
+		},
+		{
+			name:      "flash merged keeping the higher score",
+			changes:   []sceneChange{{5, 0.6}, {5.4, 0.9}, {20, 0.7}},
+			duration:  60,
+			minLength: 1,
+			want:      []shot{{Start: 0, End: 5}, {Start: 5, End: 20, Score: 0.9}, {Start: 20, End: 60, Score: 0.7}},
+		},
+		{
+			name:      "flash at the start",
+			changes:   []sceneChange{{0.5, 0.9}, {30, 0.5}},
+			duration:  60,
+			minLength: 1,
+			want:      []shot{{Start: 0, End: 30}, {Start: 30, End: 60, Score: 0.5}},
+		},
+		{
+			name:      "cut at the end",
+			changes:   []sceneChange{{30, 0.5}, {60, 0.8}},
+			duration:  60,
+			minLength: 1,
+			want:      []shot{{Start: 0, End: 30}, {Start: 30, End: 60, Score: 0.5}},
+		},
+		{
+			name:      "unknown duration",
+			changes:   []sceneChange{{10, 0.5}},
+			minLength: 1,
+			want:      []shot{{Start: 0, End: 10}, {Start: 10, End: 10, Score: 0.5}},
+		},
+		{
+			name:     "no cuts",
+			duration: 60,
+			want:     []shot{{Start: 0, End: 60}},
+		},
+	}
+	for _, tt := range tests {
+		if got := splitShots(tt.changes, tt.duration, tt.minLength); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPosterShot(t *testing.T) {
+	shots := func(lengths ...float64) []shot {
+		var list []shot
+		start := 0.0
+		for i, length := range lengths {
+			s := shot{Start: start, End: start + length}
+			if length > 0 {
+				s.Keyframe = fmt.Sprintf("shot_%04d.jpg", i)
+			}
+			list = append(list, s)
+			start += length
+		}
+		return list
+	}
+	tests := []struct {
+		name  string
+		shots []shot
+		want  int
+	}{
+		{"longest shot", shots(10, 5, 25, 5), 2},
+		{"long first shot passed over", shots(40, 5, 10), 2},
+		{"single shot", shots(40), 0},
+		{"shots without keyframes", []shot{{Start: 0, End: 10}, {Start: 10, End: 20}}, -1},
+		{"no shots", nil, -1},
+	}
+	for _, tt := range tests {
+		a := &sceneAnalysis{Shots: tt.shots}
+		if got := a.posterShot(); got != tt.want {
+			t.Errorf("%s: shot %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Page sizes of the video list
+const (
+	defaultPageSize = 100
+	maxPageSize     = 500
+)
+
+// Weights of a query match by the field it was found in
+const (
+	weightName        = 3
+	weightTags        = 2
+	weightCategory    = 2
+	weightDescription = 1
+	weightCustom      = 1
+)
+
+// Sort keys of the video list
+var videoSorts = []string{"relevance", "uploadedAt", "name", "duration", "size"}
+
+// indexEntry is a video in the search index. The file facts are stored
+// so that durations are only probed for new or changed files; the text
+// fields are indexed from the metadata.
+type indexEntry struct {
+	Size       int64     `json:"size"`
+	ModTime    time.Time `json:"modTime"`
+	Duration   float64   `json:"duration"`
+	UploadedAt time.Time `json:"uploadedAt"`
+
+	id       string
+	metadata videoMetadata
+	terms    map[string]int // Indexed term to the weight of its best field
+}
+
+// The search index: the entries of all videos, and the IDs of the videos
+// containing each term
+var (
+	index    = make(map[string]*indexEntry)
+	postings = make(map[string]map[string]bool)
+	indexMu  sync.Mutex
+)
+
+// indexFile is where the file facts of indexed videos are stored
+func indexFile() string {
+	return filepath.Join(uploadsDir, ".index.json")
+}
+
+// loadIndex builds the search index from the stored file facts, the video
+// metadata and the uploads directory. Files that are new or changed since
+// they were indexed are probed again.
+func loadIndex(ctx context.Context) error {
+	stored := make(map[string]*indexEntry)
+	if err := readJSONFile(indexFile(), &stored); err != nil {
+		slog.Warn("Failed to read search index, rebuilding it", "error", err)
+	}
+
+	files, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		return err
+	}
+	probed := 0
+	for _, file := range files {
+		if file.IsDir() || !getConfig().allowsExtension(filepath.Ext(file.Name())) {
+			continue
+		}
+		if !refreshIndexEntry(ctx, file.Name(), stored[file.Name()]) {
+			probed++
+		}
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if err := writeJSONFile(indexFile(), index); err != nil {
+		return err
+	}
+	slog.Info("Search index loaded", "videos", len(index), "probed", probed)
+	return nil
+}
+
+// indexVideo adds a video to the search index, or updates it after its
+// file or metadata changed
+func indexVideo(ctx context.Context, id string) {
+	indexMu.Lock()
+	previous := index[id]
+	indexMu.Unlock()
+
+	refreshIndexEntry(ctx, id, previous)
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if err := writeJSONFile(indexFile(), index); err != nil {
+		slog.ErrorContext(ctx, "Failed to save search index", "error", err)
+	}
+}
+
+// refreshIndexEntry indexes a video, reusing the probed duration of
+// previous when the file is unchanged. It reports whether it was reused.
+func refreshIndexEntry(ctx context.Context, id string, previous *indexEntry) bool {
+	info, err := os.Stat(filepath.Join(uploadsDir, id))
+	if err != nil {
+		unindexVideo(id)
+		return false
+	}
+
+	e := &indexEntry{Size: info.Size(), ModTime: info.ModTime(), UploadedAt: info.ModTime()}
+	reused := previous != nil && previous.Size == e.Size && previous.ModTime.Equal(e.ModTime)
+	if reused {
+		e.Duration = previous.Duration
+		e.UploadedAt = previous.UploadedAt
+	} else if probe, err := probeVideo(ctx, filepath.Join(uploadsDir, id)); err == nil {
+		e.Duration = probe.Duration
+	} else {
+		slog.WarnContext(ctx, "Failed to probe video for the search index", "video_id", id, "error", err)
+	}
+	e.id = id
+	e.metadata = lookupMetadata(id)
+	e.terms = e.indexTerms()
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	removePostingsLocked(id)
+	index[id] = e
+	for term := range e.terms {
+		if postings[term] == nil {
+			postings[term] = make(map[string]bool)
+		}
+		postings[term][id] = true
+	}
+	return reused
+}
+
+// lookupIndexEntry returns the index entry of a video, if it is indexed
+func lookupIndexEntry(id string) (indexEntry, bool) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	e, ok := index[id]
+	if !ok {
+		return indexEntry{}, false
+	}
+	return *e, true
+}
+
+// unindexVideo removes a deleted video from the search index
+func unindexVideo(id string) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if _, ok := index[id]; !ok {
+		return
+	}
+	removePostingsLocked(id)
+	delete(index, id)
+	if err := writeJSONFile(indexFile(), index); err != nil {
+		slog.Error("Failed to save search index", "error", err)
+	}
+}
+
+// removePostingsLocked drops a video from the postings of its terms.
+// indexMu must be held.
+func removePostingsLocked(id string) {
+	e, ok := index[id]
+	if !ok {
+		return
+	}
+	for term := range e.terms {
+		delete(postings[term], id)
+		if len(postings[term]) == 0 {
+			delete(postings, term)
+		}
+	}
+}
+
+// indexTerms returns the terms of the text fields of a video, each with the
+// weight of the most important field it occurs in
+func (e *indexEntry) indexTerms() map[string]int {
+	terms := make(map[string]int)
+	add := func(text string, weight int) {
+		for _, term := range tokenize(text) {
+			terms[term] = max(terms[term], weight)
+		}
+	}
+
+	m := e.metadata
+	add(m.displayName(strings.TrimSuffix(e.id, filepath.Ext(e.id))), weightName)
+	add(strings.Join(m.Tags, " "), weightTags)
+	add(m.Category, weightCategory)
+	add(m.Description, weightDescription)
+	for _, value := range m.CustomFields {
+		switch v := value.(type) {
+		case string:
+			add(v, weightCustom)
+		case []interface{}:
+			for _, item := range v {
+				if s, ok := item.(string); ok {
+					add(s, weightCustom)
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// tokenize splits text into lowercase words
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// matchQueryLocked scores the videos containing every word of a query.
+// Each word matches the terms it is a prefix of, so results appear while
+// typing. indexMu must be held.
+func matchQueryLocked(query string) map[string]int {
+	var scores map[string]int
+	for _, word := range tokenize(query) {
+		best := make(map[string]int)
+		for term, ids := range postings {
+			if !strings.HasPrefix(term, word) {
+				continue
+			}
+			for id := range ids {
+				best[id] = max(best[id], index[id].terms[term])
+			}
+		}
+		if scores == nil {
+			scores = best
+			continue
+		}
+		for id := range scores {
+			if weight, ok := best[id]; ok {
+				scores[id] += weight
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	return scores
+}
+
+// videoQuery is a parsed video list request
+type videoQuery struct {
+	Text           string
+	Tags           []string
+	Formats        []string
+	MinDuration    float64
+	MaxDuration    float64 // 0 for no limit
+	UploadedAfter  time.Time
+	UploadedBefore time.Time
+	Owner          string
+	Status         string
+	Category       string
+	Workspace      string
+	Sort           string
+	Descending     bool
+	Limit          int
+	Cursor         *videoCursor
+}
+
+// videoCursor points after the last video of a page. It holds the sort
+// key of that video, so pages stay consistent while videos are added.
+type videoCursor struct {
+	Sort string      `json:"s"`
+	Desc bool        `json:"d"`
+	Key  interface{} `json:"k"`
+	ID   string      `json:"id"`
+}
+
+// parseVideoQuery reads the search, filter, sort and page parameters of
+// the video list
+func parseVideoQuery(c *fiber.Ctx) (*videoQuery, error) {
+	q := &videoQuery{
+		Text:      strings.TrimSpace(c.Query("q")),
+		Owner:     c.Query("owner"),
+		Status:    c.Query("status"),
+		Category:  c.Query("category"),
+		Workspace: c.Query("workspace"),
+		Sort:      c.Query("sort"),
+		Limit:     defaultPageSize,
+	}
+
+	if tags := c.Query("tags"); tags != "" {
+		normalized, err := normalizeTags(strings.Split(tags, ","))
+		if err != nil {
+			return nil, err
+		}
+		q.Tags = normalized
+	}
+	if formats := c.Query("format"); formats != "" {
+		for _, format := range strings.Split(formats, ",") {
+			format = strings.ToLower(strings.TrimSpace(format))
+			if !slices.Contains(playbackFormats, format) {
+				return nil, fmt.Errorf("format must be one of %s", strings.Join(playbackFormats, ", "))
+			}
+			q.Formats = append(q.Formats, format)
+		}
+	}
+	if q.Status != "" && !slices.Contains(videoStatuses, q.Status) {
+		return nil, fmt.Errorf("status must be one of %s", strings.Join(videoStatuses, ", "))
+	}
+
+	var err error
+	if q.MinDuration, err = queryFloat(c, "minDuration"); err != nil {
+		return nil, err
+	}
+	if q.MaxDuration, err = queryFloat(c, "maxDuration"); err != nil {
+		return nil, err
+	}
+	if q.UploadedAfter, err = queryTime(c, "uploadedAfter"); err != nil {
+		return nil, err
+	}
+	if q.UploadedBefore, err = queryTime(c, "uploadedBefore"); err != nil {
+		return nil, err
+	}
+
+	if q.Sort == "" {
+		q.Sort = "uploadedAt"
+		if q.Text != "" {
+			q.Sort = "relevance"
+		}
+	}
+	if !slices.Contains(videoSorts, q.Sort) {
+		return nil, fmt.Errorf("sort must be one of %s", strings.Join(videoSorts, ", "))
+	}
+	if q.Sort == "relevance" && q.Text == "" {
+		return nil, fmt.Errorf("sort by relevance needs a query")
+	}
+	switch c.Query("order") {
+	case "":
+		q.Descending = q.Sort != "name"
+	case "asc":
+	case "desc":
+		q.Descending = true
+	default:
+		return nil, fmt.Errorf("order must be asc or desc")
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n < 1 || n > maxPageSize {
+			return nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = n
+	}
+	if cursor := c.Query("cursor"); cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			q.Cursor = &videoCursor{}
+			err = json.Unmarshal(data, q.Cursor)
+		}
+		if err != nil || q.Cursor.Sort != q.Sort || q.Cursor.Desc != q.Descending {
+			return nil, fmt.Errorf("invalid cursor")
+		}
+	}
+	return q, nil
+}
+
+// queryFloat reads an optional non-negative number parameter
+func queryFloat(c *fiber.Ctx, name string) (float64, error) {
+	value := c.Query(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative number", name)
+	}
+	return n, nil
+}
+
+// queryTime reads an optional RFC 3339 time or YYYY-MM-DD date parameter
+func queryTime(c *fiber.Ctx, name string) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s must be an RFC 3339 time or a YYYY-MM-DD date", name)
+}
+
+// searchResult is a video matching a query, with its sort key
+type searchResult struct {
+	entry indexEntry
+	key   interface{}
+}
+
+// searchVideos returns a page of the videos matching q, the total number
+// of matches and the cursor of the next page, if there is one
+func searchVideos(q *videoQuery) ([]searchResult, int, string) {
+	indexMu.Lock()
+	var scores map[string]int
+	if q.Text != "" {
+		scores = matchQueryLocked(q.Text)
+	}
+	var candidates []indexEntry
+	for id, e := range index {
+		if scores != nil {
+			if _, ok := scores[id]; !ok {
+				continue
+			}
+		}
+		candidates = append(candidates, *e)
+	}
+	indexMu.Unlock()
+
+	// Filters on renditions are applied outside indexMu, as they take
+	// renditionsMu
+	var results []searchResult
+	for _, e := range candidates {
+		if !q.matches(e) {
+			continue
+		}
+		results = append(results, searchResult{entry: e, key: q.sortKey(e, scores[e.id])})
+	}
+	sort.Slice(results, func(a, b int) bool {
+		return q.compare(results[a].key, results[a].entry.id, results[b].key, results[b].entry.id) < 0
+	})
+
+	total := len(results)
+	if q.Cursor != nil {
+		start := sort.Search(len(results), func(i int) bool {
+			return q.compare(results[i].key, results[i].entry.id, q.Cursor.Key, q.Cursor.ID) > 0
+		})
+		results = results[start:]
+	}
+	next := ""
+	if len(results) > q.Limit {
+		results = results[:q.Limit]
+		last := results[len(results)-1]
+		data, _ := json.Marshal(videoCursor{Sort: q.Sort, Desc: q.Descending, Key: last.key, ID: last.entry.id})
+		next = base64.RawURLEncoding.EncodeToString(data)
+	}
+	return results, total, next
+}
+
+// matches reports whether a video passes the filters of q
+func (q *videoQuery) matches(e indexEntry) bool {
+	m := e.metadata
+	switch {
+	case q.Owner != "" && m.Owner != q.Owner,
+		q.Category != "" && !strings.EqualFold(m.Category, q.Category),
+		q.Workspace != "" && m.Workspace != q.Workspace,
+		e.Duration < q.MinDuration,
+		q.MaxDuration > 0 && e.Duration > q.MaxDuration,
+		!q.UploadedAfter.IsZero() && e.UploadedAt.Before(q.UploadedAfter),
+		!q.UploadedBefore.IsZero() && !e.UploadedAt.Before(q.UploadedBefore):
+		return false
+	}
+	for _, tag := range q.Tags {
+		if !slices.Contains(m.Tags, tag) {
+			return false
+		}
+	}
+	if len(q.Formats) > 0 {
+		playable := playableFormats(e.id)
+		for _, format := range q.Formats {
+			if !slices.Contains(playable, format) {
+				return false
+			}
+		}
+	}
+	return q.Status == "" || videoStatus(e.id) == q.Status
+}
+
+// sortKey returns the value a video is sorted by. Keys are strings or
+// float64, so they survive the JSON round trip through a cursor.
+func (q *videoQuery) sortKey(e indexEntry, score int) interface{} {
+	switch q.Sort {
+	case "relevance":
+		return float64(score)
+	case "name":
+		return strings.ToLower(e.metadata.displayName(e.id))
+	case "duration":
+		return e.Duration
+	case "size":
+		return float64(e.Size)
+	default:
+		return float64(e.UploadedAt.UnixMicro())
+	}
+}
+
+// compare orders two videos by sort key in the direction of q, then by ID
+func (q *videoQuery) compare(keyA interface{}, idA string, keyB interface{}, idB string) int {
+	result := 0
+	switch a := keyA.(type) {
+	case string:
+		b, _ := keyB.(string)
+		result = strings.Compare(a, b)
+	case float64:
+		b, _ := keyB.(float64)
+		switch {
+		case a < b:
+			result = -1
+		case a > b:
+			result = 1
+		}
+	}
+	if q.Descending {
+		result = -result
+	}
+	if result == 0 {
+		result = strings.Compare(idA, idB)
+	}
+	return result
+}
+
+// nextPageLink returns the URL of the next page of the video list
+func nextPageLink(c *fiber.Ctx, cursor string) string {
+	query, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+	query.Set("cursor", cursor)
+	return c.Path() + "?" + query.Encode()
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// parseQuery runs parseVideoQuery on a request with the given query string
+func parseQuery(t *testing.T, query url.Values) (*videoQuery, error) {
+	t.Helper()
+	var q *videoQuery
+	var err error
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		q, err = parseVideoQuery(c)
+		return nil
+	})
+	if _, testErr := app.Test(httptest.NewRequest("GET", "/?"+query.Encode(), nil)); testErr != nil {
+		t.Fatal(testErr)
+	}
+	return q, err
+}
+
+func TestVideoCompare(t *testing.T) {
+	asc := &videoQuery{}
+	desc := &videoQuery{Descending: true}
+	tests := []struct {
+		name       string
+		q          *videoQuery
+		keyA, keyB interface{}
+		idA, idB   string
+		want       int
+	}{
+		{"numbers ascending", asc, 1.0, 2.0, "b", "a", -1},
+		{"numbers descending", desc, 1.0, 2.0, "b", "a", 1},
+		{"strings ascending", asc, "alpha", "beta", "z", "a", -1},
+		{"strings descending", desc, "alpha", "beta", "z", "a", 1},
+		{"equal keys by ID", asc, 5.0, 5.0, "a.mp4", "b.mp4", -1},
+		{"equal keys by ID when descending", desc, 5.0, 5.0, "a.mp4", "b.mp4", -1},
+		{"same video", desc, "x", "x", "a.mp4", "a.mp4", 0},
+		{"large timestamps", desc, 1760000000000001.0, 1760000000000000.0, "a", "b", -1},
+	}
+	for _, tt := range tests {
+		if got := tt.q.compare(tt.keyA, tt.idA, tt.keyB, tt.idB); got != tt.want {
+			t.Errorf("%s: compare = %d, want %d", tt.name, got, tt.want)
+		}
+		if got := tt.q.compare(tt.keyB, tt.idB, tt.keyA, tt.idA); got != -tt.want {
+			t.Errorf("%s: reversed compare = %d, want %d", tt.name, got, -tt.want)
+		}
+	}
+}
+
+func TestSearchCursorRoundTrip(t *testing.T) {
+	indexMu.Lock()
+	saved := index
+	index = make(map[string]*indexEntry)
+	uploaded := time.Date(2026, 10, 1, 12, 0, 0, 123456000, time.UTC)
+	titles := []string{"Zebra", "apple", "Mango", "apple", "banana", "Cherry", "date"}
+	for i, title := range titles {
+		id := string(rune('a'+i)) + ".mp4"
+		index[id] = &indexEntry{
+			id:         id,
+			Size:       int64(1000 * (i % 3)),
+			Duration:   float64(i%4) + 0.1,
+			UploadedAt: uploaded.Add(time.Duration(i%5) * time.Microsecond),
+			metadata:   videoMetadata{Title: title},
+		}
+	}
+	indexMu.Unlock()
+	t.Cleanup(func() {
+		indexMu.Lock()
+		index = saved
+		indexMu.Unlock()
+	})
+
+	for _, sort := range []string{"uploadedAt", "name", "duration", "size"} {
+		for _, order := range []string{"asc", "desc"} {
+			query := url.Values{"sort": {sort}, "order": {order}}
+			q, err := parseQuery(t, query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.Limit = len(titles)
+			all, total, next := searchVideos(q)
+			if total != len(titles) || next != "" {
+				t.Fatalf("%s %s: total %d, next %q", sort, order, total, next)
+			}
+			var want []string
+			for _, r := range all {
+				want = append(want, r.entry.id)
+			}
+
+			// Pages of two follow each other through the cursor
+			var got []string
+			query.Set("limit", "2")
+			for pages := 0; ; pages++ {
+				if pages > len(titles) {
+					t.Fatalf("%s %s: cursor does not advance", sort, order)
+				}
+				q, err := parseQuery(t, query)
+				if err != nil {
+					t.Fatalf("%s %s: %v", sort, order, err)
+				}
+				page, _, next := searchVideos(q)
+				for _, r := range page {
+					got = append(got, r.entry.id)
+				}
+				if next == "" {
+					break
+				}
+				query.Set("cursor", next)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("%s %s: paged %v, want %v", sort, order, got, want)
+			}
+		}
+	}
+}
+
+func TestSearchCursorMismatch(t *testing.T) {
+	q := &videoQuery{Sort: "name", Limit: 1}
+	indexMu.Lock()
+	saved := index
+	index = map[string]*indexEntry{
+		"a.mp4": {id: "a.mp4"},
+		"b.mp4": {id: "b.mp4"},
+	}
+	indexMu.Unlock()
+	t.Cleanup(func() {
+		indexMu.Lock()
+		index = saved
+		indexMu.Unlock()
+	})
+	_, _, next := searchVideos(q)
+	if next == "" {
+		t.Fatal("no cursor for the second page")
+	}
+
+	tests := []url.Values{
+		{"sort": {"name"}, "order": {"desc"}, "cursor": {next}},
+		{"sort": {"size"}, "order": {"asc"}, "cursor": {next}},
+		{"sort": {"name"}, "order": {"asc"}, "cursor": {"not base64!"}},
+		{"sort": {"name"}, "order": {"asc"}, "cursor": {"bm90IGpzb24"}},
+	}
+	for _, query := range tests {
+		if _, err := parseQuery(t, query); err == nil {
+			t.Errorf("%v: cursor accepted", query)
+		}
+	}
+	if _, err := parseQuery(t, url.Values{"sort": {"name"}, "order": {"asc"}, "cursor": {next}}); err != nil {
+		t.Errorf("matching cursor refused: %v", err)
+	}
+}
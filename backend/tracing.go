@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer used for request and pipeline spans
+var tracer = otel.Tracer("videostreaming")
+
+// initTracing installs the trace exporter selected by OTEL_TRACES_EXPORTER:
+// "otlp" (configured through the standard OTEL_EXPORTER_OTLP_* variables),
+// "stdout" for local testing, or "none" (the default). The returned
+// function flushes pending spans.
+func initTracing() (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch strings.ToLower(os.Getenv("OTEL_TRACES_EXPORTER")) {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		exporter, err = otlptracehttp.New(context.Background())
+	case "stdout":
+		exporter, err = stdouttrace.New(stdouttrace.WithPrettyPrint())
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_EXPORTER %q", os.Getenv("OTEL_TRACES_EXPORTER"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName("videostreaming"),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	slog.Info("Tracing enabled", "exporter", os.Getenv("OTEL_TRACES_EXPORTER"))
+	return provider.Shutdown, nil
+}
+
+// headerCarrier adapts fasthttp request headers for trace propagation
+type headerCarrier struct {
+	c *fiber.Ctx
+}
+
+func (h headerCarrier) Get(key string) string {
+	return h.c.Get(key)
+}
+
+func (h headerCarrier) Set(key, value string) {
+	h.c.Request().Header.Set(key, value)
+}
+
+func (h headerCarrier) Keys() []string {
+	var keys []string
+	h.c.Request().Header.VisitAll(func(key, _ []byte) {
+		keys = append(keys, string(key))
+	})
+	return keys
+}
+
+// tracingMiddleware starts a server span for every request. Handlers get
+// the span context through c.UserContext().
+func tracingMiddleware(c *fiber.Ctx) error {
+	ctx := otel.GetTextMapPropagator().Extract(context.Background(), headerCarrier{c})
+	ctx, span := tracer.Start(ctx, c.Method()+" "+c.Path(),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(c.Method()),
+			semconv.URLPath(c.Path()),
+		))
+	defer span.End()
+
+	c.SetUserContext(ctx)
+	err := c.Next()
+
+	// Name the span after the matched route to keep cardinality low
+	span.SetName(c.Method() + " " + c.Route().Path)
+	span.SetAttributes(
+		semconv.HTTPRoute(c.Route().Path),
+		semconv.HTTPResponseStatusCode(c.Response().StatusCode()),
+	)
+	if err != nil {
+		span.RecordError(err)
+	}
+	if err != nil || c.Response().StatusCode() >= 500 {
+		span.SetStatus(codes.Error, "")
+	}
+	return err
+}
+
+// startCommand starts a span for a child process, recording its arguments
+func startCommand(ctx context.Context, cmd *exec.Cmd) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "exec "+filepath.Base(cmd.Path), trace.WithAttributes(
+		semconv.ProcessExecutableName(filepath.Base(cmd.Path)),
+		semconv.ProcessCommandArgs(cmd.Args...),
+	))
+}
+
+// endCommand ends a child process span with its exit status
+func endCommand(span trace.Span, cmd *exec.Cmd, err error) {
+	if cmd.ProcessState != nil {
+		span.SetAttributes(semconv.ProcessExitCode(cmd.ProcessState.ExitCode()))
+	}
+	endStage(span, err)
+}
+
+// startStage starts a span for one stage of the processing pipeline
+func startStage(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endStage ends a stage span, recording err when it is not nil
+func endStage(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// The global tracer only delegates to the first provider installed, so
+// every test shares one recorder
+var (
+	spanRecorder     *tracetest.SpanRecorder
+	spanRecorderOnce sync.Once
+)
+
+// recordSpans returns a function listing the spans named name that ended
+// since it was called
+func recordSpans(name string) func() []sdktrace.ReadOnlySpan {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	start := len(spanRecorder.Ended())
+	return func() []sdktrace.ReadOnlySpan {
+		var spans []sdktrace.ReadOnlySpan
+		for _, s := range spanRecorder.Ended()[start:] {
+			if s.Name() == name {
+				spans = append(spans, s)
+			}
+		}
+		return spans
+	}
+}
+
+// spanAttribute returns the value of an attribute of a span
+func spanAttribute(s sdktrace.ReadOnlySpan, key attribute.Key) (attribute.Value, bool) {
+	for _, kv := range s.Attributes() {
+		if kv.Key == key {
+			return kv.Value, true
+		}
+	}
+	return attribute.Value{}, false
+}
+
+func TestTracingMiddleware(t *testing.T) {
+	ended := recordSpans("GET /videos/:id")
+	app := fiber.New()
+	app.Use(tracingMiddleware)
+	app.Get("/videos/:id", func(c *fiber.Ctx) error {
+		if c.Params("id") == "broken.mp4" {
+			return c.SendStatus(fiber.StatusInternalServerError)
+		}
+		return c.SendString("ok")
+	})
+
+	// The caller's trace is continued
+	traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest("GET", "/videos/a.mp4", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	if _, err := app.Test(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.Test(httptest.NewRequest("GET", "/videos/broken.mp4", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := ended()
+	if len(spans) != 2 {
+		t.Fatalf("%d spans named after the route, want 2", len(spans))
+	}
+	if got := spans[0].SpanContext().TraceID().String(); got != traceID {
+		t.Errorf("trace %s, want %s", got, traceID)
+	}
+	if route, _ := spanAttribute(spans[0], "http.route"); route.AsString() != "/videos/:id" {
+		t.Errorf("route %q, want /videos/:id", route.AsString())
+	}
+	if spans[0].Status().Code == codes.Error || spans[1].Status().Code != codes.Error {
+		t.Errorf("statuses %v and %v, want only the failed request marked", spans[0].Status(), spans[1].Status())
+	}
+	if status, _ := spanAttribute(spans[1], "http.response.status_code"); status.AsInt64() != 500 {
+		t.Errorf("status code %d, want 500", status.AsInt64())
+	}
+}
+
+func TestCommandSpans(t *testing.T) {
+	ended := recordSpans("exec sh")
+	cmd := exec.Command("sh", "-c", "exit 3")
+	_, span := startCommand(t.Context(), cmd)
+	endCommand(span, cmd, cmd.Run())
+
+	spans := ended()
+	if len(spans) != 1 {
+		t.Fatalf("%d command spans, want 1", len(spans))
+	}
+	if code, _ := spanAttribute(spans[0], "process.exit.code"); code.AsInt64() != 3 {
+		t.Errorf("exit code %d, want 3", code.AsInt64())
+	}
+	if args, _ := spanAttribute(spans[0], "process.command_args"); len(args.AsStringSlice()) != 3 {
+		t.Errorf("arguments %v, want sh -c and the script", args.AsStringSlice())
+	}
+	if spans[0].Status().Code != codes.Error {
+		t.Errorf("status %v, want an error", spans[0].Status())
+	}
+}
+
+func TestInitTracingExporters(t *testing.T) {
+	t.Setenv("OTEL_TRACES_EXPORTER", "none")
+	shutdown, err := initTracing()
+	if err != nil || shutdown(t.Context()) != nil {
+		t.Errorf("disabled tracing failed: %v", err)
+	}
+	t.Setenv("OTEL_TRACES_EXPORTER", "zipkin")
+	if _, err := initTracing(); err == nil {
+		t.Error("unknown exporter accepted")
+	}
+}
@@ -0,0 +1,550 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+)
+
+// Webhook events
+const (
+	eventVideoUploaded = "video.uploaded"
+	eventVideoUpdated  = "video.updated"
+	eventVideoDeleted  = "video.deleted"
+	eventJobStarted    = "job.started"
+	eventJobProgress   = "job.progress"
+	eventJobSucceeded  = "job.succeeded"
+	eventJobFailed     = "job.failed"
+)
+
+var webhookEvents = []string{
+	eventVideoUploaded, eventVideoUpdated, eventVideoDeleted,
+	eventJobStarted, eventJobProgress, eventJobSucceeded, eventJobFailed,
+}
+
+// Delivery states
+const (
+	deliveryPending   = "pending"
+	deliverySucceeded = "succeeded"
+	deliveryFailed    = "failed"
+)
+
+// Delivery retries: the n-th retry waits webhookRetryBase * 2^(n-1)
+const (
+	webhookMaxAttempts = 6
+	webhookTimeout     = 10 * time.Second
+)
+
+var webhookRetryBase = 10 * time.Second
+
+// job.progress is sent at most this often per job
+const webhookProgressInterval = 5 * time.Second
+
+// Deliveries are kept this long for the delivery log
+const deliveryRetention = 7 * 24 * time.Hour
+
+// webhook is a registered endpoint and the events it receives
+type webhook struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"` // "*" receives every event
+	Secret    string    `json:"secret,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// deliveryAttempt is one HTTP request of a delivery
+type deliveryAttempt struct {
+	At         time.Time `json:"at"`
+	StatusCode int       `json:"statusCode,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMs int64     `json:"durationMs"`
+}
+
+// delivery is an event sent to a webhook
+type delivery struct {
+	ID            string            `json:"id"`
+	WebhookID     string            `json:"webhookId"`
+	Event         string            `json:"event"`
+	Payload       json.RawMessage   `json:"payload"`
+	State         string            `json:"state"`
+	Attempts      []deliveryAttempt `json:"attempts"`
+	NextAttemptAt time.Time         `json:"nextAttemptAt,omitzero"`
+	CreatedAt     time.Time         `json:"createdAt"`
+
+	// Attempts in the current round of retries, which a redelivery restarts
+	Round int `json:"round"`
+}
+
+// webhookState is what is stored in webhooksFile
+type webhookState struct {
+	Webhooks   map[string]*webhook  `json:"webhooks"`
+	Deliveries map[string]*delivery `json:"deliveries"`
+}
+
+// Registered webhooks and their deliveries
+var (
+	webhooks   = make(map[string]*webhook)
+	deliveries = make(map[string]*delivery)
+	webhooksMu sync.Mutex
+
+	webhookClient = &http.Client{
+		Timeout: webhookTimeout,
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{Timeout: webhookTimeout, Control: checkWebhookDial}).DialContext,
+		},
+	}
+)
+
+// Address ranges webhooks are not delivered to besides loopback, private,
+// link-local, multicast and unspecified addresses
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // Shared address space
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"), // Benchmarking
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// publicAddress reports whether webhooks may be delivered to addr
+func publicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkWebhookDial refuses connections of webhook deliveries to non-public
+// addresses. It runs on the resolved address, so DNS names and redirects
+// cannot reach the local network either.
+func checkWebhookDial(network, address string, _ syscall.RawConn) error {
+	if getConfig().Webhooks.AllowPrivateNetworks {
+		return nil
+	}
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !publicAddress(addrPort.Addr()) {
+		return fmt.Errorf("webhook address %s is not public", addrPort.Addr())
+	}
+	return nil
+}
+
+// checkWebhookURL refuses webhook URLs whose host resolves to a non-public
+// address
+func checkWebhookURL(ctx context.Context, u *url.URL) error {
+	if getConfig().Webhooks.AllowPrivateNetworks {
+		return nil
+	}
+	host := u.Hostname()
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("url host %s could not be resolved", host)
+	}
+	for _, addr := range addrs {
+		if !publicAddress(addr) {
+			return fmt.Errorf("url host %s resolves to the non-public address %s", host, addr)
+		}
+	}
+	return nil
+}
+
+// webhooksFile is where webhooks and their deliveries are stored
+func webhooksFile() string {
+	return filepath.Join(uploadsDir, ".webhooks.json")
+}
+
+// loadWebhooks reads the stored webhooks and resumes pending deliveries
+func loadWebhooks() error {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+
+	data, err := os.ReadFile(webhooksFile())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state webhookState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Webhooks != nil {
+		webhooks = state.Webhooks
+	}
+	if state.Deliveries != nil {
+		deliveries = state.Deliveries
+	}
+
+	for _, d := range deliveries {
+		if d.State == deliveryPending {
+			scheduleDeliveryLocked(d, time.Until(d.NextAttemptAt))
+		}
+	}
+	return nil
+}
+
+// saveWebhooksLocked writes webhooks and deliveries, dropping deliveries
+// older than deliveryRetention. webhooksMu must be held.
+func saveWebhooksLocked() {
+	cutoff := time.Now().Add(-deliveryRetention)
+	for id, d := range deliveries {
+		if d.State != deliveryPending && d.CreatedAt.Before(cutoff) {
+			delete(deliveries, id)
+		}
+	}
+
+	data, err := json.MarshalIndent(webhookState{Webhooks: webhooks, Deliveries: deliveries}, "", "  ")
+	if err == nil {
+		tmp := webhooksFile() + ".tmp"
+		if err = os.WriteFile(tmp, data, 0600); err == nil {
+			err = os.Rename(tmp, webhooksFile())
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to save webhooks", "error", err)
+	}
+}
+
+// subscribes reports whether the webhook receives event
+func (w *webhook) subscribes(event string) bool {
+	return slices.Contains(w.Events, "*") || slices.Contains(w.Events, event)
+}
+
+// emitEvent queues a delivery of event to every webhook subscribed to it.
+// data becomes the "data" field of the payload.
+func emitEvent(ctx context.Context, event string, data interface{}) {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+
+	queued := false
+	for _, w := range webhooks {
+		if !w.subscribes(event) {
+			continue
+		}
+		d := &delivery{
+			ID:        utils.UUIDv4(),
+			WebhookID: w.ID,
+			Event:     event,
+			State:     deliveryPending,
+			CreatedAt: time.Now(),
+		}
+		payload, err := json.Marshal(fiber.Map{
+			"id":        d.ID,
+			"event":     event,
+			"createdAt": d.CreatedAt,
+			"data":      data,
+		})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to encode webhook payload", "event", event, "error", err)
+			return
+		}
+		d.Payload = payload
+		deliveries[d.ID] = d
+		scheduleDeliveryLocked(d, 0)
+		queued = true
+	}
+	if queued {
+		saveWebhooksLocked()
+	}
+}
+
+// scheduleDeliveryLocked sends d after delay. webhooksMu must be held.
+func scheduleDeliveryLocked(d *delivery, delay time.Duration) {
+	d.NextAttemptAt = time.Now().Add(delay)
+	time.AfterFunc(max(delay, 0), func() { attemptDelivery(d.ID) })
+}
+
+// attemptDelivery sends a pending delivery once and schedules a retry with
+// exponential backoff if it fails
+func attemptDelivery(deliveryID string) {
+	webhooksMu.Lock()
+	d, ok := deliveries[deliveryID]
+	var w *webhook
+	if ok {
+		w = webhooks[d.WebhookID]
+	}
+	if !ok || w == nil || d.State != deliveryPending {
+		webhooksMu.Unlock()
+		return
+	}
+	target, secret, event, payload := w.URL, w.Secret, d.Event, d.Payload
+	webhooksMu.Unlock()
+
+	attempt := sendWebhook(target, secret, event, deliveryID, payload)
+
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	d.Attempts = append(d.Attempts, attempt)
+	d.Round++
+	switch {
+	case attempt.Error == "":
+		d.State = deliverySucceeded
+		d.NextAttemptAt = time.Time{}
+	case d.Round >= webhookMaxAttempts:
+		d.State = deliveryFailed
+		d.NextAttemptAt = time.Time{}
+		slog.Warn("Webhook delivery failed", "webhook_id", w.ID, "delivery_id", d.ID, "event", event, "error", attempt.Error)
+	default:
+		scheduleDeliveryLocked(d, webhookRetryBase<<(d.Round-1))
+	}
+	saveWebhooksLocked()
+}
+
+// sendWebhook posts a payload to a webhook. The body is signed with
+// HMAC-SHA256 over "<timestamp>.<body>" using the webhook's secret.
+func sendWebhook(target, secret, event, deliveryID string, payload []byte) deliveryAttempt {
+	attempt := deliveryAttempt{At: time.Now()}
+	timestamp := strconv.FormatInt(attempt.At.Unix(), 10)
+
+	req, err := http.NewRequest(http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "videostreaming-webhooks")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Delivery", deliveryID)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", "sha256="+signWebhook(secret, timestamp, payload))
+
+	resp, err := webhookClient.Do(req)
+	attempt.DurationMs = time.Since(attempt.At).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("endpoint responded %d", resp.StatusCode)
+	}
+	return attempt
+}
+
+// signWebhook returns the hex HMAC-SHA256 of "<timestamp>.<payload>"
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// watchJobProgress sends job.progress while a job runs, at most every
+// webhookProgressInterval and only when the progress changed. It stops
+// when stop is closed.
+func watchJobProgress(ctx context.Context, j *job, stop <-chan struct{}) {
+	ticker := time.NewTicker(webhookProgressInterval)
+	defer ticker.Stop()
+	last := -1
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			progress, _ := getTranscodingProgress(j.spec.ProgressID)
+			if progress != last && progress < 100 {
+				last = progress
+				emitEvent(ctx, eventJobProgress, fiber.Map{"job": j.snapshot(), "progress": progress})
+			}
+		}
+	}
+}
+
+// webhookResponse hides the secret of a stored webhook
+func webhookResponse(w *webhook) webhook {
+	response := *w
+	response.Secret = ""
+	return response
+}
+
+// createWebhook registers a webhook. The secret used to sign deliveries is
+// generated unless one is given, and only returned here.
+func createWebhook(c *fiber.Ctx) error {
+	var req struct {
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+		Secret string   `json:"secret"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "url must be an http or https URL",
+		})
+	}
+	if err := checkWebhookURL(c.UserContext(), u); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if len(req.Events) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "events must list at least one event",
+		})
+	}
+	for _, event := range req.Events {
+		if event != "*" && !slices.Contains(webhookEvents, event) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": fmt.Sprintf("Unknown event %q", event),
+			})
+		}
+	}
+	if req.Secret == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		req.Secret = hex.EncodeToString(secret)
+	}
+
+	w := &webhook{
+		ID:        utils.UUIDv4(),
+		URL:       req.URL,
+		Events:    req.Events,
+		Secret:    req.Secret,
+		CreatedAt: time.Now(),
+	}
+	webhooksMu.Lock()
+	webhooks[w.ID] = w
+	saveWebhooksLocked()
+	webhooksMu.Unlock()
+
+	slog.InfoContext(c.UserContext(), "Webhook registered", "webhook_id", w.ID, "url", w.URL, "events", w.Events)
+	return c.Status(fiber.StatusCreated).JSON(w)
+}
+
+// getWebhooks lists the registered webhooks
+func getWebhooks(c *fiber.Ctx) error {
+	webhooksMu.Lock()
+	list := make([]webhook, 0, len(webhooks))
+	for _, w := range webhooks {
+		list = append(list, webhookResponse(w))
+	}
+	webhooksMu.Unlock()
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt.Before(list[b].CreatedAt)
+	})
+	return c.JSON(list)
+}
+
+// getWebhook returns a single webhook
+func getWebhook(c *fiber.Ctx) error {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	w, ok := webhooks[c.Params("webhookId")]
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+	return c.JSON(webhookResponse(w))
+}
+
+// deleteWebhook removes a webhook and its delivery log
+func deleteWebhook(c *fiber.Ctx) error {
+	id := c.Params("webhookId")
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	if _, ok := webhooks[id]; !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+	delete(webhooks, id)
+	for deliveryID, d := range deliveries {
+		if d.WebhookID == id {
+			delete(deliveries, deliveryID)
+		}
+	}
+	saveWebhooksLocked()
+
+	slog.InfoContext(c.UserContext(), "Webhook deleted", "webhook_id", id)
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// getWebhookDeliveries returns the delivery log of a webhook, newest first
+func getWebhookDeliveries(c *fiber.Ctx) error {
+	id := c.Params("webhookId")
+	webhooksMu.Lock()
+	if _, ok := webhooks[id]; !ok {
+		webhooksMu.Unlock()
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Webhook not found",
+		})
+	}
+	list := make([]delivery, 0)
+	for _, d := range deliveries {
+		if d.WebhookID == id {
+			list = append(list, *d)
+		}
+	}
+	webhooksMu.Unlock()
+
+	sort.Slice(list, func(a, b int) bool {
+		return list[a].CreatedAt.After(list[b].CreatedAt)
+	})
+	return c.JSON(list)
+}
+
+// redeliverWebhook sends a delivery again now, starting a new round of
+// retries
+func redeliverWebhook(c *fiber.Ctx) error {
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+
+	d, ok := deliveries[c.Params("deliveryId")]
+	if !ok || d.WebhookID != c.Params("webhookId") {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Delivery not found",
+		})
+	}
+	if d.State == deliveryPending {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "Delivery is still pending",
+		})
+	}
+	d.State = deliveryPending
+	d.Round = 0
+	scheduleDeliveryLocked(d, 0)
+	saveWebhooksLocked()
+
+	slog.InfoContext(c.UserContext(), "Webhook redelivery requested", "webhook_id", d.WebhookID, "delivery_id", d.ID)
+	return c.Status(fiber.StatusAccepted).JSON(*d)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestSignWebhook(t *testing.T) {
+	tests := []struct {
+		secret    string
+		timestamp string
+		payload   string
+		want      string
+	}{
+		{"secret", "1700000000", `{"id":"1"}`, "086f6aff7bd084c98679825129c5a64dbad88c760016d6d2c0fb123f27951d54"},
+		{"", "0", "", "b849d5a581847b281957065739df36df2463d1977ea8d6e1e4e6cf33fadc68c3"},
+		{"k3y", "1735689600", `{"event":"video.uploaded"}`, "7a4738e42260b921d7034073a3c52a75b3e84cf28c1cb7b24f06db849ccb9a21"},
+	}
+	for _, tt := range tests {
+		if got := signWebhook(tt.secret, tt.timestamp, []byte(tt.payload)); got != tt.want {
+			t.Errorf("signWebhook(%q, %q, %q) = %s, want %s", tt.secret, tt.timestamp, tt.payload, got, tt.want)
+		}
+	}
+}
+
+func TestPublicAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"::", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := publicAddress(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("publicAddress(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+// useWebhooks gives a test empty webhook state and short retries, with
+// deliveries to private networks allowed or not
+func useWebhooks(t *testing.T, allowPrivate bool) {
+	configMu.Lock()
+	savedConfig := currentConfig
+	configMu.Unlock()
+	allowPrivateNetworks(allowPrivate)
+
+	// Deliveries read these with webhooksMu held
+	dir := t.TempDir()
+	webhooksMu.Lock()
+	savedHooks, savedDeliveries, savedDir, savedBase := webhooks, deliveries, uploadsDir, webhookRetryBase
+	webhooks, deliveries = make(map[string]*webhook), make(map[string]*delivery)
+	uploadsDir, webhookRetryBase = dir, 5*time.Millisecond
+	webhooksMu.Unlock()
+
+	t.Cleanup(func() {
+		webhooksMu.Lock()
+		webhooks, deliveries, uploadsDir, webhookRetryBase = savedHooks, savedDeliveries, savedDir, savedBase
+		webhooksMu.Unlock()
+		configMu.Lock()
+		currentConfig = savedConfig
+		configMu.Unlock()
+	})
+}
+
+// allowPrivateNetworks replaces the configuration with one that allows
+// webhooks to private networks or not
+func allowPrivateNetworks(allow bool) {
+	cfg := defaultConfig()
+	cfg.Webhooks.AllowPrivateNetworks = allow
+	configMu.Lock()
+	currentConfig = cfg
+	configMu.Unlock()
+}
+
+func webhookApp() *fiber.App {
+	app := fiber.New()
+	app.Post("/webhooks", createWebhook)
+	app.Post("/webhooks/:webhookId/deliveries/:deliveryId/redeliver", redeliverWebhook)
+	return app
+}
+
+// registerWebhook creates a webhook for every event and returns its ID
+func registerWebhook(t *testing.T, app *fiber.App, target string) string {
+	body, _ := json.Marshal(fiber.Map{"url": target, "events": []string{"*"}, "secret": "s"})
+	req := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("registering %s: status %d", target, resp.StatusCode)
+	}
+	var w webhook
+	json.NewDecoder(resp.Body).Decode(&w)
+	return w.ID
+}
+
+// waitDelivery waits until the only delivery has left the pending state
+// and returns a copy of it
+func waitDelivery(t *testing.T) delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		webhooksMu.Lock()
+		for _, d := range deliveries {
+			if d.State != deliveryPending {
+				copied := *d
+				copied.Attempts = append([]deliveryAttempt(nil), d.Attempts...)
+				webhooksMu.Unlock()
+				return copied
+			}
+		}
+		webhooksMu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("delivery still pending")
+	return delivery{}
+}
+
+// endpoint is a webhook receiver answering with the queued status codes,
+// then 200
+type endpoint struct {
+	mu         sync.Mutex
+	statuses   []int
+	signatures []string
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.signatures = append(e.signatures, r.Header.Get("X-Webhook-Signature"))
+	status := http.StatusOK
+	if len(e.statuses) > 0 {
+		status, e.statuses = e.statuses[0], e.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	useWebhooks(t, true)
+	receiver := &endpoint{statuses: []int{500, 503}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	registerWebhook(t, webhookApp(), server.URL)
+
+	emitEvent(t.Context(), eventVideoUploaded, fiber.Map{"id": "a.mp4"})
+	d := waitDelivery(t)
+
+	if d.State != deliverySucceeded || len(d.Attempts) != 3 {
+		t.Fatalf("state %s after %d attempts, want succeeded after 3", d.State, len(d.Attempts))
+	}
+	for i, want := range []int{500, 503, 200} {
+		if d.Attempts[i].StatusCode != want {
+			t.Errorf("attempt %d: status %d, want %d", i+1, d.Attempts[i].StatusCode, want)
+		}
+	}
+	// The n-th retry waits webhookRetryBase * 2^(n-1)
+	for n := 1; n < len(d.Attempts); n++ {
+		wait := d.Attempts[n].At.Sub(d.Attempts[n-1].At)
+		if min := webhookRetryBase << (n - 1); wait < min {
+			t.Errorf("retry %d after %v, want at least %v", n, wait, min)
+		}
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	timestamp := strconv.FormatInt(d.Attempts[2].At.Unix(), 10)
+	if want := "sha256=" + signWebhook("s", timestamp, d.Payload); receiver.signatures[2] != want {
+		t.Errorf("signature %s, want %s", receiver.signatures[2], want)
+	}
+}
+
+func TestWebhookDeliveryFailsAndRedelivers(t *testing.T) {
+	useWebhooks(t, true)
+	statuses := make([]int, webhookMaxAttempts)
+	for i := range statuses {
+		statuses[i] = http.StatusInternalServerError
+	}
+	receiver := &endpoint{statuses: statuses}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	app := webhookApp()
+	webhookID := registerWebhook(t, app, server.URL)
+
+	emitEvent(t.Context(), eventJobFailed, fiber.Map{"id": "job"})
+	d := waitDelivery(t)
+	if d.State != deliveryFailed || len(d.Attempts) != webhookMaxAttempts || d.Round != webhookMaxAttempts {
+		t.Fatalf("state %s after %d attempts in round %d, want failed after %d",
+			d.State, len(d.Attempts), d.Round, webhookMaxAttempts)
+	}
+	if !d.NextAttemptAt.IsZero() {
+		t.Errorf("failed delivery has a next attempt at %v", d.NextAttemptAt)
+	}
+
+	// A redelivery starts a new round and keeps the earlier attempts
+	path := "/webhooks/" + webhookID + "/deliveries/" + d.ID + "/redeliver"
+	resp, err := app.Test(httptest.NewRequest(http.MethodPost, path, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusAccepted {
+		t.Fatalf("redeliver: status %d", resp.StatusCode)
+	}
+	d = waitDelivery(t)
+	if d.State != deliverySucceeded || d.Round != 1 || len(d.Attempts) != webhookMaxAttempts+1 {
+		t.Errorf("state %s in round %d with %d attempts, want succeeded in round 1 with %d",
+			d.State, d.Round, len(d.Attempts), webhookMaxAttempts+1)
+	}
+
+	// Only finished deliveries can be sent again
+	webhooksMu.Lock()
+	deliveries[d.ID].State = deliveryPending
+	webhooksMu.Unlock()
+	resp, err = app.Test(httptest.NewRequest(http.MethodPost, path, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusConflict {
+		t.Errorf("redeliver while pending: status %d, want %d", resp.StatusCode, fiber.StatusConflict)
+	}
+}
+
+func TestWebhookPrivateNetworks(t *testing.T) {
+	useWebhooks(t, false)
+	app := webhookApp()
+	for _, target := range []string{
+		"http://127.0.0.1:8080/hook",
+		"http://localhost/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://10.0.0.5/hook",
+		"http://[::1]/hook",
+	} {
+		body, _ := json.Marshal(fiber.Map{"url": target, "events": []string{"*"}})
+		req := httptest.NewRequest(http.MethodPost, "/webhooks", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != fiber.StatusBadRequest {
+			t.Errorf("registering %s: status %d, want %d", target, resp.StatusCode, fiber.StatusBadRequest)
+		}
+	}
+
+	// A webhook registered while private networks were allowed is not
+	// delivered to once they are refused
+	receiver := &endpoint{}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	allowPrivateNetworks(true)
+	registerWebhook(t, app, server.URL)
+	allowPrivateNetworks(false)
+
+	emitEvent(t.Context(), eventVideoDeleted, fiber.Map{"id": "a.mp4"})
+	d := waitDelivery(t)
+	if d.State != deliveryFailed {
+		t.Fatalf("state %s, want failed", d.State)
+	}
+	for _, attempt := range d.Attempts {
+		if attempt.StatusCode != 0 || !strings.Contains(attempt.Error, "not public") {
+			t.Errorf("attempt %+v, want a refused connection", attempt)
+		}
+	}
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.signatures) != 0 {
+		t.Errorf("endpoint received %d requests", len(receiver.signatures))
+	}
+}